@@ -1,21 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"log"
 	"os"
 
+	"go.sia.tech/skyrecover/internal/jsonout"
 	"go.sia.tech/skyrecover/internal/siafile"
 )
 
 func main() {
-	sf, err := siafile.Load(os.Args[1])
+	compact := flag.Bool("compact", false, "write the metadata without indentation")
+	indent := flag.String("indent", jsonout.DefaultIndent, "indentation of the metadata, \"tab\" to indent with tabs")
+	flag.Parse()
+
+	sf, err := siafile.Load(flag.Arg(0))
 	if err != nil {
 		log.Fatalln("failed to parse skyfile:", err)
 	}
 
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
+	enc := jsonout.NewEncoder(os.Stdout, jsonout.ParseIndent(*compact, *indent))
 	if err := enc.Encode(sf); err != nil {
 		log.Fatalln("failed to encode skyfile:", err)
 	}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// An output stores the recovered files.
+	output interface {
+		// WriteFile writes n bytes from r to the file name.
+		WriteFile(name string, r io.Reader, n int64, mode os.FileMode) error
+		Close() error
+	}
+
+	// A dirOutput writes each file into a directory.
+	dirOutput struct {
+		dir string
+	}
+
+	// A tarOutput streams each file into a tar archive.
+	tarOutput struct {
+		f  *os.File
+		tw *tar.Writer
+	}
+
+	// A zipOutput streams each file into a zip archive.
+	zipOutput struct {
+		f  *os.File
+		zw *zip.Writer
+	}
+)
+
+// archiveName returns the name of a file in an archive. Archive members are
+// always relative.
+func archiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// path returns the path of the file name in the output directory. Names that
+// would escape the directory are rejected.
+func (do *dirOutput) path(name string) (string, error) {
+	fp := filepath.Join(do.dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(do.dir, fp)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file name %q is outside of the output directory", name)
+	}
+	return fp, nil
+}
+
+// WriteFile implements output.
+func (do *dirOutput) WriteFile(name string, r io.Reader, n int64, mode os.FileMode) error {
+	fp, err := do.path(name)
+	if err != nil {
+		return err
+	}
+	return writeSubFile(r, fp, n, mode)
+}
+
+// Close implements output.
+func (do *dirOutput) Close() error {
+	return nil
+}
+
+// WriteFile implements output.
+func (to *tarOutput) WriteFile(name string, r io.Reader, n int64, mode os.FileMode) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     archiveName(name),
+		Mode:     int64(mode.Perm()),
+		Size:     n,
+		ModTime:  time.Now(),
+	}
+	if err := to.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write header for %v: %w", name, err)
+	} else if n, err := io.CopyN(to.tw, r, n); err != nil {
+		return fmt.Errorf("failed to copy data (%v bytes written): %w", n, err)
+	}
+	return nil
+}
+
+// Close implements output.
+func (to *tarOutput) Close() error {
+	defer to.f.Close()
+	if err := to.tw.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	} else if err := to.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync archive: %w", err)
+	}
+	return nil
+}
+
+// WriteFile implements output.
+func (zo *zipOutput) WriteFile(name string, r io.Reader, n int64, mode os.FileMode) error {
+	hdr := &zip.FileHeader{
+		Name:     archiveName(name),
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	}
+	hdr.SetMode(mode.Perm())
+	w, err := zo.zw.CreateHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("failed to write header for %v: %w", name, err)
+	} else if n, err := io.CopyN(w, r, n); err != nil {
+		return fmt.Errorf("failed to copy data (%v bytes written): %w", n, err)
+	}
+	return nil
+}
+
+// Close implements output.
+func (zo *zipOutput) Close() error {
+	defer zo.f.Close()
+	if err := zo.zw.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	} else if err := zo.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync archive: %w", err)
+	}
+	return nil
+}
+
+// isArchive returns true if the output path is a tar or zip archive.
+func isArchive(fp string) bool {
+	switch strings.ToLower(filepath.Ext(fp)) {
+	case ".tar", ".zip":
+		return true
+	}
+	return false
+}
+
+// openOutput creates the output for fp. Paths ending in .tar or .zip are
+// written as an archive, anything else is a directory.
+func openOutput(fp string) (output, error) {
+	if !isArchive(fp) {
+		if stat, err := os.Stat(fp); err == nil && !stat.IsDir() {
+			return nil, fmt.Errorf("output path %v is not a directory", fp)
+		} else if err := os.MkdirAll(fp, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %w", err)
+		}
+		return &dirOutput{dir: fp}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(fp), ".zip") {
+		return &zipOutput{f: f, zw: zip.NewWriter(f)}, nil
+	}
+	return &tarOutput{f: f, tw: tar.NewWriter(f)}, nil
+}
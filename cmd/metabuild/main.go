@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -14,35 +16,201 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/aead/chacha20/chacha"
-	"gitlab.com/SkynetLabs/skyd/build"
 	"gitlab.com/SkynetLabs/skyd/skykey"
 	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"go.sia.tech/skyrecover/internal/jsonout"
 )
 
-const sectorSize = 1 << 22 // 4 MiB
+const (
+	sectorSize = 1 << 22 // 4 MiB
+
+	// defaultFileMode is used for files without a recorded mode.
+	defaultFileMode os.FileMode = 0644
+
+	// manifestName is the name of the manifest in the output.
+	manifestName = "skyfile-manifest.json"
+)
+
+// A skipMode determines which existing files are not recovered again.
+type skipMode int
+
+const (
+	// skipNone recovers every file.
+	skipNone skipMode = iota
+	// skipSize skips files that exist with the expected size.
+	skipSize
+	// skipChecksum skips files that exist with the expected size and the
+	// same checksum as the data in the skyfile.
+	skipChecksum
+)
+
+type (
+	// A skykeyStore provides the skykeys used to decrypt a skyfile.
+	skykeyStore interface {
+		KeyByID(skykey.SkykeyID) (skykey.Skykey, error)
+		Skykeys() []skykey.Skykey
+	}
+
+	// A memSkykeyStore is an in-memory skykeyStore.
+	memSkykeyStore struct {
+		keys map[skykey.SkykeyID]skykey.Skykey
+	}
+
+	// A manifestFile is a recovered file and the mode recorded in the
+	// skyfile's metadata.
+	manifestFile struct {
+		Filename    string      `json:"filename"`
+		ContentType string      `json:"contentType,omitempty"`
+		Mode        os.FileMode `json:"mode"`
+		Length      uint64      `json:"length"`
+		Checksum    string      `json:"checksum"`
+	}
+
+	// A manifest describes the recovered skyfile, including the fields a
+	// portal used to serve it as a web app.
+	manifest struct {
+		Filename           string         `json:"filename"`
+		DefaultPath        string         `json:"defaultPath,omitempty"`
+		DisableDefaultPath bool           `json:"disableDefaultPath,omitempty"`
+		TryFiles           []string       `json:"tryFiles,omitempty"`
+		ErrorPages         map[int]string `json:"errorPages,omitempty"`
+		ChecksumAlgorithm  string         `json:"checksumAlgorithm"`
+		Files              []manifestFile `json:"files"`
+	}
+)
+
+// KeyByID returns the skykey with the given ID.
+func (ms *memSkykeyStore) KeyByID(id skykey.SkykeyID) (skykey.Skykey, error) {
+	sk, ok := ms.keys[id]
+	if !ok {
+		return skykey.Skykey{}, skykey.ErrNoSkykeysWithThatID
+	}
+	return sk, nil
+}
+
+// Skykeys returns all skykeys in the store.
+func (ms *memSkykeyStore) Skykeys() []skykey.Skykey {
+	keys := make([]skykey.Skykey, 0, len(ms.keys))
+	for _, sk := range ms.keys {
+		keys = append(keys, sk)
+	}
+	return keys
+}
+
+// loadSkykeys loads skykeys from a file containing one skykey string per line.
+// Empty lines and lines starting with # are ignored.
+func loadSkykeys(fp string) (*memSkykeyStore, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open skykeys file: %w", err)
+	}
+	defer f.Close()
+
+	ms := &memSkykeyStore{
+		keys: make(map[skykey.SkykeyID]skykey.Skykey),
+	}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		str := strings.TrimSpace(s.Text())
+		if len(str) == 0 || strings.HasPrefix(str, "#") {
+			continue
+		}
+		var sk skykey.Skykey
+		if err := sk.FromString(str); err != nil {
+			return nil, fmt.Errorf("failed to parse skykey on line %v: %w", line, err)
+		}
+		ms.keys[sk.ID()] = sk
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read skykeys file: %w", err)
+	} else if len(ms.keys) == 0 {
+		return nil, errors.New("no skykeys found")
+	}
+	return ms, nil
+}
+
+// defaultSkynetDir returns the skyd data directory. Like skyd, the
+// SKYNET_DATA_DIR environment variable overrides the platform default. The
+// skykey database is stored in this directory.
+func defaultSkynetDir() string {
+	if dir := os.Getenv("SKYNET_DATA_DIR"); len(dir) != 0 {
+		return dir
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("LOCALAPPDATA"), "Skynet")
+	case "darwin":
+		return filepath.Join(os.Getenv("HOME"), "Library", "Application Support", "Skynet")
+	default:
+		return filepath.Join(os.Getenv("HOME"), ".skynet")
+	}
+}
+
+// fileMode returns the permissions to recover a file with. Only permission
+// bits are kept, and the owner can always read and write the file so a
+// recovered file is never unreadable.
+func fileMode(mode os.FileMode) os.FileMode {
+	perm := mode.Perm()
+	if perm == 0 {
+		return defaultFileMode
+	}
+	return perm | 0600
+}
 
 // writeSubFile writes a subfile from the reader to disk
-func writeSubFile(r io.Reader, fp string, n int64) error {
-	f, err := os.Create(fp)
+func writeSubFile(r io.Reader, fp string, n int64, mode os.FileMode) error {
+	// subfiles can be nested in directories
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %v: %w", fp, err)
+	}
+	f, err := os.OpenFile(fp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 	if err != nil {
 		return fmt.Errorf("failed to create file %v: %w", fp, err)
 	}
 	defer f.Close()
 	if n, err = io.CopyN(f, r, n); err != nil {
 		return fmt.Errorf("failed to copy data (%v bytes written): %w", n, err)
+	} else if err := f.Chmod(mode); err != nil { // an existing file keeps its mode otherwise
+		return fmt.Errorf("failed to set file mode: %w", err)
 	} else if err := f.Sync(); err != nil {
 		return fmt.Errorf("failed to sync file: %w", err)
 	}
 	return nil
 }
 
+// writeManifest writes the manifest to fp. If fp is empty, the manifest is
+// added to the output as skyfile-manifest.json.
+func writeManifest(m manifest, out output, fp string) error {
+	buf, err := jsonout.Marshal(m, "", jsonout.DefaultIndent)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	} else if len(fp) == 0 {
+		return out.WriteFile(manifestName, bytes.NewReader(buf), int64(len(buf)), 0644)
+	} else if err := os.WriteFile(fp, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// writeMetadata writes the parsed skyfile metadata to fp as JSON.
+func writeMetadata(meta skymodules.SkyfileMetadata, fp string) error {
+	buf, err := jsonout.Marshal(meta, "", jsonout.DefaultIndent)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	} else if err := os.WriteFile(fp, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
+
 // findMatchingSkyKey tries to find a Skykey that can decrypt the identifier and
 // be used for decrypting the associated skyfile. It returns an error if it is
 // not found.
-func findMatchingSkyKey(skykeyDB *skykey.SkykeyManager, encryptionIdentifier []byte, nonce []byte) (skykey.Skykey, error) {
+func findMatchingSkyKey(skykeyDB skykeyStore, encryptionIdentifier []byte, nonce []byte) (skykey.Skykey, error) {
 	allSkykeys := skykeyDB.Skykeys()
 	for _, sk := range allSkykeys {
 		matches, err := sk.MatchesSkyfileEncryptionID(encryptionIdentifier, nonce)
@@ -55,8 +223,13 @@ func findMatchingSkyKey(skykeyDB *skykey.SkykeyManager, encryptionIdentifier []b
 	return skykey.Skykey{}, errors.New("not found")
 }
 
+// errSkylinkV2 is returned by parseMetadata for v2 skylinks. A v2 skylink
+// points to a registry entry rather than a base sector, so it cannot be read
+// from the -base file without a registry lookup.
+var errSkylinkV2 = errors.New("v2 skylinks require a registry lookup")
+
 // parseMetadata parses a base sector and returns the Skyfile metadata.
-func parseMetadata(skykeyDB *skykey.SkykeyManager, skylink, metaPath string) (skymodules.SkyfileMetadata, []byte, error) {
+func parseMetadata(skykeyDB skykeyStore, skylink, metaPath string) (skymodules.SkyfileMetadata, []byte, error) {
 	f, err := os.Open(metaPath)
 	if err != nil {
 		return skymodules.SkyfileMetadata{}, nil, fmt.Errorf("failed to open metadata file: %w", err)
@@ -66,6 +239,8 @@ func parseMetadata(skykeyDB *skykey.SkykeyManager, skylink, metaPath string) (sk
 	var sl skymodules.Skylink
 	if err := sl.LoadString(skylink); err != nil {
 		return skymodules.SkyfileMetadata{}, nil, fmt.Errorf("failed to parse skylink: %w", err)
+	} else if sl.IsSkylinkV2() {
+		return skymodules.SkyfileMetadata{}, nil, fmt.Errorf("%w: resolve %v to the v1 skylink it points to, e.g. with a portal's /skynet/resolve endpoint, and pass that to -skylink", errSkylinkV2, skylink)
 	}
 
 	offset, length, err := sl.OffsetAndFetchSize()
@@ -101,7 +276,7 @@ func parseMetadata(skykeyDB *skykey.SkykeyManager, skylink, metaPath string) (sk
 		masterSkykey, err := skykeyDB.KeyByID(keyID)
 		// if the ID is unknown, use the key ID as an encryption identifier and
 		// try finding the associated skykey.
-		if strings.Contains(err.Error(), skykey.ErrNoSkykeysWithThatID.Error()) {
+		if err != nil && strings.Contains(err.Error(), skykey.ErrNoSkykeysWithThatID.Error()) {
 			masterSkykey, err = findMatchingSkyKey(skykeyDB, keyID[:], nonce)
 		}
 		if err != nil {
@@ -166,14 +341,72 @@ func parseMetadata(skykeyDB *skykey.SkykeyManager, skylink, metaPath string) (sk
 	// seek to the start of the JSON payload and parse it
 	if _, err := f.Seek(int64(sectorSize+translatedOffset+layout.FanoutSize), io.SeekStart); err != nil {
 		return skymodules.SkyfileMetadata{}, nil, fmt.Errorf("failed to seek to metadata pos %v: %w", translatedOffset+layout.FanoutSize, err)
-	} else if err := json.NewDecoder(f).Decode(&meta); err != nil {
+	} else if err := json.NewDecoder(io.LimitReader(f, int64(layout.MetadataSize))).Decode(&meta); err != nil {
 		return skymodules.SkyfileMetadata{}, nil, fmt.Errorf("failed to decode metadata: %w", err)
 	}
 	return meta, nil, nil
 }
 
-// recoverFiles recovers the files from the metadata and saves them in outputDir
-func recoverFiles(r io.ReadSeeker, meta skymodules.SkyfileMetadata, outputDir, algo string) {
+// checkSubfiles checks that each subfile is within the skyfile's payload so a
+// bad offset fails before any data is written.
+func checkSubfiles(meta skymodules.SkyfileMetadata) error {
+	for name, subfile := range meta.Subfiles {
+		if subfile.Offset > meta.Length || subfile.Len > meta.Length-subfile.Offset {
+			return fmt.Errorf("subfile %v at offset %v with length %v is outside of the %v byte payload", name, subfile.Offset, subfile.Len, meta.Length)
+		}
+	}
+	return nil
+}
+
+// existingChecksum returns the checksum of a file that was already recovered
+// to a directory output, or false if the file must be recovered. The file must
+// have the expected size and, with skipChecksum, the same checksum as the n
+// bytes at offset in r.
+func existingChecksum(out output, name string, r io.ReadSeeker, offset, n int64, h hash.Hash, mode skipMode) ([]byte, bool) {
+	do, ok := out.(*dirOutput)
+	if !ok || mode == skipNone {
+		return nil, false
+	}
+	fp, err := do.path(name)
+	if err != nil {
+		return nil, false
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil || !stat.Mode().IsRegular() || stat.Size() != n {
+		return nil, false
+	}
+
+	h.Reset()
+	if _, err := io.Copy(h, f); err != nil {
+		log.Printf("[WARN] failed to read existing file %v: %v", name, err)
+		return nil, false
+	}
+	checksum := h.Sum(nil)
+	if mode != skipChecksum {
+		return checksum, true
+	}
+
+	h.Reset()
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		log.Fatalln("failed to seek to file:", err)
+	} else if _, err := io.CopyN(h, r, n); err != nil {
+		log.Fatalln("failed to read file:", err)
+	} else if !bytes.Equal(h.Sum(nil), checksum) {
+		log.Printf("Existing file %v does not match its checksum, recovering it again", name)
+		return nil, false
+	}
+	return checksum, true
+}
+
+// recoverFiles recovers the files from the metadata and writes them to out.
+// The manifest is written to manifestPath, or added to out if it is empty.
+// Files that were already recovered to a directory output are skipped
+// depending on skip.
+func recoverFiles(r io.ReadSeeker, meta skymodules.SkyfileMetadata, out output, manifestPath, algo string, skip skipMode) {
 	// pipe the -extended data to a hasher to calculate the checksum
 	var h hash.Hash
 	switch strings.ToLower(algo) {
@@ -187,23 +420,69 @@ func recoverFiles(r io.ReadSeeker, meta skymodules.SkyfileMetadata, outputDir, a
 		log.Fatalln("unknown checksum algorithm:", algo)
 	}
 
+	m := manifest{
+		Filename:           meta.Filename,
+		DefaultPath:        meta.DefaultPath,
+		DisableDefaultPath: meta.DisableDefaultPath,
+		TryFiles:           meta.TryFiles,
+		ErrorPages:         meta.ErrorPages,
+		ChecksumAlgorithm:  strings.ToLower(algo),
+	}
+	defer func() {
+		if err := writeManifest(m, out, manifestPath); err != nil {
+			log.Fatalln("failed to write manifest:", err)
+		} else if len(manifestPath) != 0 {
+			log.Printf("Manifest written to %v", manifestPath)
+		}
+	}()
+
 	tr := io.TeeReader(r, h)
 	if len(meta.Subfiles) == 0 {
 		log.Println("Found 1 file")
-		outPath := filepath.Join(outputDir, meta.Filename)
-		if err := writeSubFile(tr, outPath, int64(meta.Length)); err != nil {
-			log.Fatalln("failed to write file:", err)
+		checksum, ok := existingChecksum(out, meta.Filename, r, 0, int64(meta.Length), h, skip)
+		if ok {
+			log.Printf("Skipped existing file %v (%v/%v) %v bytes %x checksum", meta.Filename, 1, 1, meta.Length, checksum)
+		} else {
+			h.Reset()
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				log.Fatalln("failed to seek to file:", err)
+			} else if err := out.WriteFile(meta.Filename, tr, int64(meta.Length), fileMode(meta.Mode)); err != nil {
+				log.Fatalln("failed to write file:", err)
+			}
+			checksum = h.Sum(nil)
+			log.Printf("Recovered file %v (%v/%v) %v bytes %x checksum", meta.Filename, 1, 1, meta.Length, checksum)
 		}
-		log.Printf("Recovered file %v (%v/%v) %v bytes %x checksum", meta.Filename, 1, 1, meta.Length, h.Sum(nil))
+		m.Files = append(m.Files, manifestFile{
+			Filename: meta.Filename,
+			Mode:     meta.Mode,
+			Length:   meta.Length,
+			Checksum: hex.EncodeToString(checksum),
+		})
 		return
 	}
+	if len(meta.DefaultPath) != 0 {
+		log.Println("Default path:", meta.DefaultPath)
+	}
 
 	log.Printf("Found %v files", len(meta.Subfiles))
 
-	var i int
+	var i, skipped int
 	n := len(meta.Subfiles)
 	for _, subfile := range meta.Subfiles {
 		i++
+		if checksum, ok := existingChecksum(out, subfile.Filename, r, int64(subfile.Offset), int64(subfile.Len), h, skip); ok {
+			skipped++
+			m.Files = append(m.Files, manifestFile{
+				Filename:    subfile.Filename,
+				ContentType: subfile.ContentType,
+				Mode:        subfile.FileMode,
+				Length:      subfile.Len,
+				Checksum:    hex.EncodeToString(checksum),
+			})
+			log.Printf("Skipped existing file %v (%v/%v) %v bytes %x checksum", subfile.Filename, i, n, subfile.Len, checksum)
+			continue
+		}
+
 		// reset the hasher
 		h.Reset()
 		// seek to the file offset in the -extended file
@@ -211,27 +490,100 @@ func recoverFiles(r io.ReadSeeker, meta skymodules.SkyfileMetadata, outputDir, a
 			log.Fatalln("failed to seek to subfile:", err)
 		}
 		// write the subfile to disk and calculate its sha256 checksum
-		outPath := filepath.Join(outputDir, subfile.Filename)
-		if err := writeSubFile(tr, outPath, int64(subfile.Len)); err != nil {
+		if err := out.WriteFile(subfile.Filename, tr, int64(subfile.Len), fileMode(subfile.FileMode)); err != nil {
 			log.Fatalln("failed to write subfile:", err)
 		}
+		m.Files = append(m.Files, manifestFile{
+			Filename:    subfile.Filename,
+			ContentType: subfile.ContentType,
+			Mode:        subfile.FileMode,
+			Length:      subfile.Len,
+			Checksum:    hex.EncodeToString(h.Sum(nil)),
+		})
 		log.Printf("Recovered file %v (%v/%v) %v bytes %x checksum", subfile.Filename, i, n, subfile.Len, h.Sum(nil))
 	}
+	if skipped != 0 {
+		log.Printf("Skipped %v/%v files that were already recovered", skipped, n)
+	}
 }
 
 func main() {
 	skylink := flag.String("skylink", "", "skylink to get metadata from")
-	skykeyPath := flag.String("skynetdir", build.SkynetDir(), "path to skykey directory - default of ~/.skynet on linux")
+	skykeyPath := flag.String("skynetdir", defaultSkynetDir(), "path to skykey directory")
+	skykeysPath := flag.String("skykeys", "", "path to a file of skykey strings, one per line, used instead of the skykey database")
 	basePath := flag.String("base", "", "path to base sector file")
 	extendedPath := flag.String("extended", "", "path to extended sector file")
-	outputDir := flag.String("output", ".", "output directory")
+	outputPath := flag.String("output", ".", "output directory, or a .tar or .zip archive to write the files to")
 	checksumAlgo := flag.String("algo", "sha256", "checksum algorithm to use")
+	manifestPath := flag.String("manifest", "", "path to write the manifest of recovered files, defaults to skyfile-manifest.json in the output directory or archive")
+	skipExisting := flag.Bool("skip-existing", false, "skip files that already exist in the output directory with the expected size")
+	verifyExisting := flag.Bool("verify-existing", false, "with -skip-existing, only skip existing files whose checksum matches the skyfile's data")
+	metaOutPath := flag.String("meta-out", "", "path to write the skyfile's parsed metadata to as JSON")
 	flag.Parse()
 
-	// open the skykey database
-	skykeyDB, err := skykey.NewSkykeyManager(*skykeyPath)
-	if err != nil {
-		log.Fatalln("failed to open skykey database:", err)
+	var skip skipMode
+	switch {
+	case *verifyExisting && !*skipExisting:
+		log.Fatalln("-verify-existing requires -skip-existing")
+	case *skipExisting && isArchive(*outputPath):
+		log.Fatalln("-skip-existing cannot be used with an archive output")
+	case *verifyExisting:
+		skip = skipChecksum
+	case *skipExisting:
+		skip = skipSize
+	}
+
+	var out output
+	openOut := func() {
+		var err error
+		out, err = openOutput(*outputPath)
+		if err != nil {
+			log.Fatalln("failed to open output:", err)
+		}
+	}
+	// create the output before anything is recovered so a bad -output fails
+	// before the skykeys and sectors are read. Without an -extended file only
+	// the metadata is recovered unless the base sector holds the payload, so
+	// the output is not created until that is known.
+	metadataOnly := len(*extendedPath) == 0 && len(*metaOutPath) != 0
+	if !metadataOnly {
+		openOut()
+	}
+	defer func() {
+		if out == nil {
+			return
+		} else if err := out.Close(); err != nil {
+			log.Fatalln("failed to close output:", err)
+		}
+	}()
+
+	if len(*manifestPath) == 0 && !isArchive(*outputPath) {
+		*manifestPath = filepath.Join(*outputPath, manifestName)
+	}
+
+	var skykeyDB skykeyStore
+	if len(*skykeysPath) != 0 {
+		// load the exported skykeys instead of skyd's database
+		ms, err := loadSkykeys(*skykeysPath)
+		if err != nil {
+			log.Fatalln("failed to load skykeys:", err)
+		}
+		skykeyDB = ms
+	} else {
+		// NewSkykeyManager creates an empty database if the directory does not
+		// exist, check it first to give a useful error.
+		if stat, err := os.Stat(*skykeyPath); err != nil {
+			log.Fatalf("failed to open skykey directory %v, set -skynetdir to skyd's data directory: %v", *skykeyPath, err)
+		} else if !stat.IsDir() {
+			log.Fatalf("skykey path %v is not a directory", *skykeyPath)
+		}
+
+		// open the skykey database
+		sm, err := skykey.NewSkykeyManager(*skykeyPath)
+		if err != nil {
+			log.Fatalln("failed to open skykey database:", err)
+		}
+		skykeyDB = sm
 	}
 
 	// parse the skyfile metadata from the -base file
@@ -240,27 +592,44 @@ func main() {
 		log.Fatalln("failed to parse base sectors:", err)
 	}
 
+	// the metadata is written before the subfiles are checked so it is kept
+	// even if the payload cannot be recovered
+	if len(*metaOutPath) != 0 {
+		if err := writeMetadata(meta, *metaOutPath); err != nil {
+			log.Fatalln(err)
+		}
+		log.Println("wrote skyfile metadata to", *metaOutPath)
+	}
+
+	if err := checkSubfiles(meta); err != nil {
+		log.Fatalln("invalid metadata:", err)
+	}
+
 	// the entire payload is in the base sector, recover files from it
 	if uint64(len(payload)) == meta.Length {
 		log.Println("base sector contains entire payload")
-		recoverFiles(bytes.NewReader(payload), meta, *outputDir, *checksumAlgo)
+		if out == nil {
+			openOut()
+		}
+		recoverFiles(bytes.NewReader(payload), meta, out, *manifestPath, *checksumAlgo, skip)
 		return
 	}
 
-	// check that the -extended file is the correct size
-	stat, err := os.Stat(*extendedPath)
-	if err != nil {
-		log.Fatalln("failed to stat extended file:", err)
-	} else if n := stat.Size(); n != int64(meta.Length) {
-		log.Fatalf("extended file is the wrong size, expected %v bytes but got %v bytes", meta.Length, n)
+	// without an -extended file only the metadata can be recovered
+	if metadataOnly {
+		log.Println("no extended file, only the metadata was recovered")
+		return
 	}
 
-	// open the -extended file
-	ef, err := os.Open(*extendedPath)
+	// open the -extended file. The files are streamed from it, it is never
+	// read into memory. If the base sector holds a prefix of the payload, the
+	// -extended file may hold only the remainder.
+	ef, r, err := openPayload(*extendedPath, payload, meta.Length)
 	if err != nil {
-		log.Fatalln("failed to open extended sector:", err)
+		log.Fatalln(err)
 	}
+	defer ef.Close()
 
 	// recover the files from the -extended file
-	recoverFiles(ef, meta, *outputDir, *checksumAlgo)
+	recoverFiles(r, meta, out, *manifestPath, *checksumAlgo, skip)
 }
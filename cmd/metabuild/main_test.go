@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gitlab.com/SkynetLabs/skyd/skymodules"
+	"lukechampine.com/frand"
+)
+
+// writeExtendedFile writes n MiB of random data to fp and returns the
+// checksum of each subfile.
+func writeExtendedFile(t *testing.T, fp string, n int, subfiles skymodules.SkyfileSubfiles) map[string]string {
+	f, err := os.Create(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1<<20)
+	for i := 0; i < n; i++ {
+		frand.Read(buf)
+		if _, err := f.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checksums := make(map[string]string)
+	for _, subfile := range subfiles {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, int64(subfile.Offset), int64(subfile.Len))); err != nil {
+			t.Fatal(err)
+		}
+		checksums[subfile.Filename] = hex.EncodeToString(h.Sum(nil))
+	}
+	return checksums
+}
+
+// recoverAllocs returns the bytes allocated while recovering the files.
+func recoverAllocs(r io.ReadSeeker, meta skymodules.SkyfileMetadata, out output, manifestPath string) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	recoverFiles(r, meta, out, manifestPath, "sha256", skipNone)
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestRecoverLargeExtendedFile(t *testing.T) {
+	const size = 64 << 20
+	dir := t.TempDir()
+	meta := skymodules.SkyfileMetadata{
+		Filename: "site",
+		Length:   size,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"a.bin":     {Filename: "a.bin", Offset: 0, Len: 40 << 20, FileMode: 0644},
+			"dir/b.bin": {Filename: "dir/b.bin", Offset: 40 << 20, Len: 24 << 20, FileMode: 0600},
+		},
+	}
+	extendedPath := filepath.Join(dir, "extended")
+	checksums := writeExtendedFile(t, extendedPath, size>>20, meta.Subfiles)
+	if err := checkSubfiles(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	ef, err := os.Open(extendedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ef.Close()
+
+	// the files are streamed, only the copy buffers should be allocated
+	outDir := filepath.Join(dir, "out")
+	manifestPath := filepath.Join(dir, manifestName)
+	if allocs := recoverAllocs(ef, meta, &dirOutput{dir: outDir}, manifestPath); allocs > size/8 {
+		t.Fatalf("recovering a %v byte file allocated %v bytes", size, allocs)
+	}
+
+	buf, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		t.Fatal(err)
+	} else if len(m.Files) != len(meta.Subfiles) {
+		t.Fatalf("expected %v files in the manifest, got %v", len(meta.Subfiles), len(m.Files))
+	}
+	for _, mf := range m.Files {
+		if mf.Checksum != checksums[mf.Filename] {
+			t.Fatalf("%v: expected checksum %v, got %v", mf.Filename, checksums[mf.Filename], mf.Checksum)
+		}
+		f, err := os.Open(filepath.Join(outDir, mf.Filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if hex.EncodeToString(h.Sum(nil)) != mf.Checksum {
+			t.Fatalf("%v: recovered file does not match its checksum", mf.Filename)
+		}
+	}
+
+	// the archive outputs stream the files the same way
+	archivePath := filepath.Join(dir, "site.tar")
+	out, err := openOutput(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocs := recoverAllocs(ef, meta, out, ""); allocs > size/8 {
+		t.Fatalf("recovering a %v byte file to an archive allocated %v bytes", size, allocs)
+	} else if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	af, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	tr := tar.NewReader(af)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	for name, checksum := range checksums {
+		if files[name] != checksum {
+			t.Fatalf("%v: archived file does not match its checksum", name)
+		}
+	}
+	if _, ok := files[manifestName]; !ok {
+		t.Fatal("expected the manifest to be archived")
+	}
+}
+
+func TestDefaultSkynetDir(t *testing.T) {
+	t.Setenv("SKYNET_DATA_DIR", "")
+	if dir := defaultSkynetDir(); len(dir) == 0 {
+		t.Fatal("expected a platform default")
+	}
+	t.Setenv("SKYNET_DATA_DIR", "/data/skynet")
+	if dir := defaultSkynetDir(); dir != "/data/skynet" {
+		t.Fatalf("expected the environment override, got %v", dir)
+	}
+}
+
+func TestDirOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	do := &dirOutput{dir: dir}
+	for _, name := range []string{"a", "a/b", "/a/b", "a/../b"} {
+		if fp, err := do.path(name); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		} else if rel, _ := filepath.Rel(dir, fp); rel != filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "/"))) {
+			t.Fatalf("%v: unexpected path %v", name, fp)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "../a", "a/../../b"} {
+		if _, err := do.path(name); err == nil {
+			t.Fatalf("%v: expected the name to be rejected", name)
+		}
+	}
+	if err := do.WriteFile("../escaped", bytes.NewReader(nil), 0, 0644); err == nil {
+		t.Fatal("expected the write to be rejected")
+	} else if _, err := os.Stat(filepath.Join(dir, "..", "escaped")); !os.IsNotExist(err) {
+		t.Fatal("file was written outside of the output directory")
+	}
+}
+
+func TestCheckSubfiles(t *testing.T) {
+	meta := skymodules.SkyfileMetadata{
+		Length: 100,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"a": {Filename: "a", Offset: 0, Len: 50},
+			"b": {Filename: "b", Offset: 50, Len: 50},
+		},
+	}
+	if err := checkSubfiles(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subfile := range []skymodules.SkyfileSubfileMetadata{
+		{Filename: "c", Offset: 60, Len: 41},
+		{Filename: "c", Offset: 101, Len: 0},
+		{Filename: "c", Offset: 1, Len: ^uint64(0)},
+	} {
+		meta.Subfiles["c"] = subfile
+		if err := checkSubfiles(meta); err == nil {
+			t.Fatalf("expected subfile at %v with length %v to be rejected", subfile.Offset, subfile.Len)
+		}
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	dir := t.TempDir()
+	meta := skymodules.SkyfileMetadata{
+		Filename: "site",
+		Length:   1 << 20,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"a": {Filename: "a", Offset: 0, Len: 1 << 19, FileMode: 0644},
+			"b": {Filename: "b", Offset: 1 << 19, Len: 1 << 18, FileMode: 0644},
+			"c": {Filename: "c", Offset: 3 << 18, Len: 1 << 18, FileMode: 0644},
+		},
+	}
+	extendedPath := filepath.Join(dir, "extended")
+	checksums := writeExtendedFile(t, extendedPath, 1, meta.Subfiles)
+	ef, err := os.Open(extendedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ef.Close()
+
+	outDir := filepath.Join(dir, "out")
+	manifestPath := filepath.Join(dir, manifestName)
+	recoverFiles(ef, meta, &dirOutput{dir: outDir}, manifestPath, "sha256", skipNone)
+
+	// b is corrupted without changing its size and c is truncated, as if
+	// the previous run was interrupted
+	corrupt := frand.Bytes(1 << 18)
+	if err := os.WriteFile(filepath.Join(outDir, "b"), corrupt, 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.Truncate(filepath.Join(outDir, "c"), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	fileChecksum := func(name string) string {
+		buf, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(buf)
+		return hex.EncodeToString(sum[:])
+	}
+
+	// only the size is checked, so b is skipped and c is recovered again
+	recoverFiles(ef, meta, &dirOutput{dir: outDir}, manifestPath, "sha256", skipSize)
+	if fileChecksum("a") != checksums["a"] || fileChecksum("c") != checksums["c"] {
+		t.Fatal("expected a and c to match their checksums")
+	} else if buf, err := os.ReadFile(filepath.Join(outDir, "b")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, corrupt) {
+		t.Fatal("expected b to be skipped")
+	}
+
+	// the checksum of b no longer matches, so it is recovered again
+	recoverFiles(ef, meta, &dirOutput{dir: outDir}, manifestPath, "sha256", skipChecksum)
+	buf, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range m.Files {
+		if mf.Checksum != checksums[mf.Filename] || fileChecksum(mf.Filename) != mf.Checksum {
+			t.Fatalf("%v: expected checksum %v", mf.Filename, checksums[mf.Filename])
+		}
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	meta := skymodules.SkyfileMetadata{
+		Filename:    "site",
+		Length:      300,
+		DefaultPath: "/index.html",
+		Subfiles: skymodules.SkyfileSubfiles{
+			"index.html":    {Filename: "index.html", ContentType: "text/html", Offset: 0, Len: 100},
+			"assets/app.js": {Filename: "assets/app.js", ContentType: "application/javascript", Offset: 100, Len: 200},
+		},
+	}
+	fp := filepath.Join(t.TempDir(), "meta.json")
+	if err := writeMetadata(meta, fp); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded skymodules.SkyfileMetadata
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	} else if decoded.Filename != meta.Filename || decoded.Length != meta.Length || decoded.DefaultPath != meta.DefaultPath {
+		t.Fatalf("expected %+v, got %+v", meta, decoded)
+	} else if sub := decoded.Subfiles["assets/app.js"]; sub != meta.Subfiles["assets/app.js"] {
+		t.Fatalf("expected subfile %+v, got %+v", meta.Subfiles["assets/app.js"], sub)
+	}
+}
+
+// splitFixture returns a small directory skyfile whose base sector holds a
+// prefix of the payload that ends partway through a subfile, the prefix, and
+// the full payload.
+func splitFixture() (meta skymodules.SkyfileMetadata, prefix, payload []byte) {
+	meta = skymodules.SkyfileMetadata{
+		Filename: "site",
+		Length:   3 << 19,
+		Subfiles: skymodules.SkyfileSubfiles{
+			"index.html":    {Filename: "index.html", Offset: 0, Len: 1 << 19, FileMode: 0644},
+			"assets/app.js": {Filename: "assets/app.js", Offset: 1 << 19, Len: 1 << 19, FileMode: 0644},
+			"assets/b.png":  {Filename: "assets/b.png", Offset: 1 << 20, Len: 1 << 19, FileMode: 0644},
+		},
+	}
+	payload = frand.Bytes(int(meta.Length))
+	return meta, payload[:3<<18+333], payload
+}
+
+func TestSplitPayload(t *testing.T) {
+	meta, prefix, payload := splitFixture()
+	checksums := make(map[string]string)
+	for _, subfile := range meta.Subfiles {
+		sum := sha256.Sum256(payload[subfile.Offset : subfile.Offset+subfile.Len])
+		checksums[subfile.Filename] = hex.EncodeToString(sum[:])
+	}
+
+	// the extended file holds either the remainder or the entire payload
+	for _, extended := range [][]byte{payload[len(prefix):], payload} {
+		dir := t.TempDir()
+		extendedPath := filepath.Join(dir, "extended")
+		if err := os.WriteFile(extendedPath, extended, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ef, r, err := openPayload(extendedPath, prefix, meta.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ef.Close()
+
+		outDir := filepath.Join(dir, "out")
+		recoverFiles(r, meta, &dirOutput{dir: outDir}, filepath.Join(dir, manifestName), "sha256", skipNone)
+		for name, checksum := range checksums {
+			buf, err := os.ReadFile(filepath.Join(outDir, name))
+			if err != nil {
+				t.Fatal(err)
+			} else if sum := sha256.Sum256(buf); hex.EncodeToString(sum[:]) != checksum {
+				t.Fatalf("%v: recovered file does not match the payload", name)
+			}
+		}
+	}
+
+	// an extended file of any other size is rejected
+	extendedPath := filepath.Join(t.TempDir(), "extended")
+	if err := os.WriteFile(extendedPath, payload[len(prefix)+1:], 0644); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := openPayload(extendedPath, prefix, meta.Length); err == nil {
+		t.Fatal("expected the extended file to be rejected")
+	}
+}
+
+func TestParseMetadataSkylinkV2(t *testing.T) {
+	basePath := filepath.Join(t.TempDir(), "base")
+	if err := os.WriteFile(basePath, make([]byte, sectorSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a v2 skylink has a bitfield of 1 followed by the registry entry ID
+	buf := make([]byte, 34)
+	buf[0] = 1
+	frand.Read(buf[2:])
+	skylink := base64.RawURLEncoding.EncodeToString(buf)
+	if _, _, err := parseMetadata(nil, skylink, basePath); !errors.Is(err, errSkylinkV2) {
+		t.Fatalf("expected %v, got %v", errSkylinkV2, err)
+	}
+}
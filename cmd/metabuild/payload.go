@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// A splitPayload reads a skyfile payload whose prefix is stored in the base
+// sector and whose remainder is stored in the -extended file.
+type splitPayload struct {
+	prefix []byte
+	rest   io.ReadSeeker
+	offset int64
+}
+
+// Read implements io.Reader. Reads that cross the end of the prefix continue
+// from the start of the remainder.
+func (sp *splitPayload) Read(p []byte) (int, error) {
+	if sp.offset < int64(len(sp.prefix)) {
+		n := copy(p, sp.prefix[sp.offset:])
+		sp.offset += int64(n)
+		return n, nil
+	}
+	n, err := sp.rest.Read(p)
+	sp.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Only io.SeekStart and io.SeekCurrent are
+// supported.
+func (sp *splitPayload) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sp.offset
+	default:
+		return 0, errors.New("unsupported whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	// position the remainder at its start while reading the prefix so the
+	// read continues at the right offset
+	restOffset := offset - int64(len(sp.prefix))
+	if restOffset < 0 {
+		restOffset = 0
+	}
+	if _, err := sp.rest.Seek(restOffset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	sp.offset = offset
+	return offset, nil
+}
+
+// openPayload opens the -extended file at fp and returns a reader for the
+// length byte payload. The file holds either the entire payload or, if the
+// base sector holds a prefix of the payload, the remainder after it.
+func openPayload(fp string, prefix []byte, length uint64) (*os.File, io.ReadSeeker, error) {
+	stat, err := os.Stat(fp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat extended file: %w", err)
+	}
+	size := uint64(stat.Size())
+	switch {
+	case size == length:
+		// the extended file holds the entire payload
+		prefix = nil
+	case len(prefix) != 0 && size == length-uint64(len(prefix)):
+	case len(prefix) != 0:
+		return nil, nil, fmt.Errorf("extended file is the wrong size, expected %v or %v bytes but got %v bytes", length, length-uint64(len(prefix)), size)
+	default:
+		return nil, nil, fmt.Errorf("extended file is the wrong size, expected %v bytes but got %v bytes", length, size)
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open extended sector: %w", err)
+	} else if len(prefix) == 0 {
+		return f, f, nil
+	}
+	log.Printf("base sector contains the first %v bytes of the payload, reading the remaining %v bytes from the extended file", len(prefix), size)
+	return f, &splitPayload{prefix: prefix, rest: f}, nil
+}
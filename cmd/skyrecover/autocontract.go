@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/wallet"
+)
+
+const (
+	// autoContractBatch is the number of contracts formed each time a sector
+	// cannot be found on the contracted hosts.
+	autoContractBatch = 10
+	// autoContractDownloadSize is the download size of contracts formed
+	// during recovery. The host only needs to serve the missing sectors.
+	autoContractDownloadSize = 64 * rhp.SectorSize
+	// autoContractDuration is the duration of contracts formed during
+	// recovery.
+	autoContractDuration = 144 * 7
+)
+
+var (
+	autoContract      bool
+	autoContractLimit int
+)
+
+// An autoContractor forms contracts with active hosts that the renter does
+// not have a contract with when a sector cannot be found on the contracted
+// hosts.
+type autoContractor struct {
+	r     *renter.Renter
+	w     renter.Wallet
+	limit int
+
+	// candidates are the active hosts that have not been tried
+	candidates []rhp.PublicKey
+	loaded     bool
+	formed     int
+}
+
+// FormBatch forms contracts with up to autoContractBatch untried active hosts.
+// It returns the hosts that contracts were formed with, or nil if there are no
+// hosts left to try or the contract limit has been reached.
+func (ac *autoContractor) FormBatch() []rhp.PublicKey {
+	if ac.formed >= ac.limit {
+		return nil
+	} else if !ac.loaded {
+		ac.loaded = true
+		active, err := ac.r.ActiveHosts(contractHostFilter())
+		if err != nil {
+			log.Printf("[WARN] failed to get active hosts: %v", err)
+			return nil
+		}
+		contracted := make(map[rhp.PublicKey]bool)
+		for _, host := range ac.r.Hosts() {
+			contracted[host] = true
+		}
+		for _, host := range active {
+			if !contracted[host] {
+				ac.candidates = append(ac.candidates, host)
+			}
+		}
+		log.Printf("Found %v active hosts without contracts", len(ac.candidates))
+	}
+
+	var formed []rhp.PublicKey
+	for len(formed) < autoContractBatch && len(ac.candidates) != 0 && ac.formed < ac.limit {
+		host := ac.candidates[0]
+		ac.candidates = ac.candidates[1:]
+		_, err := ac.r.FormDownloadContract(host, autoContractDownloadSize, autoContractDuration, ac.w)
+		var insufficient *wallet.InsufficientFundsError
+		var immature *wallet.ImmatureFundsError
+		if errors.As(err, &insufficient) || errors.As(err, &immature) {
+			// every other host would fail the same way
+			log.Printf("[WARN] wallet ran out of funds, no more contracts will be formed: %v", err)
+			ac.limit = ac.formed
+			break
+		} else if err != nil {
+			log.Printf("[WARN] failed to form contract with host %v: %v", host, err)
+			continue
+		}
+		ac.formed++
+		formed = append(formed, host)
+	}
+	if len(formed) != 0 {
+		log.Printf("Formed contracts with %v hosts (%v/%v)", len(formed), ac.formed, ac.limit)
+	}
+	return formed
+}
+
+// recoverSectorAutoContract checks all contracted hosts for a sector. If ac is
+// not nil and the sector is not found, contracts are formed with batches of
+// active hosts and the new hosts are checked until the sector is found or no
+// hosts are left.
+func recoverSectorAutoContract(ctx context.Context, rc *Recoverer, ac *autoContractor, sector crypto.Hash, hostLimit int, missing map[rhp.PublicKey]bool) ([]byte, rhp.PublicKey, bool) {
+	if buf, host, ok := rc.RecoverSector(ctx, sector, hostLimit, missing); ok || ac == nil {
+		return buf, host, ok
+	}
+
+	for {
+		// skip the hosts that have already been checked
+		checked := make(map[rhp.PublicKey]bool)
+		for _, host := range rc.r.Hosts() {
+			checked[host] = true
+		}
+		formed := ac.FormBatch()
+		if len(formed) == 0 {
+			return nil, rhp.PublicKey{}, false
+		}
+		buf, host, ok := rc.RecoverSector(ctx, sector, hostLimit, checked)
+		if ok {
+			return buf, host, true
+		}
+		for _, host := range formed {
+			if checked[host] && missing != nil {
+				missing[host] = true
+			}
+		}
+	}
+}
+
+func newAutoContractor(r *renter.Renter, w renter.Wallet, limit int) *autoContractor {
+	return &autoContractor{r: r, w: w, limit: limit}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rodaine/table"
+	"go.sia.tech/skyrecover/internal/renter"
+)
+
+// recoverBatch recovers each sia file matching pattern into outputDir, named
+// after the sia file without its extension. The files' hosts are combined so
+// --setup forms contracts once for all of them. The outcome of each file and
+// the combined spending are printed at the end.
+func recoverBatch(r *renter.Renter, pattern, outputDir string) error {
+	paths, files, err := loadSiaFiles(pattern)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, sf := range files {
+		warnRootCollisions(sf)
+	}
+	log.Printf("Recovering %v files", len(files))
+
+	// check that we have contracts with all hosts listed in the files
+	if missingHosts, err := checkMissingHosts(r, siaFilesHosts(files)); err != nil {
+		return &exitCodeError{exitError, fmt.Errorf("failed to check missing hosts: %w", err)}
+	} else if setupContracts && len(missingHosts) != 0 {
+		runSetup(r, missingHosts)
+	}
+	if len(r.Hosts()) == 0 {
+		printOnboarding(fmt.Sprintf("--from-files %q", pattern))
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		log.Fatalln("failed to create output directory:", err)
+	}
+
+	var ac *autoContractor
+	if autoContract {
+		ac = newAutoContractor(r, mustLoadWallet(), autoContractLimit)
+	}
+
+	// the hosts' performance is shared by every file
+	rc := newRecoverer(r, workers)
+	defer rc.Close()
+	if costAware {
+		enableCostAware(r, rc)
+		defer rc.PrintCostSavings()
+	}
+
+	spentStart := spending.Total()
+	tbl := table.New("File", "Status", "Chunks", "Sectors", "Spent", "Error")
+	var recovered, partial int
+	for i, sf := range files {
+		outputPath := filepath.Join(outputDir, strings.TrimSuffix(filepath.Base(paths[i]), filepath.Ext(paths[i])))
+		log.Printf("Recovering %v to %v (%v/%v)", paths[i], outputPath, i+1, len(files))
+
+		stats, err := recoverFile(rc, ac, nil, sf, outputPath)
+		status := "recovered"
+		var ece *exitCodeError
+		switch {
+		case err == nil:
+			recovered++
+		case errors.As(err, &ece) && ece.code == exitPartial:
+			status = "partial"
+			partial++
+		default:
+			status = "failed"
+		}
+		if stats == nil {
+			tbl.AddRow(paths[i], status, "", "", "", err)
+			continue
+		}
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		tbl.AddRow(paths[i], status, fmt.Sprintf("%v/%v", stats.Recovered(), stats.chunks), stats.sectorsDownloaded, stats.Spent().HumanString(), errStr)
+	}
+
+	tbl.Print()
+	spent := spending.Total().Sub(spentStart)
+	log.Printf("Recovered %v/%v files, %v partially, spent %v", recovered, len(files), partial, spent.HumanString())
+	if ac != nil && ac.formed != 0 {
+		log.Printf("Formed %v contracts during recovery", ac.formed)
+	}
+
+	switch {
+	case recovered == len(files):
+		return nil
+	case recovered == 0 && partial == 0:
+		return &exitCodeError{exitUnrecoverable, errors.New("no files were recovered")}
+	default:
+		return &exitCodeError{exitPartial, fmt.Errorf("%v/%v files were not fully recovered", len(files)-recovered, len(files))}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// maxCheckBytes is the --max-check-bytes flag, the most sector data file check
+// reads before it stops.
+var maxCheckBytes string
+
+// checkBudget limits the bytes read by file check's sector checks.
+var checkBudget byteBudget
+
+// errCheckBudgetExceeded is returned by sector checks that would read more
+// than --max-check-bytes.
+var errCheckBudgetExceeded = errors.New("check byte budget exceeded")
+
+// A byteBudget tracks the bytes read against a limit. A zero limit is
+// unlimited.
+type byteBudget struct {
+	mu        sync.Mutex
+	limit     uint64
+	used      uint64
+	exhausted bool
+}
+
+// Reserve records n bytes that are about to be read. It returns false and
+// marks the budget as exhausted if reading them would exceed the limit.
+func (bb *byteBudget) Reserve(n uint64) bool {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if bb.limit == 0 {
+		bb.used += n
+		return true
+	} else if bb.exhausted || bb.used+n > bb.limit {
+		bb.exhausted = true
+		return false
+	}
+	bb.used += n
+	return true
+}
+
+// Exhausted returns true if a reservation was refused.
+func (bb *byteBudget) Exhausted() bool {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	return bb.exhausted
+}
+
+// Used returns the bytes reserved.
+func (bb *byteBudget) Used() uint64 {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	return bb.used
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestByteBudget(t *testing.T) {
+	var unlimited byteBudget
+	for i := 0; i < 100; i++ {
+		if !unlimited.Reserve(1 << 22) {
+			t.Fatal("expected an unlimited budget to allow every read")
+		}
+	}
+	if unlimited.Exhausted() {
+		t.Fatal("expected an unlimited budget not to be exhausted")
+	}
+
+	bb := byteBudget{limit: 10 << 20}
+	if !bb.Reserve(4<<20) || !bb.Reserve(4<<20) {
+		t.Fatal("expected the reads to fit in the budget")
+	} else if bb.Reserve(4 << 20) {
+		t.Fatal("expected the read past the budget to be refused")
+	} else if !bb.Exhausted() {
+		t.Fatal("expected the budget to be exhausted")
+	} else if bb.Reserve(64) {
+		// the check stops at the first refused read even if smaller reads
+		// would still fit
+		t.Fatal("expected an exhausted budget to refuse every read")
+	} else if bb.Used() != 8<<20 {
+		t.Fatalf("expected 8 MiB used, got %v", bb.Used())
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"go.sia.tech/siad/crypto"
+)
+
+// A cacheMergeResult counts the sectors handled by mergeSectorCaches.
+type cacheMergeResult struct {
+	Imported   int
+	Duplicates int
+	Corrupt    int
+}
+
+// A cacheVerifyResult lists the sectors checked by verifySectorCache.
+type cacheVerifyResult struct {
+	Verified int
+	Corrupt  []crypto.Hash
+	Removed  int
+}
+
+var (
+	// removeCorrupt is the cache verify --remove flag.
+	removeCorrupt bool
+
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "manage directories of sectors named by merkle root, as read by --pieces-from",
+		Run:   func(cmd *cobra.Command, args []string) { cmd.Usage() },
+	}
+
+	cacheMergeCmd = &cobra.Command{
+		Use:   "merge <output dir> <cache dir>...",
+		Short: "import the verified sectors of several caches into one",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 2 {
+				cmd.Usage()
+				return
+			}
+
+			res, err := mergeSectorCaches(args[0], args[1:])
+			if err != nil {
+				log.Fatalln("failed to merge caches:", err)
+			}
+			log.Printf("Imported %v sectors into %v, %v were already present, %v were corrupt", res.Imported, args[0], res.Duplicates, res.Corrupt)
+		},
+	}
+
+	cacheVerifyCmd = &cobra.Command{
+		Use:   "verify <cache dir>",
+		Short: "check every sector in a cache against the merkle root it is named by",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				cmd.Usage()
+				return &exitCodeError{exitError, errors.New("expected a cache directory")}
+			}
+
+			res, err := verifySectorCache(args[0], removeCorrupt)
+			if err != nil {
+				log.Fatalln("failed to verify cache:", err)
+			}
+			for _, root := range res.Corrupt {
+				log.Printf("[WARN] sector %v is corrupt", root)
+			}
+			log.Printf("Verified %v sectors, %v were corrupt", res.Verified+len(res.Corrupt), len(res.Corrupt))
+			if res.Removed != 0 {
+				log.Printf("Removed %v corrupt sectors", res.Removed)
+			} else if len(res.Corrupt) != 0 {
+				return &exitCodeError{exitError, errors.New("the cache has corrupt sectors, remove them with --remove")}
+			}
+			return nil
+		},
+	}
+)
+
+// verifySectorCache checks each sector in dir against the merkle root it is
+// named by. Corrupt sectors are removed if remove is set. Files that are not
+// named by a merkle root are ignored.
+func verifySectorCache(dir string, remove bool) (res cacheVerifyResult, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return cacheVerifyResult{}, fmt.Errorf("failed to read cache: %w", err)
+	}
+	for _, entry := range entries {
+		var root crypto.Hash
+		if !entry.Type().IsRegular() || root.LoadString(entry.Name()) != nil {
+			continue
+		}
+
+		if _, err := loadLocalSector(dir, root); err == nil {
+			res.Verified++
+			continue
+		} else if errors.Is(err, fs.ErrNotExist) {
+			continue // removed since the directory was read
+		}
+		res.Corrupt = append(res.Corrupt, root)
+		if !remove {
+			continue
+		} else if err := os.Remove(filepath.Join(dir, root.String())); err != nil {
+			return res, fmt.Errorf("failed to remove sector %v: %w", root, err)
+		}
+		res.Removed++
+	}
+	return res, nil
+}
+
+// mergeSectorCaches copies the sectors in each of the source directories to
+// dst. Each sector is verified against the merkle root it is named by before
+// it is copied, and sectors already in dst are skipped. Files that are not
+// named by a merkle root are ignored.
+func mergeSectorCaches(dst string, srcs []string) (res cacheMergeResult, err error) {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return cacheMergeResult{}, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	for _, src := range srcs {
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return res, fmt.Errorf("failed to read cache %v: %w", src, err)
+		}
+		for _, entry := range entries {
+			var root crypto.Hash
+			if !entry.Type().IsRegular() || root.LoadString(entry.Name()) != nil {
+				continue
+			}
+
+			fp := filepath.Join(dst, root.String())
+			if _, err := os.Stat(fp); err == nil {
+				res.Duplicates++
+				continue
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return res, fmt.Errorf("failed to check sector %v: %w", root, err)
+			}
+
+			buf, err := loadLocalSector(src, root)
+			if err != nil {
+				log.Printf("[WARN] skipping sector %v in %v: %v", root, src, err)
+				res.Corrupt++
+				continue
+			} else if err := writeLocalSector(fp, buf); err != nil {
+				return res, err
+			}
+			res.Imported++
+		}
+	}
+	return res, nil
+}
+
+// writeLocalSector writes a sector to fp through a temporary file so a merge
+// that is interrupted does not leave a partial sector behind.
+func writeLocalSector(fp string, buf []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fp), filepath.Base(fp)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create sector file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write sector: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write sector: %w", err)
+	} else if err := os.Rename(f.Name(), fp); err != nil {
+		return fmt.Errorf("failed to write sector: %w", err)
+	}
+	return nil
+}
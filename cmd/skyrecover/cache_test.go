@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+func TestMergeSectorCaches(t *testing.T) {
+	dir := t.TempDir()
+	a, b, dst := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "merged")
+	for _, d := range []string{a, b} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeSector := func(dir string, sector *[rhp.SectorSize]byte) crypto.Hash {
+		root := crypto.Hash(rhp.SectorRoot(sector))
+		if err := os.WriteFile(filepath.Join(dir, root.String()), sector[:], 0600); err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	// a and b share one sector and b has a corrupt sector and an unrelated
+	// file
+	shared := randomSector()
+	roots := []crypto.Hash{
+		writeSector(a, randomSector()),
+		writeSector(a, shared),
+		writeSector(b, shared),
+		writeSector(b, randomSector()),
+	}
+	corrupt := randomSector()
+	corruptRoot := writeSector(b, corrupt)
+	corrupt[0] ^= 1
+	if err := os.WriteFile(filepath.Join(b, corruptRoot.String()), corrupt[:], 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(b, "notes.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := mergeSectorCaches(dst, []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	} else if res != (cacheMergeResult{Imported: 3, Duplicates: 1, Corrupt: 1}) {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 3 {
+		t.Fatalf("expected 3 sectors in the merged cache, got %v", len(entries))
+	}
+	for _, root := range roots {
+		buf, err := loadLocalSector(dst, root)
+		if err != nil {
+			t.Fatal(err)
+		} else if root == roots[1] && !bytes.Equal(buf, shared[:]) {
+			t.Fatal("shared sector data mismatch")
+		}
+	}
+
+	// merging again imports nothing
+	res, err = mergeSectorCaches(dst, []string{a, b})
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Imported != 0 || res.Duplicates != 4 {
+		t.Fatalf("expected every sector to be a duplicate, got %+v", res)
+	}
+}
+
+func TestVerifySectorCache(t *testing.T) {
+	dir := t.TempDir()
+	var roots []crypto.Hash
+	for i := 0; i < 3; i++ {
+		sector := randomSector()
+		root := crypto.Hash(rhp.SectorRoot(sector))
+		if err := os.WriteFile(filepath.Join(dir, root.String()), sector[:], 0600); err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+	// corrupt one sector and truncate another
+	buf, err := os.ReadFile(filepath.Join(dir, roots[1].String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[0] ^= 1
+	if err := os.WriteFile(filepath.Join(dir, roots[1].String()), buf, 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(dir, roots[2].String()), buf[:100], 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// without --remove the corrupt sectors are only reported
+	res, err := verifySectorCache(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Verified != 1 || len(res.Corrupt) != 2 || res.Removed != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	res, err = verifySectorCache(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Verified != 1 || res.Removed != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	} else if _, err := loadLocalSector(dir, roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range roots[1:] {
+		if _, err := os.Stat(filepath.Join(dir, root.String())); !os.IsNotExist(err) {
+			t.Fatalf("expected corrupt sector %v to be removed, got %v", root, err)
+		}
+	}
+}
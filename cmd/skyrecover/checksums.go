@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+
+	"go.sia.tech/skyrecover/internal/jsonout"
+)
+
+// A ChecksumFile is an integrity sidecar for a recovered file. Chunk
+// boundaries match the siafile's PieceSize * MinPieces, so the sidecar can be
+// reproduced from the file's metadata.
+type ChecksumFile struct {
+	Algorithm string   `json:"algorithm"`
+	FileSize  uint64   `json:"fileSize"`
+	ChunkSize uint64   `json:"chunkSize"`
+	Hash      string   `json:"hash"`
+	Chunks    []string `json:"chunks"`
+}
+
+// A checksumWriter computes the SHA-256 hash of each chunk and of the whole
+// file as it is written.
+type checksumWriter struct {
+	chunk hash.Hash
+	file  hash.Hash
+	sums  ChecksumFile
+}
+
+// Write implements io.Writer.
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	cw.chunk.Write(p)
+	cw.file.Write(p)
+	return len(p), nil
+}
+
+// EndChunk records the checksum of the data written since the last call.
+func (cw *checksumWriter) EndChunk() {
+	cw.sums.Chunks = append(cw.sums.Chunks, hex.EncodeToString(cw.chunk.Sum(nil)))
+	cw.chunk.Reset()
+}
+
+// WriteFile writes the checksums to path.
+func (cw *checksumWriter) WriteFile(path string) error {
+	cw.sums.Hash = hex.EncodeToString(cw.file.Sum(nil))
+	buf, err := jsonout.Marshal(cw.sums, "", jsonIndent())
+	if err != nil {
+		return fmt.Errorf("failed to encode checksums: %w", err)
+	} else if err := os.WriteFile(path, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write checksums: %w", err)
+	}
+	return nil
+}
+
+func newChecksumWriter(fileSize, chunkSize uint64) *checksumWriter {
+	return &checksumWriter{
+		chunk: sha256.New(),
+		file:  sha256.New(),
+		sums: ChecksumFile{
+			Algorithm: "sha256",
+			FileSize:  fileSize,
+			ChunkSize: chunkSize,
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestChecksumWriter(t *testing.T) {
+	data := frand.Bytes(2500)
+	const chunkSize = 1000
+
+	cw := newChecksumWriter(uint64(len(data)), chunkSize)
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		// write in uneven pieces, like the erasure coder
+		cw.Write(data[i : i+7])
+		cw.Write(data[i+7 : end])
+		cw.EndChunk()
+	}
+
+	path := filepath.Join(t.TempDir(), "checksums.json")
+	if err := cw.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sums ChecksumFile
+	if err := json.Unmarshal(buf, &sums); err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := func(b []byte) string {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+	if sums.Hash != checksum(data) {
+		t.Fatal("file hash mismatch")
+	} else if len(sums.Chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %v", len(sums.Chunks))
+	}
+	for i, sum := range sums.Chunks {
+		end := (i + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if sum != checksum(data[i*chunkSize:end]) {
+			t.Fatalf("chunk %v hash mismatch", i)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configNames are the names of the config files looked for in the working
+// directory and the data directory.
+var configNames = []string{"skyrecover.yaml", "skyrecover.yml", "skyrecover.toml"}
+
+// readConfigFile reads the first config file found in dir. It returns nil if
+// there is none.
+func readConfigFile(dir string) (*viper.Viper, error) {
+	for _, name := range configNames {
+		fp := filepath.Join(dir, name)
+		if _, err := os.Stat(fp); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %w", err)
+		}
+
+		v := viper.New()
+		v.SetConfigFile(fp)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %v: %w", fp, err)
+		}
+		return v, nil
+	}
+	return nil, nil
+}
+
+// commandPath returns the command's path below the root command joined by
+// dots, e.g. "file.recover".
+func commandPath(cmd *cobra.Command) string {
+	var names []string
+	for c := cmd; c.HasParent(); c = c.Parent() {
+		names = append([]string{c.Name()}, names...)
+	}
+	return strings.Join(names, ".")
+}
+
+// configValue returns the config's value for key as a flag value. Lists are
+// joined by commas.
+func configValue(v *viper.Viper, key string) string {
+	switch v.Get(key).(type) {
+	case []interface{}, []string:
+		return strings.Join(v.GetStringSlice(key), ",")
+	default:
+		return v.GetString(key)
+	}
+}
+
+// applyConfig sets the command's flags that were not set on the command line
+// from the config. Keys in a section only apply to the command at that path,
+// e.g. "file.recover.workers" only sets file recover's --workers. The most
+// specific value for each flag is used: a value in the command's section over
+// one in its parents' sections over a top-level value.
+func applyConfig(cmd *cobra.Command, v *viper.Viper) error {
+	var sections []string
+	path := commandPath(cmd)
+	for len(path) != 0 {
+		sections = append(sections, path+".")
+		if i := strings.LastIndex(path, "."); i != -1 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	sections = append(sections, "")
+
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		for _, section := range sections {
+			key := section + f.Name
+			if !v.IsSet(key) {
+				continue
+			}
+			value := configValue(v, key)
+			if serr := cmd.Flags().Set(f.Name, value); serr != nil {
+				err = fmt.Errorf("invalid value %q for %v: %w", value, key, serr)
+			}
+			return
+		}
+	})
+	return err
+}
+
+// loadConfig sets the command's flags from the config files in the working
+// directory and the data directory. Flags set on the command line take
+// precedence, then the working directory's file, which may also set --dir.
+func loadConfig(cmd *cobra.Command) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	loaded := make(map[string]bool)
+	for _, dir := range []func() string{
+		func() string { return wd },
+		func() string { return dataDir },
+	} {
+		v, err := readConfigFile(dir())
+		if err != nil {
+			return err
+		} else if v == nil {
+			continue
+		}
+		fp := v.ConfigFileUsed()
+		// the data directory may be the working directory
+		if abs, err := filepath.Abs(fp); err == nil {
+			if loaded[abs] {
+				continue
+			}
+			loaded[abs] = true
+		}
+		if err := applyConfig(cmd, v); err != nil {
+			return fmt.Errorf("config file %v: %w", fp, err)
+		}
+	}
+	return nil
+}
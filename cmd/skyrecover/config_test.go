@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// testConfigCommand returns the file recover command of a test command tree
+// and the values of its flags.
+func testConfigCommand(t *testing.T, args ...string) (*cobra.Command, *string, *int, *int, *[]string) {
+	var dir string
+	var workers, retries int
+	var hosts []string
+	root := &cobra.Command{Use: "skyrecover"}
+	root.PersistentFlags().StringVar(&dir, "dir", ".", "")
+	file := &cobra.Command{Use: "file"}
+	rec := &cobra.Command{Use: "recover", Run: func(*cobra.Command, []string) {}}
+	rec.Flags().IntVar(&workers, "workers", 100, "")
+	rec.Flags().IntVar(&retries, "chunk-retries", 0, "")
+	rec.Flags().StringSliceVar(&hosts, "hosts", nil, "")
+	root.AddCommand(file)
+	file.AddCommand(rec)
+
+	cmd, _, err := root.Find([]string{"file", "recover"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, &dir, &workers, &retries, &hosts
+}
+
+func TestApplyConfig(t *testing.T) {
+	yaml := `# skyrecover defaults
+dir: "/data"
+workers: 10
+chunk-retries: 5
+file:
+  workers: 20
+  recover:
+    workers: 50
+    hosts:
+      - a
+      - b
+`
+	toml := `# skyrecover defaults
+dir = "/data"
+workers = 10
+chunk-retries = 5
+
+[file]
+workers = 20
+
+[file.recover]
+workers = 50
+hosts = ["a", "b"]
+`
+	for name, contents := range map[string]string{
+		"skyrecover.yaml": yaml,
+		"skyrecover.toml": toml,
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		v, err := readConfigFile(dir)
+		if err != nil {
+			t.Fatal(err)
+		} else if v == nil {
+			t.Fatalf("%v: expected the config file to be found", name)
+		}
+
+		cmd, dataDir, workers, retries, hosts := testConfigCommand(t, "--chunk-retries", "3")
+		if err := applyConfig(cmd, v); err != nil {
+			t.Fatal(err)
+		} else if *dataDir != "/data" {
+			t.Fatalf("%v: expected dir /data, got %v", name, *dataDir)
+		} else if *workers != 50 {
+			t.Fatalf("%v: expected the command's section to set 50 workers, got %v", name, *workers)
+		} else if *retries != 3 {
+			t.Fatalf("%v: expected the command line to take precedence, got %v retries", name, *retries)
+		} else if strings.Join(*hosts, ",") != "a,b" {
+			t.Fatalf("%v: expected hosts a,b, got %v", name, *hosts)
+		}
+	}
+
+	if v, err := readConfigFile(t.TempDir()); err != nil || v != nil {
+		t.Fatalf("expected no config, got %v %v", v, err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "skyrecover.yaml"), []byte("workers: many\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := readConfigFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, _, _, _, _ := testConfigCommand(t, "--workers", "1")
+	if err := applyConfig(cmd, v); err != nil {
+		t.Fatal("expected flags that are already set to be skipped, got", err)
+	}
+	cmd, _, _, _, _ = testConfigCommand(t)
+	if err := applyConfig(cmd, v); err == nil {
+		t.Fatal("expected an invalid value to be rejected")
+	}
+}
@@ -1,25 +1,49 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rodaine/table"
-	"github.com/siacentral/apisdkgo"
-	"github.com/siacentral/apisdkgo/sia"
 	"github.com/spf13/cobra"
 	"go.sia.tech/siad/types"
 	"go.sia.tech/skyrecover/internal/renter"
 	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"go.sia.tech/skyrecover/internal/wallet"
 )
 
 var (
+	formFromFile  string
+	formFromFiles string
+	// formWait waits for immature outputs to mature instead of failing when
+	// they are needed to form the contracts.
+	formWait bool
+	// formRenterFunds and formHostCollateral override the funding of formed
+	// contracts. They are siacoin amounts, e.g. "10SC".
+	formRenterFunds    string
+	formHostCollateral string
+	// formRenewWindow is the number of blocks before expiry within which
+	// existing contracts are renewed instead of skipped.
+	formRenewWindow uint64 = 144
+
+	gcMinReads  uint64 = 1
+	gcDryRun    bool
+	gcExhausted bool
+
+	verifyRemove bool
+
 	contractsCmd = &cobra.Command{
 		Use:   "contracts",
 		Short: "list current contracts",
 		Run: func(cmd *cobra.Command, args []string) {
-			r, err := renter.New(dataDir)
+			r, err := newRenter()
 			if err != nil {
 				log.Fatalln("failed to initialize renter:", err)
 			}
@@ -36,45 +60,195 @@ var (
 		Use:   "hosts",
 		Short: "get a list of contracts the renter has formed",
 		Run: func(cmd *cobra.Command, args []string) {
-			siaCentralClient := apisdkgo.NewSiaClient()
-			filter := make(sia.HostFilter)
-			filter.WithAcceptingContracts(true)
-			filter.WithMinUptime(0.6)
-			filter.WithMaxContractPrice(types.SiacoinPrecision.Div64(2))
+			hosts, err := explorerClient().ActiveHosts(contractHostFilter())
+			if err != nil {
+				log.Fatalln("failed to get active hosts:", err)
+			}
 
 			tbl := table.New("Public Key", "Net Address", "Last Seen")
+			for _, host := range hosts {
+				tbl.AddRow(host.PublicKey, host.NetAddress, host.LastSuccessScan.Format(time.RFC1123))
+			}
+			tbl.Print()
+		},
+	}
 
-			for i := 0; true; i++ {
-				activeHosts, err := siaCentralClient.GetActiveHosts(filter, i, 500)
-				if err != nil {
-					log.Fatalln("failed to get active hosts:", err)
-				} else if len(activeHosts) == 0 {
-					break
+	contractsGCCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "remove contracts that cannot pay for a sector read",
+		Run: func(cmd *cobra.Command, args []string) {
+			r, err := newRenter()
+			if err != nil {
+				log.Fatalln("failed to initialize renter:", err)
+			}
+
+			results := checkContractFunds(r)
+			tbl := table.New("Host Key", "Contract ID", "Remaining", "Sector Read Cost", "Status")
+			var exhausted int
+			for _, cf := range results {
+				switch {
+				case cf.err != nil:
+					tbl.AddRow(cf.contract.HostKey, cf.contract.ID, "", "", cf.err)
+				case cf.exhausted(gcMinReads):
+					exhausted++
+					tbl.AddRow(cf.contract.HostKey, cf.contract.ID, cf.remaining.HumanString(), cf.readCost.HumanString(), "exhausted")
+				default:
+					tbl.AddRow(cf.contract.HostKey, cf.contract.ID, cf.remaining.HumanString(), cf.readCost.HumanString(), "ok")
 				}
+			}
+			tbl.Print()
+
+			if gcDryRun {
+				log.Printf("%v/%v contracts cannot pay for %v sector reads", exhausted, len(results), gcMinReads)
+				return
+			}
+			removed := removeExhaustedContracts(r, results, gcMinReads)
+			log.Printf("Removed %v/%v contracts that cannot pay for %v sector reads", removed, len(results), gcMinReads)
+			if err := r.Close(); err != nil {
+				log.Fatalln("failed to save contracts:", err)
+			}
+		},
+	}
+
+	contractsVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "check that every contract can be used for recovery",
+		Run: func(cmd *cobra.Command, args []string) {
+			r, err := newRenter()
+			if err != nil {
+				log.Fatalln("failed to initialize renter:", err)
+			}
+
+			results := checkContractFunds(r)
+			tbl := table.New("Host Key", "Contract ID", "Remaining", "Status")
+			counts := make(map[contractProblem]int)
+			for _, cf := range results {
+				problem := cf.problem(gcMinReads)
+				counts[problem]++
+				switch problem {
+				case problemNone, problemExhausted:
+					tbl.AddRow(cf.contract.HostKey, cf.contract.ID, cf.remaining.HumanString(), problem)
+				default:
+					tbl.AddRow(cf.contract.HostKey, cf.contract.ID, "", fmt.Sprintf("%v: %v", problem, cf.err))
+				}
+			}
+			tbl.Print()
+
+			log.Printf("%v/%v contracts are usable", counts[problemNone], len(results))
+			if n := counts[problemUnreachable]; n != 0 {
+				log.Printf("  %v hosts could not be reached, run verify again later or form contracts with other hosts", n)
+			}
+			if n := counts[problemHostKeyChanged]; n != 0 {
+				log.Printf("  %v hosts' addresses now belong to a different host, their sectors can only be found by fanout", n)
+			}
+			if n := counts[problemUnknown]; n != 0 {
+				log.Printf("  %v hosts have no record of their contract, remove them with --remove and form new contracts", n)
+			}
+			if n := counts[problemExhausted]; n != 0 {
+				log.Printf("  %v contracts cannot pay for %v sector reads, remove them with --remove and form new contracts", n, gcMinReads)
+			}
 
-				for _, host := range activeHosts {
-					tbl.AddRow(host.PublicKey, host.NetAddress, host.LastSuccessScan.Format(time.RFC1123))
+			if !verifyRemove {
+				return
+			}
+			var removed int
+			for _, cf := range results {
+				switch cf.problem(gcMinReads) {
+				case problemUnknown, problemExhausted:
+				default:
+					continue
 				}
+				if err := r.RemoveContract(cf.contract); err != nil {
+					log.Printf("[WARN] failed to remove contract %v: %v", cf.contract.ID, err)
+					continue
+				}
+				removed++
+			}
+			log.Printf("Removed %v/%v contracts", removed, len(results))
+			if err := r.Close(); err != nil {
+				log.Fatalln("failed to save contracts:", err)
+			}
+		},
+	}
+
+	contractsEncryptCmd = &cobra.Command{
+		Use:   "encrypt",
+		Short: "encrypt an existing contracts file with a passphrase",
+		Run: func(cmd *cobra.Command, args []string) {
+			// the renter encrypts the plaintext file when it is loaded
+			encryptContracts = true
+			r, err := newRenter()
+			if err != nil {
+				log.Fatalln("failed to initialize renter:", err)
+			} else if err := r.Close(); err != nil {
+				log.Fatalln("failed to save contracts:", err)
 			}
+			log.Println("The contracts file is encrypted. Set CONTRACTS_PASSPHRASE or enter the passphrase when prompted to use it.")
+		},
+	}
 
+	contractsImportSkydCmd = &cobra.Command{
+		Use:   "import-skyd <skyd contracts dir>",
+		Short: "import a skyd renter's contracts so they can be used for recovery",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmd.Usage()
+				os.Exit(1)
+			}
+
+			r, err := newRenter()
+			if err != nil {
+				log.Fatalln("failed to initialize renter:", err)
+			}
+
+			imported, err := r.ImportSkydContracts(args[0])
+			if err != nil {
+				log.Fatalln("failed to import contracts:", err)
+			}
+			tbl := table.New("Host Key", "Contract ID", "Expiration Height")
+			for _, contract := range imported {
+				tbl.AddRow(contract.HostKey, contract.ID, contract.ExpirationHeight)
+			}
 			tbl.Print()
+			log.Printf("Imported %v contracts", len(imported))
 		},
 	}
 
 	contractsFormCmd = &cobra.Command{
-		Use:   "form <host key>...",
+		Use:   "form [host key]...",
 		Short: "form contracts with hosts.",
 		Run: func(cmd *cobra.Command, args []string) {
 			w := mustLoadWallet()
-			r, err := renter.New(dataDir)
+			r, err := newRenter()
 			if err != nil {
 				log.Fatalln("failed to initialize contractor:", err)
-			} else if len(args) == 0 {
+			} else if len(args) == 0 && len(formFromFile) == 0 && len(formFromFiles) == 0 {
 				cmd.Usage()
 				os.Exit(1)
 			}
 
 			var hosts []rhp.PublicKey
+			if len(formFromFile) != 0 && isHostExport(formFromFile) {
+				hosts, err = loadHostExport(formFromFile)
+				if err != nil {
+					log.Fatalln("failed to load host export:", err)
+				}
+			} else if len(formFromFile) != 0 {
+				sf, err := siafile.Load(formFromFile)
+				if err != nil {
+					log.Fatalln("failed to parse skyfile:", err)
+				}
+				hosts = siaFileHosts(sf)
+			}
+			if len(formFromFiles) != 0 {
+				_, files, err := loadSiaFiles(formFromFiles)
+				if err != nil {
+					log.Fatalln("failed to load sia files:", err)
+				}
+				fileHosts := siaFilesHosts(files)
+				log.Printf("%v sia files list %v unique hosts", len(files), len(fileHosts))
+				hosts = append(hosts, fileHosts...)
+			}
 			for _, key := range args {
 				var hostPub rhp.PublicKey
 				if err := hostPub.UnmarshalText([]byte(key)); err != nil {
@@ -83,18 +257,269 @@ var (
 				hosts = append(hosts, hostPub)
 			}
 
-			for i, hostPub := range hosts {
-				// if a contract already exists, skip
-				if _, err := r.HostContract(hostPub); err == nil && !force {
-					log.Printf("Skipping host %v, contract exists", hostPub)
-					continue
-				}
-				log.Printf("Forming contract with host %v (%v/%v)", hostPub, i+1, len(hosts))
-
-				if _, err := r.FormDownloadContract(hostPub, 10*(1<<30), 144*30, w); err != nil {
-					log.Println(" WARNING: failed to update contract:", err)
-				}
+			formErr := formContracts(r, w, hosts)
+			if err := r.Close(); err != nil {
+				log.Fatalln("failed to save contracts:", err)
+			} else if formErr != nil {
+				log.Fatalln(formErr)
 			}
 		},
 	}
 )
+
+const (
+	formDownloadSize = 10 * (1 << 30) // 10 GiB
+	formDuration     = 144 * 30       // 30 days
+)
+
+// checkFormationFunds estimates the cost of forming contracts with the hosts
+// and returns an error if the wallet's balance or number of spendable outputs
+// is not enough to form all of them. Each formation requires its own output.
+func checkFormationFunds(r *renter.Renter, w *wallet.SingleAddressWallet, hosts []rhp.PublicKey, opts []renter.FormOption) error {
+	var total, max types.Currency
+	for _, hostPub := range hosts {
+		cost, err := r.EstimateFormationCost(hostPub, formDownloadSize, formDuration, opts...)
+		if err != nil {
+			log.Printf("WARNING: failed to estimate formation cost for host %v: %v", hostPub, err)
+			continue
+		}
+		total = total.Add(cost)
+		if cost.Cmp(max) > 0 {
+			max = cost
+		}
+	}
+
+	balance, err := w.Balance()
+	if err != nil {
+		return fmt.Errorf("failed to get wallet balance: %w", err)
+	}
+	utxos, err := w.SpendableUTXOs()
+	if err != nil {
+		return fmt.Errorf("failed to get spendable utxos: %w", err)
+	}
+	log.Printf("Estimated cost to form %v contracts: %v (balance %v, %v spendable outputs)", len(hosts), total.HumanString(), balance.HumanString(), len(utxos))
+
+	switch {
+	case balance.Cmp(total) < 0:
+		if err := w.MaturityError(total); err != nil {
+			return err
+		}
+		return fmt.Errorf("wallet balance %v is less than the estimated cost %v", balance.HumanString(), total.HumanString())
+	case len(utxos) < len(hosts):
+		return fmt.Errorf("wallet has %v spendable outputs, %v are required -- run wallet redistribute %v %vH", len(utxos), len(hosts), len(hosts), max)
+	}
+	return nil
+}
+
+// formContracts forms download contracts with each of the hosts. Hosts with
+// an existing contract are skipped unless force is set. Failures are logged
+// and the next host is tried, unless the wallet runs out of funds, which stops
+// formation and returns an error.
+func formContracts(r *renter.Renter, w *wallet.SingleAddressWallet, hosts []rhp.PublicKey) error {
+	var toForm []rhp.PublicKey
+	renew := make(map[rhp.PublicKey]bool)
+	for _, hostPub := range hosts {
+		// skip existing contracts unless they are about to expire
+		if contract, err := r.HostContract(hostPub); err == nil && !force {
+			if !r.ExpiresWithin(contract, formRenewWindow) {
+				log.Printf("Skipping host %v, contract exists", hostPub)
+				continue
+			}
+			renew[hostPub] = true
+		}
+		toForm = append(toForm, hostPub)
+	}
+	if len(toForm) == 0 {
+		return nil
+	}
+
+	opts, err := formOptions()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = checkFormationFunds(r, w, toForm, opts)
+	var ife *wallet.ImmatureFundsError
+	for formWait && errors.As(err, &ife) {
+		waitForHeight(w, ife.SpendableHeight)
+		err = checkFormationFunds(r, w, toForm, opts)
+	}
+	if err != nil && !force {
+		log.Fatalln(err, "-- use --force to form contracts anyway")
+	} else if err != nil {
+		log.Println("WARNING:", err)
+	}
+
+	var formed int
+	for i, hostPub := range toForm {
+		var err error
+		if renew[hostPub] {
+			log.Printf("Renewing contract with host %v (%v/%v)", hostPub, i+1, len(toForm))
+			_, err = r.RenewDownloadContract(hostPub, formDownloadSize, formDuration, w, opts...)
+		} else {
+			log.Printf("Forming contract with host %v (%v/%v)", hostPub, i+1, len(toForm))
+			_, err = r.FormDownloadContract(hostPub, formDownloadSize, formDuration, w, opts...)
+		}
+		var insufficient *wallet.InsufficientFundsError
+		switch {
+		case errors.As(err, &insufficient):
+			return outOfFundsError(r, toForm[i:], opts, formed, len(toForm), insufficient.Available, insufficient.Required, err)
+		case errors.As(err, &ife):
+			return outOfFundsError(r, toForm[i:], opts, formed, len(toForm), ife.Spendable, ife.Required, err)
+		case err != nil:
+			log.Println(" WARNING: failed to update contract:", err)
+		default:
+			formed++
+		}
+	}
+	return nil
+}
+
+// outOfFundsError returns the error formContracts stops with when the wallet
+// runs out of funds, including an estimate of the funds needed to form
+// contracts with the remaining hosts.
+func outOfFundsError(r *renter.Renter, remaining []rhp.PublicKey, opts []renter.FormOption, formed, total int, available, required types.Currency, err error) error {
+	needed := required
+	for _, hostPub := range remaining[1:] {
+		cost, err := r.EstimateFormationCost(hostPub, formDownloadSize, formDuration, opts...)
+		if err != nil {
+			continue
+		}
+		needed = needed.Add(cost)
+	}
+	shortfall := types.ZeroCurrency
+	if needed.Cmp(available) > 0 {
+		shortfall = needed.Sub(available)
+	}
+	return fmt.Errorf("wallet ran out of funds after forming %v/%v contracts: %w -- about %v more is needed to form the remaining %v contracts", formed, total, err, shortfall.HumanString(), len(remaining))
+}
+
+// parseSiacoins parses a siacoin amount, e.g. "10SC", into hastings.
+func parseSiacoins(s string) (types.Currency, error) {
+	hastings, err := types.ParseCurrency(s)
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+	var c types.Currency
+	if _, err := fmt.Sscan(hastings, &c); err != nil {
+		return types.ZeroCurrency, err
+	}
+	return c, nil
+}
+
+// formOptions returns the funding overrides set by the --renter-funds and
+// --host-collateral flags.
+func formOptions() (opts []renter.FormOption, err error) {
+	if len(formRenterFunds) != 0 {
+		funds, err := parseSiacoins(formRenterFunds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse renter funds: %w", err)
+		}
+		opts = append(opts, renter.WithRenterFunds(funds))
+	}
+	if len(formHostCollateral) != 0 {
+		collateral, err := parseSiacoins(formHostCollateral)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host collateral: %w", err)
+		}
+		opts = append(opts, renter.WithHostCollateral(collateral))
+	}
+	return opts, nil
+}
+
+// waitForHeight blocks until the wallet has seen the chain reach height.
+func waitForHeight(w *wallet.SingleAddressWallet, height uint64) {
+	log.Printf("Waiting for height %v for funds to mature (current height %v)", height, w.Height())
+	for w.Height() < height {
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// contractFunds is the result of checking a contract's remaining funds.
+type contractFunds struct {
+	contract  renter.ContractMeta
+	remaining types.Currency
+	readCost  types.Currency
+	err       error
+}
+
+// exhausted returns true if the contract cannot pay for minReads full sector
+// reads. Contracts that could not be checked are not exhausted.
+func (cf contractFunds) exhausted(minReads uint64) bool {
+	return cf.err == nil && cf.remaining.Cmp(cf.readCost.Mul64(minReads)) < 0
+}
+
+// A contractProblem is the reason a contract cannot be used for recovery.
+type contractProblem string
+
+const (
+	problemNone           contractProblem = "ok"
+	problemUnreachable    contractProblem = "unreachable"
+	problemHostKeyChanged contractProblem = "host key changed"
+	problemUnknown        contractProblem = "unknown to host"
+	problemExhausted      contractProblem = "exhausted"
+)
+
+// problem returns the reason the contract cannot be used for recovery, or
+// problemNone if it can.
+func (cf contractFunds) problem(minReads uint64) contractProblem {
+	switch {
+	case cf.err == nil && cf.exhausted(minReads):
+		return problemExhausted
+	case cf.err == nil:
+		return problemNone
+	case errors.Is(cf.err, rhp.ErrHostKeyMismatch):
+		return problemHostKeyChanged
+	case strings.Contains(cf.err.Error(), "no record of that contract"):
+		return problemUnknown
+	default:
+		return problemUnreachable
+	}
+}
+
+// checkContractFunds gets the remaining funds of each of the renter's
+// contracts from its host's latest revision.
+func checkContractFunds(r *renter.Renter) []contractFunds {
+	contracts := r.Contracts()
+	results := make([]contractFunds, len(contracts))
+	sem := make(chan struct{}, scanConcurrency)
+	var wg sync.WaitGroup
+	for i, contract := range contracts {
+		wg.Add(1)
+		go func(i int, contract renter.ContractMeta) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			remaining, readCost, err := r.ContractFundsFor(ctx, contract)
+			results[i] = contractFunds{contract, remaining, readCost, err}
+		}(i, contract)
+	}
+	wg.Wait()
+	return results
+}
+
+// removeExhaustedContracts removes the contracts that cannot pay for minReads
+// sector reads and returns the number removed.
+func removeExhaustedContracts(r *renter.Renter, results []contractFunds, minReads uint64) (removed int) {
+	for _, cf := range results {
+		if !cf.exhausted(minReads) {
+			continue
+		} else if err := r.RemoveContract(cf.contract); err != nil {
+			log.Printf("[WARN] failed to remove contract %v: %v", cf.contract.ID, err)
+			continue
+		}
+		removed++
+	}
+	return
+}
+
+// gcContracts removes contracts that cannot pay for a sector read before a
+// file is checked or recovered.
+func gcContracts(r *renter.Renter) {
+	results := checkContractFunds(r)
+	if removed := removeExhaustedContracts(r, results, gcMinReads); removed != 0 {
+		log.Printf("Removed %v contracts that cannot pay for a sector read", removed)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+// A costOrder orders each chunk's pieces by their estimated download cost using
+// a health report from file check. Pieces whose sectors are already cached are
+// free, pieces the report lists as missing are tried last.
+type costOrder struct {
+	health       FileHealth
+	minPieces    int
+	preferParity bool
+
+	// sectorCost is the cost of reading a sector from each reachable host.
+	sectorCost map[rhp.PublicKey]types.Currency
+	// maxCost is the estimated cost of a sector without a reachable host in
+	// the report. It will be fetched by fanout.
+	maxCost types.Currency
+
+	estimated types.Currency
+	naive     types.Currency
+}
+
+var (
+	onlyMissingPieces bool
+	healthReportPath  string
+)
+
+// healthReport returns the path file check writes the health report of the
+// sia file at siaPath to.
+func healthReport(siaPath string) string {
+	return filepath.Join(dataDir, filepath.Base(siaPath)+".health.json")
+}
+
+// hasLocalSector returns true if the sector can be loaded from --pieces-from.
+func hasLocalSector(root crypto.Hash) bool {
+	if len(piecesDir) == 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(piecesDir, root.String()))
+	return err == nil
+}
+
+// loadHealthReport loads a health report written by file check and checks
+// that it matches the sia file.
+func loadHealthReport(fp string, sf siafile.SiaFile) (health FileHealth, err error) {
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return FileHealth{}, fmt.Errorf("failed to read health report: %w", err)
+	} else if err := json.Unmarshal(buf, &health); err != nil {
+		return FileHealth{}, fmt.Errorf("failed to decode health report: %w", err)
+	} else if len(health.Chunks) != len(sf.Chunks) {
+		return FileHealth{}, fmt.Errorf("health report has %v chunks, sia file has %v", len(health.Chunks), len(sf.Chunks))
+	}
+	for i, chunk := range health.Chunks {
+		if len(chunk.Pieces) != len(sf.Chunks[i].Pieces) {
+			return FileHealth{}, fmt.Errorf("health report has %v pieces for chunk %v, sia file has %v", len(chunk.Pieces), i+1, len(sf.Chunks[i].Pieces))
+		}
+	}
+	return health, nil
+}
+
+// newCostOrder gets the prices of the hosts in the health report and estimates
+// the cost of recovering the file in the default piece order.
+func newCostOrder(r *renter.Renter, sf siafile.SiaFile, health FileHealth, minPieces int, preferParity bool) *costOrder {
+	contracted := make(map[rhp.PublicKey]bool)
+	for _, host := range r.Hosts() {
+		contracted[host] = true
+	}
+	seen := make(map[rhp.PublicKey]bool)
+	var hosts []rhp.PublicKey
+	addHost := func(host rhp.PublicKey) {
+		if contracted[host] && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for _, chunk := range health.Chunks {
+		for _, piece := range chunk.Pieces {
+			for _, sector := range piece {
+				for _, host := range sector.Hosts {
+					addHost(host)
+				}
+			}
+		}
+	}
+	for _, host := range siaFileHosts(sf) {
+		addHost(host)
+	}
+
+	co := &costOrder{
+		health:       health,
+		minPieces:    minPieces,
+		preferParity: preferParity,
+		sectorCost:   make(map[rhp.PublicKey]types.Currency),
+	}
+	settings, _ := fetchHostSettings(r, hosts)
+	for host, hs := range settings {
+		cost := rhp.RPCReadCost(hs, []rhp.RPCReadRequestSection{{Length: rhp.SectorSize}})
+		co.sectorCost[host] = cost
+		if cost.Cmp(co.maxCost) > 0 {
+			co.maxCost = cost
+		}
+	}
+
+	// the default order downloads each sector from its listed host
+	planned := make(map[crypto.Hash]bool)
+	for chunkIdx, chunk := range sf.Chunks {
+		var pieces int
+		for _, pieceIdx := range pieceOrder(len(chunk.Pieces), minPieces, preferParity) {
+			if pieces >= minPieces {
+				break
+			} else if len(chunk.Pieces[pieceIdx]) == 0 || co.missing(chunkIdx, pieceIdx) {
+				continue
+			}
+			pieces++
+			for _, sector := range chunk.Pieces[pieceIdx] {
+				if planned[sector.MerkleRoot] || hasLocalSector(sector.MerkleRoot) {
+					continue
+				}
+				planned[sector.MerkleRoot] = true
+				cost, ok := co.sectorCost[sector.HostKey]
+				if !ok {
+					cost = co.maxCost
+				}
+				co.naive = co.naive.Add(cost)
+			}
+		}
+	}
+	return co
+}
+
+// missing returns true if the health report lists the piece as missing.
+func (co *costOrder) missing(chunkIdx, pieceIdx int) bool {
+	for _, i := range co.health.Chunks[chunkIdx].MissingPieces {
+		if int(i) == pieceIdx {
+			return true
+		}
+	}
+	return false
+}
+
+// CheapestHost returns the cheapest reachable host the health report lists
+// for a sector.
+func (co *costOrder) CheapestHost(chunkIdx, pieceIdx, sectorIdx int) (cheapest rhp.PublicKey, cost types.Currency, ok bool) {
+	piece := co.health.Chunks[chunkIdx].Pieces[pieceIdx]
+	if sectorIdx >= len(piece) {
+		return rhp.PublicKey{}, types.ZeroCurrency, false
+	}
+	for _, host := range piece[sectorIdx].Hosts {
+		hostCost, reachable := co.sectorCost[host]
+		if reachable && (!ok || hostCost.Cmp(cost) < 0) {
+			cheapest, cost, ok = host, hostCost, true
+		}
+	}
+	return
+}
+
+// Order returns the order in which the chunk's pieces should be downloaded,
+// cheapest first. cached reports whether a sector does not need to be
+// downloaded. The estimated cost of the first minPieces pieces is added to the
+// estimated total.
+func (co *costOrder) Order(chunkIdx int, chunk siafile.Chunk, cached func(crypto.Hash) bool) []int {
+	type pieceCost struct {
+		index   int
+		cost    types.Currency
+		missing bool
+	}
+	var pieces []pieceCost
+	for _, pieceIdx := range pieceOrder(len(chunk.Pieces), co.minPieces, co.preferParity) {
+		if len(chunk.Pieces[pieceIdx]) == 0 {
+			continue
+		}
+		pc := pieceCost{index: pieceIdx, missing: co.missing(chunkIdx, pieceIdx)}
+		for sectorIdx, sector := range chunk.Pieces[pieceIdx] {
+			if cached(sector.MerkleRoot) {
+				continue
+			} else if _, cost, ok := co.CheapestHost(chunkIdx, pieceIdx, sectorIdx); ok {
+				pc.cost = pc.cost.Add(cost)
+			} else {
+				pc.cost = pc.cost.Add(co.maxCost)
+			}
+		}
+		pieces = append(pieces, pc)
+	}
+	// the stable sort keeps the default order between pieces of equal cost
+	sort.SliceStable(pieces, func(i, j int) bool {
+		if pieces[i].missing != pieces[j].missing {
+			return !pieces[i].missing
+		}
+		return pieces[i].cost.Cmp(pieces[j].cost) < 0
+	})
+
+	order := make([]int, 0, len(pieces))
+	for i, pc := range pieces {
+		if i < co.minPieces && !pc.missing {
+			co.estimated = co.estimated.Add(pc.cost)
+		}
+		order = append(order, pc.index)
+	}
+	return order
+}
+
+// PrintSavings logs the estimated cost of the recovery and how much less it is
+// than the default piece order.
+func (co *costOrder) PrintSavings() {
+	if co.estimated.Cmp(co.naive) >= 0 {
+		log.Printf("Estimated download cost: %v, the same as the default piece order", co.estimated.HumanString())
+		return
+	}
+	log.Printf("Estimated download cost: %v, %v less than the default piece order (%v)", co.estimated.HumanString(), co.naive.Sub(co.estimated).HumanString(), co.naive.HumanString())
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/jsonout"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+// cacheCoveragePath is the recover --cache-coverage flag, the sia file to
+// report the --pieces-from coverage of.
+var cacheCoveragePath string
+
+type (
+	// A ChunkCoverage is the number of a chunk's pieces with every sector in
+	// a sector cache.
+	ChunkCoverage struct {
+		MinPieces    uint32 `json:"minPieces"`
+		CachedPieces uint32 `json:"cachedPieces"`
+		// Coverage is the fraction of the pieces needed to recover the chunk
+		// that are cached, at most 1.
+		Coverage float64 `json:"coverage"`
+	}
+
+	// A CacheCoverage reports how much of a sia file can be recovered from a
+	// sector cache without downloading any sectors.
+	CacheCoverage struct {
+		Chunks []ChunkCoverage `json:"chunks"`
+		// CoveredChunks is the number of chunks that can be recovered from
+		// the cache.
+		CoveredChunks int `json:"coveredChunks"`
+		// Coverage is the fraction of the pieces needed to recover the file
+		// that are cached.
+		Coverage float64 `json:"coverage"`
+		// Offline is true if every chunk can be recovered from the cache.
+		Offline bool `json:"offline"`
+	}
+)
+
+// cacheCoverage checks which of the file's sectors are in the cache directory
+// dir. A piece is cached if all of its sectors are. Sectors are not verified
+// against their roots, cache verify finds corrupt sectors.
+func cacheCoverage(sf siafile.SiaFile, dir string) (CacheCoverage, error) {
+	cached := make(map[crypto.Hash]bool)
+	isCached := func(root crypto.Hash) (bool, error) {
+		if ok, checked := cached[root]; checked {
+			return ok, nil
+		}
+		_, err := os.Stat(filepath.Join(dir, root.String()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("failed to check sector %v: %w", root, err)
+		}
+		cached[root] = err == nil
+		return err == nil, nil
+	}
+
+	var cc CacheCoverage
+	var needed, covered uint64
+	for _, chunk := range sf.Chunks {
+		chunkCoverage := ChunkCoverage{MinPieces: sf.DataPieces}
+		for _, piece := range chunk.Pieces {
+			// empty pieces are skipped by the recovery
+			available := len(piece) != 0
+			for _, sector := range piece {
+				ok, err := isCached(sector.MerkleRoot)
+				if err != nil {
+					return CacheCoverage{}, err
+				} else if !ok {
+					available = false
+					break
+				}
+			}
+			if available {
+				chunkCoverage.CachedPieces++
+			}
+		}
+
+		usable := chunkCoverage.CachedPieces
+		if usable > chunkCoverage.MinPieces {
+			usable = chunkCoverage.MinPieces
+		}
+		chunkCoverage.Coverage = 1
+		if chunkCoverage.MinPieces != 0 {
+			chunkCoverage.Coverage = float64(usable) / float64(chunkCoverage.MinPieces)
+		}
+		if usable == chunkCoverage.MinPieces {
+			cc.CoveredChunks++
+		}
+		needed += uint64(chunkCoverage.MinPieces)
+		covered += uint64(usable)
+		cc.Chunks = append(cc.Chunks, chunkCoverage)
+	}
+	cc.Coverage = 1
+	if needed != 0 {
+		cc.Coverage = float64(covered) / float64(needed)
+	}
+	cc.Offline = cc.CoveredChunks == len(sf.Chunks)
+	return cc, nil
+}
+
+// printCacheCoverage writes the sia file's coverage by --pieces-from to
+// stdout as JSON.
+func printCacheCoverage(siaPath string) error {
+	sf, err := loadSiaFile(siaPath)
+	if err != nil {
+		return &exitCodeError{exitError, fmt.Errorf("failed to parse sia file: %w", err)}
+	}
+
+	cc, err := cacheCoverage(sf, piecesDir)
+	if err != nil {
+		return &exitCodeError{exitError, fmt.Errorf("failed to check cache coverage: %w", err)}
+	}
+	enc := jsonout.NewEncoder(os.Stdout, jsonIndent())
+	if err := enc.Encode(cc); err != nil {
+		return &exitCodeError{exitError, fmt.Errorf("failed to encode cache coverage: %w", err)}
+	}
+
+	log.Printf("%.1f%% of the pieces needed are cached, %v/%v chunks can be recovered from %v", cc.Coverage*100, cc.CoveredChunks, len(sf.Chunks), piecesDir)
+	switch {
+	case cc.Offline:
+		log.Println("File can be recovered without downloading any sectors")
+		return nil
+	case cc.CoveredChunks == 0:
+		return &exitCodeError{exitUnrecoverable, errors.New("no chunks can be recovered from the cache")}
+	default:
+		return &exitCodeError{exitPartial, fmt.Errorf("%v/%v chunks need sectors that are not cached", len(sf.Chunks)-cc.CoveredChunks, len(sf.Chunks))}
+	}
+}
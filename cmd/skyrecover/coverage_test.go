@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"lukechampine.com/frand"
+)
+
+func TestCacheCoverage(t *testing.T) {
+	dir := t.TempDir()
+	piece := func(cached bool) []siafile.Piece {
+		root := crypto.Hash(frand.Entropy256())
+		if cached {
+			if err := os.WriteFile(filepath.Join(dir, root.String()), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return []siafile.Piece{{MerkleRoot: root}}
+	}
+
+	// the first chunk has more pieces cached than it needs, the second has
+	// one of two and an empty piece, and the third has a piece with one of
+	// two sectors cached
+	sf := siafile.SiaFile{
+		DataPieces:   2,
+		ParityPieces: 1,
+		Chunks: []siafile.Chunk{
+			{Pieces: [][]siafile.Piece{piece(true), piece(true), piece(true)}},
+			{Pieces: [][]siafile.Piece{piece(true), nil, piece(false)}},
+			{Pieces: [][]siafile.Piece{append(piece(true), piece(false)...), piece(false), piece(false)}},
+		},
+	}
+	cc, err := cacheCoverage(sf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []ChunkCoverage{
+		{MinPieces: 2, CachedPieces: 3, Coverage: 1},
+		{MinPieces: 2, CachedPieces: 1, Coverage: 0.5},
+		{MinPieces: 2, CachedPieces: 0, Coverage: 0},
+	} {
+		if cc.Chunks[i] != expected {
+			t.Fatalf("chunk %v: expected %+v, got %+v", i+1, expected, cc.Chunks[i])
+		}
+	}
+	if cc.CoveredChunks != 1 || cc.Offline || cc.Coverage != 0.5 {
+		t.Fatalf("unexpected coverage %+v", cc)
+	}
+
+	// once every chunk has enough pieces the file can be recovered offline
+	sf.Chunks = sf.Chunks[:1]
+	if cc, err := cacheCoverage(sf, dir); err != nil {
+		t.Fatal(err)
+	} else if !cc.Offline || cc.Coverage != 1 {
+		t.Fatalf("expected the file to be recoverable offline, got %+v", cc)
+	}
+}
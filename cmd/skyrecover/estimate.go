@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"lukechampine.com/frand"
+)
+
+var (
+	estimateRecovery bool
+	estimateHosts    int
+)
+
+// benchmarkHosts downloads one of the file's sectors from up to n randomly
+// chosen contracted hosts and returns the time each download took. Hosts that
+// fail are skipped.
+func benchmarkHosts(r *renter.Renter, sf siafile.SiaFile, n int) (times []time.Duration) {
+	// pick a sector listed for each contracted host
+	sectors := make(map[rhp.PublicKey]crypto.Hash)
+	for _, chunk := range sf.Chunks {
+		for _, piece := range chunk.Pieces {
+			for _, sector := range piece {
+				if _, ok := sectors[sector.HostKey]; !ok {
+					sectors[sector.HostKey] = sector.MerkleRoot
+				}
+			}
+		}
+	}
+	var hosts []rhp.PublicKey
+	for _, host := range r.Hosts() {
+		if _, ok := sectors[host]; ok {
+			hosts = append(hosts, host)
+		}
+	}
+	frand.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+	if len(hosts) > n {
+		hosts = hosts[:n]
+	}
+
+	for i, host := range hosts {
+		start := time.Now()
+		if _, err := downloadSector(r, host, sectors[host]); err != nil {
+			log.Printf("[WARN] failed to benchmark host %v: %v", host, err)
+			continue
+		}
+		elapsed := time.Since(start)
+		log.Printf("Downloaded a sector from host %v in %v (%v/%v)", host, elapsed.Round(time.Millisecond), i+1, len(hosts))
+		times = append(times, elapsed)
+	}
+	return
+}
+
+// estimateDuration estimates how long recover takes to download the planned
+// sectors. Sectors are downloaded one at a time from their listed host. A
+// fanout download checks up to workers hosts at once, it is estimated as the
+// number of rounds needed to check every host it may check.
+func estimateDuration(plan RecoveryPlan, sectorTime time.Duration, hosts, workers, hostLimit int) time.Duration {
+	if hostLimit > 0 && hosts > hostLimit {
+		hosts = hostLimit
+	}
+	rounds := 1
+	if workers > 0 {
+		rounds = (hosts + workers - 1) / workers
+	}
+	if rounds < 1 {
+		rounds = 1
+	}
+	listed := plan.Sectors - plan.FanoutSectors
+	return sectorTime * time.Duration(listed+plan.FanoutSectors*rounds)
+}
+
+// printEstimate benchmarks a sample of the file's hosts and prints the
+// estimated time and cost of recovering the file.
+func printEstimate(r *renter.Renter, sf siafile.SiaFile, minPieces int) error {
+	spentStart := spending.Total()
+	times := benchmarkHosts(r, sf, estimateHosts)
+	if len(times) == 0 {
+		return errors.New("no hosts could be benchmarked")
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	sectorTime := times[len(times)/2]
+	throughput := float64(rhp.SectorSize) / sectorTime.Seconds()
+
+	plan := planRecovery(r, sf, minPieces, downloadStrategyMode, preferParity)
+	duration := estimateDuration(plan, sectorTime, len(r.Hosts()), workers, contractHostLimit)
+	downloadSize := uint64(plan.Sectors) * rhp.SectorSize
+
+	log.Println("Recovery estimate:")
+	log.Printf("  Benchmarked:    %v hosts, median %v per sector (%v/s)", len(times), sectorTime.Round(time.Millisecond), modules.FilesizeUnits(uint64(throughput)))
+	log.Printf("  Download:       %v sectors (%v), %v by fanout", plan.Sectors, modules.FilesizeUnits(downloadSize), plan.FanoutSectors)
+	if plan.FanoutSectors != 0 {
+		log.Printf("  Estimated time: %v, up to %v if fanout checks every host", (sectorTime * time.Duration(plan.Sectors)).Round(time.Second), duration.Round(time.Second))
+	} else {
+		log.Printf("  Estimated time: %v", duration.Round(time.Second))
+	}
+	log.Printf("  Estimated cost: %v", plan.EstimatedCost.HumanString())
+	log.Printf("  Benchmark cost: %v", spending.Total().Sub(spentStart).HumanString())
+	if len(plan.UnreachableHosts) != 0 {
+		log.Printf("[WARN] %v hosts could not be reached, their sectors were estimated as fanout downloads", len(plan.UnreachableHosts))
+	}
+	return nil
+}
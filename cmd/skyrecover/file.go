@@ -1,23 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/siacentral/apisdkgo"
 	"github.com/spf13/cobra"
 	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/skyrecover/internal/jsonout"
 	"go.sia.tech/skyrecover/internal/renter"
 	"go.sia.tech/skyrecover/internal/rhp/v2"
 	"go.sia.tech/skyrecover/internal/siafile"
+	"lukechampine.com/frand"
 )
 
 type (
@@ -30,17 +35,67 @@ type (
 		MinPieces       uint32          `json:"minPieces"`
 		AvailablePieces uint32          `json:"availablePieces"`
 		Pieces          [][]PieceHealth `json:"pieces"`
+		// MissingPieces are the indices of the pieces that have a sector no
+		// host is storing.
+		MissingPieces []uint32 `json:"missingPieces,omitempty"`
+	}
+
+	// A MissingHost is a host listed in the sia file that the renter does not
+	// have a contract with.
+	MissingHost struct {
+		HostKey    rhp.PublicKey `json:"hostKey"`
+		NetAddress string        `json:"netAddress,omitempty"`
+		LastSeen   time.Time     `json:"lastSeen"`
+		// Active is true if the host is online and accepting contracts. A
+		// contract should be formed with active hosts, inactive hosts are
+		// unlikely to be recoverable.
+		Active bool `json:"active"`
+	}
+
+	// A HostUsefulness is the number of a file's sectors a host serves.
+	HostUsefulness struct {
+		HostKey rhp.PublicKey `json:"hostKey"`
+		Sectors int           `json:"sectors"`
 	}
 
 	FileHealth struct {
-		Chunks      []ChunkHealth `json:"chunks"`
-		Recoverable bool          `json:"recoverable"`
+		Chunks       []ChunkHealth `json:"chunks"`
+		MissingHosts []MissingHost `json:"missingHosts"`
+		Recoverable  bool          `json:"recoverable"`
+		// SampledHosts is the number of random hosts each sector was checked
+		// on. It is zero if every host was checked.
+		SampledHosts int `json:"sampledHosts,omitempty"`
+		// Warnings are problems found while checking the file, such as a
+		// chunk count that does not match the file size.
+		Warnings []string `json:"warnings,omitempty"`
+		// Incomplete is true if the check was stopped by --max-check-bytes
+		// before every sector was checked.
+		Incomplete bool `json:"incomplete,omitempty"`
 	}
 )
 
 var (
-	inputFile  string
-	outputFile string
+	inputFile    string
+	outputFile   string
+	streamOutput bool
+	mmapOutput   bool
+	preferParity bool
+	piecesDir    string
+	probeBatch   int
+	checksumPath string
+	dryRun       bool
+	outHostsPath string
+	probeHosts   int
+	batchPattern string
+	failFast     bool
+
+	setupContracts bool
+
+	// erasureParams override the erasure coding parameters of malformed sia
+	// files
+	erasureParams siafile.Params
+
+	downloadStrategyMode = strategyListedFirst
 
 	fileCmd = &cobra.Command{
 		Use:   "file",
@@ -51,131 +106,161 @@ var (
 	healthCheckCmd = &cobra.Command{
 		Use:   "check <metadata file>",
 		Short: "get information about a file",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 1 {
 				cmd.Usage()
-				return
+				return nil
 			}
 
-			r, err := renter.New(dataDir)
-			if err != nil {
-				log.Fatalln("failed to initialize renter:", err)
+			if probeHosts > 0 && contractHostLimit > 0 {
+				log.Fatalln("--probe-hosts and --contract-host-limit cannot be combined")
+			}
+			if healthFormat != "json" && healthFormat != "csv" {
+				log.Fatalf("unknown --format %q, expected json or csv", healthFormat)
+			}
+			if len(maxCheckBytes) != 0 {
+				limit, err := parseByteSize(maxCheckBytes)
+				if err != nil {
+					log.Fatalln("failed to parse --max-check-bytes:", err)
+				} else if limit == 0 {
+					log.Fatalln("--max-check-bytes must be greater than 0")
+				}
+				checkBudget.limit = limit
 			}
 
-			availableHosts := r.Hosts()
+			r, err := newRenter()
 			if err != nil {
-				log.Fatalln("failed to get available hosts:", err)
+				log.Fatalln("failed to initialize renter:", err)
+			}
+			if gcExhausted {
+				gcContracts(r)
 			}
 
 			inputPath := args[0]
-			sf, err := siafile.Load(inputPath)
+			sf, err := loadSiaFile(inputPath)
 			if err != nil {
 				log.Fatalln("failed to parse skyfile:", err)
 			}
+			warnRootCollisions(sf)
 
 			// check that we have contracts with all hosts listed in the file
-			var missingHosts []rhp.PublicKey
-			fileHosts := make(map[rhp.PublicKey]bool)
-			for _, chunk := range sf.Chunks {
-				for _, piece := range chunk.Pieces {
-					for _, p := range piece {
-						fileHosts[p.HostKey] = true
-					}
+			missingHosts, err := checkMissingHosts(r, siaFileHosts(sf))
+			if err != nil {
+				return &exitCodeError{exitError, fmt.Errorf("failed to check missing hosts: %w", err)}
+			} else if setupContracts && len(missingHosts) != 0 {
+				runSetup(r, missingHosts)
+				missingHosts, err = checkMissingHosts(r, siaFileHosts(sf))
+				if err != nil {
+					return &exitCodeError{exitError, fmt.Errorf("failed to check missing hosts: %w", err)}
 				}
 			}
 
-			for host := range fileHosts {
-				if _, err := r.HostContract(host); err != nil {
-					missingHosts = append(missingHosts, host)
-				}
+			availableHosts := r.Hosts()
+			if len(availableHosts) == 0 {
+				printOnboarding("--from-file " + inputPath)
+				return &exitCodeError{exitError, errors.New("no contracts have been formed")}
 			}
 
-			if len(missingHosts) > 0 {
-				client := apisdkgo.NewSiaClient()
-				log.Println("missing contracts for hosts listed in the sia file:")
-				for _, hostPub := range missingHosts {
-					host, err := client.GetHost(hostPub.String())
-					if err != nil {
-						log.Fatalln("failed to get host info:", err)
-					}
-					log.Printf(" - %v %v last seen %v", host.PublicKey, host.NetAddress, time.Since(host.LastSuccessScan))
+			log.Printf("Checking file health on %v hosts...", len(availableHosts))
+			var health FileHealth
+			// a chunk count that does not match the file size is a strong
+			// sign the sia file was mis-parsed
+			if err := sf.CheckChunkCount(); err != nil {
+				log.Printf("[WARN] %v -- the sia file may be mis-parsed, check its erasure coding", err)
+				health.Warnings = append(health.Warnings, err.Error())
+			}
+			if probeHosts > 0 {
+				health.SampledHosts = probeHosts
+				if health.SampledHosts > len(availableHosts) {
+					health.SampledHosts = len(availableHosts)
 				}
 			}
-
-			if len(availableHosts) == 0 {
-				log.Fatalln("no hosts available")
+			scan := func(sectors []crypto.Hash) (map[crypto.Hash][]rhp.PublicKey, int) {
+				if probeHosts > 0 {
+					return sampleAvailability(r, availableHosts, sectors, probeBatch, health.SampledHosts)
+				}
+				return checkAvailability(r, availableHosts, sectors, probeBatch, contractHostLimit)
 			}
 
-			log.Printf("Checking file health on %v hosts...", len(availableHosts))
-			sectorAvailability := make(map[crypto.Hash][]rhp.PublicKey)
 			var sectors []crypto.Hash
-			added := make(map[crypto.Hash]bool)
-			for _, chunk := range sf.Chunks {
-				for _, piece := range chunk.Pieces {
-					for _, p := range piece {
-						if added[p.MerkleRoot] {
-							continue
-						}
-						sectors = append(sectors, p.MerkleRoot)
-						added[p.MerkleRoot] = true
+			sectorAvailability := make(map[crypto.Hash][]rhp.PublicKey)
+			var readRPCs int
+			var unhealthyChunks int
+			if failFast {
+				// check one chunk at a time and stop at the first chunk that
+				// cannot be recovered
+				for chunkIdx, chunk := range sf.Chunks {
+					chunkSectors := chunkSectorRoots(chunk, sectorAvailability)
+					available, rpcs := scan(chunkSectors)
+					for _, root := range chunkSectors {
+						// sectors that were not found are recorded so they
+						// are not checked again for later chunks
+						sectorAvailability[root] = available[root]
 					}
-				}
-			}
+					sectors = append(sectors, chunkSectors...)
+					readRPCs += rpcs
 
-			// check each host for each sector
-			for _, host := range availableHosts {
-				for _, sector := range sectors {
-					available, err := checkSector(r, host, sector)
-					if err != nil {
-						log.Printf("WARNING: failed to check sectors on host %v: %v", host, err)
-					} else if !available {
-						continue
+					if checkBudget.Exhausted() {
+						// the chunk was only partially checked
+						break
 					}
-					sectorAvailability[sector] = append(sectorAvailability[sector], host)
-				}
-			}
 
-			// build the health report
-			var health FileHealth
-			var unhealthy bool
-			for _, chunk := range sf.Chunks {
-				var chunkHealth ChunkHealth
-				chunkHealth.MinPieces = sf.DataPieces
-				for _, piece := range chunk.Pieces {
-					available := true
-					var pieceHealth []PieceHealth
-					for _, sector := range piece {
-						if len(sectorAvailability[sector.MerkleRoot]) == 0 {
-							available = false
-							break
-						}
-						pieceHealth = append(pieceHealth, PieceHealth{
-							MerkleRoot: sector.MerkleRoot,
-							Hosts:      sectorAvailability[sector.MerkleRoot],
-						})
+					chunkHealth := checkChunkHealth(sf, chunk, sectorAvailability)
+					health.Chunks = append(health.Chunks, chunkHealth)
+					if chunkHealth.AvailablePieces < chunkHealth.MinPieces {
+						unhealthyChunks++
+						log.Printf("Chunk %v/%v is not recoverable, %v/%v pieces are available -- stopping", chunkIdx+1, len(sf.Chunks), chunkHealth.AvailablePieces, chunkHealth.MinPieces)
+						break
 					}
-					if available {
-						chunkHealth.AvailablePieces++
+				}
+			} else {
+				sectors = fileSectorRoots(sf)
+				sectorAvailability, readRPCs = scan(sectors)
+				for _, chunk := range sf.Chunks {
+					chunkHealth := checkChunkHealth(sf, chunk, sectorAvailability)
+					health.Chunks = append(health.Chunks, chunkHealth)
+					if chunkHealth.AvailablePieces < chunkHealth.MinPieces {
+						unhealthyChunks++
 					}
-					chunkHealth.Pieces = append(chunkHealth.Pieces, pieceHealth)
 				}
-				health.Chunks = append(health.Chunks, chunkHealth)
-				if chunkHealth.AvailablePieces < chunkHealth.MinPieces {
-					unhealthy = true
+			}
+			if probeHosts > 0 {
+				var found, notFound int
+				for _, sector := range sectors {
+					found += len(sectorAvailability[sector])
+					if len(sectorAvailability[sector]) == 0 {
+						notFound++
+					}
 				}
+				log.Printf("Sectors were found on %.1f of %v sampled hosts on average, %v/%v sectors were not found on any", float64(found)/float64(len(sectors)), health.SampledHosts, notFound, len(sectors))
+			}
+			debugf("checked %v sectors on %v hosts with %v read RPCs", len(sectors), len(availableHosts), readRPCs)
+			if checkBudget.Exhausted() {
+				// sectors that were not checked are reported as missing
+				health.Incomplete = true
+				msg := fmt.Sprintf("check stopped after reading %v of sector data (--max-check-bytes %v), sectors that were not checked are reported as missing", modules.FilesizeUnits(checkBudget.Used()), maxCheckBytes)
+				log.Printf("[WARN] %v", msg)
+				health.Warnings = append(health.Warnings, msg)
 			}
 
-			outputPath := filepath.Join(dataDir, filepath.Base(inputPath)+".health.json")
+			outputPath := healthReport(inputPath)
+			if healthFormat == "csv" {
+				outputPath = strings.TrimSuffix(outputPath, ".json") + ".csv"
+			}
 			output, err := os.Create(outputPath)
 			if err != nil {
 				log.Fatalln("failed to create output file:", err)
 			}
 			defer output.Close()
 
-			health.Recoverable = !unhealthy
-			enc := json.NewEncoder(output)
-			enc.SetIndent("", "  ")
-			if err := enc.Encode(health); err != nil {
+			health.MissingHosts = missingHosts
+			health.Recoverable = unhealthyChunks == 0
+			if healthFormat == "csv" {
+				err = writeHealthCSV(output, health)
+			} else {
+				err = jsonout.NewEncoder(output, jsonIndent()).Encode(health)
+			}
+			if err != nil {
 				log.Fatalln("failed to encode health report:", err)
 			}
 			if health.Recoverable {
@@ -184,279 +269,1140 @@ var (
 				log.Println("File is not recoverable")
 			}
 			log.Printf("Health report written to %v", outputPath)
+
+			if len(healthDBPath) != 0 {
+				hostsScanned := len(availableHosts)
+				if health.SampledHosts > 0 {
+					hostsScanned = health.SampledHosts
+				}
+				err := recordHealthScan(healthDBPath, healthScan{
+					FileID:       siaFileID(sf),
+					FilePath:     inputPath,
+					ScannedAt:    time.Now(),
+					Health:       health,
+					HostsScanned: hostsScanned,
+				})
+				if err != nil {
+					log.Fatalln("failed to record health scan:", err)
+				}
+				log.Printf("Health scan recorded to %v", healthDBPath)
+			}
+
+			if len(outHostsPath) != 0 {
+				usefulness := hostUsefulness(availableHosts, sectorAvailability)
+				buf, err := jsonout.Marshal(usefulness, "", jsonIndent())
+				if err != nil {
+					log.Fatalln("failed to encode host usefulness:", err)
+				} else if err := os.WriteFile(outHostsPath, buf, 0644); err != nil {
+					log.Fatalln("failed to write host usefulness:", err)
+				}
+				var unused int
+				for _, hu := range usefulness {
+					if hu.Sectors == 0 {
+						unused++
+					}
+				}
+				log.Printf("%v/%v hosts serve none of the file's sectors, host usefulness written to %v", unused, len(usefulness), outHostsPath)
+			}
+
+			switch {
+			case health.Incomplete:
+				return &exitCodeError{exitPartial, errors.New("the check was stopped by --max-check-bytes, the health report is incomplete")}
+			case unhealthyChunks == 0:
+				return nil
+			case failFast && len(health.Chunks) == 1:
+				return &exitCodeError{exitUnrecoverable, errors.New("the first chunk is not recoverable")}
+			case failFast:
+				return &exitCodeError{exitPartial, fmt.Errorf("chunk %v is not recoverable", len(health.Chunks))}
+			case unhealthyChunks < len(sf.Chunks):
+				return &exitCodeError{exitPartial, fmt.Errorf("%v/%v chunks are not recoverable", unhealthyChunks, len(sf.Chunks))}
+			default:
+				return &exitCodeError{exitUnrecoverable, errors.New("no chunks are recoverable")}
+			}
 		},
 	}
 
 	recoverCmd = &cobra.Command{
 		Use:   "recover -i <input file> -o <output file>",
 		Short: "Recover a file from the Sia network.",
-		Run: func(cmd *cobra.Command, args []string) {
-			if len(inputFile) == 0 || len(outputFile) == 0 {
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if streamOutput && len(outputFile) == 0 {
+				outputFile = "-"
+			}
+			if len(cacheCoveragePath) != 0 {
+				if len(piecesDir) == 0 {
+					return &exitCodeError{exitError, errors.New("--cache-coverage requires --pieces-from")}
+				}
+				return printCacheCoverage(cacheCoveragePath)
+			}
+			switch {
+			case len(batchPattern) != 0 && (len(inputFile) != 0 || outputFile == "-" || dryRun || len(checksumPath) != 0 || len(outputMetadataPath) != 0):
+				log.Fatalln("--batch cannot be used with -i, --stream, --dry-run, --checksums, or --output-metadata")
+			case len(batchPattern) != 0 && len(outputFile) == 0:
+				cmd.Usage()
+				log.Fatalln("flag -o is required for the output directory")
+			case estimateRecovery && (len(batchPattern) != 0 || dryRun):
+				log.Fatalln("--estimate cannot be used with --batch or --dry-run")
+			case len(batchPattern) == 0 && (len(inputFile) == 0 || (len(outputFile) == 0 && !dryRun && !estimateRecovery)):
 				cmd.Usage()
 				log.Fatalln("flags -i and -o are required")
+			case mmapOutput && (streamOutput || outputFile == "-"):
+				log.Fatalln("--mmap cannot be used with --stream or stdout")
+			case len(rangesPath) != 0 && (len(batchPattern) != 0 || dryRun):
+				log.Fatalln("--ranges cannot be used with --batch or --dry-run")
+			case len(splitSize) != 0 && (mmapOutput || outputFile == "-" || dryRun):
+				log.Fatalln("--split cannot be used with --mmap, --stream, stdout, or --dry-run")
+			case onlyMissingPieces && (len(batchPattern) != 0 || dryRun):
+				log.Fatalln("--only-missing-pieces cannot be used with --batch or --dry-run")
+			case len(outputMetadataPath) != 0 && (dryRun || estimateRecovery):
+				log.Fatalln("--output-metadata cannot be used with --dry-run or --estimate")
 			}
 
-			r, err := renter.New(dataDir)
+			if len(hintsPath) != 0 {
+				hints, err := loadSectorHints(hintsPath)
+				if err != nil {
+					log.Fatalln("failed to load hints:", err)
+				}
+				sectorHints = hints
+				log.Printf("Loaded host hints for %v sectors", len(sectorHints))
+			}
+			if len(splitSize) != 0 {
+				size, err := parseByteSize(splitSize)
+				if err != nil {
+					log.Fatalln("failed to parse --split:", err)
+				} else if size == 0 {
+					log.Fatalln("--split must be greater than 0")
+				}
+				splitPartSize = size
+			}
+
+			r, err := newRenter()
 			if err != nil {
 				log.Fatalln("failed to initialize renter:", err)
 			}
+			if gcExhausted {
+				gcContracts(r)
+			}
+
+			if len(batchPattern) != 0 {
+				return recoverBatch(r, batchPattern, outputFile)
+			}
 
-			sf, err := siafile.Load(inputFile)
+			sf, err := loadSiaFile(inputFile)
 			if err != nil {
 				log.Fatalln("failed to parse skyfile:", err)
 			}
+			warnRootCollisions(sf)
 
 			// check that we have contracts with all hosts listed in the file
-			var missingHosts []rhp.PublicKey
-			fileHosts := make(map[rhp.PublicKey]bool)
-			for _, chunk := range sf.Chunks {
-				for _, piece := range chunk.Pieces {
-					for _, p := range piece {
-						fileHosts[p.HostKey] = true
-					}
-				}
+			if missingHosts, err := checkMissingHosts(r, siaFileHosts(sf)); err != nil {
+				return &exitCodeError{exitError, fmt.Errorf("failed to check missing hosts: %w", err)}
+			} else if setupContracts && len(missingHosts) != 0 {
+				runSetup(r, missingHosts)
 			}
 
-			for host := range fileHosts {
-				if _, err := r.HostContract(host); err != nil {
-					missingHosts = append(missingHosts, host)
-				}
+			if len(r.Hosts()) == 0 {
+				printOnboarding("--from-file " + inputFile)
+				return &exitCodeError{exitError, errors.New("no contracts have been formed")}
 			}
 
-			if len(missingHosts) > 0 {
-				client := apisdkgo.NewSiaClient()
-				log.Println("missing contracts for hosts listed in the sia file:")
-				for _, hostPub := range missingHosts {
-					host, err := client.GetHost(hostPub.String())
-					if err != nil {
-						log.Fatalln("failed to get host info:", err)
-					}
-					log.Printf(" - %v %v last seen %v", host.PublicKey, host.NetAddress, time.Since(host.LastSuccessScan))
+			if dryRun {
+				ec, err := siafile.InitErasureCoder(sf.EncoderType, sf.DataPieces, sf.ParityPieces)
+				if err != nil {
+					log.Fatalln("failed to initialize erasure coder:", err)
+				} else if _, err := newDownloadStrategy(downloadStrategyMode); err != nil {
+					log.Fatalln("failed to initialize download strategy:", err)
+				}
+				plan := planRecovery(r, sf, ec.MinPieces(), downloadStrategyMode, preferParity)
+				enc := jsonout.NewEncoder(os.Stdout, jsonIndent())
+				if err := enc.Encode(plan); err != nil {
+					log.Fatalln("failed to encode recovery plan:", err)
 				}
+				log.Printf("Would download %v sectors (%v by fanout) for an estimated %v", plan.Sectors, plan.FanoutSectors, plan.EstimatedCost.HumanString())
+				return nil
 			}
 
-			if len(r.Hosts()) == 0 {
-				log.Fatalln("no hosts available")
+			if estimateRecovery {
+				return printEstimate(r, sf, int(sf.DataPieces))
 			}
 
-			ec, err := siafile.InitErasureCoder(sf.EncoderType, sf.DataPieces, sf.ParityPieces)
+			var ac *autoContractor
+			if autoContract {
+				ac = newAutoContractor(r, mustLoadWallet(), autoContractLimit)
+			}
+			var co *costOrder
+			if onlyMissingPieces {
+				if len(healthReportPath) == 0 {
+					healthReportPath = healthReport(inputFile)
+				}
+				health, err := loadHealthReport(healthReportPath, sf)
+				if err != nil {
+					log.Fatalf("failed to load health report, run file check first or set --health-report: %v", err)
+				}
+				co = newCostOrder(r, sf, health, int(sf.DataPieces), preferParity)
+			}
+			rc := newRecoverer(r, workers)
+			defer rc.Close()
+			if costAware {
+				enableCostAware(r, rc)
+				defer rc.PrintCostSavings()
+			}
+			stats, err := recoverFile(rc, ac, co, sf, outputFile)
 			if err != nil {
-				log.Fatalln("failed to initialize erasure coder:", err)
+				return err
 			}
-
-			var ct crypto.CipherType
-			if err := ct.FromString(sf.MasterKeyType); err != nil {
-				log.Fatalln("failed to decode master key:", err)
+			if len(outputMetadataPath) != 0 {
+				if err := newRecoveredFileMetadata(inputFile, outputFile, sf, stats).WriteFile(outputMetadataPath); err != nil {
+					return err
+				}
+				log.Printf("Wrote file metadata to %v", outputMetadataPath)
 			}
+			return nil
+		},
+	}
+)
 
-			masterKey, err := crypto.NewSiaKey(ct, sf.MasterKey)
+// recoverFile recovers the sia file to outputPath, "-" for stdout.
+func recoverFile(rc *Recoverer, ac *autoContractor, co *costOrder, sf siafile.SiaFile, outputPath string) (stats *recoveryStats, err error) {
+	r := rc.r
+	ec, err := siafile.InitErasureCoder(sf.EncoderType, sf.DataPieces, sf.ParityPieces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize erasure coder: %w", err)
+	}
+
+	var ct crypto.CipherType
+	if err := ct.FromString(sf.MasterKeyType); err != nil {
+		return nil, fmt.Errorf("failed to decode master key: %w", err)
+	}
+
+	masterKey, err := crypto.NewSiaKey(ct, sf.MasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode master key: %w", err)
+	}
+
+	var output flushWriter
+	if mmapOutput {
+		mw, err := newMmapWriter(outputPath, int64(sf.FileSize))
+		if errors.Is(err, errMmapUnsupported) {
+			log.Println("[WARN] mmap is not supported on this platform, falling back to buffered writes")
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to map output file: %w", err)
+		} else {
+			defer func() {
+				if cerr := mw.Close(); cerr != nil && err == nil {
+					err = fmt.Errorf("failed to close output file: %w", cerr)
+				}
+			}()
+			output = mw
+		}
+	}
+	if output == nil && splitPartSize != 0 {
+		sw, err := newSplitWriter(outputPath, splitPartSize, int(sf.PieceSize)*ec.MinPieces(), sf.FileSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split output: %w", err)
+		}
+		defer func() {
+			if cerr := sw.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("failed to close output parts: %w", cerr)
+			}
+		}()
+		output = sw
+	}
+	if output == nil {
+		var f *os.File
+		if outputPath == "-" {
+			f = os.Stdout
+		} else {
+			f, err = os.Create(outputPath)
 			if err != nil {
-				log.Fatalln("failed to decode master key:", err)
+				return nil, fmt.Errorf("failed to create output file: %w", err)
 			}
+			defer f.Close()
+		}
+		// buffer the erasure coder's small writes. In stream mode the
+		// buffer is flushed after every chunk so the consumer receives
+		// data as soon as it is reconstructed.
+		output = bufio.NewWriterSize(f, int(sf.PieceSize)*ec.MinPieces())
+	}
+	defer func() {
+		if ferr := output.Flush(); ferr != nil && err == nil {
+			err = fmt.Errorf("failed to flush output: %w", ferr)
+		}
+	}()
 
-			output, err := os.Create(outputFile)
-			if err != nil {
-				log.Fatalln("failed to create output file:", err)
+	strategy, err := newDownloadStrategy(downloadStrategyMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize download strategy: %w", err)
+	}
+
+	chunkSize := sf.PieceSize * uint64(ec.MinPieces())
+	remainingSize := sf.FileSize
+
+	stats = newRecoveryStats(len(sf.Chunks))
+	defer stats.Print()
+	// the progress line is erased before the summary is printed
+	stats.progress = startProgress(sf.FileSize)
+	defer stats.progress.Stop()
+	if co != nil {
+		defer co.PrintSavings()
+	}
+
+	writers := []io.Writer{output, stats}
+	var sums *checksumWriter
+	if len(checksumPath) != 0 {
+		sums = newChecksumWriter(sf.FileSize, chunkSize)
+		writers = append(writers, sums)
+	}
+	chunkOutput := io.MultiWriter(writers...)
+
+	// zero-filled chunks are written to the output and checksums, but are not
+	// counted as recovered
+	zeroOutput := io.Writer(output)
+	if sums != nil {
+		zeroOutput = io.MultiWriter(output, sums)
+	}
+	ranges := &RecoveredRanges{FileSize: sf.FileSize}
+	if fp := outputRangesPath(outputPath); len(fp) != 0 {
+		defer func() {
+			if werr := ranges.WriteFile(fp); werr != nil && err == nil {
+				err = werr
+			} else if werr == nil {
+				log.Printf("Wrote recovered byte ranges to %v", fp)
 			}
-			defer output.Close()
+		}()
+	}
 
-			chunkSize := sf.PieceSize * uint64(ec.MinPieces())
-			remainingSize := sf.FileSize
-			// map merkle roots to the data that was recovered for that root
-			recoveredSectors := make(map[crypto.Hash][]byte)
-			for chunkIdx, chunk := range sf.Chunks {
-				if remainingSize < chunkSize {
-					chunkSize = remainingSize
-				}
-				remainingSize -= chunkSize
-
-				var recovered int
-				recoveredPieces := make([][]byte, ec.NumPieces())
-				var missingPieces []int
-				for pieceIdx, piece := range chunk.Pieces {
-					// skip empty pieces
-					if len(piece) == 0 {
-						continue
-					}
+	// recoverChunk reconstructs a chunk from its pieces and writes it
+	// to the output. With --verify, the chunk is re-encoded and
+	// checked against the siafile's piece roots before it is written.
+	recoverChunk := func(chunkIdx int, pieces [][]byte, n uint64) error {
+		if !verifyRecovered {
+			return ec.Recover(pieces, n, chunkOutput)
+		}
 
-					key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
-					var sectorsRecovered int
-					var recoveredData []byte
-					for _, sector := range piece {
-						if buf, ok := recoveredSectors[sector.MerkleRoot]; ok {
-							// we already have this sector, no need to download it again
-							sectorsRecovered++
-							recoveredData = append(recoveredData, buf...)
-							log.Printf("Sector %v already in cache", sector.MerkleRoot)
-							continue
-						}
-
-						// check the listed host first
-						buf, err := downloadSector(r, sector.HostKey, sector.MerkleRoot)
-						if err == nil {
-							sectorsRecovered++
-							recoveredSectors[sector.MerkleRoot] = buf
-							recoveredData = append(recoveredData, buf...)
-							log.Printf("Recovered sector %v from host %v", sector.MerkleRoot, sector.HostKey)
-							continue
-						} else if strings.Contains(err.Error(), "no record of that contract") {
-							// remove the host from the list of available hosts
-							r.RemoveHostContract(sector.HostKey)
-							log.Printf("[WARN] removed host %v from available hosts: contract not found -- form new contract", sector.HostKey)
-						} else {
-							log.Printf("[WARN] failed to download sector %v from host %v: %v", sector.MerkleRoot, sector.HostKey, err)
-						}
-					}
-					if sectorsRecovered != len(piece) {
-						log.Printf("Failed to recover piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
-						missingPieces = append(missingPieces, pieceIdx)
+		// Recover reconstructs the missing pieces in place
+		var downloaded []int
+		for i, piece := range pieces {
+			if piece != nil {
+				downloaded = append(downloaded, i)
+			}
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, n))
+		if err := ec.Recover(pieces, n, buf); err != nil {
+			return err
+		}
+		mismatched, err := verifyChunk(ec, masterKey, chunkIdx, sf.Chunks[chunkIdx], sf.PieceSize, buf.Bytes(), downloaded)
+		if err != nil {
+			log.Printf("[WARN] failed to verify chunk %v: %v", chunkIdx+1, err)
+		} else {
+			stats.verifiedChunks++
+			if len(mismatched) != 0 {
+				stats.mismatchedChunks = append(stats.mismatchedChunks, chunkIdx)
+				for _, pieceIdx := range mismatched {
+					log.Printf("[WARN] chunk %v: re-encoded piece %v does not match the siafile's merkle root", chunkIdx+1, pieceIdx+1)
+				}
+			}
+		}
+		_, err = chunkOutput.Write(buf.Bytes())
+		return err
+	}
+	// map merkle roots to the data that was recovered for that root
+	recoveredSectors := make(sectorCache)
+	// acceptSector checks that a sector was verified against its piece's
+	// root before it is added to the piece, so a sector served for a
+	// different position in the file is not assembled into this one.
+	acceptSector := func(chunkIdx, pieceIdx int, expected, verified crypto.Hash, host rhp.PublicKey, buf []byte) bool {
+		if err := checkSectorRoot(expected, verified, buf); err != nil {
+			log.Printf("[WARN] rejected sector from host %v for chunk %v piece %v: %v", host, chunkIdx+1, pieceIdx+1, err)
+			return false
+		}
+		return true
+	}
+	for chunkIdx, chunk := range sf.Chunks {
+		if remainingSize < chunkSize {
+			chunkSize = remainingSize
+		}
+		start := sf.FileSize - remainingSize
+		remainingSize -= chunkSize
+
+		// track the hosts that do not have each sector so they are not
+		// checked again when the chunk is retried
+		sectorMissing := make(map[crypto.Hash]map[rhp.PublicKey]bool)
+		missingHosts := func(root crypto.Hash) map[rhp.PublicKey]bool {
+			missing := sectorMissing[root]
+			if missing == nil {
+				missing = make(map[rhp.PublicKey]bool)
+				sectorMissing[root] = missing
+			}
+			return missing
+		}
+
+		var recovered int
+		var usedFanout bool
+		recoveredPieces := make([][]byte, ec.NumPieces())
+		var missingPieces []int
+		order := pieceOrder(ec.NumPieces(), ec.MinPieces(), preferParity)
+		if co != nil {
+			order = co.Order(chunkIdx, chunk, func(root crypto.Hash) bool {
+				return recoveredSectors.Has(root) || hasLocalSector(root)
+			})
+		}
+		for _, pieceIdx := range order {
+			piece := chunk.Pieces[pieceIdx]
+			// skip empty pieces
+			if len(piece) == 0 {
+				continue
+			}
+
+			key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
+			var sectorsRecovered int
+			var recoveredData []byte
+			for sectorIdx, sector := range piece {
+				if buf, ok := recoveredSectors.Get(sector.MerkleRoot); ok {
+					// we already have this sector, no need to download it again
+					stats.cacheHits++
+					sectorsRecovered++
+					recoveredData = append(recoveredData, buf...)
+					log.Printf("Sector %v already in cache", sector.MerkleRoot)
+					continue
+				}
+
+				if len(piecesDir) != 0 {
+					buf, err := loadLocalSector(piecesDir, sector.MerkleRoot)
+					if err == nil {
+						stats.localSectors++
+						sectorsRecovered++
+						recoveredSectors.Add(sector.MerkleRoot, buf)
+						recoveredData = append(recoveredData, buf...)
+						log.Printf("Loaded sector %v from %v", sector.MerkleRoot, piecesDir)
 						continue
+					} else if !errors.Is(err, fs.ErrNotExist) {
+						log.Printf("[WARN] failed to load sector %v from %v, downloading it instead: %v", sector.MerkleRoot, piecesDir, err)
 					}
+				}
 
-					decrypted, err := key.DecryptBytesInPlace(recoveredData, 0)
-					if err != nil {
-						log.Printf("Failed to decrypt piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
-					}
-					recoveredPieces[pieceIdx] = decrypted
-					recovered++
-					log.Printf("Recovered piece %v for chunk %v (%v/%v)", pieceIdx+1, chunkIdx+1, recovered, ec.MinPieces())
-					if recovered >= ec.MinPieces() {
-						break
+				if !strategy.UseListedHost() {
+					// skip the listed host and check all contracted hosts,
+					// the hinted hosts are checked first by the fanout
+					root := sector.MerkleRoot
+					if buf, host, ok := recoverSectorAutoContract(context.Background(), rc, ac, root, contractHostLimit, nil); ok && acceptSector(chunkIdx, pieceIdx, sector.MerkleRoot, root, host, buf) {
+						stats.RecordDownload(host)
+						usedFanout = true
+						sectorsRecovered++
+						recoveredSectors.Add(sector.MerkleRoot, buf)
+						recoveredData = append(recoveredData, buf...)
+						log.Println("Recovered sector", sector.MerkleRoot)
 					}
+					continue
 				}
 
-				// if enough pieces have been downloaded, recover the chunk
-				if recovered >= ec.MinPieces() {
-					if err := ec.Recover(recoveredPieces, chunkSize, output); err != nil {
-						log.Fatalf("failed to recover chunk %v: %v", chunkIdx, err)
-					}
+				// hosts known to store the sector are checked before the
+				// listed host, which may be stale. Hosts without the sector
+				// are not checked again when the missing pieces are
+				// recovered.
+				root := sector.MerkleRoot
+				if buf, host, ok := rc.recoverHintedSector(context.Background(), root, missingHosts(root)); ok && acceptSector(chunkIdx, pieceIdx, sector.MerkleRoot, root, host, buf) {
+					stats.RecordDownload(host)
+					sectorsRecovered++
+					recoveredSectors.Add(sector.MerkleRoot, buf)
+					recoveredData = append(recoveredData, buf...)
+					log.Printf("Recovered sector %v from hinted host %v", sector.MerkleRoot, host)
 					continue
 				}
 
-				log.Printf("Checking for missing pieces -- need %v more to recover...", ec.MinPieces()-recovered)
-				// try to recover the missing pieces
-				for _, pieceIdx := range missingPieces {
-					log.Printf("Looking for piece %v (%v/%v)", pieceIdx+1, recovered, ec.MinPieces())
-					piece := chunk.Pieces[pieceIdx]
-					key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
-					var sectorsRecovered int
-					var recoveredData []byte
-					for _, sector := range piece {
-						if buf, ok := recoveredSectors[sector.MerkleRoot]; ok {
-							sectorsRecovered++
-							recoveredData = append(recoveredData, buf...)
-							continue
-						}
-
-						buf, recoveredSector := recoverSector(context.Background(), r, sector.MerkleRoot, workers)
-						if recoveredSector {
-							sectorsRecovered++
-							recoveredData = append(recoveredData, buf...)
-							log.Println("Recovered sector", sector.MerkleRoot)
-						} else {
-							log.Printf("Failed to recover sector %v", sector.MerkleRoot)
-						}
+				// check the listed host, or the cheapest host with the
+				// sector, first
+				hostKey := sector.HostKey
+				if co != nil {
+					if cheapest, _, ok := co.CheapestHost(chunkIdx, pieceIdx, sectorIdx); ok {
+						hostKey = cheapest
 					}
+				}
+				if r.HostExcluded(hostKey) {
+					log.Printf("Skipping host %v for sector %v, it has reached --host-failure-limit", hostKey, sector.MerkleRoot)
+					continue
+				}
+				// downloadSector verifies the sector against its root
+				buf, err := downloadSector(r, hostKey, sector.MerkleRoot)
+				strategy.Record(err)
+				if err == nil {
+					stats.RecordDownload(hostKey)
+					sectorsRecovered++
+					recoveredSectors.Add(sector.MerkleRoot, buf)
+					recoveredData = append(recoveredData, buf...)
+					log.Printf("Recovered sector %v from host %v", sector.MerkleRoot, hostKey)
+					continue
+				} else if strings.Contains(err.Error(), "no record of that contract") {
+					// remove the host from the list of available hosts
+					r.RemoveHostContract(hostKey)
+					log.Printf("[WARN] removed host %v from available hosts: contract not found -- form new contract", hostKey)
+				} else if errors.Is(err, rhp.ErrHostKeyMismatch) {
+					log.Printf("[WARN] host %v failed key verification, it may have been reinstalled or the connection intercepted: %v", hostKey, err)
+				} else {
+					log.Printf("[WARN] failed to download sector %v from host %v: %v", sector.MerkleRoot, hostKey, err)
+				}
+			}
+			if sectorsRecovered != len(piece) {
+				log.Printf("Failed to recover piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
+				missingPieces = append(missingPieces, pieceIdx)
+				continue
+			}
+
+			decrypted, err := key.DecryptBytesInPlace(recoveredData, 0)
+			if err != nil {
+				log.Printf("Failed to decrypt piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
+			}
+			recoveredPieces[pieceIdx] = decrypted
+			recovered++
+			log.Printf("Recovered piece %v for chunk %v (%v/%v)", pieceIdx+1, chunkIdx+1, recovered, ec.MinPieces())
+			if recovered >= ec.MinPieces() {
+				break
+			}
+		}
+
+		// if enough pieces have been downloaded, recover the chunk
+		if recovered >= ec.MinPieces() {
+			if err := recoverChunk(chunkIdx, recoveredPieces, chunkSize); err != nil {
+				stats.failedChunks = append(stats.failedChunks, chunkIdx)
+				return stats, fmt.Errorf("failed to recover chunk %v: %w", chunkIdx+1, err)
+			} else if sums != nil {
+				sums.EndChunk()
+			}
+			stats.RecordChunk(usedFanout)
+			ranges.Add(start, start+chunkSize, true)
+			if streamOutput {
+				if err := output.Flush(); err != nil {
+					return stats, fmt.Errorf("failed to flush chunk %v: %w", chunkIdx+1, err)
+				}
+			}
+			stats.progress.Chunk(chunkSize)
+			continue
+		}
 
-					if sectorsRecovered != len(piece) {
-						log.Printf("Failed to recover piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
+		for round := 0; round <= chunkRetries && recovered < ec.MinPieces(); round++ {
+			if round == 0 {
+				log.Printf("Checking for missing pieces -- need %v more to recover...", ec.MinPieces()-recovered)
+			} else {
+				log.Printf("Retrying chunk %v (%v/%v) -- need %v more to recover...", chunkIdx+1, round, chunkRetries, ec.MinPieces()-recovered)
+				time.Sleep(chunkRetryDelay)
+			}
+			// try to recover the missing pieces
+			for _, pieceIdx := range missingPieces {
+				if recoveredPieces[pieceIdx] != nil {
+					continue
+				}
+				log.Printf("Looking for piece %v (%v/%v)", pieceIdx+1, recovered, ec.MinPieces())
+				piece := chunk.Pieces[pieceIdx]
+				key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
+				var sectorsRecovered int
+				var recoveredData []byte
+				for _, sector := range piece {
+					if buf, ok := recoveredSectors.Get(sector.MerkleRoot); ok {
+						sectorsRecovered++
+						recoveredData = append(recoveredData, buf...)
 						continue
 					}
 
-					decrypted, err := key.DecryptBytesInPlace(recoveredData, 0)
-					if err != nil {
-						log.Printf("Failed to decrypt piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
-					}
-					recoveredPieces[pieceIdx] = decrypted
-					recovered++
-					log.Printf("Recovered piece %v for chunk %v (%v/%v)", pieceIdx+1, chunkIdx+1, recovered, ec.MinPieces())
-					if recovered >= ec.MinPieces() {
-						break
+					root := sector.MerkleRoot
+					buf, host, recoveredSector := recoverSectorAutoContract(context.Background(), rc, ac, root, contractHostLimit, missingHosts(root))
+					if recoveredSector && acceptSector(chunkIdx, pieceIdx, sector.MerkleRoot, root, host, buf) {
+						stats.RecordDownload(host)
+						usedFanout = true
+						sectorsRecovered++
+						recoveredSectors.Add(sector.MerkleRoot, buf)
+						recoveredData = append(recoveredData, buf...)
+						log.Println("Recovered sector", sector.MerkleRoot)
+					} else {
+						log.Printf("Failed to recover sector %v", sector.MerkleRoot)
 					}
 				}
 
-				if err := ec.Recover(recoveredPieces, chunkSize, output); err != nil {
-					log.Fatalf("failed to recover chunk %v: %v", chunkIdx+1, err)
+				if sectorsRecovered != len(piece) {
+					log.Printf("Failed to recover piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
+					continue
+				}
+
+				decrypted, err := key.DecryptBytesInPlace(recoveredData, 0)
+				if err != nil {
+					log.Printf("Failed to decrypt piece %v for chunk %v", pieceIdx+1, chunkIdx+1)
+				}
+				recoveredPieces[pieceIdx] = decrypted
+				recovered++
+				log.Printf("Recovered piece %v for chunk %v (%v/%v)", pieceIdx+1, chunkIdx+1, recovered, ec.MinPieces())
+				if recovered >= ec.MinPieces() {
+					break
 				}
-				log.Printf("Recovered chunk %v/%v", chunkIdx+1, len(sf.Chunks))
 			}
-		},
+		}
+
+		if err := recoverChunk(chunkIdx, recoveredPieces, chunkSize); err != nil && !continueOnError {
+			// the chunks before this one have been written
+			stats.failedChunks = append(stats.failedChunks, chunkIdx)
+			code := exitPartial
+			if chunkIdx == 0 {
+				code = exitUnrecoverable
+			}
+			return stats, &exitCodeError{code, fmt.Errorf("failed to recover chunk %v: %w", chunkIdx+1, err)}
+		} else if err != nil {
+			// fill the chunk with zeros so the following chunks are written
+			// at their offsets
+			stats.failedChunks = append(stats.failedChunks, chunkIdx)
+			log.Printf("[WARN] failed to recover chunk %v, writing %v zero bytes: %v", chunkIdx+1, chunkSize, err)
+			if _, err := zeroOutput.Write(make([]byte, chunkSize)); err != nil {
+				return stats, fmt.Errorf("failed to zero-fill chunk %v: %w", chunkIdx+1, err)
+			} else if sums != nil {
+				sums.EndChunk()
+			}
+			ranges.Add(start, start+chunkSize, false)
+			if streamOutput {
+				if err := output.Flush(); err != nil {
+					return stats, fmt.Errorf("failed to flush chunk %v: %w", chunkIdx+1, err)
+				}
+			}
+			stats.progress.Chunk(chunkSize)
+			continue
+		} else if sums != nil {
+			sums.EndChunk()
+		}
+		stats.RecordChunk(usedFanout)
+		ranges.Add(start, start+chunkSize, true)
+		if streamOutput {
+			if err := output.Flush(); err != nil {
+				return stats, fmt.Errorf("failed to flush chunk %v: %w", chunkIdx+1, err)
+			}
+		}
+		log.Printf("Recovered chunk %v/%v", chunkIdx+1, len(sf.Chunks))
+		stats.progress.Chunk(chunkSize)
 	}
-)
 
-// downloadSector attempts to download a sector from a host.
-func downloadSector(r *renter.Renter, hostPub rhp.PublicKey, sector crypto.Hash) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	defer cancel()
+	if sums != nil {
+		if err := sums.WriteFile(checksumPath); err != nil {
+			return stats, fmt.Errorf("failed to write checksums: %w", err)
+		}
+		log.Printf("Wrote checksums to %v", checksumPath)
+	}
+	if len(stats.failedChunks) != 0 {
+		code := exitPartial
+		if stats.Recovered() == 0 {
+			code = exitUnrecoverable
+		}
+		return stats, &exitCodeError{code, fmt.Errorf("%v/%v chunks could not be recovered and were zero-filled", len(stats.failedChunks), len(sf.Chunks))}
+	}
+	return stats, nil
+}
+
+// fileSectorRoots returns the unique merkle roots of the file's sectors.
+func fileSectorRoots(sf siafile.SiaFile) (roots []crypto.Hash) {
+	added := make(map[crypto.Hash][]rhp.PublicKey)
+	for _, chunk := range sf.Chunks {
+		for _, root := range chunkSectorRoots(chunk, added) {
+			added[root] = nil
+			roots = append(roots, root)
+		}
+	}
+	return
+}
+
+// chunkSectorRoots returns the unique merkle roots of the chunk's sectors that
+// are not in checked.
+func chunkSectorRoots(chunk siafile.Chunk, checked map[crypto.Hash][]rhp.PublicKey) (roots []crypto.Hash) {
+	added := make(map[crypto.Hash]bool)
+	for _, piece := range chunk.Pieces {
+		for _, p := range piece {
+			if _, ok := checked[p.MerkleRoot]; ok || added[p.MerkleRoot] {
+				continue
+			}
+			roots = append(roots, p.MerkleRoot)
+			added[p.MerkleRoot] = true
+		}
+	}
+	return
+}
+
+// checkChunkHealth returns the health of a chunk given the hosts that have each
+// sector.
+func checkChunkHealth(sf siafile.SiaFile, chunk siafile.Chunk, sectorAvailability map[crypto.Hash][]rhp.PublicKey) ChunkHealth {
+	chunkHealth := ChunkHealth{MinPieces: sf.DataPieces}
+	for i, piece := range chunk.Pieces {
+		available := true
+		var pieceHealth []PieceHealth
+		for _, sector := range piece {
+			if len(sectorAvailability[sector.MerkleRoot]) == 0 {
+				available = false
+				break
+			}
+			pieceHealth = append(pieceHealth, PieceHealth{
+				MerkleRoot: sector.MerkleRoot,
+				Hosts:      sectorAvailability[sector.MerkleRoot],
+			})
+		}
+		if available {
+			chunkHealth.AvailablePieces++
+		} else {
+			chunkHealth.MissingPieces = append(chunkHealth.MissingPieces, uint32(i))
+		}
+		chunkHealth.Pieces = append(chunkHealth.Pieces, pieceHealth)
+	}
+	return chunkHealth
+}
+
+// hostUsefulness returns the number of sectors each host serves, sorted by
+// the number of sectors descending. Hosts that serve none of the sectors are
+// included with a count of zero.
+func hostUsefulness(hosts []rhp.PublicKey, sectorAvailability map[crypto.Hash][]rhp.PublicKey) []HostUsefulness {
+	counts := make(map[rhp.PublicKey]int)
+	for _, hosts := range sectorAvailability {
+		for _, host := range hosts {
+			counts[host]++
+		}
+	}
+	usefulness := make([]HostUsefulness, 0, len(hosts))
+	for _, host := range hosts {
+		usefulness = append(usefulness, HostUsefulness{
+			HostKey: host,
+			Sectors: counts[host],
+		})
+	}
+	sort.SliceStable(usefulness, func(i, j int) bool {
+		return usefulness[i].Sectors > usefulness[j].Sectors
+	})
+	return usefulness
+}
+
+// loadLocalSector reads a sector from a file in dir named by its merkle root.
+// The sector is only returned if its data matches the root.
+func loadLocalSector(dir string, root crypto.Hash) ([]byte, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, root.String()))
+	if err != nil {
+		return nil, err
+	} else if len(buf) != rhp.SectorSize {
+		return nil, fmt.Errorf("unexpected sector size: %v", len(buf))
+	} else if rhp.DefaultSectorVerifier.SectorRoot((*[rhp.SectorSize]byte)(buf)) != rhp.Hash256(root) {
+		return nil, errors.New("sector data does not match merkle root")
+	}
+	return buf, nil
+}
+
+// warnRootCollisions logs a warning for each merkle root that is shared by
+// multiple pieces of the file. At most one of the pieces can be recovered
+// correctly.
+func warnRootCollisions(sf siafile.SiaFile) {
+	for _, collision := range sf.RootCollisions() {
+		var positions []string
+		for _, p := range collision.Pieces {
+			positions = append(positions, fmt.Sprintf("chunk %v piece %v", p.Chunk+1, p.Piece+1))
+		}
+		log.Printf("[WARN] sector %v is used by multiple pieces (%v) -- the file may be corrupt", collision.MerkleRoot, strings.Join(positions, ", "))
+	}
+}
+
+// siaFileHosts returns the unique hosts listed in the sia file.
+func siaFileHosts(sf siafile.SiaFile) (hosts []rhp.PublicKey) {
+	seen := make(map[rhp.PublicKey]bool)
+	for _, chunk := range sf.Chunks {
+		for _, piece := range chunk.Pieces {
+			for _, p := range piece {
+				if seen[p.HostKey] {
+					continue
+				}
+				seen[p.HostKey] = true
+				hosts = append(hosts, p.HostKey)
+			}
+		}
+	}
+	return
+}
 
-	sess, err := r.NewSession(ctx, hostPub)
+// loadSiaFile loads the sia file at fp using any erasure coding parameters
+// overridden on the command line.
+func loadSiaFile(fp string) (siafile.SiaFile, error) {
+	sf, err := siafile.LoadWithParams(fp, erasureParams)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+		return siafile.SiaFile{}, err
+	} else if !erasureParams.IsZero() {
+		log.Printf("[WARN] Overriding the erasure coding of %v: type %v, %v+%v pieces of %v bytes", fp, sf.EncoderType, sf.DataPieces, sf.ParityPieces, sf.PieceSize)
+	}
+	return sf, nil
+}
+
+// loadSiaFiles loads the sia files matching the glob pattern, sorted by path.
+func loadSiaFiles(pattern string) (paths []string, files []siafile.SiaFile, err error) {
+	paths, err = filepath.Glob(pattern)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to match %q: %w", pattern, err)
+	} else if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no files match %q", pattern)
+	}
+	for _, path := range paths {
+		sf, err := loadSiaFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %v: %w", path, err)
+		}
+		files = append(files, sf)
+	}
+	return paths, files, nil
+}
+
+// siaFilesHosts returns the unique hosts listed in any of the sia files.
+func siaFilesHosts(files []siafile.SiaFile) (hosts []rhp.PublicKey) {
+	seen := make(map[rhp.PublicKey]bool)
+	for _, sf := range files {
+		for _, host := range siaFileHosts(sf) {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return
+}
+
+// checkMissingHosts logs the hosts listed in the sia files that the renter
+// does not have a contract with. Missing hosts are cross-referenced with Sia
+// Central's active hosts to distinguish hosts that a contract should be formed
+// with from hosts that are gone.
+func checkMissingHosts(r *renter.Renter, hosts []rhp.PublicKey) (missing []MissingHost, err error) {
+	var missingHosts []rhp.PublicKey
+	for _, host := range hosts {
+		if _, err := r.HostContract(host); err != nil {
+			missingHosts = append(missingHosts, host)
+		}
 	}
-	defer sess.Close()
 
-	// get the host's current settings
-	settings, err := rhp.RPCSettings(ctx, sess.Transport())
+	if len(missingHosts) == 0 {
+		return nil, nil
+	}
+
+	// without the active hosts every missing host would look gone
+	active, err := r.ActiveHosts(contractHostFilter())
 	if err != nil {
-		return nil, fmt.Errorf("failed to get settings: %w", err)
+		return nil, err
+	}
+	activeHosts := make(map[rhp.PublicKey]bool)
+	for _, host := range active {
+		activeHosts[host] = true
+	}
+
+	client := explorerClient()
+	for _, hostPub := range missingHosts {
+		mh := MissingHost{
+			HostKey: hostPub,
+			Active:  activeHosts[hostPub],
+		}
+		// delisted hosts are not returned by Sia Central
+		if host, err := client.GetHost(hostPub.String()); err == nil {
+			mh.NetAddress = host.NetAddress
+			mh.LastSeen = host.LastSuccessScan
+		}
+		missing = append(missing, mh)
 	}
 
-	buf := bytes.NewBuffer(nil)
-	sections := []rhp.RPCReadRequestSection{
-		{MerkleRoot: rhp.Hash256(sector), Offset: 0, Length: rhp.SectorSize},
+	log.Println("missing contracts for hosts listed in the sia file:")
+	for _, mh := range missing {
+		if mh.Active {
+			log.Printf(" - %v %v active -- form a contract", mh.HostKey, mh.NetAddress)
+		}
+	}
+	for _, mh := range missing {
+		if mh.Active {
+			continue
+		} else if mh.LastSeen.IsZero() {
+			log.Printf(" - %v not found -- host is gone", mh.HostKey)
+		} else {
+			log.Printf(" - %v %v last seen %v -- host is offline or not accepting contracts", mh.HostKey, mh.NetAddress, time.Since(mh.LastSeen))
+		}
 	}
-	// try to read the sector
-	cost := rhp.RPCReadCost(settings, sections)
-	if err := sess.Read(ctx, buf, sections, cost); err != nil {
-		return nil, fmt.Errorf("failed to read sector %v: %w", sector, err)
-	} else if buf.Len() != rhp.SectorSize {
-		return nil, fmt.Errorf("unexpected sector size: %v", buf.Len())
+	return missing, nil
+}
+
+// isPaymentRejected returns true if the host rejected an RPC's payment. The
+// host's prices may have changed since its settings were fetched.
+func isPaymentRejected(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "rejected for high paying renter valid output")
+}
+
+// withHostSession creates a session with the host, gets its settings, and calls
+// fn. If the host rejects fn's payment because its prices changed after the
+// settings were fetched, the settings are fetched again and fn is retried once.
+// The host closes the connection after an RPC error, so the retry uses a new
+// session.
+func withHostSession(ctx context.Context, r *renter.Renter, hostPub rhp.PublicKey, fn func(*rhp.Session, rhp.HostSettings) error) error {
+	attempt := func() error {
+		sess, err := r.NewSession(ctx, hostPub)
+		if err != nil {
+			return fmt.Errorf("failed to create session: %w", err)
+		}
+		defer sess.Close()
+		defer spending.Track(sess)()
+
+		// get the host's current settings
+		settings, err := r.HostSettings(ctx, sess)
+		if err != nil {
+			return fmt.Errorf("failed to get settings: %w", err)
+		}
+		return fn(sess, settings)
+	}
+
+	err := attempt()
+	if !isPaymentRejected(err) {
+		return err
 	}
+	log.Printf("[WARN] host %v rejected the payment, its prices may have changed -- retrying with its current settings: %v", hostPub, err)
+	r.InvalidateHostSettings(hostPub)
+	return attempt()
+}
+
+// downloadSector attempts to download a sector from a host.
+func downloadSector(r *renter.Renter, hostPub rhp.PublicKey, sector crypto.Hash) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var buf *bytes.Buffer
+	err := withHostSession(ctx, r, hostPub, func(sess *rhp.Session, settings rhp.HostSettings) error {
+		// the sector is allocated once at its full size and hashed as it is
+		// read, instead of growing the buffer and hashing it afterwards
+		buf = bytes.NewBuffer(make([]byte, 0, rhp.SectorSize))
+		sh := sess.SectorVerifier().NewSectorHasher()
+		sections := []rhp.RPCReadRequestSection{
+			{MerkleRoot: rhp.Hash256(sector), Offset: 0, Length: rhp.SectorSize},
+		}
+		// try to read the sector
+		cost := rhp.RPCReadCost(settings, sections)
+		start := time.Now()
+		if err := sess.Read(ctx, io.MultiWriter(buf, sh), sections, cost); err != nil {
+			if !strings.Contains(err.Error(), "could not find the desired sector") {
+				// the host's prices may have changed
+				r.InvalidateHostSettings(hostPub)
+			}
+			return fmt.Errorf("failed to read sector %v: %w", sector, err)
+		} else if buf.Len() != rhp.SectorSize {
+			return fmt.Errorf("unexpected sector size: %v", buf.Len())
+		}
+
+		debugf("host %v: read RPC for sector %v took %v", hostPub, sector, time.Since(start))
 
-	// verify the downloaded data matches the merkle root
-	root := rhp.SectorRoot((*[rhp.SectorSize]byte)(buf.Bytes()))
-	if root != rhp.Hash256(sector) {
-		return nil, errors.New("downloaded sector has incorrect merkle root")
+		// verify the downloaded data matches the merkle root
+		if root := crypto.Hash(sh.Root()); root != sector {
+			return fmt.Errorf("downloaded sector has merkle root %v, expected %v: %w", root, sector, errSectorRootMismatch)
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		r.RecordReadSuccess(hostPub)
+	case strings.Contains(err.Error(), "could not find the desired sector"):
+		// the host is responsive, it does not have the sector
+	case r.RecordReadFailure(hostPub):
+		log.Printf("[WARN] host %v failed %v reads in a row, it will not be checked again", hostPub, hostFailureLimit)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-// checkSector checks if a sector is available on a host.
-//
-// note: cannot be batched in RHP2 because the host terminates the RPC loop if
-// it encounters an error.
-func checkSector(r *renter.Renter, hostPub rhp.PublicKey, sector crypto.Hash) (bool, error) {
+// probeSectors optimistically reads the first leaf of each sector in a single
+// Read RPC. The session verifies a Merkle proof for each leaf against the
+// sector's root. It returns false if any of the sectors are missing. The host
+// ends the RPC loop on the first missing sector, so the caller must check each
+// sector individually to find out which.
+func probeSectors(r *renter.Renter, hostPub rhp.PublicKey, sectors []crypto.Hash) (bool, error) {
+	if !checkBudget.Reserve(uint64(len(sectors)) * rhp.LeafSize) {
+		return false, errCheckBudgetExceeded
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	sess, err := r.NewSession(ctx, hostPub)
-	if err != nil {
-		return false, fmt.Errorf("failed to create session: %w", err)
+	var found bool
+	err := withHostSession(ctx, r, hostPub, func(sess *rhp.Session, settings rhp.HostSettings) error {
+		sections := make([]rhp.RPCReadRequestSection, len(sectors))
+		for i, sector := range sectors {
+			sections[i] = rhp.RPCReadRequestSection{MerkleRoot: rhp.Hash256(sector), Offset: 0, Length: rhp.LeafSize}
+		}
+		cost := rhp.RPCReadCost(settings, sections)
+		start := time.Now()
+		if err := sess.Read(ctx, io.Discard, sections, cost); err != nil && strings.Contains(err.Error(), "could not find the desired sector") {
+			return nil
+		} else if err != nil {
+			r.InvalidateHostSettings(hostPub)
+			return fmt.Errorf("failed to probe %v sectors: %w", len(sectors), err)
+		}
+		debugf("host %v: read RPC probing %v sectors took %v", hostPub, len(sectors), time.Since(start))
+		found = true
+		return nil
+	})
+	return found, err
+}
+
+// checkSectors checks which sectors are available on a host. Up to batchSize
+// sectors are probed in a single Read RPC. If any sector in a batch is
+// missing, each sector in the batch is checked individually. It returns the
+// availability of each sector and the number of Read RPCs used.
+func checkSectors(r *renter.Renter, hostPub rhp.PublicKey, sectors []crypto.Hash, batchSize int) (available []bool, rpcs int) {
+	if batchSize < 1 {
+		batchSize = 1
 	}
-	defer sess.Close()
+	available = make([]bool, len(sectors))
+	for i := 0; i < len(sectors); i += batchSize {
+		end := i + batchSize
+		if end > len(sectors) {
+			end = len(sectors)
+		}
 
-	// get the host's current settings
-	settings, err := rhp.RPCSettings(ctx, sess.Transport())
-	if err != nil {
-		return false, fmt.Errorf("failed to get settings: %w", err)
+		if batchSize > 1 {
+			rpcs++
+			ok, err := probeSectors(r, hostPub, sectors[i:end])
+			if errors.Is(err, errCheckBudgetExceeded) {
+				return
+			} else if err != nil {
+				debugf("host %v: failed to probe sectors, checking individually: %v", hostPub, err)
+			} else if ok {
+				for j := i; j < end; j++ {
+					available[j] = true
+				}
+				continue
+			}
+		}
+
+		for j := i; j < end; j++ {
+			rpcs++
+			ok, err := checkSector(r, hostPub, sectors[j])
+			if errors.Is(err, errCheckBudgetExceeded) {
+				return
+			} else if err != nil {
+				log.Printf("WARNING: failed to check sectors on host %v: %v", hostPub, err)
+				continue
+			}
+			available[j] = ok
+		}
+	}
+	return
+}
+
+// A countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// checkAvailability checks each host for each sector and returns the hosts
+// that have each sector and the number of Read RPCs used. If hostLimit is
+// greater than zero, a sector is no longer checked once it has been found or
+// hostLimit hosts have been checked.
+func checkAvailability(r *renter.Renter, hosts []rhp.PublicKey, sectors []crypto.Hash, batchSize, hostLimit int) (map[crypto.Hash][]rhp.PublicKey, int) {
+	sectorAvailability := make(map[crypto.Hash][]rhp.PublicKey)
+	checked := make(map[crypto.Hash]int)
+	var readRPCs int
+	for _, host := range hosts {
+		toCheck := sectors
+		if hostLimit > 0 {
+			toCheck = nil
+			for _, sector := range sectors {
+				if len(sectorAvailability[sector]) == 0 && checked[sector] < hostLimit {
+					toCheck = append(toCheck, sector)
+				}
+			}
+			if len(toCheck) == 0 {
+				break
+			}
+		}
+
+		available, rpcs := checkSectors(r, host, toCheck, batchSize)
+		readRPCs += rpcs
+		for i, sector := range toCheck {
+			checked[sector]++
+			if available[i] {
+				sectorAvailability[sector] = append(sectorAvailability[sector], host)
+			}
+		}
+		if checkBudget.Exhausted() {
+			break
+		}
 	}
+	return sectorAvailability, readRPCs
+}
 
-	buf := bytes.NewBuffer(nil)
+// sampleAvailability checks each sector on n randomly chosen hosts instead of
+// every host. The sectors sampled on each host are still checked together so
+// reads are batched.
+func sampleAvailability(r *renter.Renter, hosts []rhp.PublicKey, sectors []crypto.Hash, batchSize, n int) (map[crypto.Hash][]rhp.PublicKey, int) {
+	if n > len(hosts) {
+		n = len(hosts)
+	}
+	sample := append([]rhp.PublicKey(nil), hosts...)
+	toCheck := make(map[rhp.PublicKey][]crypto.Hash)
+	for _, sector := range sectors {
+		// partially shuffle the hosts, the first n are the sample
+		for i := 0; i < n; i++ {
+			j := i + frand.Intn(len(sample)-i)
+			sample[i], sample[j] = sample[j], sample[i]
+			toCheck[sample[i]] = append(toCheck[sample[i]], sector)
+		}
+	}
 
-	sections := []rhp.RPCReadRequestSection{
-		{MerkleRoot: rhp.Hash256(sector), Offset: 0, Length: rhp.SectorSize},
+	sectorAvailability := make(map[crypto.Hash][]rhp.PublicKey)
+	var readRPCs int
+	for _, host := range hosts {
+		if len(toCheck[host]) == 0 {
+			continue
+		}
+		available, rpcs := checkSectors(r, host, toCheck[host], batchSize)
+		readRPCs += rpcs
+		for i, sector := range toCheck[host] {
+			if available[i] {
+				sectorAvailability[sector] = append(sectorAvailability[sector], host)
+			}
+		}
+		if checkBudget.Exhausted() {
+			break
+		}
 	}
-	// try to read the sector
-	cost := rhp.RPCReadCost(settings, sections)
-	if err := sess.Read(ctx, buf, sections, cost); err != nil && strings.Contains(err.Error(), "could not find the desired sector") {
-		return false, nil
-	} else if err != nil {
-		return false, fmt.Errorf("failed to read sector %v: %w", sector, err)
-	} else if buf.Len() != rhp.SectorSize {
-		return false, fmt.Errorf("unexpected sector size: %v", buf.Len())
+	return sectorAvailability, readRPCs
+}
+
+// checkSector checks if a sector is available on a host.
+//
+// note: cannot be batched in RHP2 because the host terminates the RPC loop if
+// it encounters an error. probeSectors batches optimistically instead.
+func checkSector(r *renter.Renter, hostPub rhp.PublicKey, sector crypto.Hash) (bool, error) {
+	if !checkBudget.Reserve(rhp.SectorSize) {
+		return false, errCheckBudgetExceeded
 	}
 
-	// verify the downloaded data matches the merkle root
-	root := rhp.SectorRoot((*[rhp.SectorSize]byte)(buf.Bytes()))
-	return root == rhp.Hash256(sector), nil
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var found bool
+	err := withHostSession(ctx, r, hostPub, func(sess *rhp.Session, settings rhp.HostSettings) error {
+		// the sector's data is not needed, hash it as it is read
+		sh := sess.SectorVerifier().NewSectorHasher()
+		cw := &countingWriter{w: sh}
+
+		sections := []rhp.RPCReadRequestSection{
+			{MerkleRoot: rhp.Hash256(sector), Offset: 0, Length: rhp.SectorSize},
+		}
+		// try to read the sector
+		cost := rhp.RPCReadCost(settings, sections)
+		start := time.Now()
+		if err := sess.Read(ctx, cw, sections, cost); err != nil && strings.Contains(err.Error(), "could not find the desired sector") {
+			return nil
+		} else if err != nil {
+			r.InvalidateHostSettings(hostPub)
+			return fmt.Errorf("failed to read sector %v: %w", sector, err)
+		} else if cw.n != rhp.SectorSize {
+			return fmt.Errorf("unexpected sector size: %v", cw.n)
+		}
+
+		debugf("host %v: read RPC for sector %v took %v", hostPub, sector, time.Since(start))
+		found = sh.Root() == rhp.Hash256(sector)
+		return nil
+	})
+	return found, err
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// healthFormat is the file check --format flag, json or csv.
+var healthFormat = "json"
+
+// healthColumns are the columns of a CSV health report.
+var healthColumns = []string{"chunk", "minPieces", "availablePieces", "redundancy", "recoverable"}
+
+// redundancy returns the ratio of available pieces to the pieces needed to
+// recover a chunk.
+func redundancy(available, minPieces uint32) float64 {
+	if minPieces == 0 {
+		return 0
+	}
+	return float64(available) / float64(minPieces)
+}
+
+// writeHealthCSV writes one row per chunk of the health report followed by a
+// summary row. The summary row totals the pieces and has the lowest
+// redundancy of any chunk, which limits the file's redundancy.
+func writeHealthCSV(w io.Writer, health FileHealth) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(healthColumns); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	var minPieces, available uint32
+	var lowest float64
+	for i, chunk := range health.Chunks {
+		r := redundancy(chunk.AvailablePieces, chunk.MinPieces)
+		if i == 0 || r < lowest {
+			lowest = r
+		}
+		minPieces += chunk.MinPieces
+		available += chunk.AvailablePieces
+		row := []string{
+			strconv.Itoa(i + 1),
+			strconv.FormatUint(uint64(chunk.MinPieces), 10),
+			strconv.FormatUint(uint64(chunk.AvailablePieces), 10),
+			strconv.FormatFloat(r, 'f', 2, 64),
+			strconv.FormatBool(chunk.AvailablePieces >= chunk.MinPieces),
+		}
+		if err := cw.Write(row); err != nil {
+			return fmt.Errorf("failed to write chunk %v: %w", i+1, err)
+		}
+	}
+	summary := []string{
+		"total",
+		strconv.FormatUint(uint64(minPieces), 10),
+		strconv.FormatUint(uint64(available), 10),
+		strconv.FormatFloat(lowest, 'f', 2, 64),
+		strconv.FormatBool(health.Recoverable),
+	}
+	if err := cw.Write(summary); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	cw.Flush()
+	return cw.Error()
+}
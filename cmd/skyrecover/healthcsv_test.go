@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteHealthCSV(t *testing.T) {
+	health := FileHealth{
+		Chunks: []ChunkHealth{
+			{MinPieces: 10, AvailablePieces: 30},
+			{MinPieces: 10, AvailablePieces: 8},
+			{MinPieces: 10, AvailablePieces: 15},
+		},
+	}
+	var buf bytes.Buffer
+	if err := writeHealthCSV(&buf, health); err != nil {
+		t.Fatal(err)
+	}
+	expected := `chunk,minPieces,availablePieces,redundancy,recoverable
+1,10,30,3.00,true
+2,10,8,0.80,false
+3,10,15,1.50,true
+total,30,53,0.80,false
+`
+	if buf.String() != expected {
+		t.Fatalf("expected\n%v\ngot\n%v", expected, buf.String())
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/siafile"
+	_ "modernc.org/sqlite" // registers the pure Go sqlite driver
+)
+
+// healthDBPath is the SQLite database file check records each scan to.
+var healthDBPath string
+
+// sqliteTimeFormat is the format of SQLite's datetime function. Scan times are
+// stored in it so they can be compared with datetime in queries regardless of
+// how the driver formats a time.Time.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// healthSchema creates the tables of the health database. A scan is one run
+// of file check, chunk_availability holds the scan's result for each chunk.
+const healthSchema = `
+CREATE TABLE IF NOT EXISTS scans (
+	id INTEGER PRIMARY KEY,
+	file_id TEXT NOT NULL,
+	file_path TEXT NOT NULL,
+	scanned_at TIMESTAMP NOT NULL,
+	recoverable BOOLEAN NOT NULL,
+	min_redundancy REAL NOT NULL,
+	hosts_scanned INTEGER NOT NULL,
+	chunks INTEGER NOT NULL,
+	unhealthy_chunks INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS scans_file_id_scanned_at ON scans(file_id, scanned_at);
+CREATE TABLE IF NOT EXISTS chunk_availability (
+	scan_id INTEGER NOT NULL REFERENCES scans(id) ON DELETE CASCADE,
+	chunk INTEGER NOT NULL,
+	min_pieces INTEGER NOT NULL,
+	available_pieces INTEGER NOT NULL,
+	PRIMARY KEY (scan_id, chunk)
+);`
+
+// A healthScan is a file check result recorded to the health database.
+type healthScan struct {
+	FileID       crypto.Hash
+	FilePath     string
+	ScannedAt    time.Time
+	Health       FileHealth
+	HostsScanned int
+}
+
+// siaFileID returns an identifier for the file that does not change when the
+// .sia file is moved or rehosted, the hash of its sector roots.
+func siaFileID(sf siafile.SiaFile) crypto.Hash {
+	return crypto.HashAll(fileSectorRoots(sf))
+}
+
+// minRedundancy returns the lowest ratio of available to required pieces of
+// the file's chunks.
+func minRedundancy(health FileHealth) float64 {
+	if len(health.Chunks) == 0 {
+		return 0
+	}
+	min := -1.0
+	for _, chunk := range health.Chunks {
+		if chunk.MinPieces == 0 {
+			continue
+		}
+		redundancy := float64(chunk.AvailablePieces) / float64(chunk.MinPieces)
+		if min < 0 || redundancy < min {
+			min = redundancy
+		}
+	}
+	if min < 0 {
+		return 0
+	}
+	return min
+}
+
+// openHealthDB opens the health database at fp, creating it if it does not
+// exist.
+func openHealthDB(fp string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+fp+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	} else if _, err := db.Exec(healthSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+	return db, nil
+}
+
+// recordHealthScan inserts the scan and its chunks' availability into the
+// health database at fp.
+func recordHealthScan(fp string, scan healthScan) error {
+	db, err := openHealthDB(fp)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	filePath, err := filepath.Abs(scan.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	var unhealthy int
+	for _, chunk := range scan.Health.Chunks {
+		if chunk.AvailablePieces < chunk.MinPieces {
+			unhealthy++
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO scans (file_id, file_path, scanned_at, recoverable, min_redundancy, hosts_scanned, chunks, unhealthy_chunks) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		scan.FileID.String(), filePath, scan.ScannedAt.UTC().Format(sqliteTimeFormat), scan.Health.Recoverable, minRedundancy(scan.Health), scan.HostsScanned, len(scan.Health.Chunks), unhealthy)
+	if err != nil {
+		return fmt.Errorf("failed to insert scan: %w", err)
+	}
+	scanID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get scan id: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO chunk_availability (scan_id, chunk, min_pieces, available_pieces) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare chunk insert: %w", err)
+	}
+	defer stmt.Close()
+	for i, chunk := range scan.Health.Chunks {
+		if _, err := stmt.Exec(scanID, i, chunk.MinPieces, chunk.AvailablePieces); err != nil {
+			return fmt.Errorf("failed to insert chunk %v: %w", i, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit scan: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.sia.tech/siad/crypto"
+)
+
+func TestRecordHealthScan(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "health.db")
+	fileID := crypto.Hash{1}
+	week := 7 * 24 * time.Hour
+	start := time.Now().Add(-week - time.Hour)
+
+	// the file loses a piece of its second chunk between the scans
+	scans := []FileHealth{
+		{Recoverable: true, Chunks: []ChunkHealth{{MinPieces: 10, AvailablePieces: 30}, {MinPieces: 10, AvailablePieces: 25}}},
+		{Recoverable: true, Chunks: []ChunkHealth{{MinPieces: 10, AvailablePieces: 30}, {MinPieces: 10, AvailablePieces: 12}}},
+	}
+	for i, health := range scans {
+		err := recordHealthScan(fp, healthScan{
+			FileID:       fileID,
+			FilePath:     "file.sia",
+			ScannedAt:    start.Add(time.Duration(i) * week),
+			Health:       health,
+			HostsScanned: 50,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := openHealthDB(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var count int
+	var redundancy float64
+	err = db.QueryRow(`SELECT COUNT(*), MIN(min_redundancy) FROM scans WHERE file_id = ?`, fileID.String()).Scan(&count, &redundancy)
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("expected 2 scans, got %v", count)
+	} else if redundancy != 1.2 {
+		t.Fatalf("expected min redundancy 1.2, got %v", redundancy)
+	}
+
+	var available int
+	err = db.QueryRow(`SELECT c.available_pieces FROM chunk_availability c JOIN scans s ON s.id = c.scan_id WHERE s.file_id = ? AND c.chunk = 1 ORDER BY s.scanned_at DESC LIMIT 1`, fileID.String()).Scan(&available)
+	if err != nil {
+		t.Fatal(err)
+	} else if available != 12 {
+		t.Fatalf("expected 12 available pieces in the latest scan, got %v", available)
+	}
+
+	// the README's query for files whose redundancy dropped this week
+	var previous, current float64
+	err = db.QueryRow(`SELECT previous, min_redundancy FROM (SELECT *, LAG(min_redundancy) OVER (PARTITION BY file_id ORDER BY scanned_at) AS previous FROM scans) WHERE scanned_at > datetime('now', '-7 days') AND min_redundancy < previous`).Scan(&previous, &current)
+	if err != nil {
+		t.Fatal(err)
+	} else if previous != 2.5 || current != 1.2 {
+		t.Fatalf("expected redundancy to drop from 2.5 to 1.2, got %v to %v", previous, current)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+var (
+	hintsPath string
+	// sectorHints maps sector roots to the hosts known to store them. Hinted
+	// hosts are checked before the listed host and the contracted hosts.
+	sectorHints map[crypto.Hash][]rhp.PublicKey
+)
+
+// loadSectorHints loads a JSON object mapping merkle roots to the public keys
+// of the hosts that store them.
+func loadSectorHints(fp string) (map[crypto.Hash][]rhp.PublicKey, error) {
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hints: %w", err)
+	}
+	var raw map[string][]rhp.PublicKey
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode hints: %w", err)
+	}
+
+	hints := make(map[crypto.Hash][]rhp.PublicKey, len(raw))
+	for s, hosts := range raw {
+		var root crypto.Hash
+		if err := root.LoadString(s); err != nil {
+			return nil, fmt.Errorf("failed to decode merkle root %q: %w", s, err)
+		}
+		hints[root] = append(hints[root], hosts...)
+	}
+	return hints, nil
+}
+
+// hintedHosts returns the hinted hosts for the sector that the renter has a
+// contract with and are not in missing.
+func hintedHosts(r *renter.Renter, sector crypto.Hash, missing map[rhp.PublicKey]bool) (hosts []rhp.PublicKey) {
+	for _, host := range sectorHints[sector] {
+		if missing[host] {
+			continue
+		} else if _, err := r.HostContract(host); err != nil {
+			log.Printf("[WARN] skipping hinted host %v for sector %v: %v", host, sector, err)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return
+}
+
+// recoverHintedSector checks the hinted hosts for a sector. Hosts that do not
+// have the sector are added to missing.
+func (rc *Recoverer) recoverHintedSector(ctx context.Context, sector crypto.Hash, missing map[rhp.PublicKey]bool) ([]byte, rhp.PublicKey, bool) {
+	hosts := hintedHosts(rc.r, sector, missing)
+	if len(hosts) == 0 {
+		return nil, rhp.PublicKey{}, false
+	}
+	log.Printf("Checking %v hinted hosts for sector %v", len(hosts), sector)
+	buf, host, _, ok := rc.FetchSector(ctx, sector, hosts, missing)
+	return buf, host, ok
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siacentral/apisdkgo/sia"
+	"github.com/spf13/cobra"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/jsonout"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+// An exportedHost is an active host written by hosts export. Prices are in
+// hastings per byte, or per byte per block for storage.
+type exportedHost struct {
+	PublicKey         string         `json:"publicKey"`
+	NetAddress        string         `json:"netAddress"`
+	Version           string         `json:"version"`
+	Uptime            float32        `json:"uptime"`
+	LastSeen          time.Time      `json:"lastSeen"`
+	ContractPrice     types.Currency `json:"contractPrice"`
+	DownloadPrice     types.Currency `json:"downloadPrice"`
+	SectorAccessPrice types.Currency `json:"sectorAccessPrice"`
+	StoragePrice      types.Currency `json:"storagePrice"`
+}
+
+// exportColumns are the columns of a CSV host export.
+var exportColumns = []string{"publicKey", "netAddress", "version", "uptime", "lastSeen", "contractPrice", "downloadPrice", "sectorAccessPrice", "storagePrice"}
+
+var hostsExportCmd = &cobra.Command{
+	Use:   "export <file>",
+	Short: "write the active hosts to a JSON or CSV file",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		hosts, err := explorerClient().ActiveHosts(contractHostFilter())
+		if err != nil {
+			log.Fatalln("failed to get active hosts:", err)
+		}
+		exported := make([]exportedHost, 0, len(hosts))
+		for _, host := range hosts {
+			exported = append(exported, exportHost(host))
+		}
+		if err := writeHostExport(args[0], exported); err != nil {
+			log.Fatalln("failed to export hosts:", err)
+		}
+		log.Printf("Exported %v hosts to %v", len(exported), args[0])
+	},
+}
+
+// contractHostFilter returns the filter used to list hosts to form contracts
+// with.
+func contractHostFilter() sia.HostFilter {
+	filter := make(sia.HostFilter)
+	filter.WithAcceptingContracts(true)
+	filter.WithMinUptime(0.6)
+	filter.WithMaxContractPrice(types.SiacoinPrecision.Div64(2))
+	return filter
+}
+
+// exportHost converts a host returned by Sia Central to an exportedHost.
+func exportHost(host sia.HostDetails) exportedHost {
+	eh := exportedHost{
+		PublicKey:  host.PublicKey,
+		NetAddress: host.NetAddress,
+		Version:    host.Version,
+		Uptime:     host.EstimatedUptime,
+		LastSeen:   host.LastSuccessScan,
+	}
+	if host.Settings != nil {
+		eh.ContractPrice = host.Settings.ContractPrice
+		eh.DownloadPrice = host.Settings.DownloadBandwidthPrice
+		eh.SectorAccessPrice = host.Settings.SectorAccessPrice
+		eh.StoragePrice = host.Settings.StoragePrice
+	}
+	return eh
+}
+
+// isCSV returns true if the host export at fp is a CSV file. Any other
+// extension is JSON.
+func isCSV(fp string) bool {
+	return strings.EqualFold(filepath.Ext(fp), ".csv")
+}
+
+// isHostExport returns true if fp is a host export instead of a .sia file.
+func isHostExport(fp string) bool {
+	switch strings.ToLower(filepath.Ext(fp)) {
+	case ".json", ".csv":
+		return true
+	}
+	return false
+}
+
+// writeHostExport writes the hosts to fp as CSV if it ends in .csv, otherwise
+// as JSON.
+func writeHostExport(fp string, hosts []exportedHost) error {
+	f, err := os.Create(fp)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer f.Close()
+
+	if isCSV(fp) {
+		w := csv.NewWriter(f)
+		if err := w.Write(exportColumns); err != nil {
+			return fmt.Errorf("failed to write header: %w", err)
+		}
+		for _, host := range hosts {
+			row := []string{
+				host.PublicKey,
+				host.NetAddress,
+				host.Version,
+				strconv.FormatFloat(float64(host.Uptime), 'f', 4, 32),
+				host.LastSeen.Format(time.RFC3339),
+				host.ContractPrice.String(),
+				host.DownloadPrice.String(),
+				host.SectorAccessPrice.String(),
+				host.StoragePrice.String(),
+			}
+			if err := w.Write(row); err != nil {
+				return fmt.Errorf("failed to write host %v: %w", host.PublicKey, err)
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to write hosts: %w", err)
+		}
+	} else if err := jsonout.NewEncoder(f, jsonIndent()).Encode(hosts); err != nil {
+		return fmt.Errorf("failed to write hosts: %w", err)
+	}
+	return f.Sync()
+}
+
+// loadHostExport returns the public keys of the hosts in a JSON or CSV file
+// written by hosts export. Only the publicKey column is required, so the file
+// can be edited or filtered externally.
+func loadHostExport(fp string) (hosts []rhp.PublicKey, err error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	var keys []string
+	if isCSV(fp) {
+		r := csv.NewReader(f)
+		header, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		col := -1
+		for i, name := range header {
+			if name == "publicKey" {
+				col = i
+			}
+		}
+		if col == -1 {
+			return nil, errors.New("missing publicKey column")
+		}
+		for {
+			row, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read row: %w", err)
+			}
+			keys = append(keys, row[col])
+		}
+	} else {
+		var exported []exportedHost
+		if err := json.NewDecoder(f).Decode(&exported); err != nil {
+			return nil, fmt.Errorf("failed to decode hosts: %w", err)
+		}
+		for _, host := range exported {
+			keys = append(keys, host.PublicKey)
+		}
+	}
+
+	for _, key := range keys {
+		var hostPub rhp.PublicKey
+		if err := hostPub.UnmarshalText([]byte(key)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal host public key %v: %w", key, err)
+		}
+		hosts = append(hosts, hostPub)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"lukechampine.com/frand"
+)
+
+func TestHostExport(t *testing.T) {
+	var keys []rhp.PublicKey
+	var hosts []exportedHost
+	for i := 0; i < 3; i++ {
+		var key rhp.PublicKey
+		frand.Read(key[:])
+		keys = append(keys, key)
+		hosts = append(hosts, exportedHost{
+			PublicKey:     key.String(),
+			NetAddress:    "host.example.com:9982",
+			Uptime:        0.95,
+			LastSeen:      time.Now(),
+			ContractPrice: types.SiacoinPrecision.Div64(10),
+			DownloadPrice: types.NewCurrency64(uint64(i) * 1e12),
+		})
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"hosts.json", "hosts.csv"} {
+		fp := filepath.Join(dir, name)
+		if err := writeHostExport(fp, hosts); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadHostExport(fp)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(loaded, keys) {
+			t.Fatalf("%v: expected hosts %v, got %v", name, keys, loaded)
+		}
+	}
+
+	// a filtered CSV only needs the publicKey column
+	fp := filepath.Join(dir, "filtered.csv")
+	if err := os.WriteFile(fp, []byte("netAddress,publicKey\nhost.example.com:9982,"+keys[1].String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadHostExport(fp)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(loaded, keys[1:2]) {
+		t.Fatalf("expected hosts %v, got %v", keys[1:2], loaded)
+	}
+
+	if err := os.WriteFile(fp, []byte("netAddress\nhost.example.com:9982\n"), 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := loadHostExport(fp); err == nil {
+		t.Fatal("expected an error without a publicKey column")
+	}
+}
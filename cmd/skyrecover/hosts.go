@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rodaine/table"
+	"github.com/spf13/cobra"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+// scanConcurrency is the number of hosts scanned at once.
+const scanConcurrency = 10
+
+var (
+	scanFromFile string
+
+	hostsCmd = &cobra.Command{
+		Use:   "hosts",
+		Short: "host commands",
+		Run:   func(cmd *cobra.Command, args []string) { cmd.Usage() },
+	}
+
+	hostsScanCmd = &cobra.Command{
+		Use:   "scan [host key]...",
+		Short: "check that hosts are reachable without forming contracts",
+		Run: func(cmd *cobra.Command, args []string) {
+			r, err := newRenter()
+			if err != nil {
+				log.Fatalln("failed to initialize renter:", err)
+			} else if len(args) == 0 && len(scanFromFile) == 0 {
+				cmd.Usage()
+				os.Exit(1)
+			}
+
+			var hosts []rhp.PublicKey
+			if len(scanFromFile) != 0 {
+				sf, err := siafile.Load(scanFromFile)
+				if err != nil {
+					log.Fatalln("failed to parse skyfile:", err)
+				}
+				hosts = siaFileHosts(sf)
+			}
+			for _, key := range args {
+				var hostPub rhp.PublicKey
+				if err := hostPub.UnmarshalText([]byte(key)); err != nil {
+					log.Fatalf("failed to unmarshal host public key %v: %v", key, err)
+				}
+				hosts = append(hosts, hostPub)
+			}
+
+			type scanResult struct {
+				settings rhp.HostSettings
+				latency  time.Duration
+				err      error
+			}
+			results := make([]scanResult, len(hosts))
+			sem := make(chan struct{}, scanConcurrency)
+			var wg sync.WaitGroup
+			for i, hostPub := range hosts {
+				wg.Add(1)
+				go func(i int, hostPub rhp.PublicKey) {
+					defer wg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+
+					ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+					defer cancel()
+					settings, latency, err := r.ScanHost(ctx, hostPub)
+					results[i] = scanResult{settings, latency, err}
+				}(i, hostPub)
+			}
+			wg.Wait()
+
+			var reachable int
+			tbl := table.New("Host Key", "Status", "Latency", "Contract Price", "Download Price", "Error")
+			for i, hostPub := range hosts {
+				res := results[i]
+				if res.err != nil {
+					tbl.AddRow(hostPub, "unreachable", "", "", "", res.err)
+					continue
+				}
+				reachable++
+				tbl.AddRow(hostPub, "reachable", res.latency.Round(time.Millisecond), res.settings.ContractPrice.HumanString(), res.settings.DownloadBandwidthPrice.Mul64(1e12).HumanString()+"/TB", "")
+			}
+			tbl.Print()
+			log.Printf("%v/%v hosts reachable", reachable, len(hosts))
+		},
+	}
+)
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 
 	"github.com/spf13/cobra"
+	"go.sia.tech/skyrecover/internal/jsonout"
+	"go.sia.tech/skyrecover/internal/renter"
 )
 
 var (
-	dataDir string
-	force   bool
+	dataDir           string
+	contractsDir      string
+	force             bool
+	compressContracts bool
+	encryptContracts  bool
+	verbose           bool
+	compactJSON       bool
+	indentJSON        string
 
 	contractDownloadSize uint64 = 1 << 30 // 1 GiB of downloaded data
 	contractDuration     uint64 = 144 * 7 // 1 week
@@ -20,9 +31,35 @@ var (
 		Use:   "healthcheck",
 		Short: "",
 		Run:   func(cmd *cobra.Command, args []string) {},
+
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadConfig(cmd); err != nil {
+				return err
+			}
+			return setNetwork(cmd, args)
+		},
+		// errors are logged by main
+		SilenceErrors: true,
+		SilenceUsage:  true,
 	}
 )
 
+// Exit codes returned by file check and file recover.
+const (
+	exitError         = 1 // the command failed before checking or recovering the file
+	exitPartial       = 2 // some, but not all, of the file's chunks are recoverable
+	exitUnrecoverable = 3 // none of the file's chunks are recoverable
+)
+
+// An exitCodeError ends the process with a specific exit code.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string { return e.err.Error() }
+func (e *exitCodeError) Unwrap() error { return e.err }
+
 func init() {
 	log.SetFlags(0)
 
@@ -36,24 +73,197 @@ func init() {
 		defaultDataDir = filepath.Join(os.Getenv("HOME"), ".local/renterc")
 	}
 
-	contractsFormCmd.Flags().BoolVarP(&force, "force", "f", force, "force contract formation")
+	contractsFormCmd.Flags().BoolVarP(&force, "force", "f", force, "form contracts even if a contract exists or the wallet cannot fund all of them")
+	contractsFormCmd.Flags().Uint64Var(&formRenewWindow, "renew-window", formRenewWindow, "renew existing contracts that expire within this many blocks instead of skipping them")
+	contractsFormCmd.Flags().BoolVar(&formWait, "wait", false, "wait for immature wallet outputs to mature if they are needed to form the contracts")
+	contractsFormCmd.Flags().StringVar(&formFromFile, "from-file", "", "form contracts with the hosts listed in a .sia file, or a .json or .csv file written by hosts export")
+	contractsFormCmd.Flags().StringVar(&formFromFiles, "from-files", "", "form contracts with the hosts listed in any .sia file matching a glob pattern")
 	contractsFormCmd.Flags().Uint64Var(&contractDownloadSize, "download-size", contractDownloadSize, "contract download size")
+	contractsFormCmd.Flags().StringVar(&formRenterFunds, "renter-funds", "", "siacoins to fund each contract with instead of estimating them from the download size")
+	contractsFormCmd.Flags().StringVar(&formHostCollateral, "host-collateral", "", "siacoins of collateral to ask each host to add to the contract")
 	contractsFormCmd.Flags().Uint64Var(&contractDuration, "duration", contractDuration, "contract duration")
-	contractsCmd.AddCommand(contractsFormCmd, contractsHostsCmd)
+	contractsGCCmd.Flags().Uint64Var(&gcMinReads, "min-reads", gcMinReads, "remove contracts that cannot pay for this many full sector reads")
+	contractsGCCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "list exhausted contracts without removing them")
+	contractsVerifyCmd.Flags().Uint64Var(&gcMinReads, "min-reads", gcMinReads, "flag contracts that cannot pay for this many full sector reads")
+	contractsVerifyCmd.Flags().BoolVar(&verifyRemove, "remove", false, "remove contracts that are exhausted or unknown to their host")
+	contractsCmd.AddCommand(contractsFormCmd, contractsHostsCmd, contractsImportSkydCmd, contractsGCCmd, contractsVerifyCmd, contractsEncryptCmd)
 
-	walletCmd.AddCommand(walletDistributeCmd)
+	walletAddressCmd.Flags().BoolVar(&addressQR, "qr", false, "also print the address as a QR code")
+	walletFaucetCmd.Flags().StringVar(&faucetAmount, "amount", faucetAmount, "amount of siacoins to request")
+	walletFaucetCmd.Flags().StringVar(&faucetURL, "faucet-url", "", "faucet to request funds from, defaults to the network's faucet")
+	walletCmd.AddCommand(walletAddressCmd, walletDistributeCmd, walletValidateCmd, walletFaucetCmd)
+
+	hostsScanCmd.Flags().StringVar(&scanFromFile, "from-file", "", "scan the hosts listed in a .sia file")
+	hostsCmd.AddCommand(hostsScanCmd, hostsExportCmd)
 
 	recoverCmd.Flags().StringVarP(&inputFile, "input", "i", "", "input file")
-	recoverCmd.Flags().StringVarP(&outputFile, "output", "o", "", "output file")
+	recoverCmd.Flags().StringVarP(&outputFile, "output", "o", "", "output file, - for stdout, or the output directory with --batch")
+	recoverCmd.Flags().StringVar(&batchPattern, "batch", "", "recover every .sia file matching a glob pattern into the -o directory")
+	recoverCmd.Flags().BoolVar(&streamOutput, "stream", false, "write each chunk to the output as soon as it is recovered, defaults to stdout")
+	recoverCmd.Flags().BoolVar(&mmapOutput, "mmap", false, "write the output through a memory-mapped file sized to the file's length")
+	recoverCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the sectors that would be downloaded and the estimated cost as JSON without downloading")
+	recoverCmd.Flags().BoolVar(&estimateRecovery, "estimate", false, "download a sector from a sample of the file's hosts and print the estimated time and cost of the recovery")
+	recoverCmd.Flags().IntVar(&estimateHosts, "estimate-hosts", 5, "number of hosts --estimate downloads a sector from")
+	recoverCmd.Flags().BoolVar(&verifyRecovered, "verify", false, "re-encode each recovered chunk and check its pieces against the siafile's merkle roots")
+	recoverCmd.Flags().StringVar(&checksumPath, "checksums", "", "write SHA-256 checksums of each chunk and the whole file to a JSON sidecar")
+	recoverCmd.Flags().StringVar(&outputMetadataPath, "output-metadata", "", "after a successful recovery, write the file's size, erasure coding, skylinks and the hosts used to a JSON sidecar")
+	recoverCmd.Flags().StringVar(&piecesDir, "pieces-from", "", "load sectors from a directory of files named by merkle root before downloading them")
+	recoverCmd.Flags().StringVar(&cacheCoveragePath, "cache-coverage", "", "print which of a sia file's pieces are in --pieces-from as JSON and whether it can be recovered without downloading, then exit")
+	recoverCmd.Flags().BoolVar(&onlyMissingPieces, "only-missing-pieces", false, "use file check's health report to download the cheapest pieces first, skipping cached sectors and pieces the report lists as missing")
+	recoverCmd.Flags().StringVar(&healthReportPath, "health-report", "", "health report used by --only-missing-pieces, defaults to the one file check writes for the input file")
+	recoverCmd.Flags().BoolVar(&preferParity, "prefer-parity", false, "download parity pieces before data pieces to test parity integrity")
+	recoverCmd.Flags().StringVar(&downloadStrategyMode, "download-strategy", downloadStrategyMode, "sector download order: listed-first, fanout-first, or adaptive")
+	recoverCmd.Flags().BoolVar(&continueOnError, "continue-on-error", false, "zero-fill chunks that cannot be recovered and continue with the next chunk, writing the recovered byte ranges to <output>.ranges.json")
+	recoverCmd.Flags().StringVar(&hintsPath, "hints", "", "JSON file mapping merkle roots to the public keys of hosts known to store them, checked before the listed and contracted hosts")
+	recoverCmd.Flags().StringVar(&splitSize, "split", "", "write the output to numbered part files of at most this size, e.g. 4GiB, with a <output>.parts.json manifest")
+	recoverCmd.Flags().StringVar(&rangesPath, "ranges", "", "write the recovered and zero-filled byte ranges to a JSON file, defaults to <output>.ranges.json with --continue-on-error")
+	recoverCmd.Flags().IntVar(&chunkRetries, "chunk-retries", 0, "number of times to retry a chunk that could not be recovered, skipping hosts that do not have its sectors")
+	recoverCmd.Flags().DurationVar(&notFoundRetryDelay, "not-found-retry", 0, "check hosts that report a sector as not found once more after this delay, 0 to disable")
+	recoverCmd.Flags().BoolVar(&autoContract, "auto-contract", false, "when a sector is not found on the contracted hosts, form contracts with other active hosts and check them")
+	recoverCmd.Flags().IntVar(&autoContractLimit, "auto-contract-limit", 50, "maximum number of contracts --auto-contract forms")
+	recoverCmd.Flags().IntVar(&contractHostLimit, "contract-host-limit", 0, "maximum number of contracted hosts to check for each sector, 0 for no limit")
+	recoverCmd.Flags().BoolVar(&noProgress, "no-progress", false, "do not show the progress line with the percent recovered, throughput, ETA, and active hosts")
+	recoverCmd.Flags().IntVar(&hostFailureLimit, "host-failure-limit", 0, "stop checking a host for the rest of the run after this many consecutive failed reads, 0 for no limit")
+	recoverCmd.Flags().BoolVar(&costAware, "cost-aware", false, "check the cheapest hosts for a sector first instead of racing every host, reporting the estimated cost saved")
+	healthCheckCmd.Flags().StringVar(&healthDBPath, "db", "", "also record the scan and each chunk's availability to a SQLite database for historical tracking")
+	healthCheckCmd.Flags().BoolVar(&failFast, "fail-fast", false, "check one chunk at a time and stop at the first chunk that is not recoverable")
+	healthCheckCmd.Flags().StringVar(&maxCheckBytes, "max-check-bytes", "", "stop checking once this much sector data has been read, e.g. 10GiB, and write a partial report")
+	healthCheckCmd.Flags().IntVar(&contractHostLimit, "contract-host-limit", 0, "maximum number of contracted hosts to check for each sector, stopping once it is found, 0 for no limit")
 	recoverCmd.Flags().IntVarP(&workers, "workers", "w", 100, "number of workers to use")
-	fileCmd.AddCommand(healthCheckCmd, recoverCmd)
+	healthCheckCmd.Flags().IntVar(&probeHosts, "probe-hosts", 0, "check each sector on this many randomly sampled contracted hosts instead of all of them, 0 to check every host")
+	healthCheckCmd.Flags().IntVar(&probeBatch, "probe-batch", 16, "number of sectors to probe per read RPC, falling back to one at a time if any are missing")
+	healthCheckCmd.Flags().StringVar(&healthFormat, "format", healthFormat, "format of the health report, json or csv. --only-missing-pieces reads the JSON report")
+	healthCheckCmd.Flags().StringVar(&outHostsPath, "out-hosts", "", "write the number of the file's sectors each host serves to a JSON file")
+	healthCheckCmd.Flags().BoolVar(&gcExhausted, "gc-contracts", false, "remove contracts that cannot pay for a sector read before checking")
+	recoverCmd.Flags().BoolVar(&gcExhausted, "gc-contracts", false, "remove contracts that cannot pay for a sector read before recovering")
+	healthCheckCmd.Flags().BoolVar(&setupContracts, "setup", false, "interactively fund the wallet and form contracts with the file's hosts")
+	recoverCmd.Flags().BoolVar(&setupContracts, "setup", false, "interactively fund the wallet and form contracts with the file's hosts")
+	rehostCmd.Flags().IntVar(&probeBatch, "probe-batch", 16, "number of sectors to probe per read RPC, falling back to one at a time if any are missing")
+	fileCmd.PersistentFlags().Uint64Var(&erasureParams.PieceSize, "piece-size", 0, "override the sia file's piece size, 0 to use the stored value")
+	fileCmd.PersistentFlags().Uint32Var(&erasureParams.EncoderType, "encoder-type", 0, "override the sia file's erasure coder: 1 for Reed-Solomon, 2 for Reed-Solomon with 64 byte segments, 0 to use the stored value")
+	fileCmd.PersistentFlags().Uint32Var(&erasureParams.DataPieces, "data-pieces", 0, "override the sia file's number of data pieces, 0 to use the stored value")
+	fileCmd.PersistentFlags().Uint32Var(&erasureParams.ParityPieces, "parity-pieces", 0, "override the sia file's number of parity pieces, 0 to use the stored value")
+	repairCmd.Flags().Float64Var(&targetRedundancy, "target-redundancy", 1.5, "upload just enough new pieces to bring each chunk to this redundancy, the number of available pieces divided by the minimum")
+	repairCmd.Flags().StringVar(&healthReportPath, "health-report", "", "health report listing the missing pieces, defaults to the one file check writes for the input file")
+	fileCmd.AddCommand(healthCheckCmd, recoverCmd, rehostCmd, repairCmd)
+
+	cacheCmd.AddCommand(cacheMergeCmd, cacheVerifyCmd)
+	cacheVerifyCmd.Flags().BoolVar(&removeCorrupt, "remove", false, "remove the corrupt sectors")
 
 	rootCmd.PersistentFlags().StringVarP(&dataDir, "dir", "d", defaultDataDir, "data directory")
-	rootCmd.AddCommand(walletCmd, contractsCmd, fileCmd)
+	rootCmd.PersistentFlags().StringVar(&contractsDir, "contracts-dir", "", "directory containing the renter key and contracts, defaults to the data directory")
+	rootCmd.PersistentFlags().StringVar(&networkName, "network", networkName, "network to use, mainnet or zen")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "log the duration of each RPC")
+	rootCmd.PersistentFlags().BoolVar(&keepSessions, "keep-sessions", false, "record every host session and print its settings, contract revisions and RPCs on exit")
+	rootCmd.PersistentFlags().StringVar(&siaCentralURL, "siacentral-url", "", "address of the Sia Central API, defaults to the network's")
+	rootCmd.PersistentFlags().DurationVar(&siaCentralTimeout, "siacentral-timeout", siaCentralTimeout, "timeout of each Sia Central API request")
+	rootCmd.PersistentFlags().StringVar(&proxyAddr, "proxy", "", "connect to hosts through a SOCKS5 proxy, e.g. socks5://127.0.0.1:9050")
+	rootCmd.PersistentFlags().BoolVar(&compactJSON, "compact", false, "write JSON reports and the contracts file without indentation")
+	rootCmd.PersistentFlags().StringVar(&indentJSON, "indent", jsonout.DefaultIndent, "indentation of JSON reports and the contracts file, \"tab\" to indent with tabs")
+	rootCmd.PersistentFlags().BoolVar(&compressContracts, "compress-contracts", false, "gzip compress the contracts file")
+	rootCmd.PersistentFlags().BoolVar(&encryptContracts, "encrypt-contracts", false, "encrypt the contracts file with a passphrase read from CONTRACTS_PASSPHRASE or prompted for")
+
+	rootCmd.AddCommand(walletCmd, contractsCmd, hostsCmd, fileCmd, cacheCmd)
+}
+
+// renterOptions returns the renter options set by the persistent flags.
+func renterOptions() []renter.Option {
+	opts := []renter.Option{
+		renter.WithCompression(compressContracts),
+		renter.WithIndent(jsonIndent()),
+		renter.WithExplorer(explorerClient()),
+		renter.WithNetwork(network.Name),
+		renter.WithHostFailureLimit(hostFailureLimit),
+	}
+	if verbose {
+		opts = append(opts, renter.WithDebugLogger(log.Default()))
+	}
+	if keepSessions {
+		opts = append(opts, renter.WithSessionRecording())
+	}
+	return opts
+}
+
+// newRenter initializes a renter using the contracts directory.
+func newRenter() (*renter.Renter, error) {
+	dir := contractsDir
+	if len(dir) == 0 {
+		dir = dataDir
+	}
+	opts := renterOptions()
+	// an encrypted file always needs the passphrase to be loaded
+	if encryptContracts || renter.ContractsEncrypted(dir) {
+		opts = append(opts, renter.WithPassphrase(contractsPassphrase()))
+	}
+	if len(proxyAddr) != 0 {
+		d, err := newProxyDialer(proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, renter.WithDialer(d))
+	}
+	r, err := renter.New(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	saveOnInterrupt(r)
+	if keepSessions {
+		sessionRenters = append(sessionRenters, r)
+	}
+	return r, nil
+}
+
+// contractsPassphrase returns the contracts file's passphrase from the
+// CONTRACTS_PASSPHRASE environment variable, prompting for it if it is not
+// set.
+func contractsPassphrase() string {
+	passphrase := os.Getenv("CONTRACTS_PASSPHRASE")
+	if len(passphrase) == 0 {
+		passphrase = prompt("Contracts passphrase:")
+	}
+	if len(passphrase) == 0 {
+		log.Fatalln("a passphrase is required to encrypt the contracts file")
+	}
+	return passphrase
+}
+
+// saveOnInterrupt saves the renter's contracts before exiting when the process
+// is interrupted, so contracts formed since the last save are not lost.
+func saveOnInterrupt(r *renter.Renter) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Println("Interrupted, saving contracts")
+		if err := r.Close(); err != nil {
+			log.Println("failed to save contracts:", err)
+		}
+		os.Exit(exitError)
+	}()
+}
+
+// jsonIndent returns the indentation of JSON output set by --compact and
+// --indent.
+func jsonIndent() string {
+	return jsonout.ParseIndent(compactJSON, indentJSON)
+}
+
+// debugf logs a debug message if --verbose is set.
+func debugf(format string, v ...interface{}) {
+	if verbose {
+		log.Printf("[DEBUG] "+format, v...)
+	}
 }
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	printSessionSummaries()
+	if err != nil {
+		var ece *exitCodeError
+		if errors.As(err, &ece) {
+			log.Println(err)
+			os.Exit(ece.code)
+		}
 		log.Fatalln(err)
 	}
 }
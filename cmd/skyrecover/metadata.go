@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/jsonout"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+// outputMetadataPath is the path recover writes the recovered file's metadata
+// sidecar to.
+var outputMetadataPath string
+
+// RecoveredFileMetadata describes a recovered file and how it was recovered,
+// so the output is self-describing when it is archived without its sia file.
+type RecoveredFileMetadata struct {
+	Source string `json:"source"`
+	Output string `json:"output"`
+
+	FileSize      uint64   `json:"fileSize"`
+	PieceSize     uint64   `json:"pieceSize"`
+	EncoderType   uint32   `json:"encoderType"`
+	DataPieces    uint32   `json:"dataPieces"`
+	ParityPieces  uint32   `json:"parityPieces"`
+	MasterKeyType string   `json:"masterKeyType"`
+	Chunks        int      `json:"chunks"`
+	Skylinks      []string `json:"skylinks"`
+
+	HostsUsed         []rhp.PublicKey `json:"hostsUsed"`
+	SectorsDownloaded int             `json:"sectorsDownloaded"`
+	CacheHits         int             `json:"cacheHits"`
+	LocalSectors      int             `json:"localSectors"`
+	Spent             types.Currency  `json:"spent"`
+	RecoveredAt       time.Time       `json:"recoveredAt"`
+	Elapsed           string          `json:"elapsed"`
+}
+
+// newRecoveredFileMetadata returns the metadata of the sia file at source
+// recovered to output.
+func newRecoveredFileMetadata(source, output string, sf siafile.SiaFile, stats *recoveryStats) RecoveredFileMetadata {
+	hosts := make([]rhp.PublicKey, 0, len(stats.hosts))
+	for host := range stats.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(hosts[i][:], hosts[j][:]) < 0
+	})
+
+	// empty lists are written as [] so consumers do not need to check for null
+	skylinks := sf.Skylinks
+	if skylinks == nil {
+		skylinks = []string{}
+	}
+	return RecoveredFileMetadata{
+		Source: source,
+		Output: output,
+
+		FileSize:      sf.FileSize,
+		PieceSize:     sf.PieceSize,
+		EncoderType:   sf.EncoderType,
+		DataPieces:    sf.DataPieces,
+		ParityPieces:  sf.ParityPieces,
+		MasterKeyType: sf.MasterKeyType,
+		Chunks:        len(sf.Chunks),
+		Skylinks:      skylinks,
+
+		HostsUsed:         hosts,
+		SectorsDownloaded: stats.sectorsDownloaded,
+		CacheHits:         stats.cacheHits,
+		LocalSectors:      stats.localSectors,
+		Spent:             stats.Spent(),
+		RecoveredAt:       time.Now().UTC(),
+		Elapsed:           time.Since(stats.start).Round(time.Second).String(),
+	}
+}
+
+// WriteFile writes the metadata to fp as JSON.
+func (rm RecoveredFileMetadata) WriteFile(fp string) error {
+	buf, err := jsonout.Marshal(rm, "", jsonIndent())
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	} else if err := os.WriteFile(fp, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"lukechampine.com/frand"
+)
+
+func TestRecoveredFileMetadata(t *testing.T) {
+	sf := siafile.SiaFile{
+		FileSize:      10 << 20,
+		PieceSize:     1 << 22,
+		EncoderType:   1,
+		DataPieces:    10,
+		ParityPieces:  20,
+		MasterKeyType: "threefish",
+		Chunks:        make([]siafile.Chunk, 1),
+	}
+	stats := newRecoveryStats(len(sf.Chunks))
+	for i := 0; i < 5; i++ {
+		var host rhp.PublicKey
+		frand.Read(host[:])
+		stats.RecordDownload(host)
+	}
+
+	fp := filepath.Join(t.TempDir(), "photos.jpeg.meta.json")
+	if err := newRecoveredFileMetadata("photos.jpeg.sia", "photos.jpeg", sf, stats).WriteFile(fp); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rm RecoveredFileMetadata
+	if err := json.Unmarshal(buf, &rm); err != nil {
+		t.Fatal(err)
+	} else if rm.FileSize != sf.FileSize || rm.DataPieces != sf.DataPieces || rm.ParityPieces != sf.ParityPieces || rm.Chunks != 1 {
+		t.Fatalf("metadata does not match the sia file: %+v", rm)
+	} else if rm.Skylinks == nil {
+		t.Fatal("expected an empty skylink list")
+	} else if rm.SectorsDownloaded != 5 || len(rm.HostsUsed) != 5 {
+		t.Fatalf("expected 5 sectors from 5 hosts, got %v from %v", rm.SectorsDownloaded, len(rm.HostsUsed))
+	}
+	for i := 1; i < len(rm.HostsUsed); i++ {
+		if bytes.Compare(rm.HostsUsed[i-1][:], rm.HostsUsed[i][:]) >= 0 {
+			t.Fatal("expected the hosts to be sorted")
+		}
+	}
+}
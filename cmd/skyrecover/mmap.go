@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A flushWriter is the destination of recovered chunks.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// errMmapUnsupported is returned by newMmapWriter on platforms without mmap.
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// An mmapWriter writes to a file through a shared memory mapping. The file is
+// sized when the writer is created and writes past the end fail.
+type mmapWriter struct {
+	f      *os.File
+	data   []byte
+	offset int64
+}
+
+// Write implements io.Writer, writing p at the current offset.
+func (w *mmapWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (w *mmapWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(w.data)) {
+		return 0, fmt.Errorf("offset %v out of range", off)
+	}
+	n := copy(w.data[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// Flush is a no-op. The mapping is synced to disk when the writer is closed.
+func (w *mmapWriter) Flush() error {
+	return nil
+}
+
+// Close syncs and unmaps the file.
+func (w *mmapWriter) Close() error {
+	if w.data != nil {
+		if err := munmapFile(w.data); err != nil {
+			w.f.Close()
+			return fmt.Errorf("failed to unmap file: %w", err)
+		}
+		w.data = nil
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	return w.f.Close()
+}
+
+// newMmapWriter creates the file at path, sizes it to size bytes, and maps it
+// into memory.
+func newMmapWriter(path string, size int64) (*mmapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	} else if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to size file: %w", err)
+	}
+
+	w := &mmapWriter{f: f}
+	// mapping an empty file fails
+	if size == 0 {
+		return w, nil
+	}
+	w.data, err = mmapFile(f, int(size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
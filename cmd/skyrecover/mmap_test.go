@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestMmapWriter(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "output")
+	data := frand.Bytes(1 << 20)
+
+	w, err := newMmapWriter(fp, int64(len(data)))
+	if errors.Is(err, errMmapUnsupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	// write the first half sequentially and the second half at an offset
+	half := len(data) / 2
+	if _, err := w.Write(data[:half]); err != nil {
+		t.Fatal(err)
+	} else if _, err := w.WriteAt(data[half:], int64(half)); err != nil {
+		t.Fatal(err)
+	} else if _, err := w.WriteAt([]byte{1}, int64(len(data))); err == nil {
+		t.Fatal("expected error writing past the end of the file")
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, data) {
+		t.Fatal("output mismatch")
+	}
+}
+
+// BenchmarkOutput compares writing recovered chunks through a memory mapping
+// to buffered writes.
+func BenchmarkOutput(b *testing.B) {
+	const (
+		fileSize  = 64 << 20
+		chunkSize = 40 << 20 // 10 data pieces
+		writeSize = 4096
+	)
+	buf := frand.Bytes(writeSize)
+
+	writeFile := func(b *testing.B, w flushWriter) {
+		for written := 0; written < fileSize; written += writeSize {
+			if _, err := w.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+			if written%chunkSize == 0 {
+				if err := w.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("mmap", func(b *testing.B) {
+		fp := filepath.Join(b.TempDir(), "output")
+		b.SetBytes(fileSize)
+		for i := 0; i < b.N; i++ {
+			w, err := newMmapWriter(fp, fileSize)
+			if errors.Is(err, errMmapUnsupported) {
+				b.Skip(err)
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			writeFile(b, w)
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("buffered", func(b *testing.B) {
+		fp := filepath.Join(b.TempDir(), "output")
+		b.SetBytes(fileSize)
+		for i := 0; i < b.N; i++ {
+			f, err := os.Create(fp)
+			if err != nil {
+				b.Fatal(err)
+			}
+			writeFile(b, bufio.NewWriterSize(f, chunkSize))
+			if err := f.Sync(); err != nil {
+				b.Fatal(err)
+			} else if err := f.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.sia.tech/skyrecover/internal/explorer"
+)
+
+var (
+	networkName = explorer.Mainnet.Name
+	network     = explorer.Mainnet
+
+	siaCentralURL     string
+	siaCentralTimeout = 30 * time.Second
+
+	// siaCentral is shared by every command so the API's connections are
+	// reused.
+	siaCentral = explorer.NewClient(network)
+)
+
+// setNetwork activates the network selected by --network. It runs before every
+// command so transactions and revisions are signed for the right chain.
+func setNetwork(cmd *cobra.Command, args []string) error {
+	n, err := explorer.LookupNetwork(networkName)
+	if err != nil {
+		return err
+	}
+	n.Activate()
+	network = n
+
+	opts := []explorer.Option{explorer.WithTimeout(siaCentralTimeout)}
+	if len(siaCentralURL) != 0 {
+		opts = append(opts, explorer.WithAddress(siaCentralURL))
+	}
+	siaCentral = explorer.NewClient(n, opts...)
+	return nil
+}
+
+// explorerClient returns the Sia Central client for the active network.
+func explorerClient() *explorer.Client {
+	return siaCentral
+}
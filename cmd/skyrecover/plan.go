@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+type (
+	// A SectorPlan is a sector that recover would download. If HostKey is
+	// nil, the sector would be fetched by fanout from all contracted hosts.
+	SectorPlan struct {
+		MerkleRoot crypto.Hash    `json:"merkleRoot"`
+		HostKey    *rhp.PublicKey `json:"hostKey,omitempty"`
+		Fanout     bool           `json:"fanout"`
+		Cost       types.Currency `json:"cost"`
+	}
+
+	// A PiecePlan lists the sectors that would be downloaded for a piece.
+	PiecePlan struct {
+		Piece   int          `json:"piece"`
+		Sectors []SectorPlan `json:"sectors"`
+	}
+
+	// A ChunkPlan lists the pieces that would be downloaded for a chunk.
+	ChunkPlan struct {
+		Chunk  int         `json:"chunk"`
+		Pieces []PiecePlan `json:"pieces"`
+	}
+
+	// A RecoveryPlan is the result of a dry run of recover.
+	RecoveryPlan struct {
+		Strategy         string          `json:"strategy"`
+		Sectors          int             `json:"sectors"`
+		FanoutSectors    int             `json:"fanoutSectors"`
+		EstimatedCost    types.Currency  `json:"estimatedCost"`
+		UnreachableHosts []rhp.PublicKey `json:"unreachableHosts,omitempty"`
+		Chunks           []ChunkPlan     `json:"chunks"`
+	}
+)
+
+// fetchHostSettings returns the settings of each contracted host. Hosts that
+// cannot be reached are returned separately.
+func fetchHostSettings(r *renter.Renter, hosts []rhp.PublicKey) (map[rhp.PublicKey]rhp.HostSettings, []rhp.PublicKey) {
+	settings := make(map[rhp.PublicKey]rhp.HostSettings)
+	var unreachable []rhp.PublicKey
+	for _, host := range hosts {
+		hs, err := func() (rhp.HostSettings, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			sess, err := r.NewSession(ctx, host)
+			if err != nil {
+				return rhp.HostSettings{}, err
+			}
+			defer sess.Close()
+			return r.HostSettings(ctx, sess)
+		}()
+		if err != nil {
+			log.Printf("[WARN] failed to get settings from host %v: %v", host, err)
+			unreachable = append(unreachable, host)
+			continue
+		}
+		settings[host] = hs
+	}
+	return settings, unreachable
+}
+
+// planRecovery walks the file's chunks in the order recover would and returns
+// the sectors that would be downloaded and their estimated cost. Only the
+// minimum number of pieces per chunk is planned. The adaptive strategy is
+// planned as listed-first since its switch depends on download results.
+func planRecovery(r *renter.Renter, sf siafile.SiaFile, minPieces int, mode string, preferParity bool) RecoveryPlan {
+	hosts := r.Hosts()
+	settings, unreachable := fetchHostSettings(r, hosts)
+
+	sectionCost := func(host rhp.PublicKey) types.Currency {
+		return rhp.RPCReadCost(settings[host], []rhp.RPCReadRequestSection{{Length: rhp.SectorSize}})
+	}
+	// a fanout download is paid for by whichever host serves the sector,
+	// estimate the cost as the most expensive reachable host
+	var fanoutCost types.Currency
+	for host := range settings {
+		if cost := sectionCost(host); cost.Cmp(fanoutCost) > 0 {
+			fanoutCost = cost
+		}
+	}
+
+	plan := RecoveryPlan{
+		Strategy:         mode,
+		UnreachableHosts: unreachable,
+	}
+	planned := make(map[crypto.Hash]bool)
+	for chunkIdx, chunk := range sf.Chunks {
+		chunkPlan := ChunkPlan{Chunk: chunkIdx}
+		for _, pieceIdx := range pieceOrder(len(chunk.Pieces), minPieces, preferParity) {
+			if len(chunkPlan.Pieces) >= minPieces {
+				break
+			} else if len(chunk.Pieces[pieceIdx]) == 0 {
+				continue
+			}
+
+			piecePlan := PiecePlan{Piece: pieceIdx}
+			for _, sector := range chunk.Pieces[pieceIdx] {
+				// sectors are only downloaded once
+				if planned[sector.MerkleRoot] {
+					continue
+				}
+				planned[sector.MerkleRoot] = true
+
+				sp := SectorPlan{MerkleRoot: sector.MerkleRoot}
+				hostKey := sector.HostKey
+				if _, ok := settings[hostKey]; ok && mode != strategyFanoutFirst {
+					sp.HostKey = &hostKey
+					sp.Cost = sectionCost(hostKey)
+				} else {
+					// the listed host is not contracted or not reachable
+					sp.Fanout = true
+					sp.Cost = fanoutCost
+					plan.FanoutSectors++
+				}
+				plan.Sectors++
+				plan.EstimatedCost = plan.EstimatedCost.Add(sp.Cost)
+				piecePlan.Sectors = append(piecePlan.Sectors, sp)
+			}
+			chunkPlan.Pieces = append(chunkPlan.Pieces, piecePlan)
+		}
+		plan.Chunks = append(plan.Chunks, chunkPlan)
+	}
+	return plan
+}
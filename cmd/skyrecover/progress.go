@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+// progressWindow is the number of recently recovered chunks the throughput,
+// ETA, and active hosts are computed from.
+const progressWindow = 10
+
+// noProgress is the recover --no-progress flag.
+var noProgress bool
+
+// A progressSample is a chunk processed by the recovery.
+type progressSample struct {
+	at    time.Time
+	bytes uint64
+	hosts map[rhp.PublicKey]bool
+}
+
+// A progressLine is a status line that is redrawn in place as chunks are
+// recovered. It implements io.Writer so log output is written above the line
+// instead of through it. A nil progressLine does nothing.
+type progressLine struct {
+	mu    sync.Mutex
+	w     io.Writer
+	total uint64
+	done  uint64
+	// samples holds the start of the window followed by up to
+	// progressWindow chunks
+	samples []progressSample
+	// hosts are the hosts that served sectors for the current chunk
+	hosts map[rhp.PublicKey]bool
+	drawn bool
+}
+
+// RecordHost records a host that served a sector for the current chunk.
+func (pl *progressLine) RecordHost(host rhp.PublicKey) {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.hosts[host] = true
+}
+
+// Chunk records a chunk of n bytes that was recovered or zero-filled and
+// redraws the line.
+func (pl *progressLine) Chunk(n uint64) {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.addChunk(n, time.Now())
+	pl.draw()
+}
+
+// addChunk adds a chunk to the window. The caller must hold pl.mu.
+func (pl *progressLine) addChunk(n uint64, now time.Time) {
+	pl.done += n
+	pl.samples = append(pl.samples, progressSample{at: now, bytes: n, hosts: pl.hosts})
+	if len(pl.samples) > progressWindow+1 {
+		pl.samples = pl.samples[len(pl.samples)-progressWindow-1:]
+	}
+	pl.hosts = make(map[rhp.PublicKey]bool)
+}
+
+// status returns the line's text. The caller must hold pl.mu.
+func (pl *progressLine) status() string {
+	percent := 100.0
+	if pl.total != 0 {
+		percent = float64(pl.done) / float64(pl.total) * 100
+	}
+
+	var windowBytes uint64
+	active := make(map[rhp.PublicKey]bool)
+	for host := range pl.hosts {
+		active[host] = true
+	}
+	for _, s := range pl.samples[1:] {
+		windowBytes += s.bytes
+		for host := range s.hosts {
+			active[host] = true
+		}
+	}
+	var rate float64
+	if elapsed := pl.samples[len(pl.samples)-1].at.Sub(pl.samples[0].at); elapsed > 0 {
+		rate = float64(windowBytes) / elapsed.Seconds()
+	}
+	eta := "--"
+	if pl.done >= pl.total {
+		eta = "0s"
+	} else if rate > 0 {
+		eta = (time.Duration(float64(pl.total-pl.done)/rate) * time.Second).Round(time.Second).String()
+	}
+	return fmt.Sprintf("Recovering: %.1f%% (%v/%v), %.2f MB/s, ETA %v, %v active hosts", percent, modules.FilesizeUnits(pl.done), modules.FilesizeUnits(pl.total), rate/1e6, eta, len(active))
+}
+
+// draw redraws the line. The caller must hold pl.mu.
+func (pl *progressLine) draw() {
+	fmt.Fprintf(pl.w, "\r%v\033[K", pl.status())
+	pl.drawn = true
+}
+
+// clear erases the line. The caller must hold pl.mu.
+func (pl *progressLine) clear() {
+	if pl.drawn {
+		io.WriteString(pl.w, "\r\033[K")
+		pl.drawn = false
+	}
+}
+
+// Write implements io.Writer. The line is erased, p is written in its place,
+// and the line is redrawn below it.
+func (pl *progressLine) Write(p []byte) (int, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	drawn := pl.drawn
+	pl.clear()
+	n, err := pl.w.Write(p)
+	if drawn {
+		pl.draw()
+	}
+	return n, err
+}
+
+// Stop erases the line and writes log output directly to stderr again.
+func (pl *progressLine) Stop() {
+	if pl == nil {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.clear()
+	log.SetOutput(os.Stderr)
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressLine(w io.Writer, total uint64) *progressLine {
+	return &progressLine{
+		w:       w,
+		total:   total,
+		samples: []progressSample{{at: time.Now()}},
+		hosts:   make(map[rhp.PublicKey]bool),
+	}
+}
+
+// startProgress shows a progress line for a recovery of total bytes on
+// stderr. It returns nil if --no-progress is set or stderr is not a terminal.
+func startProgress(total uint64) *progressLine {
+	if noProgress || !isTerminal(os.Stderr) {
+		return nil
+	}
+	pl := newProgressLine(os.Stderr, total)
+	log.SetOutput(pl)
+	return pl
+}
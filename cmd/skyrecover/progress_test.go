@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"lukechampine.com/frand"
+)
+
+func TestProgressLine(t *testing.T) {
+	const chunkSize = 1 << 20
+	var buf bytes.Buffer
+	pl := newProgressLine(&buf, 40*chunkSize)
+	start := pl.samples[0].at
+
+	var host1, host2 rhp.PublicKey
+	frand.Read(host1[:])
+	frand.Read(host2[:])
+
+	// the first chunks are slow, the last 10 take a second each
+	for i := 0; i < 20; i++ {
+		if i < 10 {
+			pl.RecordHost(host1)
+		} else {
+			pl.RecordHost(host2)
+		}
+		pl.addChunk(chunkSize, start.Add(time.Duration(100+i)*time.Second))
+	}
+	status := pl.status()
+	for _, s := range []string{"50.0%", "1.05 MB/s", "ETA 20s", "1 active hosts"} {
+		if !strings.Contains(status, s) {
+			t.Fatalf("expected %q in status %q", s, status)
+		}
+	}
+
+	// log output is written above the line once it is drawn
+	pl.Write([]byte("before\n"))
+	if buf.String() != "before\n" {
+		t.Fatalf("expected log output to be written as is, got %q", buf.String())
+	}
+	pl.draw()
+	buf.Reset()
+	pl.Write([]byte("after\n"))
+	if expected := "\r\033[Kafter\n\r" + status + "\033[K"; buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	var nilLine *progressLine
+	nilLine.RecordHost(host1)
+	nilLine.Chunk(chunkSize)
+	nilLine.Stop()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/hosttest"
+	"go.sia.tech/skyrecover/internal/renter"
+)
+
+// serveSOCKS5 handles a single unauthenticated SOCKS5 CONNECT request, dialing
+// the requested address with d.
+func serveSOCKS5(conn net.Conn, d renter.Dialer) error {
+	defer conn.Close()
+
+	// greeting: version, methods
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	} else if _, err := io.ReadFull(conn, make([]byte, hdr[1])); err != nil {
+		return err
+	} else if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+
+	// request: version, command, reserved, address type
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return err
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return err
+		}
+		host = string(name)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	target, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	go io.Copy(target, conn)
+	_, err = io.Copy(conn, target)
+	return err
+}
+
+func TestProxyDownload(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var proxied int
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			proxied++
+			go serveSOCKS5(conn, network)
+		}
+	}()
+
+	d, err := newProxyDialer("socks5://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := renter.New(t.TempDir(), renter.WithExplorer(network), renter.WithDialer(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sector := randomSector()
+	root := host.AddSector(sector)
+	buf, err := downloadSector(r, host.PublicKey(), crypto.Hash(root))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("sector data mismatch")
+	} else if proxied != 2 {
+		t.Fatalf("expected 2 proxied connections, got %v", proxied)
+	}
+
+	if _, err := newProxyDialer("http://127.0.0.1:8080"); err == nil {
+		t.Fatal("expected error for unsupported scheme")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"go.sia.tech/skyrecover/internal/jsonout"
+)
+
+type (
+	// A ByteRange is the half-open range [Start, End) of the output file.
+	ByteRange struct {
+		Start uint64 `json:"start"`
+		End   uint64 `json:"end"`
+	}
+
+	// RecoveredRanges lists the byte ranges of a best-effort output file that
+	// were recovered and the ranges that were zero-filled because their chunk
+	// could not be recovered.
+	RecoveredRanges struct {
+		FileSize   uint64      `json:"fileSize"`
+		Recovered  []ByteRange `json:"recovered"`
+		ZeroFilled []ByteRange `json:"zeroFilled"`
+	}
+)
+
+var (
+	continueOnError bool
+	rangesPath      string
+)
+
+// outputRangesPath returns the path the ranges of a best-effort recovery to
+// outputPath are written to, or an empty string if they are not written.
+func outputRangesPath(outputPath string) string {
+	switch {
+	case len(rangesPath) != 0:
+		return rangesPath
+	case continueOnError && outputPath != "-":
+		return outputPath + ".ranges.json"
+	}
+	return ""
+}
+
+// appendRange appends [start, end) to ranges, extending the last range if they
+// are adjacent.
+func appendRange(ranges []ByteRange, start, end uint64) []ByteRange {
+	if n := len(ranges); n != 0 && ranges[n-1].End == start {
+		ranges[n-1].End = end
+		return ranges
+	}
+	return append(ranges, ByteRange{Start: start, End: end})
+}
+
+// Add records the result of the chunk covering [start, end).
+func (rr *RecoveredRanges) Add(start, end uint64, recovered bool) {
+	if recovered {
+		rr.Recovered = appendRange(rr.Recovered, start, end)
+	} else {
+		rr.ZeroFilled = appendRange(rr.ZeroFilled, start, end)
+	}
+}
+
+// WriteFile writes the ranges to fp as JSON.
+func (rr *RecoveredRanges) WriteFile(fp string) error {
+	// empty lists are written as [] so consumers do not need to check for null
+	if rr.Recovered == nil {
+		rr.Recovered = []ByteRange{}
+	}
+	if rr.ZeroFilled == nil {
+		rr.ZeroFilled = []ByteRange{}
+	}
+	buf, err := jsonout.Marshal(rr, "", jsonIndent())
+	if err != nil {
+		return fmt.Errorf("failed to encode ranges: %w", err)
+	} else if err := os.WriteFile(fp, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write ranges: %w", err)
+	}
+	return nil
+}
@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
 	"go.sia.tech/skyrecover/internal/renter"
 	"go.sia.tech/skyrecover/internal/rhp/v2"
 )
 
 type (
+	// work is a host to check for a sector. The result is sent on results.
 	work struct {
+		ctx        context.Context
 		SectorRoot crypto.Hash
 		HostKey    rhp.PublicKey
+		results    chan<- result
 	}
 
 	result struct {
@@ -23,85 +31,493 @@ type (
 		Err        error
 		Data       []byte
 	}
+
+	// A downloadStrategy decides whether a sector should be downloaded from
+	// the host listed in the sia file or from all contracted hosts.
+	downloadStrategy struct {
+		mode     string
+		switched bool
+
+		attempts int
+		failures int
+	}
+
+	// hostStats is the scheduling state of a host.
+	hostStats struct {
+		successes int
+		failures  int
+		// avgTime is the moving average of the host's successful download
+		// times
+		avgTime time.Duration
+	}
+
+	// A Recoverer downloads sectors from the renter's hosts. Its pool of
+	// workers and the performance of each host are kept for the whole
+	// recovery, so hosts that have been fast are checked first and slow or
+	// failing hosts are not checked first for every sector.
+	Recoverer struct {
+		r    *renter.Renter
+		work chan work
+		wg   sync.WaitGroup
+
+		mu    sync.Mutex
+		hosts map[rhp.PublicKey]*hostStats
+
+		// sectorCost is the cost of reading a sector from each host, nil
+		// unless --cost-aware is set
+		sectorCost map[rhp.PublicKey]types.Currency
+		// costPaid and costBaseline are the estimated cost of the sectors
+		// fetched with cost-aware ordering and of the same sectors at the
+		// average price of the hosts that were checked
+		costPaid     types.Currency
+		costBaseline types.Currency
+	}
+
+	// A sectorCache holds the sectors recovered so far so sectors shared by
+	// several pieces are only downloaded once.
+	sectorCache map[crypto.Hash][]byte
+)
+
+// errSectorRootMismatch is returned when a sector's data does not match the
+// Merkle root the piece expects.
+var errSectorRootMismatch = errors.New("sector data does not match the expected merkle root")
+
+// Add adds a sector under the Merkle root it was verified against when it was
+// downloaded or loaded. The data is not hashed again when it is reused.
+func (sc sectorCache) Add(root crypto.Hash, data []byte) {
+	sc[root] = data
+}
+
+// Has returns true if the sector is in the cache.
+func (sc sectorCache) Has(root crypto.Hash) bool {
+	_, ok := sc[root]
+	return ok
+}
+
+// Get returns the cached data of the sector a piece expects.
+func (sc sectorCache) Get(expected crypto.Hash) ([]byte, bool) {
+	data, ok := sc[expected]
+	return data, ok
+}
+
+// checkSectorRoot checks that a sector, verified against the root verified
+// when it was downloaded or loaded, is the sector a piece expects. Sectors are
+// hashed once where they enter the recovery, by the session's SectorVerifier
+// or when they are loaded from disk, so the data is not hashed again here.
+func checkSectorRoot(expected, verified crypto.Hash, data []byte) error {
+	if len(data) != rhp.SectorSize {
+		return fmt.Errorf("sector %v has %v bytes: %w", expected, len(data), errSectorRootMismatch)
+	} else if verified != expected {
+		return fmt.Errorf("sector %v was verified against root %v: %w", expected, verified, errSectorRootMismatch)
+	}
+	return nil
+}
+
+const (
+	// strategyListedFirst tries the listed host before checking all
+	// contracted hosts.
+	strategyListedFirst = "listed-first"
+	// strategyFanoutFirst skips the listed host and checks all contracted
+	// hosts.
+	strategyFanoutFirst = "fanout-first"
+	// strategyAdaptive tries the listed host until the listed hosts' failure
+	// rate exceeds adaptiveFailureRate.
+	strategyAdaptive = "adaptive"
+
+	// adaptiveMinAttempts is the number of listed host downloads required
+	// before the adaptive strategy considers the failure rate.
+	adaptiveMinAttempts = 10
+	// adaptiveFailureRate is the listed host failure rate at which the
+	// adaptive strategy switches to fanout.
+	adaptiveFailureRate = 0.5
+
+	// chunkRetryDelay is the delay before a chunk that could not be recovered
+	// is retried.
+	chunkRetryDelay = 30 * time.Second
+
+	// costAwareHosts is the number of hosts checked for a sector at once with
+	// --cost-aware. The cheapest hosts are checked first and a more expensive
+	// host is only checked once a cheaper one has failed.
+	costAwareHosts = 2
 )
 
 var (
-	workers int
+	workers           int
+	chunkRetries      int
+	contractHostLimit int
+	costAware         bool
+	// hostFailureLimit is the number of consecutive failed reads after
+	// which a host is no longer checked, 0 for no limit.
+	hostFailureLimit int
+	// notFoundRetryDelay is how long to wait before checking hosts that
+	// reported a sector as not found again. Zero disables the retry.
+	notFoundRetryDelay time.Duration
 )
 
-func downloadWorker(ctx context.Context, r *renter.Renter, workChan <-chan work, resultsChan chan<- result) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case piece, ok := <-workChan:
-			if !ok {
-				return // work chan is closed and empty, stop the worker
-			}
-			buf, err := downloadSector(r, piece.HostKey, piece.SectorRoot)
-			resultsChan <- result{
-				SectorRoot: piece.SectorRoot,
-				HostKey:    piece.HostKey,
-				Err:        err,
-				Data:       buf,
-			}
+// UseListedHost returns true if the sector should be downloaded from the host
+// listed in the sia file first.
+func (ds *downloadStrategy) UseListedHost() bool {
+	switch ds.mode {
+	case strategyFanoutFirst:
+		return false
+	case strategyAdaptive:
+		if ds.switched {
+			return false
+		} else if ds.attempts < adaptiveMinAttempts || float64(ds.failures)/float64(ds.attempts) < adaptiveFailureRate {
+			return true
 		}
+		ds.switched = true
+		log.Printf("[WARN] %v/%v downloads from listed hosts failed, switching to fanout", ds.failures, ds.attempts)
+		return false
+	default:
+		return true
 	}
+}
 
+// Record records the result of a download from a listed host.
+func (ds *downloadStrategy) Record(err error) {
+	ds.attempts++
+	if err != nil {
+		ds.failures++
+	}
 }
 
-func recoverSector(ctx context.Context, r *renter.Renter, sector crypto.Hash, workers int) ([]byte, bool) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+func newDownloadStrategy(mode string) (*downloadStrategy, error) {
+	switch mode {
+	case strategyListedFirst, strategyFanoutFirst, strategyAdaptive:
+		return &downloadStrategy{mode: mode}, nil
+	default:
+		return nil, fmt.Errorf("unknown download strategy %q", mode)
+	}
+}
+
+// pieceOrder returns the order in which a chunk's pieces should be
+// downloaded. If preferParity is true, parity pieces are downloaded before data
+// pieces so the chunk must be reconstructed from parity.
+func pieceOrder(numPieces, minPieces int, preferParity bool) []int {
+	order := make([]int, 0, numPieces)
+	if preferParity {
+		for i := minPieces; i < numPieces; i++ {
+			order = append(order, i)
+		}
+		for i := 0; i < minPieces; i++ {
+			order = append(order, i)
+		}
+		return order
+	}
+	for i := 0; i < numPieces; i++ {
+		order = append(order, i)
+	}
+	return order
+}
 
-	workChan := make(chan work, workers)
-	resultsChan := make(chan result, workers)
+// slowHostTime is the average download time above which a host is scheduled
+// after the hosts that have not been tried yet.
+const slowHostTime = 30 * time.Second
 
-	var wg sync.WaitGroup
-	wg.Add(workers)
+// newRecoverer starts a pool of workers downloading sectors from the renter's
+// hosts. Close must be called to stop the workers.
+func newRecoverer(r *renter.Renter, workers int) *Recoverer {
+	if workers < 1 {
+		workers = 1
+	}
+	rc := &Recoverer{
+		r:     r,
+		work:  make(chan work),
+		hosts: make(map[rhp.PublicKey]*hostStats),
+	}
+	rc.wg.Add(workers)
 	for i := 0; i < workers; i++ {
-		go func() {
-			downloadWorker(ctx, r, workChan, resultsChan)
-			wg.Done()
-		}()
+		go rc.worker()
 	}
+	return rc
+}
 
-	go func() {
-		wg.Wait()          // wait for all workers to finish
-		close(resultsChan) // close the results chan to signal to break out of the loop
-	}()
+// Close stops the workers. It must not be called while a sector is being
+// fetched.
+func (rc *Recoverer) Close() {
+	close(rc.work)
+	rc.wg.Wait()
+}
+
+func (rc *Recoverer) worker() {
+	defer rc.wg.Done()
+	for w := range rc.work {
+		res := result{
+			SectorRoot: w.SectorRoot,
+			HostKey:    w.HostKey,
+		}
+		// the sector may have been found since the work was queued
+		if err := w.ctx.Err(); err != nil {
+			res.Err = err
+		} else {
+			start := time.Now()
+			res.Data, res.Err = downloadSector(rc.r, w.HostKey, w.SectorRoot)
+			rc.record(w.HostKey, time.Since(start), res.Err)
+		}
+		w.results <- res
+	}
+}
+
+// record updates the host's scheduling state with the result of a download.
+// A host that does not have the sector is neither penalized nor rewarded.
+func (rc *Recoverer) record(host rhp.PublicKey, elapsed time.Duration, err error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	hs, ok := rc.hosts[host]
+	if !ok {
+		hs = new(hostStats)
+		rc.hosts[host] = hs
+	}
+	switch {
+	case err == nil:
+		if hs.successes == 0 {
+			hs.avgTime = elapsed
+		} else {
+			hs.avgTime = (hs.avgTime*3 + elapsed) / 4
+		}
+		hs.successes++
+	case strings.Contains(err.Error(), "could not find the desired sector"):
+	default:
+		hs.failures++
+	}
+}
+
+// rank returns the scheduling class of a host: hosts that have served sectors
+// quickly first, then hosts that have not been tried, then slow hosts, then
+// hosts that fail more often than they succeed.
+func (hs *hostStats) rank() int {
+	switch {
+	case hs == nil || (hs.successes == 0 && hs.failures == 0):
+		return 1
+	case hs.failures > hs.successes:
+		return 3
+	case hs.avgTime > slowHostTime:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// schedule returns the hosts in the order they should be checked for a
+// sector. Hosts of the same class keep their order, except that hosts that
+// have served sectors are ordered by their average download time.
+func (rc *Recoverer) schedule(hosts []rhp.PublicKey) []rhp.PublicKey {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	scheduled := append([]rhp.PublicKey(nil), hosts...)
+	sort.SliceStable(scheduled, func(i, j int) bool {
+		a, b := rc.hosts[scheduled[i]], rc.hosts[scheduled[j]]
+		if ra, rb := a.rank(), b.rank(); ra != rb {
+			return ra < rb
+		} else if ra == 0 || ra == 2 {
+			return a.avgTime < b.avgTime
+		}
+		return false
+	})
+	return scheduled
+}
 
+// RecoverSector checks the sector's hinted hosts, then all contracted hosts
+// for a sector. Hosts in missing are skipped and hosts that do not have the
+// sector are added to missing. If hostLimit is greater than zero, at most
+// hostLimit hosts are checked, preferring the hosts scheduled first. If
+// notFoundRetryDelay is set, hosts that report the sector as not found are
+// checked once more after the delay.
+func (rc *Recoverer) RecoverSector(ctx context.Context, sector crypto.Hash, hostLimit int, missing map[rhp.PublicKey]bool) ([]byte, rhp.PublicKey, bool) {
+	// check the hinted hosts before the blanket fanout. The hosts that do not
+	// have the sector are skipped by the fanout.
+	if len(sectorHints[sector]) != 0 {
+		if missing == nil {
+			missing = make(map[rhp.PublicKey]bool)
+		}
+		if buf, host, ok := rc.recoverHintedSector(ctx, sector, missing); ok {
+			return buf, host, true
+		}
+	}
+
+	var availableHosts []rhp.PublicKey
+	for _, host := range rc.r.Hosts() {
+		if !missing[host] {
+			availableHosts = append(availableHosts, host)
+		}
+	}
+	availableHosts = rc.schedule(availableHosts)
+	if hostLimit > 0 && len(availableHosts) > hostLimit {
+		availableHosts = availableHosts[:hostLimit]
+	}
+
+	log.Printf("Checking %v hosts for sector %v", len(availableHosts), sector.String())
+	buf, host, notFound, ok := rc.FetchSector(ctx, sector, availableHosts, missing)
+	if ok || notFoundRetryDelay <= 0 || len(notFound) == 0 {
+		return buf, host, ok
+	}
+
+	// some hosts briefly report a sector as missing, e.g. during maintenance
+	log.Printf("%v hosts did not have sector %v, checking them again in %v", len(notFound), sector, notFoundRetryDelay)
+	select {
+	case <-ctx.Done():
+		return nil, rhp.PublicKey{}, false
+	case <-time.After(notFoundRetryDelay):
+	}
+	for _, host := range notFound {
+		delete(missing, host)
+	}
+	buf, host, _, ok = rc.FetchSector(ctx, sector, notFound, missing)
+	return buf, host, ok
+}
+
+// enableCostAware gets the settings of the renter's hosts and enables
+// cost-aware ordering on the recoverer.
+func enableCostAware(r *renter.Renter, rc *Recoverer) {
+	log.Println("Getting host prices for --cost-aware")
+	settings, _ := fetchHostSettings(r, r.Hosts())
+	rc.SetHostPrices(settings)
+}
+
+// SetHostPrices enables cost-aware ordering using the hosts' settings. Hosts
+// without settings are checked after the hosts with known prices.
+func (rc *Recoverer) SetHostPrices(settings map[rhp.PublicKey]rhp.HostSettings) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.sectorCost = make(map[rhp.PublicKey]types.Currency, len(settings))
+	for host, hs := range settings {
+		rc.sectorCost[host] = rhp.RPCReadCost(hs, []rhp.RPCReadRequestSection{{Length: rhp.SectorSize}})
+	}
+}
+
+// orderByCost returns the hosts ordered by the cost of reading a sector,
+// cheapest first. Hosts of equal cost keep their order and hosts without a
+// known price are checked last.
+func (rc *Recoverer) orderByCost(hosts []rhp.PublicKey) []rhp.PublicKey {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	ordered := append([]rhp.PublicKey(nil), hosts...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, aok := rc.sectorCost[ordered[i]]
+		b, bok := rc.sectorCost[ordered[j]]
+		if aok != bok {
+			return aok
+		}
+		return a.Cmp(b) < 0
+	})
+	return ordered
+}
+
+// recordCost adds the cost of a sector fetched from host to the cost paid and
+// the average price of the checked hosts to the baseline. Sectors fetched from
+// hosts without a known price are not counted.
+func (rc *Recoverer) recordCost(host rhp.PublicKey, hosts []rhp.PublicKey) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	paid, ok := rc.sectorCost[host]
+	if !ok {
+		return
+	}
+	var total types.Currency
+	var n uint64
+	for _, h := range hosts {
+		if cost, ok := rc.sectorCost[h]; ok {
+			total = total.Add(cost)
+			n++
+		}
+	}
+	rc.costPaid = rc.costPaid.Add(paid)
+	rc.costBaseline = rc.costBaseline.Add(total.Div64(n))
+}
+
+// PrintCostSavings logs the estimated cost saved by cost-aware ordering.
+func (rc *Recoverer) PrintCostSavings() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.sectorCost == nil {
+		return
+	} else if rc.costPaid.Cmp(rc.costBaseline) >= 0 {
+		log.Printf("Cost-aware host selection: paid an estimated %v, no less than the average host price", rc.costPaid.HumanString())
+		return
+	}
+	log.Printf("Cost-aware host selection: paid an estimated %v, %v less than the average host price (%v)", rc.costPaid.HumanString(), rc.costBaseline.Sub(rc.costPaid).HumanString(), rc.costBaseline.HumanString())
+}
+
+// FetchSector checks the hosts for a sector in scheduling order using the
+// recoverer's workers. With --cost-aware, the cheapest hosts are checked
+// first and only costAwareHosts hosts are checked at once. Hosts that do not
+// have the sector are added to missing and returned in notFound.
+func (rc *Recoverer) FetchSector(ctx context.Context, sector crypto.Hash, hosts []rhp.PublicKey, missing map[rhp.PublicKey]bool) (_ []byte, _ rhp.PublicKey, notFound []rhp.PublicKey, _ bool) {
+	hosts = rc.schedule(hosts)
+	rc.mu.Lock()
+	costAware := rc.sectorCost != nil
+	rc.mu.Unlock()
+	// slots limits the hosts checked at once, nil for no limit
+	var slots chan struct{}
+	if costAware {
+		hosts = rc.orderByCost(hosts)
+		slots = make(chan struct{}, costAwareHosts)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	// every queued host sends exactly one result, the buffer ensures workers
+	// never block on a sector that has already been found
+	results := make(chan result, len(hosts))
+	queued := make(chan struct{})
 	go func() {
-		availableHosts := r.Hosts()
-		log.Printf("Checking %v hosts for sector %v", len(availableHosts), sector.String())
-		for _, host := range availableHosts {
+		defer close(queued)
+		for _, host := range hosts {
+			if slots != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case slots <- struct{}{}:
+				}
+			}
 			select {
 			case <-ctx.Done():
 				return
-			default:
-			}
-			workChan <- work{
-				SectorRoot: sector,
-				HostKey:    host,
+			case rc.work <- work{ctx: ctx, SectorRoot: sector, HostKey: host, results: results}:
 			}
 		}
-		// close the work chan to signal that no more hosts are available
-		close(workChan)
+	}()
+	// wait for the queueing goroutine so no work is sent after Close
+	defer func() {
+		cancel()
+		<-queued
 	}()
 
-	for result := range resultsChan {
+	for range hosts {
+		var result result
+		select {
+		case <-ctx.Done():
+			return nil, rhp.PublicKey{}, notFound, false
+		case result = <-results:
+		}
+
 		switch {
 		case result.Err == nil: // sector has been recovered
-			// cancel the context to stop the workers
-			cancel()
-			return result.Data, true
+			if costAware {
+				rc.recordCost(result.HostKey, hosts)
+			}
+			return result.Data, result.HostKey, notFound, true
 		case strings.Contains(result.Err.Error(), "could not find the desired sector"): // host does not have the sector, try another host
-			continue
+			if missing != nil {
+				missing[result.HostKey] = true
+			}
+			notFound = append(notFound, result.HostKey)
 		case strings.Contains(result.Err.Error(), "no record of that contract"): // sync issue -- host is missing contract, remove host from available hosts
+			if missing != nil {
+				missing[result.HostKey] = true
+			}
 			// remove the host from the list of available hosts
-			r.RemoveHostContract(result.HostKey)
+			rc.r.RemoveHostContract(result.HostKey)
 			log.Printf("[WARN] removed host %v from available hosts: contract not found -- form new contract", result.HostKey)
+		case errors.Is(result.Err, rhp.ErrHostKeyMismatch): // the host's key changed, retrying will not help
+			if missing != nil {
+				missing[result.HostKey] = true
+			}
+			log.Printf("[WARN] host %v failed key verification, it may have been reinstalled or the connection intercepted: %v", result.HostKey, result.Err)
+		}
+		// the host failed, check the next one
+		if slots != nil {
+			<-slots
 		}
 	}
-	return nil, false
+	return nil, rhp.PublicKey{}, notFound, false
 }
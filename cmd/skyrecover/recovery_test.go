@@ -0,0 +1,950 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/hosttest"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"go.sia.tech/skyrecover/internal/wallet"
+	"lukechampine.com/frand"
+)
+
+// testWallet is a renter.Wallet that does not fund or sign transactions. The
+// in-process hosts do not validate the formation transaction.
+type testWallet struct{}
+
+func (testWallet) Address() types.UnlockHash { return types.UnlockHash{} }
+
+func (testWallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	return nil, func() {}, nil
+}
+
+func (testWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash, cf types.CoveredFields) error {
+	return nil
+}
+
+// newTestRenter returns a renter with contracts formed with each host.
+func newTestRenter(t testing.TB, network *hosttest.Network, hosts ...*hosttest.Host) *renter.Renter {
+	t.Helper()
+
+	r, err := renter.New(t.TempDir(), renter.WithExplorer(network), renter.WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	for _, h := range hosts {
+		if _, err := r.FormDownloadContract(h.PublicKey(), 1<<30, 144, testWallet{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// testRecoverer returns a Recoverer that is closed when the test ends.
+func testRecoverer(t testing.TB, r *renter.Renter, workers int) *Recoverer {
+	rc := newRecoverer(r, workers)
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+// testRecoverSector recovers a sector with a new Recoverer.
+func testRecoverSector(t testing.TB, r *renter.Renter, sector crypto.Hash, workers, hostLimit int, missing map[rhp.PublicKey]bool) ([]byte, rhp.PublicKey, bool) {
+	return testRecoverer(t, r, workers).RecoverSector(context.Background(), sector, hostLimit, missing)
+}
+
+func randomSector() *[rhp.SectorSize]byte {
+	var sector [rhp.SectorSize]byte
+	frand.Read(sector[:])
+	return &sector
+}
+
+func BenchmarkDownloadSector(b *testing.B) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+	r := newTestRenter(b, network, host)
+	root := crypto.Hash(host.AddSector(randomSector()))
+
+	b.ReportAllocs()
+	b.SetBytes(rhp.SectorSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := downloadSector(r, host.PublicKey(), root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCheckSector(b *testing.B) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+	r := newTestRenter(b, network, host)
+	root := crypto.Hash(host.AddSector(randomSector()))
+
+	b.ReportAllocs()
+	b.SetBytes(rhp.SectorSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ok, err := checkSector(r, host.PublicKey(), root); err != nil {
+			b.Fatal(err)
+		} else if !ok {
+			b.Fatal("expected sector to be available")
+		}
+	}
+}
+
+func TestDownloadSector(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+	r := newTestRenter(t, network, host)
+
+	sector := randomSector()
+	root := crypto.Hash(host.AddSector(sector))
+
+	buf, err := downloadSector(r, host.PublicKey(), root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("sector data mismatch")
+	}
+
+	if ok, err := checkSector(r, host.PublicKey(), root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected sector to be available")
+	}
+
+	host.DeleteSector(rhp.Hash256(root))
+	if _, err := downloadSector(r, host.PublicKey(), root); err == nil || !strings.Contains(err.Error(), hosttest.ErrSectorNotFound.Error()) {
+		t.Fatalf("expected %q, got %v", hosttest.ErrSectorNotFound, err)
+	} else if ok, err := checkSector(r, host.PublicKey(), root); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected sector to be missing")
+	}
+
+	host.DeleteContracts()
+	if _, err := downloadSector(r, host.PublicKey(), root); err == nil || !strings.Contains(err.Error(), hosttest.ErrContractNotFound.Error()) {
+		t.Fatalf("expected %q, got %v", hosttest.ErrContractNotFound, err)
+	}
+}
+
+func TestRecoverSector(t *testing.T) {
+	network := hosttest.NewNetwork()
+	noSector, noContract, good := network.AddHost(), network.AddHost(), network.AddHost()
+	r := newTestRenter(t, network, noSector, noContract, good)
+
+	sector := randomSector()
+	root := crypto.Hash(noContract.AddSector(sector))
+	good.AddSector(sector)
+	noContract.DeleteContracts()
+
+	// skipping the good host, recovery should fail and both failing hosts
+	// should be marked missing
+	missing := map[rhp.PublicKey]bool{good.PublicKey(): true}
+	if _, _, ok := testRecoverSector(t, r, root, 3, 0, missing); ok {
+		t.Fatal("expected recovery to fail")
+	} else if !missing[noSector.PublicKey()] || !missing[noContract.PublicKey()] {
+		t.Fatalf("expected failing hosts to be marked missing, got %v", missing)
+	}
+
+	// the host without a contract should be removed from the renter
+	if _, err := r.HostContract(noContract.PublicKey()); !errors.Is(err, renter.ErrNoContract) {
+		t.Fatalf("expected %v, got %v", renter.ErrNoContract, err)
+	} else if _, err := r.HostContract(noSector.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, _, ok := testRecoverSector(t, r, root, 3, 0, make(map[rhp.PublicKey]bool))
+	if !ok {
+		t.Fatal("expected sector to be recovered")
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("sector data mismatch")
+	}
+}
+
+func TestLoadLocalSector(t *testing.T) {
+	dir := t.TempDir()
+	sector := randomSector()
+	root := crypto.Hash(rhp.SectorRoot(sector))
+
+	if _, err := loadLocalSector(dir, root); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, root.String()), sector[:], 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := loadLocalSector(dir, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("sector data mismatch")
+	}
+
+	// corrupt the archived sector
+	sector[0] ^= 1
+	if err := os.WriteFile(filepath.Join(dir, root.String()), sector[:], 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := loadLocalSector(dir, root); err == nil {
+		t.Fatal("expected error for corrupt sector")
+	}
+}
+
+func TestCheckSectors(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+	r := newTestRenter(t, network, host)
+
+	sectors := make([]crypto.Hash, 20)
+	for i := range sectors {
+		sectors[i] = crypto.Hash(host.AddSector(randomSector()))
+	}
+
+	// a healthy host is probed in batches
+	available, rpcs := checkSectors(r, host.PublicKey(), sectors, 8)
+	for i := range available {
+		if !available[i] {
+			t.Fatalf("expected sector %v to be available", i)
+		}
+	}
+	if rpcs != 3 {
+		t.Fatalf("expected 3 read RPCs, got %v", rpcs)
+	}
+
+	// a missing sector falls back to checking its batch individually
+	host.DeleteSector(rhp.Hash256(sectors[10]))
+	available, rpcs = checkSectors(r, host.PublicKey(), sectors, 8)
+	for i := range available {
+		if available[i] != (i != 10) {
+			t.Fatalf("sector %v: expected available %v, got %v", i, i != 10, available[i])
+		}
+	}
+	if rpcs != 3+8 {
+		t.Fatalf("expected 11 read RPCs, got %v", rpcs)
+	}
+}
+
+func TestPlanRecovery(t *testing.T) {
+	network := hosttest.NewNetwork()
+	contracted := network.AddHost()
+	uncontracted := network.AddHost()
+	r := newTestRenter(t, network, contracted)
+
+	root := func() crypto.Hash { return crypto.Hash(frand.Entropy256()) }
+	shared := root()
+	sf := siafile.SiaFile{
+		Chunks: []siafile.Chunk{
+			{Pieces: [][]siafile.Piece{
+				{{MerkleRoot: shared, HostKey: contracted.PublicKey()}},
+				{{MerkleRoot: root(), HostKey: contracted.PublicKey()}},
+				{{MerkleRoot: root(), HostKey: contracted.PublicKey()}},
+			}},
+			{Pieces: [][]siafile.Piece{
+				{{MerkleRoot: shared, HostKey: contracted.PublicKey()}},
+				{{MerkleRoot: root(), HostKey: uncontracted.PublicKey()}},
+				{{MerkleRoot: root(), HostKey: contracted.PublicKey()}},
+			}},
+		},
+	}
+
+	plan := planRecovery(r, sf, 2, strategyListedFirst, false)
+	// the shared sector is only downloaded once
+	if plan.Sectors != 3 {
+		t.Fatalf("expected 3 sectors, got %v", plan.Sectors)
+	} else if plan.FanoutSectors != 1 {
+		t.Fatalf("expected 1 fanout sector, got %v", plan.FanoutSectors)
+	} else if sp := plan.Chunks[1].Pieces[1].Sectors[0]; !sp.Fanout || sp.HostKey != nil {
+		t.Fatal("expected the uncontracted host's sector to use fanout")
+	} else if plan.EstimatedCost.IsZero() {
+		t.Fatal("expected non-zero cost")
+	}
+
+	plan = planRecovery(r, sf, 2, strategyFanoutFirst, true)
+	if plan.FanoutSectors != plan.Sectors {
+		t.Fatalf("expected all %v sectors to use fanout, got %v", plan.Sectors, plan.FanoutSectors)
+	} else if plan.Chunks[0].Pieces[0].Piece != 2 {
+		t.Fatalf("expected parity piece first, got %v", plan.Chunks[0].Pieces[0].Piece)
+	}
+}
+
+func TestRehostChunks(t *testing.T) {
+	hostA, hostB, hostC := rhp.PublicKey{1}, rhp.PublicKey{2}, rhp.PublicKey{3}
+	found, lost := crypto.Hash{1}, crypto.Hash{2}
+	sf := siafile.SiaFile{
+		Chunks: []siafile.Chunk{
+			{Pieces: [][]siafile.Piece{
+				{{MerkleRoot: found, HostKey: hostA}},
+				{{MerkleRoot: lost, HostKey: hostA}, {MerkleRoot: lost, HostKey: hostB}},
+			}},
+		},
+	}
+
+	chunks, unlocated := rehostChunks(sf, map[crypto.Hash][]rhp.PublicKey{
+		found: {hostB, hostC},
+	})
+	expected := [][]siafile.Piece{
+		{{MerkleRoot: found, HostKey: hostB}, {MerkleRoot: found, HostKey: hostC}},
+		{{MerkleRoot: lost, HostKey: hostA}, {MerkleRoot: lost, HostKey: hostB}},
+	}
+	if !reflect.DeepEqual(chunks[0].Pieces, expected) {
+		t.Fatalf("expected %v, got %v", expected, chunks[0].Pieces)
+	} else if len(unlocated) != 1 || unlocated[0] != lost {
+		t.Fatalf("expected %v to be unlocated, got %v", lost, unlocated)
+	}
+}
+
+func TestHostUsefulness(t *testing.T) {
+	hosts := make([]rhp.PublicKey, 3)
+	for i := range hosts {
+		hosts[i] = rhp.PublicKey(frand.Entropy256())
+	}
+	roots := []crypto.Hash{frand.Entropy256(), frand.Entropy256(), frand.Entropy256()}
+	availability := map[crypto.Hash][]rhp.PublicKey{
+		roots[0]: {hosts[1], hosts[2]},
+		roots[1]: {hosts[2]},
+		roots[2]: {hosts[2]},
+	}
+
+	expected := []HostUsefulness{
+		{HostKey: hosts[2], Sectors: 3},
+		{HostKey: hosts[1], Sectors: 1},
+		{HostKey: hosts[0], Sectors: 0},
+	}
+	if usefulness := hostUsefulness(hosts, availability); !reflect.DeepEqual(usefulness, expected) {
+		t.Fatalf("expected %v, got %v", expected, usefulness)
+	}
+}
+
+func TestRecoverSectorAutoContract(t *testing.T) {
+	network := hosttest.NewNetwork()
+	contracted := network.AddHost()
+	uncontracted := network.AddHost()
+	r := newTestRenter(t, network, contracted)
+	root := crypto.Hash(uncontracted.AddSector(randomSector()))
+
+	// without auto-contract the sector cannot be found
+	if _, _, ok := recoverSectorAutoContract(context.Background(), testRecoverer(t, r, 2), nil, root, 0, nil); ok {
+		t.Fatal("expected sector to be unrecoverable")
+	}
+
+	// the limit prevents forming contracts
+	missing := make(map[rhp.PublicKey]bool)
+	if _, _, ok := recoverSectorAutoContract(context.Background(), testRecoverer(t, r, 2), newAutoContractor(r, testWallet{}, 0), root, 0, missing); ok {
+		t.Fatal("expected sector to be unrecoverable")
+	} else if !missing[contracted.PublicKey()] {
+		t.Fatal("expected contracted host to be marked missing")
+	}
+
+	buf, host, ok := recoverSectorAutoContract(context.Background(), testRecoverer(t, r, 2), newAutoContractor(r, testWallet{}, 1), root, 0, missing)
+	if !ok {
+		t.Fatal("expected sector to be recovered")
+	} else if host != uncontracted.PublicKey() {
+		t.Fatalf("expected sector from %v, got %v", uncontracted.PublicKey(), host)
+	} else if crypto.Hash(rhp.SectorRoot((*[rhp.SectorSize]byte)(buf))) != root {
+		t.Fatal("sector data mismatch")
+	} else if _, err := r.HostContract(uncontracted.PublicKey()); err != nil {
+		t.Fatal("expected a contract with the uncontracted host:", err)
+	}
+}
+
+// brokeWallet is a renter.Wallet without funds. It counts the transactions
+// it was asked to fund.
+type brokeWallet struct {
+	testWallet
+	attempts *int
+}
+
+func (bw brokeWallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	*bw.attempts++
+	return nil, nil, &wallet.InsufficientFundsError{Required: amount}
+}
+
+func TestAutoContractOutOfFunds(t *testing.T) {
+	network := hosttest.NewNetwork()
+	for i := 0; i < 3; i++ {
+		network.AddHost()
+	}
+	r := newTestRenter(t, network)
+
+	// once the wallet is out of funds, no other hosts are tried
+	var attempts int
+	ac := newAutoContractor(r, brokeWallet{attempts: &attempts}, 3)
+	if formed := ac.FormBatch(); len(formed) != 0 {
+		t.Fatalf("expected no contracts, got %v", len(formed))
+	} else if attempts != 1 {
+		t.Fatalf("expected 1 funding attempt, got %v", attempts)
+	} else if formed := ac.FormBatch(); len(formed) != 0 || attempts != 1 {
+		t.Fatalf("expected formation to stop, got %v contracts after %v attempts", len(formed), attempts)
+	}
+}
+
+func TestContractHostLimit(t *testing.T) {
+	network := hosttest.NewNetwork()
+	hosts := []*hosttest.Host{network.AddHost(), network.AddHost(), network.AddHost()}
+	r := newTestRenter(t, network, hosts...)
+
+	sectors := make([]crypto.Hash, 2)
+	for i := range sectors {
+		sector := randomSector()
+		for _, h := range hosts {
+			sectors[i] = crypto.Hash(h.AddSector(sector))
+		}
+	}
+
+	// without a limit every host is checked
+	availability, _ := checkAvailability(r, r.Hosts(), sectors, 8, 0)
+	for _, sector := range sectors {
+		if len(availability[sector]) != len(hosts) {
+			t.Fatalf("expected sector on %v hosts, got %v", len(hosts), len(availability[sector]))
+		}
+	}
+
+	// with a limit each sector is only checked until it is found
+	availability, rpcs := checkAvailability(r, r.Hosts(), sectors, 8, 1)
+	for _, sector := range sectors {
+		if len(availability[sector]) != 1 {
+			t.Fatalf("expected sector on 1 host, got %v", len(availability[sector]))
+		}
+	}
+	if rpcs != 1 {
+		t.Fatalf("expected 1 read RPC, got %v", rpcs)
+	}
+
+	// fanout only checks up to the limit
+	missing := make(map[rhp.PublicKey]bool)
+	if _, _, ok := testRecoverSector(t, r, frand.Entropy256(), 3, 2, missing); ok {
+		t.Fatal("expected sector to be unrecoverable")
+	} else if len(missing) != 2 {
+		t.Fatalf("expected 2 hosts to be checked, got %v", len(missing))
+	}
+}
+
+func TestSampleAvailability(t *testing.T) {
+	network := hosttest.NewNetwork()
+	hosts := []*hosttest.Host{network.AddHost(), network.AddHost(), network.AddHost(), network.AddHost()}
+	r := newTestRenter(t, network, hosts...)
+
+	sectors := make([]crypto.Hash, 10)
+	for i := range sectors {
+		sector := randomSector()
+		for _, h := range hosts {
+			sectors[i] = crypto.Hash(h.AddSector(sector))
+		}
+	}
+
+	// every sector is on every host, so it should be found on each sampled
+	// host
+	availability, _ := sampleAvailability(r, r.Hosts(), sectors, 8, 2)
+	for _, sector := range sectors {
+		if len(availability[sector]) != 2 {
+			t.Fatalf("expected sector on 2 sampled hosts, got %v", len(availability[sector]))
+		} else if availability[sector][0] == availability[sector][1] {
+			t.Fatal("host was sampled twice")
+		}
+	}
+
+	// the sample is capped at the number of hosts
+	availability, _ = sampleAvailability(r, r.Hosts(), sectors, 8, 10)
+	for _, sector := range sectors {
+		if len(availability[sector]) != len(hosts) {
+			t.Fatalf("expected sector on %v hosts, got %v", len(hosts), len(availability[sector]))
+		}
+	}
+}
+
+func TestRemoveExhaustedContracts(t *testing.T) {
+	network := hosttest.NewNetwork()
+	funded, drained, offline := network.AddHost(), network.AddHost(), network.AddHost()
+	r := newTestRenter(t, network, funded, offline)
+	if _, err := r.FormDownloadContract(drained.PublicKey(), 0, 144, testWallet{}); err != nil {
+		t.Fatal(err)
+	}
+	network.RemoveHost(offline)
+
+	results := checkContractFunds(r)
+	for _, cf := range results {
+		// a contract with 1 GiB of download funds cannot pay for 1000 sector
+		// reads
+		if cf.contract.HostKey == funded.PublicKey() && (cf.exhausted(1) || !cf.exhausted(1000)) {
+			t.Fatalf("unexpected funds %v for a read cost of %v", cf.remaining, cf.readCost)
+		}
+	}
+	if n := removeExhaustedContracts(r, results, 1); n != 1 {
+		t.Fatalf("expected 1 contract to be removed, got %v", n)
+	}
+	// only the drained contract is removed, the offline host's contract is
+	// kept because it could not be checked
+	if _, err := r.HostContract(drained.PublicKey()); err == nil {
+		t.Fatal("expected drained contract to be removed")
+	} else if _, err := r.HostContract(offline.PublicKey()); err != nil {
+		t.Fatal("expected offline host's contract to be kept")
+	}
+}
+
+func TestRecoverFile(t *testing.T) {
+	network := hosttest.NewNetwork()
+	hosts := []*hosttest.Host{network.AddHost(), network.AddHost(), network.AddHost()}
+	r := newTestRenter(t, network, hosts...)
+
+	ec, err := siafile.InitErasureCoder(1, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeThreefish)
+	data := frand.Bytes(2*rhp.SectorSize - 100)
+	padded := make([]byte, 2*rhp.SectorSize)
+	copy(padded, data)
+	pieces, err := ec.Encode(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sf := siafile.SiaFile{
+		FileSize:      uint64(len(data)),
+		PieceSize:     rhp.SectorSize,
+		EncoderType:   1,
+		DataPieces:    2,
+		ParityPieces:  1,
+		MasterKey:     masterKey.Key(),
+		MasterKeyType: crypto.TypeThreefish.String(),
+		Chunks:        []siafile.Chunk{{}},
+	}
+	for i, piece := range pieces {
+		var sector [rhp.SectorSize]byte
+		copy(sector[:], masterKey.Derive(0, uint64(i)).EncryptBytes(piece))
+		root := hosts[i].AddSector(&sector)
+		sf.Chunks[0].Pieces = append(sf.Chunks[0].Pieces, []siafile.Piece{{HostKey: hosts[i].PublicKey(), MerkleRoot: crypto.Hash(root)}})
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "file")
+	stats, err := recoverFile(testRecoverer(t, r, workers), nil, nil, sf, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.Recovered() != 1 {
+		t.Fatalf("expected 1 recovered chunk, got %v", stats.Recovered())
+	} else if stats.Spent().IsZero() {
+		t.Fatal("expected download spending to be recorded")
+	}
+	if buf, err := os.ReadFile(outputPath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, data) {
+		t.Fatal("recovered data does not match")
+	}
+
+	// with --split the output is written to part files that concatenate to
+	// the file
+	splitPartSize = uint64(len(data)/3 + 1)
+	splitPath := filepath.Join(t.TempDir(), "split")
+	_, err = recoverFile(testRecoverer(t, r, workers), nil, nil, sf, splitPath)
+	splitPartSize = 0
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined []byte
+	for i := 0; i < 3; i++ {
+		buf, err := os.ReadFile(fmt.Sprintf("%s.part%04d", splitPath, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined = append(joined, buf...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("split parts do not match")
+	} else if _, err := os.Stat(partsManifestPath(splitPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file whose sectors are on none of the hosts cannot be recovered
+	for i := range sf.Chunks[0].Pieces {
+		sf.Chunks[0].Pieces[i][0].MerkleRoot = frand.Entropy256()
+	}
+	var ece *exitCodeError
+	if _, err := recoverFile(testRecoverer(t, r, workers), nil, nil, sf, outputPath); !errors.As(err, &ece) || ece.code != exitUnrecoverable {
+		t.Fatalf("expected unrecoverable error, got %v", err)
+	}
+
+	// with --continue-on-error the chunk is zero-filled and the ranges are
+	// written next to the output
+	continueOnError = true
+	defer func() { continueOnError = false }()
+	if _, err := recoverFile(testRecoverer(t, r, workers), nil, nil, sf, outputPath); !errors.As(err, &ece) || ece.code != exitUnrecoverable {
+		t.Fatalf("expected unrecoverable error, got %v", err)
+	}
+	if buf, err := os.ReadFile(outputPath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, make([]byte, len(data))) {
+		t.Fatal("expected the output to be zero-filled")
+	}
+	var ranges RecoveredRanges
+	if buf, err := os.ReadFile(outputPath + ".ranges.json"); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(buf, &ranges); err != nil {
+		t.Fatal(err)
+	} else if len(ranges.Recovered) != 0 || !reflect.DeepEqual(ranges.ZeroFilled, []ByteRange{{0, uint64(len(data))}}) {
+		t.Fatalf("unexpected ranges %+v", ranges)
+	}
+}
+
+func TestSectorHints(t *testing.T) {
+	network := hosttest.NewNetwork()
+	stale, other, hinted := network.AddHost(), network.AddHost(), network.AddHost()
+	r := newTestRenter(t, network, stale, other, hinted)
+
+	sector := randomSector()
+	root := crypto.Hash(hinted.AddSector(sector))
+	other.AddSector(sector)
+
+	fp := filepath.Join(t.TempDir(), "hints.json")
+	buf, err := json.Marshal(map[string][]rhp.PublicKey{
+		root.String(): {stale.PublicKey(), hinted.PublicKey()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(fp, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hints, err := loadSectorHints(fp)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(hints[root], []rhp.PublicKey{stale.PublicKey(), hinted.PublicKey()}) {
+		t.Fatalf("unexpected hints %v", hints)
+	}
+	sectorHints = hints
+	defer func() { sectorHints = nil }()
+
+	// the hinted hosts are checked before the other contracted hosts, and
+	// hinted hosts without the sector are marked missing
+	missing := make(map[rhp.PublicKey]bool)
+	data, host, ok := testRecoverSector(t, r, root, 1, 0, missing)
+	if !ok {
+		t.Fatal("expected sector to be recovered")
+	} else if host != hinted.PublicKey() {
+		t.Fatalf("expected sector from hinted host %v, got %v", hinted.PublicKey(), host)
+	} else if !bytes.Equal(data, sector[:]) {
+		t.Fatal("sector data mismatch")
+	} else if !missing[stale.PublicKey()] {
+		t.Fatal("expected the stale hinted host to be marked missing")
+	}
+
+	if err := os.WriteFile(fp, []byte(`{"not a root": []}`), 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := loadSectorHints(fp); err == nil {
+		t.Fatal("expected an invalid merkle root to be rejected")
+	}
+}
+
+func TestRecoveredRanges(t *testing.T) {
+	var rr RecoveredRanges
+	rr.Add(0, 10, true)
+	rr.Add(10, 20, true)
+	rr.Add(20, 30, false)
+	rr.Add(30, 40, true)
+	rr.Add(40, 50, false)
+	rr.Add(50, 55, false)
+	if exp := []ByteRange{{0, 20}, {30, 40}}; !reflect.DeepEqual(rr.Recovered, exp) {
+		t.Fatalf("expected recovered ranges %v, got %v", exp, rr.Recovered)
+	} else if exp := []ByteRange{{20, 30}, {40, 55}}; !reflect.DeepEqual(rr.ZeroFilled, exp) {
+		t.Fatalf("expected zero-filled ranges %v, got %v", exp, rr.ZeroFilled)
+	}
+}
+
+func TestCostOrder(t *testing.T) {
+	cheap, expensive, missing := rhp.PublicKey{1}, rhp.PublicKey{2}, rhp.PublicKey{3}
+	cached := crypto.Hash{4}
+
+	// piece 0 is only on the expensive host, piece 1 is on both, piece 2 is
+	// cached, and piece 3 is missing
+	chunk := siafile.Chunk{Pieces: [][]siafile.Piece{
+		{{HostKey: expensive, MerkleRoot: crypto.Hash{1}}},
+		{{HostKey: expensive, MerkleRoot: crypto.Hash{2}}},
+		{{HostKey: expensive, MerkleRoot: cached}},
+		{{HostKey: missing, MerkleRoot: crypto.Hash{3}}},
+	}}
+	co := &costOrder{
+		health: FileHealth{Chunks: []ChunkHealth{{
+			Pieces: [][]PieceHealth{
+				{{Hosts: []rhp.PublicKey{expensive}}},
+				{{Hosts: []rhp.PublicKey{expensive, cheap}}},
+				{{Hosts: []rhp.PublicKey{expensive}}},
+				nil,
+			},
+			MissingPieces: []uint32{3},
+		}}},
+		minPieces: 2,
+		sectorCost: map[rhp.PublicKey]types.Currency{
+			cheap:     types.NewCurrency64(1),
+			expensive: types.NewCurrency64(10),
+		},
+		maxCost: types.NewCurrency64(10),
+	}
+
+	order := co.Order(0, chunk, func(root crypto.Hash) bool { return root == cached })
+	if !reflect.DeepEqual(order, []int{2, 1, 0, 3}) {
+		t.Fatalf("expected order [2 1 0 3], got %v", order)
+	} else if !co.estimated.Equals64(1) {
+		t.Fatalf("expected estimated cost 1, got %v", co.estimated)
+	} else if host, _, ok := co.CheapestHost(0, 1, 0); !ok || host != cheap {
+		t.Fatalf("expected cheapest host %v, got %v", cheap, host)
+	} else if _, _, ok := co.CheapestHost(0, 3, 0); ok {
+		t.Fatal("expected missing piece to have no host")
+	}
+}
+
+func TestCheckChunkHealth(t *testing.T) {
+	host := rhp.PublicKey{1}
+	sf := siafile.SiaFile{DataPieces: 1, ParityPieces: 1}
+	chunk := siafile.Chunk{Pieces: [][]siafile.Piece{
+		{{HostKey: host, MerkleRoot: crypto.Hash{1}}},
+		{{HostKey: host, MerkleRoot: crypto.Hash{2}}, {HostKey: host, MerkleRoot: crypto.Hash{1}}},
+	}}
+
+	checked := map[crypto.Hash][]rhp.PublicKey{{1}: {host}}
+	if roots := chunkSectorRoots(chunk, checked); !reflect.DeepEqual(roots, []crypto.Hash{{2}}) {
+		t.Fatalf("expected only the unchecked root, got %v", roots)
+	}
+
+	health := checkChunkHealth(sf, chunk, checked)
+	if health.AvailablePieces != 1 || health.MinPieces != 1 {
+		t.Fatalf("expected 1/1 available pieces, got %v/%v", health.AvailablePieces, health.MinPieces)
+	} else if !reflect.DeepEqual(health.MissingPieces, []uint32{1}) {
+		t.Fatalf("expected piece 1 to be missing, got %v", health.MissingPieces)
+	}
+}
+
+func TestEstimateDuration(t *testing.T) {
+	plan := RecoveryPlan{Sectors: 10, FanoutSectors: 2}
+	tests := []struct {
+		hosts, workers, hostLimit int
+		want                      time.Duration
+	}{
+		{hosts: 50, workers: 100, want: 10 * time.Second},
+		{hosts: 250, workers: 100, want: 14 * time.Second},
+		{hosts: 250, workers: 100, hostLimit: 50, want: 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := estimateDuration(plan, time.Second, test.hosts, test.workers, test.hostLimit); got != test.want {
+			t.Errorf("estimateDuration(%v hosts, %v workers, %v limit) = %v, expected %v", test.hosts, test.workers, test.hostLimit, got, test.want)
+		}
+	}
+}
+
+func TestNotFoundRetry(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+	r := newTestRenter(t, network, host)
+
+	sector := randomSector()
+	root := crypto.Hash(rhp.SectorRoot(sector))
+	if _, _, ok := testRecoverSector(t, r, root, 1, 0, make(map[rhp.PublicKey]bool)); ok {
+		t.Fatal("expected recovery to fail")
+	}
+
+	// the host stores the sector after it was first checked
+	notFoundRetryDelay = 500 * time.Millisecond
+	t.Cleanup(func() { notFoundRetryDelay = 0 })
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		host.AddSector(sector)
+	}()
+	missing := make(map[rhp.PublicKey]bool)
+	buf, _, ok := testRecoverSector(t, r, root, 1, 0, missing)
+	if !ok {
+		t.Fatal("expected sector to be recovered after the retry")
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("sector data mismatch")
+	} else if missing[host.PublicKey()] {
+		t.Fatal("expected host to be removed from missing")
+	}
+}
+
+func TestContractProblem(t *testing.T) {
+	remaining := types.SiacoinPrecision
+	tests := []struct {
+		cf   contractFunds
+		want contractProblem
+	}{
+		{contractFunds{remaining: remaining, readCost: remaining.Div64(2)}, problemNone},
+		{contractFunds{remaining: remaining, readCost: remaining.Mul64(2)}, problemExhausted},
+		{contractFunds{err: fmt.Errorf("failed to create session: %w", rhp.ErrHostKeyMismatch)}, problemHostKeyChanged},
+		{contractFunds{err: fmt.Errorf("failed to create session: %w", hosttest.ErrContractNotFound)}, problemUnknown},
+		{contractFunds{err: errors.New("connection refused")}, problemUnreachable},
+	}
+	for _, test := range tests {
+		if got := test.cf.problem(1); got != test.want {
+			t.Errorf("expected %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestPriceChangeRetry(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+	r := newTestRenter(t, network, host)
+	sector := randomSector()
+	root := crypto.Hash(host.AddSector(sector))
+
+	// cache the host's settings
+	if _, err := downloadSector(r, host.PublicKey(), root); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host raises its prices, the cached settings underpay
+	host.SetDownloadPrice(types.NewCurrency64(10))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sess, err := r.NewSession(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := r.HostSettings(ctx, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := []rhp.RPCReadRequestSection{{MerkleRoot: rhp.Hash256(root), Length: rhp.SectorSize}}
+	err = sess.Read(ctx, io.Discard, sections, rhp.RPCReadCost(settings, sections))
+	sess.Close()
+	if !isPaymentRejected(err) {
+		t.Fatalf("expected the payment to be rejected, got %v", err)
+	}
+
+	// the settings are fetched again and the read is retried
+	if buf, err := downloadSector(r, host.PublicKey(), root); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("downloaded sector does not match")
+	}
+	host.SetDownloadPrice(types.NewCurrency64(20))
+	if ok, err := checkSector(r, host.PublicKey(), root); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected sector to be available")
+	}
+}
+
+func TestSectorCache(t *testing.T) {
+	var sector [rhp.SectorSize]byte
+	frand.Read(sector[:])
+	root := crypto.Hash(rhp.SectorRoot(&sector))
+
+	cache := make(sectorCache)
+	if _, ok := cache.Get(root); ok {
+		t.Fatal("expected a miss")
+	}
+	cache.Add(root, sector[:])
+	if buf, ok := cache.Get(root); !ok {
+		t.Fatal("expected a hit")
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("cached data does not match")
+	} else if _, ok := cache.Get(crypto.Hash{1}); ok {
+		t.Fatal("expected a sector to only be returned for the root it was added under")
+	}
+}
+
+func TestCheckSectorRoot(t *testing.T) {
+	// two pieces whose sectors are both valid for their own positions
+	first, second := randomSector(), randomSector()
+	firstRoot, secondRoot := crypto.Hash(rhp.SectorRoot(first)), crypto.Hash(rhp.SectorRoot(second))
+
+	if err := checkSectorRoot(firstRoot, firstRoot, first[:]); err != nil {
+		t.Fatal(err)
+	}
+	// a sector verified against another piece's root must not be appended
+	// to this one
+	if err := checkSectorRoot(firstRoot, secondRoot, second[:]); !errors.Is(err, errSectorRootMismatch) {
+		t.Fatalf("expected the second piece's sector to be rejected for the first, got %v", err)
+	} else if err := checkSectorRoot(secondRoot, firstRoot, first[:]); !errors.Is(err, errSectorRootMismatch) {
+		t.Fatalf("expected the first piece's sector to be rejected for the second, got %v", err)
+	} else if err := checkSectorRoot(firstRoot, firstRoot, first[:rhp.SectorSize-1]); !errors.Is(err, errSectorRootMismatch) {
+		t.Fatalf("expected the partial sector to be rejected, got %v", err)
+	}
+}
+
+func TestRecovererSchedule(t *testing.T) {
+	network := hosttest.NewNetwork()
+	hosts := []*hosttest.Host{network.AddHost(), network.AddHost(), network.AddHost(), network.AddHost(), network.AddHost()}
+	r := newTestRenter(t, network, hosts...)
+	rc := testRecoverer(t, r, 2)
+
+	failing, slow, unknown, fast, fastest := hosts[0].PublicKey(), hosts[1].PublicKey(), hosts[2].PublicKey(), hosts[3].PublicKey(), hosts[4].PublicKey()
+	rc.record(failing, time.Second, errors.New("connection reset"))
+	rc.record(slow, time.Minute, nil)
+	rc.record(fast, 2*time.Second, nil)
+	rc.record(fastest, time.Second, nil)
+	// a host that does not have a sector is not penalized
+	rc.record(fastest, time.Second, errors.New("could not find the desired sector"))
+
+	scheduled := rc.schedule([]rhp.PublicKey{failing, slow, unknown, fast, fastest})
+	expected := []rhp.PublicKey{fastest, fast, unknown, slow, failing}
+	if !reflect.DeepEqual(scheduled, expected) {
+		t.Fatalf("expected %v, got %v", expected, scheduled)
+	}
+
+	// the pool is reused for every sector and the hosts that served a sector
+	// are checked first for the next one
+	for i := 0; i < 3; i++ {
+		sector := randomSector()
+		var root crypto.Hash
+		for _, h := range hosts[2:] {
+			root = crypto.Hash(h.AddSector(sector))
+		}
+		buf, _, ok := rc.RecoverSector(context.Background(), root, 1, make(map[rhp.PublicKey]bool))
+		if !ok {
+			t.Fatalf("expected sector %v to be recovered", i)
+		} else if !bytes.Equal(buf, sector[:]) {
+			t.Fatal("sector data mismatch")
+		}
+	}
+}
+
+func TestCostAwareFetch(t *testing.T) {
+	network := hosttest.NewNetwork()
+	hosts := []*hosttest.Host{network.AddHost(), network.AddHost(), network.AddHost()}
+	expensive, mid, cheap := hosts[0], hosts[1], hosts[2]
+	price := cheap.Settings().DownloadBandwidthPrice
+	expensive.SetDownloadPrice(price.Mul64(3))
+	mid.SetDownloadPrice(price.Mul64(2))
+
+	r := newTestRenter(t, network, hosts...)
+	rc := testRecoverer(t, r, 3)
+	enableCostAware(r, rc)
+
+	ordered := rc.orderByCost([]rhp.PublicKey{expensive.PublicKey(), {1}, mid.PublicKey(), cheap.PublicKey()})
+	expected := []rhp.PublicKey{cheap.PublicKey(), mid.PublicKey(), expensive.PublicKey(), {1}}
+	if !reflect.DeepEqual(ordered, expected) {
+		t.Fatalf("expected %v, got %v", expected, ordered)
+	}
+
+	// the most expensive host is only checked if both cheaper hosts fail
+	sector := randomSector()
+	var root crypto.Hash
+	for _, h := range hosts {
+		root = crypto.Hash(h.AddSector(sector))
+	}
+	buf, host, ok := rc.RecoverSector(context.Background(), root, 0, make(map[rhp.PublicKey]bool))
+	if !ok {
+		t.Fatal("expected sector to be recovered")
+	} else if !bytes.Equal(buf, sector[:]) {
+		t.Fatal("sector data mismatch")
+	} else if host == expensive.PublicKey() {
+		t.Fatal("expected a cheaper host to serve the sector")
+	} else if rc.costPaid.Cmp(rc.costBaseline) >= 0 {
+		t.Fatalf("expected the cost paid %v to be less than the baseline %v", rc.costPaid, rc.costBaseline)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+var rehostCmd = &cobra.Command{
+	Use:   "rehost <metadata file> <output file>",
+	Short: "rewrite a file's host table with the contracted hosts that currently store its sectors",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Usage()
+			return
+		}
+
+		r, err := newRenter()
+		if err != nil {
+			log.Fatalln("failed to initialize renter:", err)
+		}
+
+		inputPath, outputPath := args[0], args[1]
+		sf, err := loadSiaFile(inputPath)
+		if err != nil {
+			log.Fatalln("failed to parse skyfile:", err)
+		}
+
+		hosts := r.Hosts()
+		if len(hosts) == 0 {
+			printOnboarding("--from-file " + inputPath)
+			log.Fatalln("no contracted hosts to scan")
+		}
+
+		var sectors []crypto.Hash
+		added := make(map[crypto.Hash]bool)
+		for _, chunk := range sf.Chunks {
+			for _, pieces := range chunk.Pieces {
+				for _, p := range pieces {
+					if !added[p.MerkleRoot] {
+						sectors = append(sectors, p.MerkleRoot)
+						added[p.MerkleRoot] = true
+					}
+				}
+			}
+		}
+
+		log.Printf("Scanning %v hosts for %v sectors...", len(hosts), len(sectors))
+		availability := make(map[crypto.Hash][]rhp.PublicKey)
+		for _, host := range hosts {
+			available, _ := checkSectors(r, host, sectors, probeBatch)
+			for i, sector := range sectors {
+				if available[i] {
+					availability[sector] = append(availability[sector], host)
+				}
+			}
+		}
+
+		chunks, unlocated := rehostChunks(sf, availability)
+		for _, root := range unlocated {
+			log.Printf("[WARN] sector %v was not found on any contracted host, keeping its original hosts", root)
+		}
+		if err := siafile.Rewrite(inputPath, outputPath, chunks); err != nil {
+			log.Fatalln("failed to write file:", err)
+		}
+		log.Printf("Located %v/%v sectors, wrote %v", len(sectors)-len(unlocated), len(sectors), outputPath)
+	},
+}
+
+// rehostChunks returns the file's chunks with each sector associated with the
+// hosts that currently store it. Sectors that were not found on any host keep
+// their original hosts and are returned as unlocated.
+func rehostChunks(sf siafile.SiaFile, availability map[crypto.Hash][]rhp.PublicKey) (chunks []siafile.Chunk, unlocated []crypto.Hash) {
+	seen := make(map[crypto.Hash]bool)
+	for _, chunk := range sf.Chunks {
+		rehosted := siafile.Chunk{Pieces: make([][]siafile.Piece, len(chunk.Pieces))}
+		for i, pieces := range chunk.Pieces {
+			placed := make(map[crypto.Hash]bool)
+			for _, piece := range pieces {
+				if placed[piece.MerkleRoot] {
+					continue
+				}
+				placed[piece.MerkleRoot] = true
+
+				hosts := availability[piece.MerkleRoot]
+				if len(hosts) == 0 {
+					// keep every original host of the sector
+					for _, p := range pieces {
+						if p.MerkleRoot == piece.MerkleRoot {
+							rehosted.Pieces[i] = append(rehosted.Pieces[i], p)
+						}
+					}
+					if !seen[piece.MerkleRoot] {
+						unlocated = append(unlocated, piece.MerkleRoot)
+					}
+				}
+				for _, host := range hosts {
+					rehosted.Pieces[i] = append(rehosted.Pieces[i], siafile.Piece{
+						MerkleRoot: piece.MerkleRoot,
+						HostKey:    host,
+					})
+				}
+				seen[piece.MerkleRoot] = true
+			}
+		}
+		chunks = append(chunks, rehosted)
+	}
+	return
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+var targetRedundancy float64
+
+var repairCmd = &cobra.Command{
+	Use:   "repair <metadata file> <output file>",
+	Short: "upload new copies of a file's missing pieces to active hosts until it reaches a target redundancy",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Usage()
+			return
+		} else if targetRedundancy < 1 {
+			log.Fatalln("--target-redundancy must be at least 1")
+		}
+
+		r, err := newRenter()
+		if err != nil {
+			log.Fatalln("failed to initialize renter:", err)
+		}
+
+		inputPath, outputPath := args[0], args[1]
+		sf, err := loadSiaFile(inputPath)
+		if err != nil {
+			log.Fatalln("failed to parse skyfile:", err)
+		}
+
+		if len(healthReportPath) == 0 {
+			healthReportPath = healthReport(inputPath)
+		}
+		health, err := loadHealthReport(healthReportPath, sf)
+		if err != nil {
+			log.Fatalf("failed to load health report, run file check first or set --health-report: %v", err)
+		}
+
+		ec, err := siafile.InitErasureCoder(sf.EncoderType, sf.DataPieces, sf.ParityPieces)
+		if err != nil {
+			log.Fatalln("failed to initialize erasure coder:", err)
+		}
+		var ct crypto.CipherType
+		if err := ct.FromString(sf.MasterKeyType); err != nil {
+			log.Fatalln("failed to decode master key:", err)
+		}
+		masterKey, err := crypto.NewSiaKey(ct, sf.MasterKey)
+		if err != nil {
+			log.Fatalln("failed to decode master key:", err)
+		}
+
+		// new pieces can only be uploaded to active hosts the renter has a
+		// contract with
+		active, err := r.ActiveHosts(contractHostFilter())
+		if err != nil {
+			log.Fatalln("failed to get active hosts:", err)
+		}
+		isActive := make(map[rhp.PublicKey]bool)
+		for _, host := range active {
+			isActive[host] = true
+		}
+		var candidates []rhp.PublicKey
+		for _, host := range r.Hosts() {
+			if isActive[host] {
+				candidates = append(candidates, host)
+			}
+		}
+		if len(candidates) == 0 {
+			log.Fatalln("no active contracted hosts to upload to, form contracts with active hosts first")
+		}
+
+		// copy the pieces so the new hosts can be set without modifying sf
+		chunks := make([]siafile.Chunk, len(sf.Chunks))
+		for i, chunk := range sf.Chunks {
+			chunks[i].Pieces = append([][]siafile.Piece(nil), chunk.Pieces...)
+		}
+
+		var uploaded, repaired, belowTarget int
+		for chunkIdx, chunkHealth := range health.Chunks {
+			pieces := repairPieces(chunkHealth, targetRedundancy)
+			if len(pieces) == 0 {
+				continue
+			} else if int(chunkHealth.AvailablePieces) < ec.MinPieces() {
+				log.Printf("[WARN] chunk %v is not recoverable (%v/%v pieces), skipping", chunkIdx+1, chunkHealth.AvailablePieces, ec.MinPieces())
+				belowTarget++
+				continue
+			}
+
+			hosts := repairHosts(candidates, sf.Chunks[chunkIdx], chunkHealth)
+			if len(hosts) < len(pieces) {
+				log.Printf("[WARN] chunk %v needs %v new pieces, only %v active hosts do not already store one of its pieces", chunkIdx+1, len(pieces), len(hosts))
+			}
+			// start each chunk at a different host to spread the uploads
+			if len(hosts) != 0 {
+				offset := chunkIdx % len(hosts)
+				hosts = append(hosts[offset:], hosts[:offset]...)
+			}
+
+			data, err := downloadChunk(r, ec, masterKey, sf, chunkIdx, chunkHealth)
+			if err != nil {
+				log.Printf("[WARN] failed to download chunk %v: %v", chunkIdx+1, err)
+				belowTarget++
+				continue
+			}
+			encoded, err := ec.Encode(data)
+			if err != nil {
+				log.Fatalf("failed to encode chunk %v: %v", chunkIdx+1, err)
+			}
+
+			var chunkUploaded int
+			sector := new([rhp.SectorSize]byte)
+			for _, pieceIdx := range pieces {
+				key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
+				ciphertext := key.EncryptBytes(encoded[pieceIdx])
+				if len(ciphertext) > rhp.SectorSize {
+					log.Fatalf("piece %v of chunk %v is larger than a sector", pieceIdx+1, chunkIdx+1)
+				}
+				// pieces are padded to a full sector before they are uploaded
+				*sector = [rhp.SectorSize]byte{}
+				copy(sector[:], ciphertext)
+
+				for len(hosts) != 0 {
+					host := hosts[0]
+					hosts = hosts[1:]
+					root, err := uploadSector(r, host, sector)
+					if err != nil {
+						log.Printf("[WARN] failed to upload piece %v of chunk %v to host %v: %v", pieceIdx+1, chunkIdx+1, host, err)
+						continue
+					}
+					chunks[chunkIdx].Pieces[pieceIdx] = []siafile.Piece{{MerkleRoot: root, HostKey: host}}
+					chunkUploaded++
+					log.Printf("Uploaded piece %v of chunk %v to host %v", pieceIdx+1, chunkIdx+1, host)
+					break
+				}
+			}
+			uploaded += chunkUploaded
+			if chunkUploaded != 0 {
+				repaired++
+			}
+			if chunkUploaded != len(pieces) {
+				belowTarget++
+			}
+		}
+
+		if err := siafile.Rewrite(inputPath, outputPath, chunks); err != nil {
+			log.Fatalln("failed to write file:", err)
+		}
+		if belowTarget != 0 {
+			log.Printf("[WARN] %v chunks are still below %vx redundancy", belowTarget, targetRedundancy)
+		}
+		log.Printf("Uploaded %v pieces to repair %v chunks, wrote %v", uploaded, repaired, outputPath)
+	},
+}
+
+// repairPieces returns the indices of the chunk's missing pieces that must be
+// uploaded to bring it to the target redundancy, the number of pieces divided
+// by the minimum number of pieces. The target is capped at the chunk's total
+// number of pieces.
+func repairPieces(health ChunkHealth, target float64) []int {
+	// subtract a small epsilon so targets like 1.1x are not rounded up by
+	// floating point error
+	want := int(math.Ceil(target*float64(health.MinPieces) - 1e-9))
+	need := want - int(health.AvailablePieces)
+	if need <= 0 {
+		return nil
+	} else if need > len(health.MissingPieces) {
+		need = len(health.MissingPieces)
+	}
+	pieces := make([]int, need)
+	for i := range pieces {
+		pieces[i] = int(health.MissingPieces[i])
+	}
+	return pieces
+}
+
+// repairHosts returns the candidate hosts that do not store any of the chunk's
+// pieces, either as listed in the sia file or as found by file check.
+func repairHosts(candidates []rhp.PublicKey, chunk siafile.Chunk, health ChunkHealth) []rhp.PublicKey {
+	used := make(map[rhp.PublicKey]bool)
+	for _, pieces := range chunk.Pieces {
+		for _, p := range pieces {
+			used[p.HostKey] = true
+		}
+	}
+	for _, pieces := range health.Pieces {
+		for _, p := range pieces {
+			for _, host := range p.Hosts {
+				used[host] = true
+			}
+		}
+	}
+	var hosts []rhp.PublicKey
+	for _, host := range candidates {
+		if !used[host] {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// downloadChunk downloads the minimum number of the chunk's available pieces
+// from the hosts in its health report and returns the padded chunk data.
+func downloadChunk(r *renter.Renter, ec modules.ErasureCoder, masterKey crypto.CipherKey, sf siafile.SiaFile, chunkIdx int, health ChunkHealth) ([]byte, error) {
+	missing := make(map[int]bool)
+	for _, pieceIdx := range health.MissingPieces {
+		missing[int(pieceIdx)] = true
+	}
+
+	var recovered int
+	pieces := make([][]byte, ec.NumPieces())
+	for pieceIdx, piece := range sf.Chunks[chunkIdx].Pieces {
+		if missing[pieceIdx] || len(piece) == 0 || len(health.Pieces[pieceIdx]) != len(piece) {
+			continue
+		}
+
+		var data []byte
+		for _, sector := range health.Pieces[pieceIdx] {
+			var buf []byte
+			for _, host := range sector.Hosts {
+				var err error
+				buf, err = downloadSector(r, host, sector.MerkleRoot)
+				if err == nil {
+					break
+				}
+				log.Printf("[WARN] failed to download sector %v from host %v: %v", sector.MerkleRoot, host, err)
+			}
+			if buf == nil {
+				data = nil
+				break
+			}
+			data = append(data, buf...)
+		}
+		if data == nil {
+			continue
+		}
+
+		key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
+		decrypted, err := key.DecryptBytesInPlace(data, 0)
+		if err != nil {
+			log.Printf("[WARN] failed to decrypt piece %v of chunk %v: %v", pieceIdx+1, chunkIdx+1, err)
+			continue
+		}
+		pieces[pieceIdx] = decrypted
+		recovered++
+		if recovered >= ec.MinPieces() {
+			break
+		}
+	}
+	if recovered < ec.MinPieces() {
+		return nil, fmt.Errorf("downloaded %v/%v pieces", recovered, ec.MinPieces())
+	}
+
+	n := sf.PieceSize * uint64(ec.MinPieces())
+	buf := bytes.NewBuffer(make([]byte, 0, n))
+	if err := ec.Recover(pieces, n, buf); err != nil {
+		return nil, fmt.Errorf("failed to recover chunk: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// uploadSector appends a sector to the host's contract, paying for its storage
+// until the contract ends, and returns the sector's merkle root.
+func uploadSector(r *renter.Renter, hostPub rhp.PublicKey, sector *[rhp.SectorSize]byte) (crypto.Hash, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var root rhp.Hash256
+	err := withHostSession(ctx, r, hostPub, func(sess *rhp.Session, settings rhp.HostSettings) error {
+		height, end := r.BlockHeight(), sess.Contract().EndHeight()
+		if end <= height {
+			return fmt.Errorf("contract ends at height %v", end)
+		}
+		price, collateral := rhp.RPCAppendCost(settings, end-height)
+		var err error
+		root, err = sess.Append(ctx, sector, price, collateral)
+		if err != nil {
+			// the host's prices may have changed
+			r.InvalidateHostSettings(hostPub)
+			return fmt.Errorf("failed to append sector: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	return crypto.Hash(root), nil
+}
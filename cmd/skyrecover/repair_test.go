@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"lukechampine.com/frand"
+)
+
+func TestRepairPieces(t *testing.T) {
+	health := ChunkHealth{
+		MinPieces:       10,
+		AvailablePieces: 12,
+		MissingPieces:   []uint32{3, 7, 12, 15, 20, 21, 25, 29},
+	}
+
+	tests := []struct {
+		target float64
+		want   []int
+	}{
+		{1, nil},
+		{1.1, nil},
+		{1.2, nil},
+		{1.3, []int{3}},
+		{1.5, []int{3, 7, 12}},
+		{1.55, []int{3, 7, 12, 15}},
+		{3, []int{3, 7, 12, 15, 20, 21, 25, 29}},
+	}
+	for _, tt := range tests {
+		if got := repairPieces(health, tt.target); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("target %v: expected pieces %v, got %v", tt.target, tt.want, got)
+		}
+	}
+}
+
+func TestRepairHosts(t *testing.T) {
+	hostKey := func() (pk rhp.PublicKey) {
+		frand.Read(pk[:])
+		return
+	}
+	listed, found, free1, free2 := hostKey(), hostKey(), hostKey(), hostKey()
+
+	chunk := siafile.Chunk{Pieces: [][]siafile.Piece{
+		{{MerkleRoot: crypto.Hash(frand.Entropy256()), HostKey: listed}},
+	}}
+	health := ChunkHealth{Pieces: [][]PieceHealth{
+		{{MerkleRoot: chunk.Pieces[0][0].MerkleRoot, Hosts: []rhp.PublicKey{found}}},
+	}}
+
+	hosts := repairHosts([]rhp.PublicKey{listed, free1, found, free2}, chunk, health)
+	if !reflect.DeepEqual(hosts, []rhp.PublicKey{free1, free2}) {
+		t.Fatalf("expected hosts %v, got %v", []rhp.PublicKey{free1, free2}, hosts)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// withBackoff calls fn until it succeeds, fails with an error that retry
+// reports as permanent, or has been called attempts times. The delay between
+// attempts doubles after each one. The last error is returned.
+func withBackoff(attempts int, delay time.Duration, retry func(error) bool, fn func() error) (err error) {
+	for i := 1; ; i++ {
+		err = fn()
+		if err == nil || i >= attempts || !retry(err) {
+			return err
+		}
+		log.Printf("[WARN] attempt %v/%v failed, retrying in %v: %v", i, attempts, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
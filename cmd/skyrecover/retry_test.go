@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithBackoff(t *testing.T) {
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+	retry := func(err error) bool { return errors.Is(err, errTransient) }
+
+	// transient errors are retried until fn succeeds
+	var calls int
+	err := withBackoff(5, time.Millisecond, retry, func() error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if calls != 3 {
+		t.Fatalf("expected 3 calls, got %v", calls)
+	}
+
+	// permanent errors are not retried
+	calls = 0
+	err = withBackoff(5, time.Millisecond, retry, func() error {
+		calls++
+		return errPermanent
+	})
+	if !errors.Is(err, errPermanent) || calls != 1 {
+		t.Fatalf("expected 1 call to fail permanently, got %v calls: %v", calls, err)
+	}
+
+	// the last error is returned once the attempts run out
+	calls = 0
+	err = withBackoff(3, time.Millisecond, retry, func() error {
+		calls++
+		return errTransient
+	})
+	if !errors.Is(err, errTransient) || calls != 3 {
+		t.Fatalf("expected 3 calls to fail, got %v calls: %v", calls, err)
+	}
+}
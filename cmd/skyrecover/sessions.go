@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/skyrecover/internal/renter"
+)
+
+var (
+	keepSessions bool
+	// sessionRenters are the renters whose sessions are summarized on exit
+	// when --keep-sessions is set.
+	sessionRenters []*renter.Renter
+)
+
+// printSessionSummaries logs the settings, contract revisions and RPCs of
+// every session opened by the renters created with --keep-sessions.
+func printSessionSummaries() {
+	var n int
+	for _, r := range sessionRenters {
+		for _, rec := range r.Sessions() {
+			n++
+			log.Printf("Session %v: host %v (%v), contract %v", n, rec.HostKey, rec.NetAddress, rec.ContractID)
+			if rec.OpenErr != nil {
+				log.Printf("  Failed to open after %v: %v", rec.OpenElapsed.Round(time.Millisecond), rec.OpenErr)
+				continue
+			}
+			log.Printf("  Opened:    %v in %v", rec.Opened.Format(time.RFC3339), rec.OpenElapsed.Round(time.Millisecond))
+			if s := rec.Settings; s != nil {
+				source := "fetched"
+				if rec.SettingsCached {
+					source = "cached"
+				}
+				log.Printf("  Settings:  version %v, download %v/TiB, sector access %v, base RPC %v (%v)", s.Version, s.DownloadBandwidthPrice.Mul64(1<<40).HumanString(), s.SectorAccessPrice.HumanString(), s.BaseRPCPrice.HumanString(), source)
+			}
+			log.Printf("  Revision:  %v -> %v", rec.StartRevision, rec.Revision)
+			for _, rpc := range rec.RPCs {
+				status := "ok"
+				if rpc.Err != nil {
+					status = rpc.Err.Error()
+				}
+				log.Printf("  RPC %-8v %v, %v up, %v down, cost %v: %v", rpc.RPC, rpc.Elapsed.Round(time.Millisecond), modules.FilesizeUnits(rpc.Uploaded), modules.FilesizeUnits(rpc.Downloaded), rpc.Cost.HumanString(), status)
+			}
+		}
+	}
+}
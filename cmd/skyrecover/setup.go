@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.sia.tech/skyrecover/internal/renter"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt prints msg and returns the line entered by the user.
+func prompt(msg string) string {
+	fmt.Fprint(os.Stderr, msg+" ")
+	line, err := stdin.ReadString('\n')
+	if err != nil {
+		log.Fatalln("failed to read input:", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+// printOnboarding prints the steps required to form contracts when the renter
+// has none. formFlags are the contracts form flags that select the files'
+// hosts.
+func printOnboarding(formFlags string) {
+	log.Println("No contracts have been formed. Contracts with the file's hosts are required to check or recover it:")
+	log.Println("  1. Get the wallet address and send Siacoins to it:")
+	log.Println("       skyrecover wallet")
+	log.Println("  2. Split the balance into one output per host so contracts can be formed in parallel:")
+	log.Println("       skyrecover wallet redistribute <number of hosts> <amount per host>")
+	log.Println("  3. Form contracts with the hosts listed in the file:")
+	log.Printf("       skyrecover contracts form %v", formFlags)
+	log.Println("Or run the command again with --setup to walk through these steps.")
+}
+
+// runSetup walks the user through funding the wallet, redistributing its
+// outputs, and forming contracts with the active missing hosts.
+func runSetup(r *renter.Renter, missing []MissingHost) {
+	var hosts []rhp.PublicKey
+	for _, mh := range missing {
+		if mh.Active {
+			hosts = append(hosts, mh.HostKey)
+		}
+	}
+	if len(hosts) == 0 {
+		log.Println("None of the missing hosts are accepting contracts")
+		return
+	}
+	log.Printf("Contracts will be formed with %v active hosts listed in the file", len(hosts))
+
+	w := mustLoadWallet()
+	log.Println("Wallet Address:", w.Address())
+	for {
+		balance, err := w.Balance()
+		if err != nil {
+			log.Fatalln("failed to get wallet balance:", err)
+		}
+		log.Println("Wallet Balance:", balance.HumanString())
+		if immature := w.ImmatureBalance(); !immature.IsZero() {
+			log.Printf("%v is still maturing and cannot be spent yet (current height %v)", immature.HumanString(), w.Height())
+		}
+		if !balance.IsZero() && strings.ToLower(prompt("Continue with this balance? [y/N]")) == "y" {
+			break
+		}
+		prompt("Send Siacoins to the wallet address and press enter once the transaction has confirmed")
+	}
+
+	// each contract formation requires its own output
+	utxos, err := w.SpendableUTXOs()
+	if err != nil {
+		log.Fatalln("failed to get spendable utxos:", err)
+	}
+	if len(utxos) < len(hosts) {
+		balance, err := w.Balance()
+		if err != nil {
+			log.Fatalln("failed to get wallet balance:", err)
+		}
+		// leave one share for the transaction fee
+		outputs := uint64(len(hosts))
+		amount := balance.Div64(outputs + 1)
+		if strings.ToLower(prompt(fmt.Sprintf("The wallet has %v outputs, redistribute into %v outputs of %v? [y/N]", len(utxos), outputs, amount.HumanString()))) == "y" {
+			txn, release, err := w.Redistribute(outputs, amount)
+			if err != nil {
+				log.Fatalln("failed to redistribute funds:", err)
+			}
+			if err := broadcastTransaction(txn); err != nil {
+				release()
+				log.Fatalln("failed to broadcast transaction:", err)
+			}
+			log.Printf("Transaction %v broadcast, waiting for confirmation...", txn.ID())
+			for {
+				time.Sleep(30 * time.Second)
+				utxos, err := w.SpendableUTXOs()
+				if err != nil {
+					log.Fatalln("failed to get spendable utxos:", err)
+				} else if len(utxos) >= len(hosts) {
+					break
+				}
+			}
+		}
+	}
+
+	if err := formContracts(r, w, hosts); err != nil {
+		log.Println("[WARN]", err)
+	}
+}
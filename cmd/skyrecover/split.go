@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.sia.tech/skyrecover/internal/jsonout"
+)
+
+type (
+	// An OutputPart is one of the part files of a split output.
+	OutputPart struct {
+		Name   string `json:"name"`
+		Offset uint64 `json:"offset"`
+		Length uint64 `json:"length"`
+	}
+
+	// A PartsManifest describes the part files of a split output. The
+	// original file is the concatenation of the parts in order.
+	PartsManifest struct {
+		FileSize uint64       `json:"fileSize"`
+		PartSize uint64       `json:"partSize"`
+		Parts    []OutputPart `json:"parts"`
+	}
+
+	// A splitWriter writes a recovered file to numbered part files, each at
+	// most partSize bytes. The manifest is written when it is closed.
+	splitWriter struct {
+		base     string
+		partSize uint64
+		bufSize  int
+
+		f        *os.File
+		w        *bufio.Writer
+		offset   uint64
+		manifest PartsManifest
+	}
+)
+
+var (
+	// splitSize is the --split flag, the maximum size of each part file.
+	splitSize string
+	// splitPartSize is the parsed splitSize, 0 to write a single output file.
+	splitPartSize uint64
+)
+
+// byteUnits are the suffixes accepted by parseByteSize.
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes with an optional unit, e.g. "4GiB" or
+// "700MB".
+func parseByteSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	mult := uint64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(strings.ToLower(s), strings.ToLower(unit.suffix)) {
+			s, mult = strings.TrimSpace(s[:len(s)-len(unit.suffix)]), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	} else if n > ^uint64(0)/mult {
+		return 0, fmt.Errorf("size %v overflows", s)
+	}
+	return n * mult, nil
+}
+
+// partsManifestPath returns the path of the manifest of a split output.
+func partsManifestPath(outputPath string) string {
+	return outputPath + ".parts.json"
+}
+
+// newSplitWriter returns a splitWriter writing parts of outputPath. Each part
+// is buffered with bufSize bytes.
+func newSplitWriter(outputPath string, partSize uint64, bufSize int, fileSize uint64) (*splitWriter, error) {
+	if partSize == 0 {
+		return nil, errors.New("part size must be greater than 0")
+	}
+	return &splitWriter{
+		base:     outputPath,
+		partSize: partSize,
+		bufSize:  bufSize,
+		manifest: PartsManifest{
+			FileSize: fileSize,
+			PartSize: partSize,
+			Parts:    []OutputPart{},
+		},
+	}, nil
+}
+
+// closePart flushes and closes the current part file.
+func (sw *splitWriter) closePart() error {
+	if sw.f == nil {
+		return nil
+	}
+	f := sw.f
+	sw.f = nil
+	if err := sw.w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to flush part: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close part: %w", err)
+	}
+	return nil
+}
+
+// nextPart closes the current part file and creates the next one.
+func (sw *splitWriter) nextPart() error {
+	if err := sw.closePart(); err != nil {
+		return err
+	}
+	fp := fmt.Sprintf("%s.part%04d", sw.base, len(sw.manifest.Parts))
+	f, err := os.Create(fp)
+	if err != nil {
+		return fmt.Errorf("failed to create part: %w", err)
+	}
+	sw.f = f
+	if sw.w == nil {
+		sw.w = bufio.NewWriterSize(f, sw.bufSize)
+	} else {
+		sw.w.Reset(f)
+	}
+	sw.manifest.Parts = append(sw.manifest.Parts, OutputPart{
+		Name:   filepath.Base(fp),
+		Offset: sw.offset,
+	})
+	return nil
+}
+
+// Write implements io.Writer. Data is written to the part file covering its
+// offset in the output, creating the next part when the current one is full.
+func (sw *splitWriter) Write(p []byte) (n int, err error) {
+	for len(p) != 0 {
+		if sw.f == nil || sw.manifest.Parts[len(sw.manifest.Parts)-1].Length == sw.partSize {
+			if err := sw.nextPart(); err != nil {
+				return n, err
+			}
+		}
+		part := &sw.manifest.Parts[len(sw.manifest.Parts)-1]
+		buf := p
+		if rem := sw.partSize - part.Length; uint64(len(buf)) > rem {
+			buf = buf[:rem]
+		}
+		w, err := sw.w.Write(buf)
+		n += w
+		sw.offset += uint64(w)
+		part.Length += uint64(w)
+		if err != nil {
+			return n, fmt.Errorf("failed to write part: %w", err)
+		}
+		p = p[w:]
+	}
+	return n, nil
+}
+
+// Flush flushes the current part file's buffer.
+func (sw *splitWriter) Flush() error {
+	if sw.w == nil || sw.f == nil {
+		return nil
+	}
+	return sw.w.Flush()
+}
+
+// Close closes the last part file and writes the manifest.
+func (sw *splitWriter) Close() error {
+	if err := sw.closePart(); err != nil {
+		return err
+	}
+	buf, err := jsonout.Marshal(sw.manifest, "", jsonIndent())
+	if err != nil {
+		return fmt.Errorf("failed to encode parts manifest: %w", err)
+	} else if err := os.WriteFile(partsManifestPath(sw.base), buf, 0644); err != nil {
+		return fmt.Errorf("failed to write parts manifest: %w", err)
+	}
+	return nil
+}
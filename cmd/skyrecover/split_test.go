@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestSplitWriter(t *testing.T) {
+	const partSize = 1000
+	data := frand.Bytes(3500)
+	outputPath := filepath.Join(t.TempDir(), "file")
+
+	sw, err := newSplitWriter(outputPath, partSize, 64, uint64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in uneven pieces so writes straddle the part boundaries
+	for rem := data; len(rem) != 0; {
+		n := frand.Intn(700) + 1
+		if n > len(rem) {
+			n = len(rem)
+		}
+		if _, err := sw.Write(rem[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rem = rem[n:]
+	}
+	if err := sw.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(partsManifestPath(outputPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest PartsManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	} else if manifest.FileSize != uint64(len(data)) || manifest.PartSize != partSize {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	} else if len(manifest.Parts) != 4 {
+		t.Fatalf("expected 4 parts, got %v", len(manifest.Parts))
+	}
+
+	var joined []byte
+	for i, part := range manifest.Parts {
+		if name := fmt.Sprintf("file.part%04d", i); part.Name != name {
+			t.Fatalf("expected part %v to be named %v, got %v", i, name, part.Name)
+		} else if part.Offset != uint64(len(joined)) {
+			t.Fatalf("expected part %v at offset %v, got %v", i, len(joined), part.Offset)
+		}
+		buf, err := os.ReadFile(filepath.Join(filepath.Dir(outputPath), part.Name))
+		if err != nil {
+			t.Fatal(err)
+		} else if uint64(len(buf)) != part.Length || len(buf) > partSize {
+			t.Fatalf("part %v: expected %v bytes, got %v", i, part.Length, len(buf))
+		}
+		joined = append(joined, buf...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("concatenated parts do not match the data")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size uint64
+	}{
+		{"4096", 4096},
+		{"100B", 100},
+		{"4GiB", 4 << 30},
+		{"4 gib", 4 << 30},
+		{"700MB", 700e6},
+		{"2KiB", 2048},
+	}
+	for _, test := range tests {
+		if size, err := parseByteSize(test.s); err != nil {
+			t.Fatalf("%q: %v", test.s, err)
+		} else if size != test.size {
+			t.Fatalf("%q: expected %v, got %v", test.s, test.size, size)
+		}
+	}
+
+	for _, s := range []string{"", "GiB", "-1", "1.5GiB", "99999999999TiB"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+// spending is the total contract funds spent on read RPCs.
+var spending spendTracker
+
+// A spendTracker totals the contract funds spent by sessions.
+type spendTracker struct {
+	mu    sync.Mutex
+	total types.Currency
+}
+
+// Track returns a function that records the funds the session has spent
+// since Track was called. It should be deferred until the session is closed.
+func (st *spendTracker) Track(sess *rhp.Session) func() {
+	before := sess.Contract().RenterFunds()
+	return func() {
+		after := sess.Contract().RenterFunds()
+		if after.Cmp(before) >= 0 {
+			return
+		}
+		st.mu.Lock()
+		st.total = st.total.Add(before.Sub(after))
+		st.mu.Unlock()
+	}
+}
+
+// Total returns the total funds spent.
+func (st *spendTracker) Total() types.Currency {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.total
+}
+
+// recoveryStats aggregates the counters printed at the end of a recovery. It
+// implements io.Writer to count the bytes written to the output.
+type recoveryStats struct {
+	start      time.Time
+	spentStart types.Currency
+
+	chunks       int
+	listedChunks int
+	fanoutChunks int
+	failedChunks []int
+
+	verifiedChunks   int
+	mismatchedChunks []int
+
+	sectorsDownloaded int
+	cacheHits         int
+	localSectors      int
+	hosts             map[rhp.PublicKey]bool
+
+	bytesWritten uint64
+
+	// progress is the recovery's progress line, nil if it is not shown
+	progress *progressLine
+}
+
+// Write implements io.Writer.
+func (rs *recoveryStats) Write(p []byte) (int, error) {
+	rs.bytesWritten += uint64(len(p))
+	return len(p), nil
+}
+
+// RecordDownload records a sector downloaded from a host.
+func (rs *recoveryStats) RecordDownload(host rhp.PublicKey) {
+	rs.sectorsDownloaded++
+	rs.hosts[host] = true
+	rs.progress.RecordHost(host)
+}
+
+// RecordChunk records a recovered chunk. A chunk that needed any sector from
+// fanout is counted as a fanout chunk.
+func (rs *recoveryStats) RecordChunk(fanout bool) {
+	if fanout {
+		rs.fanoutChunks++
+	} else {
+		rs.listedChunks++
+	}
+}
+
+// Recovered returns the number of chunks recovered.
+func (rs *recoveryStats) Recovered() int {
+	return rs.listedChunks + rs.fanoutChunks
+}
+
+// Spent returns the contract funds spent since the recovery started.
+func (rs *recoveryStats) Spent() types.Currency {
+	return spending.Total().Sub(rs.spentStart)
+}
+
+// Print logs the summary.
+func (rs *recoveryStats) Print() {
+	recovered := rs.Recovered()
+	log.Println("Recovery summary:")
+	log.Printf("  Chunks:         %v/%v recovered (%v from listed hosts, %v needed fanout)", recovered, rs.chunks, rs.listedChunks, rs.fanoutChunks)
+	log.Printf("  Sectors:        %v downloaded, %v cache hits, %v loaded locally", rs.sectorsDownloaded, rs.cacheHits, rs.localSectors)
+	log.Printf("  Hosts used:     %v", len(rs.hosts))
+	log.Printf("  Spent:          %v", rs.Spent().HumanString())
+	log.Printf("  Bytes written:  %v (%v)", rs.bytesWritten, modules.FilesizeUnits(rs.bytesWritten))
+	log.Printf("  Elapsed:        %v", time.Since(rs.start).Round(time.Second))
+	if len(rs.failedChunks) != 0 {
+		log.Printf("  Failed chunks:  %v", chunkList(rs.failedChunks))
+	}
+	if rs.verifiedChunks != 0 {
+		log.Printf("  Verified:       %v chunks, %v mismatched", rs.verifiedChunks, len(rs.mismatchedChunks))
+	}
+	if len(rs.mismatchedChunks) != 0 {
+		log.Printf("  Mismatched:     %v", chunkList(rs.mismatchedChunks))
+	}
+}
+
+// chunkList formats chunk indices as a comma-separated list of chunk numbers.
+func chunkList(chunks []int) string {
+	var s []string
+	for _, i := range chunks {
+		s = append(s, strconv.Itoa(i+1))
+	}
+	return strings.Join(s, ", ")
+}
+
+func newRecoveryStats(chunks int) *recoveryStats {
+	return &recoveryStats{
+		start:      time.Now(),
+		spentStart: spending.Total(),
+		chunks:     chunks,
+		hosts:      make(map[rhp.PublicKey]bool),
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+)
+
+var verifyRecovered bool
+
+// verifyChunk re-encodes and re-encrypts a recovered chunk and checks that the
+// merkle root of each of the pieces in downloaded matches the roots recorded in
+// the siafile. It returns the indices of the pieces that do not match.
+//
+// Twofish encryption uses a random nonce, so pieces encrypted with it cannot be
+// reproduced and are not verified.
+func verifyChunk(ec modules.ErasureCoder, masterKey crypto.CipherKey, chunkIdx int, chunk siafile.Chunk, pieceSize uint64, data []byte, downloaded []int) ([]int, error) {
+	if masterKey.Type() == crypto.TypeTwofish {
+		return nil, fmt.Errorf("cannot verify pieces encrypted with %v", masterKey.Type())
+	}
+
+	// chunks are padded to their full size before they are encoded
+	padded := make([]byte, pieceSize*uint64(ec.MinPieces()))
+	copy(padded, data)
+	pieces, err := ec.Encode(padded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chunk: %w", err)
+	}
+
+	var mismatched []int
+	sector := new([rhp.SectorSize]byte)
+	for _, pieceIdx := range downloaded {
+		key := masterKey.Derive(uint64(chunkIdx), uint64(pieceIdx))
+		ciphertext := key.EncryptBytes(pieces[pieceIdx])
+		if len(ciphertext) > rhp.SectorSize {
+			return nil, fmt.Errorf("piece %v is larger than a sector", pieceIdx)
+		}
+		// pieces are padded to a full sector before they are uploaded
+		*sector = [rhp.SectorSize]byte{}
+		copy(sector[:], ciphertext)
+		root := crypto.Hash(rhp.DefaultSectorVerifier.SectorRoot(sector))
+		for _, p := range chunk.Pieces[pieceIdx] {
+			if p.MerkleRoot != root {
+				mismatched = append(mismatched, pieceIdx)
+				break
+			}
+		}
+	}
+	return mismatched, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"go.sia.tech/skyrecover/internal/siafile"
+	"lukechampine.com/frand"
+)
+
+func TestVerifyChunk(t *testing.T) {
+	ec, err := siafile.InitErasureCoder(1, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey := crypto.GenerateSiaKey(crypto.TypeThreefish)
+	pieceSize := uint64(rhp.SectorSize)
+
+	// upload a partial chunk the way siad does
+	data := frand.Bytes(int(pieceSize)*ec.MinPieces() - 100)
+	padded := make([]byte, pieceSize*uint64(ec.MinPieces()))
+	copy(padded, data)
+	pieces, err := ec.Encode(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunk siafile.Chunk
+	for i, piece := range pieces {
+		var sector [rhp.SectorSize]byte
+		copy(sector[:], masterKey.Derive(0, uint64(i)).EncryptBytes(piece))
+		chunk.Pieces = append(chunk.Pieces, []siafile.Piece{{MerkleRoot: crypto.Hash(rhp.SectorRoot(&sector))}})
+	}
+
+	// recover the chunk from the second data piece and the parity piece
+	recovered := [][]byte{nil, pieces[1], pieces[2]}
+	var buf bytes.Buffer
+	if err := ec.Recover(recovered, uint64(len(data)), &buf); err != nil {
+		t.Fatal(err)
+	} else if mismatched, err := verifyChunk(ec, masterKey, 0, chunk, pieceSize, buf.Bytes(), []int{1, 2}); err != nil {
+		t.Fatal(err)
+	} else if len(mismatched) != 0 {
+		t.Fatalf("expected no mismatched pieces, got %v", mismatched)
+	}
+
+	// a decoding error changes the roots of the re-encoded pieces
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[0] ^= 1
+	if mismatched, err := verifyChunk(ec, masterKey, 0, chunk, pieceSize, corrupt, []int{1, 2}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(mismatched, []int{2}) {
+		t.Fatalf("expected piece 2 to mismatch, got %v", mismatched)
+	}
+
+	// the wrong chunk index derives the wrong keys
+	if mismatched, err := verifyChunk(ec, masterKey, 1, chunk, pieceSize, buf.Bytes(), []int{1, 2}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(mismatched, []int{1, 2}) {
+		t.Fatalf("expected pieces 1 and 2 to mismatch, got %v", mismatched)
+	}
+
+	if _, err := verifyChunk(ec, crypto.GenerateSiaKey(crypto.TypeTwofish), 0, chunk, pieceSize, buf.Bytes(), []int{1, 2}); err == nil {
+		t.Fatal("expected twofish pieces to be unverifiable")
+	}
+}
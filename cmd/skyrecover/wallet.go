@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"time"
 
-	"github.com/siacentral/apisdkgo"
 	"github.com/spf13/cobra"
 	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/explorer"
 	"go.sia.tech/skyrecover/internal/wallet"
+	"rsc.io/qr"
 )
 
 var (
+	faucetAmount = "1KS"
+	faucetURL    string
+	addressQR    bool
+
 	walletCmd = &cobra.Command{
 		Use:   "wallet",
 		Short: "get the wallet address and balance",
@@ -25,6 +33,72 @@ var (
 
 			log.Println("Wallet Address:", w.Address())
 			log.Println("Wallet Balance:", balance.HumanString())
+			if immature := w.ImmatureBalance(); !immature.IsZero() {
+				log.Println("Immature Balance:", immature.HumanString())
+			}
+		},
+	}
+
+	walletValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "validate the recovery phrase and print the wallet address without network access",
+		Run: func(cmd *cobra.Command, args []string) {
+			addr, err := wallet.AddressFromPhrase(mustRecoveryPhrase())
+			if err != nil {
+				log.Fatalln("failed to validate recovery phrase:", err)
+			}
+			log.Println("Recovery phrase is valid")
+			log.Println("Wallet Address:", addr)
+		},
+	}
+
+	walletAddressCmd = &cobra.Command{
+		Use:   "address",
+		Short: "print the wallet address without network access",
+		Run: func(cmd *cobra.Command, args []string) {
+			addr, err := wallet.AddressFromPhrase(mustRecoveryPhrase())
+			if err != nil {
+				log.Fatalln("failed to get wallet address:", err)
+			}
+			// the address is printed to stdout so it can be piped or copied
+			fmt.Println(addr)
+			if addressQR {
+				if err := writeQR(os.Stdout, addr.String()); err != nil {
+					log.Fatalln("failed to render QR code:", err)
+				}
+			}
+		},
+	}
+
+	walletFaucetCmd = &cobra.Command{
+		Use:   "faucet",
+		Short: "request testnet funds from the faucet to the wallet address",
+		Run: func(cmd *cobra.Command, args []string) {
+			faucet := faucetURL
+			if len(faucet) == 0 {
+				faucet = network.FaucetAddress
+			}
+			if len(faucet) == 0 {
+				log.Fatalf("the %s network does not have a faucet, use --network zen", network.Name)
+			}
+
+			hastings, err := types.ParseCurrency(faucetAmount)
+			if err != nil {
+				log.Fatalln("failed to parse amount:", err)
+			}
+			var amount types.Currency
+			if _, err := fmt.Sscan(hastings, &amount); err != nil {
+				log.Fatalln("failed to parse amount:", err)
+			}
+
+			addr, err := wallet.AddressFromPhrase(mustRecoveryPhrase())
+			if err != nil {
+				log.Fatalln("failed to get wallet address:", err)
+			}
+			if err := explorerClient().RequestFunds(faucet, addr, amount); err != nil {
+				log.Fatalln("failed to request funds:", err)
+			}
+			log.Printf("Requested %v for %v", amount.HumanString(), addr)
 		},
 	}
 
@@ -67,11 +141,10 @@ var (
 			if err != nil {
 				log.Fatalln("failed to redistribute funds:", err)
 			}
-			defer release()
 
 			log.Printf("Creating %v outputs of %v each", count, outputAmount.HumanString())
-			siaCentralClient := apisdkgo.NewSiaClient()
-			if err := siaCentralClient.BroadcastTransactionSet([]types.Transaction{txn}); err != nil {
+			if err := broadcastTransaction(txn); err != nil {
+				release()
 				log.Fatalln("failed to broadcast transaction:", err)
 			}
 			log.Printf("Transaction %v broadcast", txn.ID())
@@ -79,12 +152,71 @@ var (
 	}
 )
 
-func mustLoadWallet() *wallet.SingleAddressWallet {
+// broadcastAttempts and broadcastDelay control how often a broadcast that
+// fails transiently is retried: 5 attempts over about 75 seconds.
+const (
+	broadcastAttempts = 5
+	broadcastDelay    = 5 * time.Second
+)
+
+// broadcastTransaction broadcasts the transaction, retrying with backoff if
+// siacentral fails transiently, e.g. when rate limited or when the transaction
+// pool is full. A transaction the network rejects as invalid is not retried.
+func broadcastTransaction(txn types.Transaction) error {
+	return withBackoff(broadcastAttempts, broadcastDelay, explorer.IsTransient, func() error {
+		return explorerClient().BroadcastTransactionSet([]types.Transaction{txn})
+	})
+}
+
+// writeQR renders text as a QR code using half block characters, two rows of
+// modules per line. Light modules are drawn so the code scans on terminals
+// with a dark background.
+func writeQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return err
+	}
+	// a 2 module quiet zone surrounds the code
+	const quiet = 2
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return true
+		}
+		return !code.Black(x, y)
+	}
+
+	bw := bufio.NewWriter(w)
+	size := code.Size + 2*quiet
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := light(x, y), y+1 < size && light(x, y+1)
+			switch {
+			case top && bottom:
+				bw.WriteString("█")
+			case top:
+				bw.WriteString("▀")
+			case bottom:
+				bw.WriteString("▄")
+			default:
+				bw.WriteByte(' ')
+			}
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func mustRecoveryPhrase() string {
 	recoveryPhrase := os.Getenv("RECOVERY_PHRASE")
 	if recoveryPhrase == "" {
 		log.Fatalln("RECOVERY_PHRASE environment variable not set")
 	}
-	wallet, err := wallet.New(recoveryPhrase)
+	return recoveryPhrase
+}
+
+func mustLoadWallet() *wallet.SingleAddressWallet {
+	wallet, err := wallet.New(dataDir, mustRecoveryPhrase(), wallet.WithExplorer(explorerClient()))
 	if err != nil {
 		log.Fatalln("failed to initialize wallet:", err)
 	}
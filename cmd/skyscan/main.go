@@ -6,39 +6,123 @@ import (
 	"crypto/sha512"
 	"encoding/hex"
 	"flag"
+	"fmt"
 	"hash"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gitlab.com/SkynetLabs/skyd/skymodules"
 )
 
+// hashers are the supported checksum algorithms.
+var hashers = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// detectAlgorithms returns the algorithms that produce checksums with the same
+// hex length as checksum.
+func detectAlgorithms(checksum string) (algos []string) {
+	for name, newHash := range hashers {
+		if newHash().Size()*2 == len(checksum) {
+			algos = append(algos, name)
+		}
+	}
+	sort.Strings(algos)
+	return
+}
+
+// skylinkLength returns the length of the file encoded in the skylink.
+func skylinkLength(skylink string) (uint64, error) {
+	var sl skymodules.Skylink
+	if err := sl.LoadString(skylink); err != nil {
+		return 0, fmt.Errorf("failed to parse skylink: %w", err)
+	}
+	_, length, err := sl.OffsetAndFetchSize()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get fetch size: %w", err)
+	}
+	return length, nil
+}
+
+// outputPath returns the path the matched file is written to. If output is a
+// directory, or ends with a path separator, the file is written to
+// <output>/<checksum>.bin and the directory is created if it does not exist.
+func outputPath(output, checksum string) (string, error) {
+	if stat, err := os.Stat(output); err == nil && !stat.IsDir() {
+		return output, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to stat output: %w", err)
+	} else if err != nil && !strings.HasSuffix(output, string(filepath.Separator)) && !strings.HasSuffix(output, "/") {
+		return output, nil
+	}
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return filepath.Join(output, checksum+".bin"), nil
+}
+
 func main() {
 	fileChecksum := flag.String("checksum", "", "checksum of the file")
-	fileLength := flag.Uint64("len", 0, "length of the file")
+	fileLength := flag.Uint64("len", 0, "length of the file, overrides -skylink")
+	skylink := flag.String("skylink", "", "skylink to read the length of the file from. The fetch size is rounded up, use -len if the exact length is known")
 	inputFilePath := flag.String("input", "", "path to the input file")
-	outputFilePath := flag.String("output", ".", "path to the output file")
-	checksumAlgo := flag.String("algo", "sha256", "checksum algorithm to use")
+	outputFilePath := flag.String("output", ".", "path to the output file, or a directory to write <checksum>.bin to")
+	checksumAlgo := flag.String("algo", "sha256", "checksum algorithm to use: md5, sha256, sha512, or auto to infer it from the checksum's length")
+	resumeFrom := flag.Uint64("resume-from", 0, "offset to resume an interrupted scan from")
+	statePath := flag.String("state", "", "file to save the scan's progress to, e.g. .scanstate. A scan of the same input and checksum resumes from the saved offset")
 	flag.Parse()
 
+	if *fileLength == 0 && len(*skylink) != 0 {
+		length, err := skylinkLength(*skylink)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		*fileLength = length
+		log.Printf("Using length %v from skylink", length)
+	}
+
 	switch {
 	case len(*fileChecksum) == 0:
 		log.Fatalln("missing -checksum")
 	case *fileLength == 0:
-		log.Fatalln("missing -len")
-	}
-
-	var h hash.Hash
-	switch strings.ToLower(*checksumAlgo) {
-	case "sha256":
-		h = sha256.New()
-	case "sha512":
-		h = sha512.New()
-	case "md5":
-		h = md5.New()
-	default:
+		log.Fatalln("missing -len or -skylink")
+	}
+
+	checksum := strings.ToLower(*fileChecksum)
+	var algos []string
+	if algo := strings.ToLower(*checksumAlgo); algo == "auto" {
+		algos = detectAlgorithms(checksum)
+		if len(algos) == 0 {
+			log.Fatalf("no supported checksum algorithm produces %v hex characters", len(checksum))
+		}
+		log.Printf("Trying %v", strings.Join(algos, ", "))
+	} else if _, ok := hashers[algo]; ok {
+		algos = []string{algo}
+	} else {
 		log.Fatalln("unknown checksum algorithm:", *checksumAlgo)
 	}
 
+	// resolve the output before scanning so a bad -output fails early
+	outputFile, err := outputPath(*outputFilePath, checksum)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	hs := make([]hash.Hash, len(algos))
+	for i, algo := range algos {
+		hs[i] = hashers[algo]()
+	}
+
 	stat, err := os.Stat(*inputFilePath)
 	if err != nil {
 		log.Fatalln("failed to stat input file:", err)
@@ -51,23 +135,86 @@ func main() {
 		log.Fatalln("failed to read input file:", err)
 	}
 
+	var stateKey string
+	if len(*statePath) != 0 {
+		stateKey, err = scanStateKey(*inputFilePath, checksum)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		states, err := loadScanStates(*statePath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// an explicit -resume-from takes precedence over the saved offset
+		if offset, ok := states[stateKey]; ok && *resumeFrom == 0 {
+			*resumeFrom = offset
+			log.Printf("Resuming from offset %v saved in %v", offset, *statePath)
+		}
+	}
+
 	n := uint64(len(input)) - *fileLength
-	for i := uint64(0); i < n; i++ {
-		// reset the hasher
-		h.Reset()
+	if *resumeFrom > n {
+		log.Fatalf("-resume-from %v is past the last offset %v", *resumeFrom, n)
+	}
+
+	// the offset being scanned is saved periodically and when the scan is
+	// interrupted
+	var scanned atomic.Uint64
+	scanned.Store(*resumeFrom)
+	var saveMu sync.Mutex
+	var finished bool
+	saveProgress := func(offset uint64, done bool) {
+		saveMu.Lock()
+		defer saveMu.Unlock()
+		if len(*statePath) == 0 || finished {
+			return
+		}
+		finished = done
+		if done {
+			offset = 0 // remove the scan from the state file
+		}
+		if err := saveScanOffset(*statePath, stateKey, offset); err != nil {
+			log.Println("[WARN] failed to save scan progress:", err)
+		}
+	}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		t := time.NewTicker(10 * time.Second)
+		for {
+			select {
+			case <-t.C:
+				saveProgress(scanned.Load(), false)
+			case <-c:
+				offset := scanned.Load()
+				saveProgress(offset, false)
+				log.Printf("Interrupted at offset %v, resume with -resume-from %v", offset, offset)
+				os.Exit(1)
+			}
+		}
+	}()
+	// the scan is finished, its saved progress is no longer needed
+	defer saveProgress(0, true)
+
+	for i := *resumeFrom; i <= n; i++ {
+		scanned.Store(i)
 		// get the current chunk range
 		start := i
 		end := i + *fileLength
 		chunk := input[start:end]
-		// check the checksum
-		if _, err := h.Write(chunk); err != nil {
-			log.Fatalln("failed to write chunk to hasher:", err)
-		} else if *fileChecksum == hex.EncodeToString(h.Sum(nil)) {
-			log.Printf("Found match at %v-%v", start, end)
-			if err := os.WriteFile(*outputFilePath, chunk, 0644); err != nil {
-				log.Fatalln("failed to write to output file:", err)
+		// check the checksum with each candidate algorithm
+		for j, h := range hs {
+			h.Reset()
+			if _, err := h.Write(chunk); err != nil {
+				log.Fatalln("failed to write chunk to hasher:", err)
+			} else if checksum == hex.EncodeToString(h.Sum(nil)) {
+				log.Printf("Found %v match at %v-%v", algos[j], start, end)
+				if err := os.WriteFile(outputFile, chunk, 0644); err != nil {
+					log.Fatalln("failed to write to output file:", err)
+				}
+				log.Println("Wrote match to", outputFile)
+				return
 			}
-			return
 		}
 	}
 
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	const checksum = "e9cd47a4"
+
+	tests := []struct {
+		output   string
+		expected string
+	}{
+		{dir, filepath.Join(dir, checksum+".bin")},
+		{filepath.Join(dir, "out.png"), filepath.Join(dir, "out.png")},
+		{filepath.Join(dir, "new") + "/", filepath.Join(dir, "new", checksum+".bin")},
+	}
+	for _, test := range tests {
+		fp, err := outputPath(test.output, checksum)
+		if err != nil {
+			t.Fatal(err)
+		} else if fp != test.expected {
+			t.Fatalf("%v: expected %v, got %v", test.output, test.expected, fp)
+		}
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "new")); err != nil || !stat.IsDir() {
+		t.Fatalf("expected the output directory to be created: %v", err)
+	}
+}
+
+func TestScanState(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), ".scanstate")
+	a, err := scanStateKey("a.bin", "e9cd47a4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := scanStateKey("b.bin", "e9cd47a4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saveScanOffset(fp, a, 100); err != nil {
+		t.Fatal(err)
+	} else if err := saveScanOffset(fp, b, 200); err != nil {
+		t.Fatal(err)
+	} else if err := saveScanOffset(fp, a, 150); err != nil {
+		t.Fatal(err)
+	}
+	states, err := loadScanStates(fp)
+	if err != nil {
+		t.Fatal(err)
+	} else if states[a] != 150 || states[b] != 200 {
+		t.Fatalf("unexpected states %v", states)
+	}
+
+	// a finished scan is removed without affecting the others
+	if err := saveScanOffset(fp, a, 0); err != nil {
+		t.Fatal(err)
+	} else if states, err = loadScanStates(fp); err != nil {
+		t.Fatal(err)
+	} else if _, ok := states[a]; ok || states[b] != 200 {
+		t.Fatalf("unexpected states %v", states)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// scanStateKey returns the key of a scan's progress in the state file, the
+// absolute path of the input and the checksum.
+func scanStateKey(input, checksum string) (string, error) {
+	abs, err := filepath.Abs(input)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	return abs + ":" + checksum, nil
+}
+
+// loadScanStates loads the offsets of the scans saved in the state file. A
+// missing file has no saved scans.
+func loadScanStates(fp string) (map[string]uint64, error) {
+	states := make(map[string]uint64)
+	buf, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read scan state: %w", err)
+	} else if err := json.Unmarshal(buf, &states); err != nil {
+		return nil, fmt.Errorf("failed to decode scan state: %w", err)
+	}
+	return states, nil
+}
+
+// saveScanOffset records the offset a scan has reached in the state file. A
+// zero offset removes the scan.
+func saveScanOffset(fp, key string, offset uint64) error {
+	states, err := loadScanStates(fp)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		delete(states, key)
+	} else {
+		states[key] = offset
+	}
+	buf, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode scan state: %w", err)
+	}
+	// write to a temporary file so an interrupted save does not lose the
+	// other scans
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return fmt.Errorf("failed to write scan state: %w", err)
+	} else if err := os.Rename(tmp, fp); err != nil {
+		return fmt.Errorf("failed to rename scan state: %w", err)
+	}
+	return nil
+}
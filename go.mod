@@ -8,13 +8,18 @@ require (
 	github.com/rodaine/table v1.1.0
 	github.com/siacentral/apisdkgo v0.2.6
 	github.com/spf13/cobra v1.1.3
+	github.com/spf13/pflag v1.0.5
+	github.com/spf13/viper v1.15.0
 	gitlab.com/NebulousLabs/encoding v0.0.0-20200604091946-456c3dc907fe
 	gitlab.com/SkynetLabs/skyd v1.6.9
 	go.sia.tech/renterd v0.0.0-20221205102301-90c186786876
 	go.sia.tech/siad v1.5.9
 	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/net v0.0.0-20220809184613-07c6da5e1ced
 	golang.org/x/sys v0.0.0-20220808155132-1c4a2a72c664
 	lukechampine.com/frand v1.4.2
+	modernc.org/sqlite v1.20.4
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -25,7 +30,6 @@ require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.1.0 // indirect
 	github.com/klauspost/reedsolomon v1.10.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/tus/tusd v1.9.0 // indirect
 	gitlab.com/NebulousLabs/bolt v1.4.4 // indirect
 	gitlab.com/NebulousLabs/entropy-mnemonics v0.0.0-20181018051301-7532f67e3500 // indirect
@@ -39,6 +43,5 @@ require (
 	gitlab.com/NebulousLabs/siamux v0.0.2-0.20220819160410-b3fb3772a220 // indirect
 	gitlab.com/NebulousLabs/threadgroup v0.0.0-20200608151952-38921fbef213 // indirect
 	gitlab.com/NebulousLabs/writeaheadlog v0.0.0-20200618142844-c59a90f49130 // indirect
-	golang.org/x/net v0.0.0-20220809184613-07c6da5e1ced // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
@@ -0,0 +1,342 @@
+// Package explorer provides Sia Central API clients for the networks
+// supported by skyrecover.
+package explorer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siacentral/apisdkgo/sia"
+	"go.sia.tech/siad/types"
+)
+
+type (
+	// A Network is a Sia network with a Sia Central explorer.
+	Network struct {
+		Name string
+		// APIAddress is the base address of the network's Sia Central API.
+		APIAddress string
+		// FaucetAddress is the address funds are requested from. It is empty
+		// if the network does not have a faucet.
+		FaucetAddress string
+
+		// The hardfork heights determine the replay protection prefix of
+		// transaction and revision signatures.
+		ASICHardforkHeight       types.BlockHeight
+		FoundationHardforkHeight types.BlockHeight
+	}
+
+	// A Client is a Sia Central API client for a specific network. A single
+	// client should be shared so its connections are reused.
+	Client struct {
+		address   string
+		userAgent string
+		http      *http.Client
+	}
+
+	// An Option configures a Client.
+	Option func(*Client)
+
+	// An APIError is an error response from the API.
+	APIError struct {
+		StatusCode int
+		Message    string
+	}
+)
+
+func (e *APIError) Error() string {
+	if len(e.Message) == 0 {
+		return fmt.Sprintf("request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s (status %d)", e.Message, e.StatusCode)
+}
+
+// transientMessages are rejections that may succeed if the request is
+// retried later.
+var transientMessages = []string{
+	"rate limit",
+	"too many requests",
+	"cannot accept more transactions", // the transaction pool is full
+}
+
+// duplicateMessages are broadcast rejections for transactions that are
+// already in the transaction pool, e.g. from a broadcast that succeeded but
+// whose response was lost.
+var duplicateMessages = []string{
+	"only duplicate transactions",
+	"already in the transaction pool",
+}
+
+func containsAny(s string, substrs []string) bool {
+	s = strings.ToLower(s)
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTransient returns true if a request that failed with err may succeed if it
+// is retried. Requests the API rejected as invalid are not transient;
+// connection errors, rate limits and server errors are.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500 || containsAny(apiErr.Message, transientMessages)
+}
+
+// DefaultUserAgent is the User-Agent header sent to the API.
+const DefaultUserAgent = "skyrecover"
+
+// activeHostsPageSize is the number of hosts requested at a time, the most
+// the API returns.
+const activeHostsPageSize = 500
+
+var (
+	// Mainnet is the Sia mainnet.
+	Mainnet = Network{
+		Name:       "mainnet",
+		APIAddress: "https://api.siacentral.com/v2",
+
+		ASICHardforkHeight:       179000,
+		FoundationHardforkHeight: 298000,
+	}
+
+	// Zen is the Zen testnet.
+	Zen = Network{
+		Name:          "zen",
+		APIAddress:    "https://api.siacentral.com/v2/zen",
+		FaucetAddress: "https://api.siacentral.com/v2/zen/faucet",
+
+		ASICHardforkHeight:       20,
+		FoundationHardforkHeight: 30,
+	}
+)
+
+// LookupNetwork returns the network with the given name.
+func LookupNetwork(name string) (Network, error) {
+	switch name {
+	case Mainnet.Name:
+		return Mainnet, nil
+	case Zen.Name:
+		return Zen, nil
+	default:
+		return Network{}, fmt.Errorf("unknown network %q, must be %q or %q", name, Mainnet.Name, Zen.Name)
+	}
+}
+
+// Activate sets the hardfork heights siad uses to sign transactions to the
+// network's. It must be called before any transaction or revision is signed.
+func (n Network) Activate() {
+	types.ASICHardforkHeight = n.ASICHardforkHeight
+	types.FoundationHardforkHeight = n.FoundationHardforkHeight
+}
+
+// request sends a request to the API and decodes the response into value.
+// Paths are relative to the client's address, full URLs are used as is.
+func (c *Client) request(method, path string, body, value interface{}) error {
+	addr := path
+	if !strings.HasPrefix(addr, "http") {
+		addr = c.address + path
+	}
+
+	var r io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		r = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, addr, r)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	var apiResp sia.APIResponse
+	if err := json.Unmarshal(buf, &apiResp); err != nil {
+		return fmt.Errorf("failed to decode response (status %d): %w", resp.StatusCode, err)
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 || apiResp.Type != "success" {
+		return &APIError{StatusCode: resp.StatusCode, Message: apiResp.Message}
+	} else if value == nil {
+		return nil
+	} else if err := json.Unmarshal(buf, value); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// GetChainIndex returns the current height and block ID of the network.
+func (c *Client) GetChainIndex() (sia.ChainIndex, error) {
+	var resp struct {
+		Index sia.ChainIndex `json:"index"`
+	}
+	if err := c.request(http.MethodGet, "/explorer/consensus/index", nil, &resp); err != nil {
+		return sia.ChainIndex{}, fmt.Errorf("failed to get chain index: %w", err)
+	}
+	return resp.Index, nil
+}
+
+// GetHost returns the host with the given public key or net address.
+func (c *Client) GetHost(id string) (sia.HostDetails, error) {
+	var resp struct {
+		Host sia.HostDetails `json:"host"`
+	}
+	if err := c.request(http.MethodGet, "/hosts/"+url.PathEscape(id), nil, &resp); err != nil {
+		return sia.HostDetails{}, fmt.Errorf("failed to get host: %w", err)
+	}
+	return resp.Host, nil
+}
+
+// GetActiveHosts returns a page of the network's active hosts.
+func (c *Client) GetActiveHosts(filter sia.HostFilter, page, limit int) ([]sia.HostDetails, error) {
+	if page < 0 {
+		page = 0
+	}
+	if limit < 0 || limit > activeHostsPageSize {
+		limit = activeHostsPageSize
+	}
+
+	values := make(url.Values)
+	for k, v := range filter {
+		values[k] = v
+	}
+	values.Set("page", strconv.Itoa(page))
+	values.Set("limit", strconv.Itoa(limit))
+
+	var resp struct {
+		Hosts []sia.HostDetails `json:"hosts"`
+	}
+	if err := c.request(http.MethodGet, "/hosts?"+values.Encode(), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to get hosts: %w", err)
+	}
+	return resp.Hosts, nil
+}
+
+// ActiveHosts returns every active host matching the filter, requesting
+// activeHostsPageSize hosts at a time.
+func (c *Client) ActiveHosts(filter sia.HostFilter) ([]sia.HostDetails, error) {
+	var hosts []sia.HostDetails
+	for page := 0; ; page++ {
+		details, err := c.GetActiveHosts(filter, page, activeHostsPageSize)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, details...)
+		if len(details) < activeHostsPageSize {
+			return hosts, nil
+		}
+	}
+}
+
+// GetTransactionFees returns the minimum and maximum recommended fee per byte.
+func (c *Client) GetTransactionFees() (min, max types.Currency, err error) {
+	var resp struct {
+		Minimum types.Currency `json:"minimum"`
+		Maximum types.Currency `json:"maximum"`
+	}
+	if err := c.request(http.MethodGet, "/wallet/fees", nil, &resp); err != nil {
+		return types.ZeroCurrency, types.ZeroCurrency, fmt.Errorf("failed to get transaction fees: %w", err)
+	}
+	return resp.Minimum, resp.Maximum, nil
+}
+
+// GetAddressBalance returns the balance and unspent outputs of an address. The
+// API does not paginate addresses, limit and page are ignored.
+func (c *Client) GetAddressBalance(limit, page int, address string) (resp sia.GetTransactionsResp, err error) {
+	if err := c.request(http.MethodGet, "/wallet/addresses/"+url.PathEscape(address), nil, &resp); err != nil {
+		return sia.GetTransactionsResp{}, fmt.Errorf("failed to get address balance: %w", err)
+	}
+	return resp, nil
+}
+
+// BroadcastTransactionSet broadcasts the transaction set to the network. A
+// transaction set that is already in the transaction pool is not an error, so
+// a broadcast can be retried safely.
+func (c *Client) BroadcastTransactionSet(txnSet []types.Transaction) error {
+	req := map[string]interface{}{
+		"transactions": txnSet,
+	}
+	var apiErr *APIError
+	if err := c.request(http.MethodPost, "/wallet/broadcast", req, nil); errors.As(err, &apiErr) && containsAny(apiErr.Message, duplicateMessages) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to broadcast transaction set: %w", err)
+	}
+	return nil
+}
+
+// RequestFunds asks the faucet at faucetAddr to send amount to addr.
+func (c *Client) RequestFunds(faucetAddr string, addr types.UnlockHash, amount types.Currency) error {
+	req := struct {
+		UnlockHash types.UnlockHash `json:"unlockHash"`
+		Amount     types.Currency   `json:"amount"`
+	}{addr, amount}
+	if err := c.request(http.MethodPost, faucetAddr, req, nil); err != nil {
+		return fmt.Errorf("failed to request funds: %w", err)
+	}
+	return nil
+}
+
+// WithAddress overrides the network's API address, e.g. to use a self-hosted
+// mirror.
+func WithAddress(addr string) Option {
+	return func(c *Client) {
+		c.address = strings.TrimSuffix(addr, "/")
+	}
+}
+
+// WithTimeout sets the timeout of each request. The default is 30 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http.Timeout = timeout
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with each request.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) {
+		c.userAgent = ua
+	}
+}
+
+// NewClient returns a Sia Central API client for the network.
+func NewClient(n Network, opts ...Option) *Client {
+	c := &Client{
+		address:   n.APIAddress,
+		userAgent: DefaultUserAgent,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
@@ -0,0 +1,178 @@
+package explorer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/siacentral/apisdkgo/sia"
+	"go.sia.tech/siad/types"
+)
+
+func TestLookupNetwork(t *testing.T) {
+	for _, n := range []Network{Mainnet, Zen} {
+		got, err := LookupNetwork(n.Name)
+		if err != nil {
+			t.Fatal(err)
+		} else if got != n {
+			t.Fatalf("expected %v, got %v", n, got)
+		}
+	}
+	if _, err := LookupNetwork("testnet"); err == nil {
+		t.Fatal("expected unknown network to fail")
+	}
+}
+
+func TestGetActiveHosts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zen/hosts" {
+			http.NotFound(w, r)
+			return
+		} else if r.URL.Query().Get("page") != "2" || r.URL.Query().Get("limit") != "10" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":  "success",
+			"hosts": []sia.HostDetails{{PublicKey: "ed25519:01"}},
+		})
+	}))
+	defer srv.Close()
+
+	c := NewClient(Network{APIAddress: srv.URL + "/zen"})
+	hosts, err := c.GetActiveHosts(make(sia.HostFilter), 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 || hosts[0].PublicKey != "ed25519:01" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestActiveHosts(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// the first page is full, the second is not
+		n := activeHostsPageSize
+		if r.URL.Query().Get("page") != "0" {
+			n = 1
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":  "success",
+			"hosts": make([]sia.HostDetails, n),
+		})
+	}))
+	defer srv.Close()
+
+	c := NewClient(Network{APIAddress: srv.URL})
+	hosts, err := c.ActiveHosts(make(sia.HostFilter))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != activeHostsPageSize+1 {
+		t.Fatalf("expected %v hosts, got %v", activeHostsPageSize+1, len(hosts))
+	} else if requests != 2 {
+		t.Fatalf("expected 2 requests, got %v", requests)
+	}
+}
+
+func TestRequestFunds(t *testing.T) {
+	addr := types.UnlockHash{1}
+	amount := types.SiacoinPrecision.Mul64(100)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			UnlockHash types.UnlockHash `json:"unlockHash"`
+			Amount     types.Currency   `json:"amount"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		} else if req.UnlockHash != addr || !req.Amount.Equals(amount) {
+			t.Errorf("unexpected request %v", req)
+		}
+		if req.Amount.Cmp(types.SiacoinPrecision.Mul64(1000)) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(sia.APIResponse{Type: "error", Message: "amount too large"})
+			return
+		}
+		json.NewEncoder(w).Encode(sia.APIResponse{Type: "success"})
+	}))
+	defer srv.Close()
+
+	c := NewClient(Zen)
+	if err := c.RequestFunds(srv.URL, addr, amount); err != nil {
+		t.Fatal(err)
+	}
+	amount = types.SiacoinPrecision.Mul64(10000)
+	if err := c.RequestFunds(srv.URL, addr, amount); err == nil {
+		t.Fatal("expected faucet error")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mirror/explorer/consensus/index" {
+			http.NotFound(w, r)
+			return
+		} else if ua := r.Header.Get("User-Agent"); ua != "test" {
+			t.Errorf("expected user agent %q, got %q", "test", ua)
+		} else if r.URL.Query().Get("slow") == "true" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"type":  "success",
+			"index": sia.ChainIndex{Height: 100},
+		})
+	}))
+	defer srv.Close()
+
+	c := NewClient(Mainnet, WithAddress(srv.URL+"/mirror/"), WithUserAgent("test"), WithTimeout(50*time.Millisecond))
+	index, err := c.GetChainIndex()
+	if err != nil {
+		t.Fatal(err)
+	} else if index.Height != 100 {
+		t.Fatalf("expected height 100, got %v", index.Height)
+	}
+
+	if err := c.request(http.MethodGet, "/explorer/consensus/index?slow=true", nil, nil); err == nil {
+		t.Fatal("expected request to time out")
+	}
+}
+
+func TestBroadcastTransactionSet(t *testing.T) {
+	var status int
+	var message string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(sia.APIResponse{Type: "error", Message: message})
+			return
+		}
+		json.NewEncoder(w).Encode(sia.APIResponse{Type: "success"})
+	}))
+	defer srv.Close()
+
+	c := NewClient(Network{APIAddress: srv.URL})
+	tests := []struct {
+		status    int
+		message   string
+		ok        bool
+		transient bool
+	}{
+		{http.StatusOK, "", true, false},
+		{http.StatusTooManyRequests, "", false, true},
+		{http.StatusBadGateway, "", false, true},
+		{http.StatusBadRequest, "transaction pool cannot accept more transactions", false, true},
+		{http.StatusBadRequest, "transaction set contains only duplicate transactions", true, false},
+		{http.StatusBadRequest, "transaction contains a storage proof and conflicts", false, false},
+	}
+	for _, test := range tests {
+		status, message = test.status, test.message
+		err := c.BroadcastTransactionSet([]types.Transaction{{}})
+		if test.ok != (err == nil) {
+			t.Fatalf("%v %q: unexpected error %v", test.status, test.message, err)
+		} else if IsTransient(err) != test.transient {
+			t.Fatalf("%v %q: expected transient to be %v", test.status, test.message, test.transient)
+		}
+	}
+}
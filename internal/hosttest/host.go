@@ -0,0 +1,424 @@
+// Package hosttest provides an in-process RHPv2 host for testing renter
+// interactions without connecting to the Sia network.
+package hosttest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"lukechampine.com/frand"
+)
+
+var (
+	// ErrContractNotFound is returned by the Lock RPC when the host does not
+	// have the requested contract. The message matches siad.
+	ErrContractNotFound = errors.New("no record of that contract")
+	// ErrSectorNotFound is returned by the Read RPC when the host does not
+	// have the requested sector. The message matches siad.
+	ErrSectorNotFound = errors.New("could not find the desired sector")
+	// ErrInsufficientPayment is returned by the Read RPC when the renter pays
+	// less than the host's current prices. The message matches siad.
+	ErrInsufficientPayment = errors.New("rejected for high paying renter valid output")
+)
+
+type contract struct {
+	revision   types.FileContractRevision
+	signatures [2]types.TransactionSignature
+}
+
+// A Host is an in-process RHPv2 host that stores sectors in memory. It
+// implements the Settings, FormContract, RenewAndClear, Lock, and Read RPCs.
+// Sectors are shared by all contracts.
+type Host struct {
+	mu        sync.Mutex
+	settings  rhp.HostSettings
+	privKey   rhp.PrivateKey
+	sectors   map[rhp.Hash256]*[rhp.SectorSize]byte
+	contracts map[types.FileContractID]*contract
+}
+
+// PublicKey returns the host's public key.
+func (h *Host) PublicKey() rhp.PublicKey {
+	return h.key().PublicKey()
+}
+
+// RotateKey replaces the host's key with a new random key, simulating a host
+// that has been reinstalled at the same net address.
+func (h *Host) RotateKey() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.privKey = rhp.GeneratePrivateKey()
+}
+
+func (h *Host) key() rhp.PrivateKey {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.privKey
+}
+
+// NetAddress returns the host's net address.
+func (h *Host) NetAddress() string {
+	return h.Settings().NetAddress
+}
+
+// Settings returns the host's settings.
+func (h *Host) Settings() rhp.HostSettings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.settings
+}
+
+// SetDownloadPrice changes the host's download bandwidth price, simulating a
+// host that adjusts its prices while renters have its settings cached.
+func (h *Host) SetDownloadPrice(price types.Currency) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.settings.DownloadBandwidthPrice = price
+}
+
+// AddSector stores a sector on the host and returns its Merkle root.
+func (h *Host) AddSector(sector *[rhp.SectorSize]byte) rhp.Hash256 {
+	root := rhp.SectorRoot(sector)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sectors[root] = sector
+	return root
+}
+
+// DeleteSector removes a sector from the host.
+func (h *Host) DeleteSector(root rhp.Hash256) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sectors, root)
+}
+
+// DeleteContracts removes all of the host's contracts, simulating a host that
+// has lost its contract database.
+func (h *Host) DeleteContracts() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.contracts = make(map[types.FileContractID]*contract)
+}
+
+func (h *Host) signRevision(rev types.FileContractRevision) types.TransactionSignature {
+	sig := h.key().SignHash(rhp.Hash256(crypto.HashObject(rev)))
+	return types.TransactionSignature{
+		ParentID:       crypto.Hash(rev.ParentID),
+		CoveredFields:  types.CoveredFields{FileContractRevisions: []uint64{0}},
+		PublicKeyIndex: 1,
+		Signature:      sig[:],
+	}
+}
+
+func (h *Host) handleSettings(t *rhp.Transport) error {
+	buf, err := json.Marshal(h.Settings())
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+	return t.WriteResponse(&rhp.RPCSettingsResponse{Settings: buf})
+}
+
+func (h *Host) handleFormContract(t *rhp.Transport) error {
+	var req rhp.RPCFormContractRequest
+	if err := t.ReadRequest(&req, 65536); err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	} else if len(req.Transactions) == 0 || len(req.Transactions[len(req.Transactions)-1].FileContracts) == 0 {
+		return t.WriteResponseErr(errors.New("transaction set does not contain a file contract"))
+	}
+
+	// the host does not add any inputs or collateral
+	if err := t.WriteResponse(&rhp.RPCFormContractAdditions{}); err != nil {
+		return fmt.Errorf("failed to write additions: %w", err)
+	}
+
+	var renterSigs rhp.RPCFormContractSignatures
+	if err := t.ReadResponse(&renterSigs, 4096); err != nil {
+		return fmt.Errorf("failed to read renter signatures: %w", err)
+	}
+
+	txn := req.Transactions[len(req.Transactions)-1]
+	fc := txn.FileContracts[0]
+	hostKey := h.PublicKey()
+	rev := types.FileContractRevision{
+		ParentID: txn.FileContractID(0),
+		UnlockConditions: types.UnlockConditions{
+			PublicKeys: []types.SiaPublicKey{
+				req.RenterKey,
+				{Algorithm: types.SignatureEd25519, Key: hostKey[:]},
+			},
+			SignaturesRequired: 2,
+		},
+		NewRevisionNumber: 1,
+
+		NewFileSize:           fc.FileSize,
+		NewFileMerkleRoot:     fc.FileMerkleRoot,
+		NewWindowStart:        fc.WindowStart,
+		NewWindowEnd:          fc.WindowEnd,
+		NewValidProofOutputs:  fc.ValidProofOutputs,
+		NewMissedProofOutputs: fc.MissedProofOutputs,
+		NewUnlockHash:         fc.UnlockHash,
+	}
+	hostSig := h.signRevision(rev)
+
+	h.mu.Lock()
+	h.contracts[rev.ParentID] = &contract{
+		revision:   rev,
+		signatures: [2]types.TransactionSignature{renterSigs.RevisionSignature, hostSig},
+	}
+	h.mu.Unlock()
+
+	return t.WriteResponse(&rhp.RPCFormContractSignatures{
+		RevisionSignature: hostSig,
+	})
+}
+
+func (h *Host) handleRenewContract(t *rhp.Transport, c *contract) error {
+	var req rhp.RPCRenewAndClearContractRequest
+	if err := t.ReadRequest(&req, 65536); err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	} else if c == nil {
+		t.WriteResponseErr(rhp.ErrNoContractLocked)
+		return rhp.ErrNoContractLocked
+	} else if len(req.Transactions) == 0 || len(req.Transactions[len(req.Transactions)-1].FileContracts) == 0 {
+		return t.WriteResponseErr(errors.New("transaction set does not contain a file contract"))
+	}
+
+	// the host does not add any inputs or collateral
+	if err := t.WriteResponse(&rhp.RPCFormContractAdditions{}); err != nil {
+		return fmt.Errorf("failed to write additions: %w", err)
+	}
+
+	var renterSigs rhp.RPCRenewAndClearContractSignatures
+	if err := t.ReadResponse(&renterSigs, 4096); err != nil {
+		return fmt.Errorf("failed to read renter signatures: %w", err)
+	}
+
+	txn := req.Transactions[len(req.Transactions)-1]
+	fc := txn.FileContracts[0]
+	rev := types.FileContractRevision{
+		ParentID:          txn.FileContractID(0),
+		UnlockConditions:  c.revision.UnlockConditions,
+		NewRevisionNumber: 1,
+
+		NewFileSize:           fc.FileSize,
+		NewFileMerkleRoot:     fc.FileMerkleRoot,
+		NewWindowStart:        fc.WindowStart,
+		NewWindowEnd:          fc.WindowEnd,
+		NewValidProofOutputs:  fc.ValidProofOutputs,
+		NewMissedProofOutputs: fc.MissedProofOutputs,
+		NewUnlockHash:         fc.UnlockHash,
+	}
+	hostSig := h.signRevision(rev)
+
+	// clear the old contract so it cannot be revised again
+	final := c.revision
+	final.NewValidProofOutputs = append([]types.SiacoinOutput(nil), final.NewValidProofOutputs...)
+	for i := range final.NewValidProofOutputs {
+		if i < len(req.FinalValidProofValues) {
+			final.NewValidProofOutputs[i].Value = req.FinalValidProofValues[i]
+		}
+	}
+	final.NewMissedProofOutputs = final.NewValidProofOutputs
+	final.NewRevisionNumber = math.MaxUint64
+	final.NewFileSize = 0
+	final.NewFileMerkleRoot = crypto.Hash{}
+	finalSig := h.signRevision(final)
+
+	h.mu.Lock()
+	c.revision = final
+	c.signatures = [2]types.TransactionSignature{{Signature: renterSigs.FinalRevisionSignature[:]}, finalSig}
+	h.contracts[rev.ParentID] = &contract{
+		revision:   rev,
+		signatures: [2]types.TransactionSignature{renterSigs.RevisionSignature, hostSig},
+	}
+	h.mu.Unlock()
+
+	resp := &rhp.RPCRenewAndClearContractSignatures{
+		RevisionSignature: hostSig,
+	}
+	copy(resp.FinalRevisionSignature[:], finalSig.Signature)
+	return t.WriteResponse(resp)
+}
+
+func (h *Host) handleLock(t *rhp.Transport) (*contract, error) {
+	var req rhp.RPCLockRequest
+	if err := t.ReadRequest(&req, 4096); err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+
+	h.mu.Lock()
+	c, ok := h.contracts[req.ContractID]
+	h.mu.Unlock()
+	if !ok {
+		t.WriteResponseErr(ErrContractNotFound)
+		return nil, ErrContractNotFound
+	}
+
+	var challenge [16]byte
+	frand.Read(challenge[:])
+	resp := &rhp.RPCLockResponse{
+		Acquired:     true,
+		NewChallenge: challenge,
+		Revision:     c.revision,
+		Signatures:   c.signatures[:],
+	}
+	if err := t.WriteResponse(resp); err != nil {
+		return nil, fmt.Errorf("failed to write response: %w", err)
+	}
+	t.SetChallenge(challenge)
+	return c, nil
+}
+
+func (h *Host) handleRead(t *rhp.Transport, c *contract) error {
+	var req rhp.RPCReadRequest
+	if err := t.ReadRequest(&req, 4096); err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	} else if c == nil {
+		t.WriteResponseErr(rhp.ErrNoContractLocked)
+		return rhp.ErrNoContractLocked
+	}
+
+	// apply the renter's payment
+	rev := c.revision
+	rev.NewRevisionNumber = req.NewRevisionNumber
+	rev.NewValidProofOutputs = append([]types.SiacoinOutput(nil), rev.NewValidProofOutputs...)
+	for i, v := range req.NewValidProofValues {
+		rev.NewValidProofOutputs[i].Value = v
+	}
+	rev.NewMissedProofOutputs = append([]types.SiacoinOutput(nil), rev.NewMissedProofOutputs...)
+	for i, v := range req.NewMissedProofValues {
+		rev.NewMissedProofOutputs[i].Value = v
+	}
+	hostSig := h.signRevision(rev)
+
+	// like siad, the payment must cover the host's current prices
+	cost := rhp.RPCReadCost(h.Settings(), req.Sections)
+	if len(req.NewValidProofValues) == 0 || c.revision.NewValidProofOutputs[0].Value.Cmp(req.NewValidProofValues[0]) < 0 {
+		err := fmt.Errorf("%w: renter increased its valid proof output", ErrInsufficientPayment)
+		t.WriteResponseErr(err)
+		return err
+	} else if paid := c.revision.NewValidProofOutputs[0].Value.Sub(req.NewValidProofValues[0]); paid.Cmp(cost) < 0 {
+		err := fmt.Errorf("%w: expected at least %v to be exchanged, but %v was exchanged", ErrInsufficientPayment, cost, paid)
+		t.WriteResponseErr(err)
+		return err
+	}
+
+	for i, sec := range req.Sections {
+		h.mu.Lock()
+		sector, ok := h.sectors[sec.MerkleRoot]
+		h.mu.Unlock()
+		if !ok {
+			t.WriteResponseErr(ErrSectorNotFound)
+			return ErrSectorNotFound
+		} else if sec.Offset+sec.Length > rhp.SectorSize || sec.Offset%rhp.LeafSize != 0 || sec.Length%rhp.LeafSize != 0 {
+			err := errors.New("invalid section")
+			t.WriteResponseErr(err)
+			return err
+		}
+
+		// like siad, the signature is only sent with the final section
+		resp := &rhp.RPCReadResponse{
+			Data: sector[sec.Offset : sec.Offset+sec.Length],
+		}
+		if i == len(req.Sections)-1 {
+			copy(resp.Signature[:], hostSig.Signature)
+		}
+		if req.MerkleProof {
+			start, end := int(sec.Offset/rhp.LeafSize), int((sec.Offset+sec.Length)/rhp.LeafSize)
+			for _, h := range crypto.MerkleRangeProof(sector[:], start, end) {
+				resp.MerkleProof = append(resp.MerkleProof, rhp.Hash256(h))
+			}
+		}
+		if err := t.WriteResponse(resp); err != nil {
+			return fmt.Errorf("failed to write sector data: %w", err)
+		}
+	}
+
+	var stop rhp.Specifier
+	if err := t.ReadResponse(&stop, 4096); err != nil {
+		return fmt.Errorf("failed to read stop signal: %w", err)
+	} else if stop != rhp.RPCReadStop {
+		return fmt.Errorf("expected stop signal, got %v", stop)
+	}
+
+	h.mu.Lock()
+	c.revision = rev
+	c.signatures[0].Signature = req.Signature[:]
+	c.signatures[1] = hostSig
+	h.mu.Unlock()
+	return nil
+}
+
+// Serve handles RPCs on conn until the renter closes the connection or an RPC
+// fails. Like siad, the connection is closed after an RPC error.
+func (h *Host) Serve(conn net.Conn) error {
+	defer conn.Close()
+
+	t, err := rhp.NewHostTransport(conn, h.key())
+	if err != nil {
+		return fmt.Errorf("failed to complete handshake: %w", err)
+	}
+	defer t.Close()
+
+	var locked *contract
+	for {
+		id, err := t.ReadID()
+		if errors.Is(err, rhp.ErrRenterClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read RPC ID: %w", err)
+		}
+
+		switch id {
+		case rhp.RPCSettingsID:
+			err = h.handleSettings(t)
+		case rhp.RPCFormContractID:
+			err = h.handleFormContract(t)
+		case rhp.RPCRenewClearContractID:
+			err = h.handleRenewContract(t, locked)
+		case rhp.RPCLockID:
+			locked, err = h.handleLock(t)
+		case rhp.RPCReadID:
+			err = h.handleRead(t, locked)
+		case rhp.RPCUnlockID:
+			locked = nil
+		default:
+			err = fmt.Errorf("unsupported RPC %v", id)
+			t.WriteResponseErr(err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// NewHost returns a new Host with the given net address and a random key.
+func NewHost(netAddress string) *Host {
+	return &Host{
+		privKey: rhp.GeneratePrivateKey(),
+		settings: rhp.HostSettings{
+			AcceptingContracts:     true,
+			MaxDownloadBatchSize:   1 << 22,
+			MaxDuration:            144 * 7 * 52,
+			MaxReviseBatchSize:     1 << 22,
+			NetAddress:             netAddress,
+			SectorSize:             rhp.SectorSize,
+			WindowSize:             144,
+			BaseRPCPrice:           types.NewCurrency64(1),
+			ContractPrice:          types.SiacoinPrecision,
+			DownloadBandwidthPrice: types.NewCurrency64(1),
+			SectorAccessPrice:      types.NewCurrency64(1),
+			MaxCollateral:          types.SiacoinPrecision.Mul64(1000),
+			Version:                "1.5.9",
+		},
+		sectors:   make(map[rhp.Hash256]*[rhp.SectorSize]byte),
+		contracts: make(map[types.FileContractID]*contract),
+	}
+}
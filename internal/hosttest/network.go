@@ -0,0 +1,145 @@
+package hosttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/siacentral/apisdkgo/sia"
+	"go.sia.tech/siad/types"
+)
+
+// A Network routes connections to in-process hosts by net address. It
+// implements renter.Dialer and renter.Explorer.
+type Network struct {
+	mu       sync.Mutex
+	height   uint64
+	hosts    map[string]*Host // keyed by net address
+	delisted map[string]bool  // keyed by public key
+}
+
+// AddHost adds a new host to the network.
+func (n *Network) AddHost() *Host {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	h := NewHost(fmt.Sprintf("host%d.test:9982", len(n.hosts)+1))
+	n.hosts[h.NetAddress()] = h
+	return h
+}
+
+// RemoveHost removes the host from the network. Connections to its net
+// address will fail.
+func (n *Network) RemoveHost(h *Host) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.hosts, h.NetAddress())
+}
+
+// Delist hides the host from GetHost while leaving it reachable.
+func (n *Network) Delist(h *Host) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delisted[h.PublicKey().String()] = true
+}
+
+// SetHeight sets the height returned by GetChainIndex.
+func (n *Network) SetHeight(height uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.height = height
+}
+
+// DialContext implements renter.Dialer. The host is served over an in-memory
+// pipe.
+func (n *Network) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n.mu.Lock()
+	h, ok := n.hosts[address]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %v %v: connection refused", network, address)
+	}
+
+	renterConn, hostConn := net.Pipe()
+	go h.Serve(hostConn)
+	return renterConn, nil
+}
+
+// GetChainIndex implements renter.Explorer.
+func (n *Network) GetChainIndex() (sia.ChainIndex, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return sia.ChainIndex{
+		ID:     strings.Repeat("0", 64),
+		Height: n.height,
+	}, nil
+}
+
+// GetHost implements renter.Explorer. Like siacentral, hosts can be looked up
+// by public key or net address.
+func (n *Network) GetHost(id string) (sia.HostDetails, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, h := range n.hosts {
+		pub := h.PublicKey().String()
+		if n.delisted[pub] {
+			continue
+		} else if pub == id || h.NetAddress() == id {
+			settings := h.Settings()
+			return sia.HostDetails{
+				NetAddress: h.NetAddress(),
+				PublicKey:  pub,
+				Online:     true,
+				Settings: &sia.HostExternalSettings{
+					NetAddress:             settings.NetAddress,
+					AcceptingContracts:     settings.AcceptingContracts,
+					WindowSize:             settings.WindowSize,
+					BaseRPCPrice:           settings.BaseRPCPrice,
+					ContractPrice:          settings.ContractPrice,
+					DownloadBandwidthPrice: settings.DownloadBandwidthPrice,
+					SectorAccessPrice:      settings.SectorAccessPrice,
+					MaxCollateral:          settings.MaxCollateral,
+				},
+			}, nil
+		}
+	}
+	return sia.HostDetails{}, errors.New("host not found")
+}
+
+// ActiveHosts implements renter.Explorer. Every listed host accepting contracts
+// is active, the filter is ignored.
+func (n *Network) ActiveHosts(filter sia.HostFilter) ([]sia.HostDetails, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var active []sia.HostDetails
+	for _, h := range n.hosts {
+		pub := h.PublicKey().String()
+		if n.delisted[pub] || !h.Settings().AcceptingContracts {
+			continue
+		}
+		active = append(active, sia.HostDetails{
+			NetAddress: h.NetAddress(),
+			PublicKey:  pub,
+			Online:     true,
+		})
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].PublicKey < active[j].PublicKey })
+	return active, nil
+}
+
+// GetTransactionFees implements renter.Explorer.
+func (n *Network) GetTransactionFees() (min, max types.Currency, err error) {
+	return types.NewCurrency64(1), types.NewCurrency64(1), nil
+}
+
+// NewNetwork returns an empty Network.
+func NewNetwork() *Network {
+	return &Network{
+		height:   100,
+		hosts:    make(map[string]*Host),
+		delisted: make(map[string]bool),
+	}
+}
@@ -0,0 +1,42 @@
+// Package jsonout encodes JSON output with a configurable indentation.
+package jsonout
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// DefaultIndent is the indentation used when none is specified.
+const DefaultIndent = "  "
+
+// ParseIndent returns the indentation for the --compact and --indent flags.
+// Compact output has no indentation. "tab" indents with tabs.
+func ParseIndent(compact bool, indent string) string {
+	switch {
+	case compact:
+		return ""
+	case indent == "tab":
+		return "\t"
+	default:
+		return indent
+	}
+}
+
+// NewEncoder returns a JSON encoder that writes to w with the indentation. An
+// empty indent writes compact JSON.
+func NewEncoder(w io.Writer, indent string) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if len(indent) != 0 {
+		enc.SetIndent("", indent)
+	}
+	return enc
+}
+
+// Marshal returns the JSON encoding of v with the indentation. An empty indent
+// returns compact JSON.
+func Marshal(v interface{}, prefix, indent string) ([]byte, error) {
+	if len(indent) == 0 {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, prefix, indent)
+}
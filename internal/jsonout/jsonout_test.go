@@ -0,0 +1,34 @@
+package jsonout
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	v := map[string][]int{"a": {1, 2}}
+	tests := []struct {
+		compact  bool
+		indent   string
+		expected string
+	}{
+		{false, DefaultIndent, "{\n  \"a\": [\n    1,\n    2\n  ]\n}\n"},
+		{false, "tab", "{\n\t\"a\": [\n\t\t1,\n\t\t2\n\t]\n}\n"},
+		{true, DefaultIndent, "{\"a\":[1,2]}\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, ParseIndent(test.compact, test.indent)).Encode(v); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != test.expected {
+			t.Errorf("compact %v, indent %q: expected %q, got %q", test.compact, test.indent, test.expected, buf.String())
+		}
+
+		b, err := Marshal(v, "", ParseIndent(test.compact, test.indent))
+		if err != nil {
+			t.Fatal(err)
+		} else if string(b)+"\n" != test.expected {
+			t.Errorf("compact %v, indent %q: expected %q, got %q", test.compact, test.indent, test.expected, b)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package renter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+// encryptedContractsFile is the contracts file written when the renter has a
+// passphrase. It holds the same JSON, gzip compressed if compression is
+// enabled, sealed with XChaCha20-Poly1305.
+const encryptedContractsFile = "contracts.json.enc"
+
+// encryptedMagic and encryptedVersion identify an encrypted contracts file.
+// They are followed by the key derivation salt, the nonce, and the
+// ciphertext.
+const (
+	encryptedMagic   = "skyrcont"
+	encryptedVersion = 1
+	saltSize         = 16
+)
+
+var (
+	// ErrPassphraseRequired is returned when the contracts file is encrypted
+	// and the renter has no passphrase.
+	ErrPassphraseRequired = errors.New("contracts file is encrypted, a passphrase is required")
+	// ErrWrongPassphrase is returned when the contracts file cannot be
+	// decrypted with the renter's passphrase.
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupt contracts file")
+)
+
+// WithPassphrase encrypts the contracts file, which contains the renter's
+// private key, with a key derived from passphrase. An existing plaintext
+// contracts file is encrypted when the renter is created. An empty
+// passphrase leaves the contracts file unencrypted.
+func WithPassphrase(passphrase string) Option {
+	return func(r *Renter) {
+		r.passphrase = passphrase
+	}
+}
+
+// ContractsEncrypted returns true if the contracts file in dir is encrypted.
+func ContractsEncrypted(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, encryptedContractsFile))
+	return err == nil
+}
+
+// A contractsKey is the key the contracts file is encrypted with and the salt
+// it was derived with. Deriving the key is deliberately slow, so it is derived
+// once and reused for every save; each save uses a new nonce.
+type contractsKey struct {
+	salt []byte
+	key  []byte
+}
+
+// deriveKey derives the contracts file's encryption key from the passphrase
+// using Argon2id with the parameters recommended by its RFC.
+func deriveKey(passphrase string, salt []byte) contractsKey {
+	return contractsKey{
+		salt: salt,
+		key:  argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, chacha20poly1305.KeySize),
+	}
+}
+
+// encryptionKey returns the renter's contracts key, deriving it with a random
+// salt if the contracts file has not been loaded or saved yet. The caller
+// must hold r.saveMu.
+func (r *Renter) encryptionKey() contractsKey {
+	if r.contractsKey.key == nil {
+		r.contractsKey = deriveKey(r.passphrase, frand.Bytes(saltSize))
+	}
+	return r.contractsKey
+}
+
+// encryptContracts seals the contracts file with the key.
+func encryptContracts(plaintext []byte, ck contractsKey) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(ck.key)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptedMagic), encryptedVersion)
+	header = append(header, ck.salt...)
+	header = append(header, frand.Bytes(aead.NonceSize())...)
+	nonce := header[len(header)-aead.NonceSize():]
+	// the header is authenticated so it cannot be changed without detection
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// decryptContracts opens a contracts file sealed by encryptContracts and
+// returns the key it was sealed with.
+func decryptContracts(buf []byte, passphrase string) ([]byte, contractsKey, error) {
+	if len(passphrase) == 0 {
+		return nil, contractsKey{}, ErrPassphraseRequired
+	}
+	headerSize := len(encryptedMagic) + 1 + saltSize + chacha20poly1305.NonceSizeX
+	if len(buf) < headerSize || !bytes.Equal(buf[:len(encryptedMagic)], []byte(encryptedMagic)) {
+		return nil, contractsKey{}, errors.New("not an encrypted contracts file")
+	} else if v := buf[len(encryptedMagic)]; v != encryptedVersion {
+		return nil, contractsKey{}, fmt.Errorf("unsupported encrypted contracts file version %v", v)
+	}
+	salt := append([]byte(nil), buf[len(encryptedMagic)+1:len(encryptedMagic)+1+saltSize]...)
+	ck := deriveKey(passphrase, salt)
+	aead, err := chacha20poly1305.NewX(ck.key)
+	if err != nil {
+		return nil, contractsKey{}, err
+	}
+	header := buf[:headerSize]
+	plaintext, err := aead.Open(nil, header[len(header)-aead.NonceSize():], buf[headerSize:], header)
+	if err != nil {
+		return nil, contractsKey{}, ErrWrongPassphrase
+	}
+	return plaintext, ck, nil
+}
@@ -1,33 +1,63 @@
 package renter
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/siacentral/apisdkgo"
+	"github.com/siacentral/apisdkgo/sia"
 	"go.sia.tech/siad/crypto"
 	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/explorer"
+	"go.sia.tech/skyrecover/internal/jsonout"
 	"go.sia.tech/skyrecover/internal/rhp/v2"
 	"go.sia.tech/skyrecover/internal/wallet"
 )
 
 type (
+	// saveMeta is the contracts file format. It is the only format read and
+	// written by skyrecover; expired contracts are pruned on load.
 	saveMeta struct {
+		Network   string         `json:"network,omitempty"`
 		RenterKey rhp.PrivateKey `json:"renterKey"`
 		Contracts []ContractMeta `json:"contracts"`
 	}
 
+	// ContractMeta is the information stored for each contract.
 	ContractMeta struct {
 		ID               types.FileContractID `json:"id"`
 		HostKey          rhp.PublicKey        `json:"hostKey"`
 		ExpirationHeight uint64               `json:"expirationHeight"`
+		NetAddress       string               `json:"netAddress,omitempty"`
+		// RenterKey signs the contract's revisions if it was not formed
+		// with the renter's key, e.g. contracts imported from skyd.
+		RenterKey rhp.PrivateKey `json:"renterKey,omitempty"`
+	}
+
+	// An Explorer provides the chain and host information required to form
+	// contracts and dial hosts. It is implemented by siacentral's API client.
+	Explorer interface {
+		GetChainIndex() (sia.ChainIndex, error)
+		GetHost(id string) (sia.HostDetails, error)
+		ActiveHosts(filter sia.HostFilter) ([]sia.HostDetails, error)
+		GetTransactionFees() (min, max types.Currency, err error)
+	}
+
+	// A Dialer connects to a host's net address.
+	Dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
 	}
 
 	Wallet interface {
@@ -36,27 +66,142 @@ type (
 		SignTransaction(txn *types.Transaction, toSign []crypto.Hash, cf types.CoveredFields) error
 	}
 
+	cachedSettings struct {
+		settings rhp.HostSettings
+		fetched  time.Time
+	}
+
+	// An Option configures a Renter.
+	Option func(*Renter)
+
 	// A Renter is a helper type that manages the formation of contracts and rhp
 	// sessions.
 	Renter struct {
 		renterKey rhp.PrivateKey
 		dir       string
+		compress  bool
+		indent    string
+		network   string
+		debug     *log.Logger
+		explorer  Explorer
+		dialer    Dialer
+		// sessionLog records the renter's sessions, nil unless
+		// WithSessionRecording is set
+		sessionLog *sessionLog
+		// passphrase encrypts the contracts file, empty for plaintext
+		passphrase string
+		// contractsKey is derived from the passphrase, guarded by saveMu
+		contractsKey contractsKey
 
 		close chan struct{}
 
+		// saveMu serializes writes to the contracts file
+		saveMu sync.Mutex
+
 		mu            sync.Mutex
 		currentHeight uint64
-		contracts     map[rhp.PublicKey]ContractMeta
+		// dirty is set when the contracts have changed since they were last
+		// saved. A failed save is retried in the background.
+		dirty     bool
+		contracts map[rhp.PublicKey][]ContractMeta
+		// funds is the renter funds remaining in each contract when it was
+		// last locked, used to choose between a host's contracts
+		funds    map[types.FileContractID]types.Currency
+		settings map[rhp.PublicKey]cachedSettings
+		// failures counts each host's consecutive failed reads. A host with
+		// failureLimit failures is excluded from Hosts.
+		failures     map[rhp.PublicKey]int
+		failureLimit int
 	}
 )
 
+const (
+	// mainnet is the network of a contracts file that does not record one.
+	mainnet = "mainnet"
+
+	contractsFile           = "contracts.json"
+	compressedContractsFile = "contracts.json.gz"
+
+	// settingsTTL is how long a host's settings are cached before the
+	// Settings RPC is called again.
+	settingsTTL = 5 * time.Minute
+)
+
 var (
 	ErrNoContract = errors.New("no contract formed")
+	// ErrWrongNetwork is returned when the contracts file was written for a
+	// different network than the renter's.
+	ErrWrongNetwork = errors.New("contracts file is for a different network")
 )
 
+// WithCompression gzip compresses the contracts file. An existing compressed
+// contracts file is always detected and kept compressed.
+func WithCompression(compress bool) Option {
+	return func(r *Renter) {
+		r.compress = compress
+	}
+}
+
+// WithIndent sets the indentation of the contracts file. An empty indent
+// writes compact JSON.
+func WithIndent(indent string) Option {
+	return func(r *Renter) {
+		r.indent = indent
+	}
+}
+
+// WithNetwork sets the network the renter's contracts are formed on. The
+// default is mainnet, which is not recorded in the contracts file so it stays
+// readable by older versions.
+func WithNetwork(name string) Option {
+	return func(r *Renter) {
+		if name == mainnet {
+			name = ""
+		}
+		r.network = name
+	}
+}
+
+// WithExplorer sets the Explorer used to look up the chain and hosts. The
+// default is siacentral.
+func WithExplorer(e Explorer) Option {
+	return func(r *Renter) {
+		r.explorer = e
+	}
+}
+
+// WithDialer sets the Dialer used to connect to hosts.
+func WithDialer(d Dialer) Option {
+	return func(r *Renter) {
+		r.dialer = d
+	}
+}
+
+// WithDebugLogger logs the duration of each phase of dialing a host to l.
+func WithDebugLogger(l *log.Logger) Option {
+	return func(r *Renter) {
+		r.debug = l
+	}
+}
+
+// WithHostFailureLimit excludes a host from Hosts for the rest of the
+// renter's lifetime once limit reads from it have failed in a row. A limit of
+// 0 never excludes a host.
+func WithHostFailureLimit(limit int) Option {
+	return func(r *Renter) {
+		r.failureLimit = limit
+	}
+}
+
+// debugf logs a debug message if a debug logger is set.
+func (r *Renter) debugf(format string, v ...interface{}) {
+	if r.debug != nil {
+		r.debug.Printf("[DEBUG] "+format, v...)
+	}
+}
+
 func (r *Renter) refreshHeight() error {
-	client := apisdkgo.NewSiaClient()
-	tip, err := client.GetChainIndex()
+	tip, err := r.explorer.GetChainIndex()
 	if err != nil {
 		return err
 	}
@@ -66,20 +211,172 @@ func (r *Renter) refreshHeight() error {
 	return nil
 }
 
-func (r *Renter) FormDownloadContract(hostKey rhp.PublicKey, downloadAmount, duration uint64, w Wallet) (ContractMeta, error) {
-	siacentralClient := apisdkgo.NewSiaClient()
-	block, err := siacentralClient.GetChainIndex()
+// downloadFunding estimates the funding required to download downloadAmount
+// bytes from a host.
+func downloadFunding(settings rhp.HostSettings, downloadAmount uint64) types.Currency {
+	sectorAccesses := downloadAmount / rhp.SectorSize
+	return settings.DownloadBandwidthPrice.Mul64(downloadAmount).Add(settings.SectorAccessPrice.Mul64(sectorAccesses + 1))
+}
+
+// formationFee estimates the miner fee for a contract formation transaction.
+func (r *Renter) formationFee() (types.Currency, error) {
+	_, max, err := r.explorer.GetTransactionFees()
+	if err != nil {
+		return types.ZeroCurrency, fmt.Errorf("failed to get transaction fees: %w", err)
+	}
+	return max.Mul64(1200), nil
+}
+
+// ScanHost dials the host at its listed net address and calls the Settings
+// RPC. No contract is required. It returns the host's settings and the time
+// taken to dial, complete the handshake, and receive the settings.
+func (r *Renter) ScanHost(ctx context.Context, hostKey rhp.PublicKey) (rhp.HostSettings, time.Duration, error) {
+	host, err := r.explorer.GetHost(hostKey.String())
+	if err != nil {
+		return rhp.HostSettings{}, 0, fmt.Errorf("failed to get host: %w", err)
+	}
+
+	start := time.Now()
+	t, err := r.dialTransport(ctx, host.NetAddress, hostKey)
+	if err != nil {
+		return rhp.HostSettings{}, 0, fmt.Errorf("failed to dial host: %w", err)
+	}
+	defer t.Close()
+
+	settings, err := rhp.RPCSettings(ctx, t)
+	if err != nil {
+		return rhp.HostSettings{}, 0, fmt.Errorf("failed to get host settings: %w", err)
+	}
+	return settings, time.Since(start), nil
+}
+
+// ContractFunds locks the host's contract with the most remaining funds and
+// returns the renter funds remaining in its latest revision and the cost of
+// reading a full sector from the host.
+func (r *Renter) ContractFunds(ctx context.Context, hostKey rhp.PublicKey) (remaining, readCost types.Currency, err error) {
+	sess, err := r.NewSession(ctx, hostKey)
+	if err != nil {
+		return types.ZeroCurrency, types.ZeroCurrency, fmt.Errorf("failed to create session: %w", err)
+	}
+	defer sess.Close()
+	return r.sessionFunds(ctx, sess)
+}
+
+// ContractFundsFor is like ContractFunds, but locks the given contract rather
+// than the host's best contract.
+func (r *Renter) ContractFundsFor(ctx context.Context, contract ContractMeta) (remaining, readCost types.Currency, err error) {
+	sess, err := r.contractSession(ctx, contract)
+	if err != nil {
+		return types.ZeroCurrency, types.ZeroCurrency, fmt.Errorf("failed to create session: %w", err)
+	}
+	defer sess.Close()
+	return r.sessionFunds(ctx, sess)
+}
+
+// sessionFunds returns the renter funds remaining in the session's contract
+// and the cost of reading a full sector from its host.
+func (r *Renter) sessionFunds(ctx context.Context, sess *rhp.Session) (remaining, readCost types.Currency, err error) {
+	settings, err := r.HostSettings(ctx, sess)
+	if err != nil {
+		return types.ZeroCurrency, types.ZeroCurrency, fmt.Errorf("failed to get host settings: %w", err)
+	}
+	sections := []rhp.RPCReadRequestSection{{Length: rhp.SectorSize}}
+	return sess.Contract().RenterFunds(), rhp.RPCReadCost(settings, sections), nil
+}
+
+type (
+	// A FormOption overrides how a contract formed by FormDownloadContract is
+	// funded.
+	FormOption func(*contractFunding)
+
+	contractFunding struct {
+		renterFunds    types.Currency
+		hostCollateral types.Currency
+	}
+)
+
+// WithRenterFunds sets the renter's funding of the contract, replacing the
+// estimate from the download amount.
+func WithRenterFunds(funds types.Currency) FormOption {
+	return func(cf *contractFunding) {
+		cf.renterFunds = funds
+	}
+}
+
+// WithHostCollateral sets the collateral the host is asked to add to the
+// contract. The default is no collateral.
+func WithHostCollateral(collateral types.Currency) FormOption {
+	return func(cf *contractFunding) {
+		cf.hostCollateral = collateral
+	}
+}
+
+// formationFunding returns the renter funds and host collateral of a contract
+// with the host.
+func formationFunding(settings rhp.HostSettings, downloadAmount uint64, opts []FormOption) (contractFunding, error) {
+	var cf contractFunding
+	for _, opt := range opts {
+		opt(&cf)
+	}
+	if cf.renterFunds.IsZero() {
+		cf.renterFunds = downloadFunding(settings, downloadAmount)
+	}
+	if cf.hostCollateral.Cmp(settings.MaxCollateral) > 0 {
+		return contractFunding{}, fmt.Errorf("host collateral %v exceeds the host's max collateral %v", cf.hostCollateral.HumanString(), settings.MaxCollateral.HumanString())
+	}
+	return cf, nil
+}
+
+// EstimateFormationCost estimates the total cost, including fees, of forming a
+// download contract with the host. The host's prices are taken from the
+// explorer instead of dialing the host.
+func (r *Renter) EstimateFormationCost(hostKey rhp.PublicKey, downloadAmount, duration uint64, opts ...FormOption) (types.Currency, error) {
+	host, err := r.explorer.GetHost(hostKey.String())
+	if err != nil {
+		return types.ZeroCurrency, fmt.Errorf("failed to get host: %w", err)
+	} else if host.Settings == nil {
+		return types.ZeroCurrency, errors.New("host has no settings")
+	}
+	settings := rhp.HostSettings{
+		WindowSize:             host.Settings.WindowSize,
+		ContractPrice:          host.Settings.ContractPrice,
+		DownloadBandwidthPrice: host.Settings.DownloadBandwidthPrice,
+		SectorAccessPrice:      host.Settings.SectorAccessPrice,
+		MaxCollateral:          host.Settings.MaxCollateral,
+	}
+	funding, err := formationFunding(settings, downloadAmount, opts)
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+
+	r.mu.Lock()
+	height := r.currentHeight
+	r.mu.Unlock()
+
+	contract := rhp.PrepareContractFormation(r.renterKey, hostKey, funding.renterFunds, funding.hostCollateral, height+duration, settings, types.UnlockHash{})
+	fee, err := r.formationFee()
+	if err != nil {
+		return types.ZeroCurrency, err
+	}
+	return rhp.ContractFormationCost(contract, settings.ContractPrice).Add(fee), nil
+}
+
+// FormDownloadContract forms a contract with the host funded to download
+// downloadAmount bytes. The funding and host collateral can be overridden with
+// FormOptions.
+func (r *Renter) FormDownloadContract(hostKey rhp.PublicKey, downloadAmount, duration uint64, w Wallet, opts ...FormOption) (ContractMeta, error) {
+	block, err := r.explorer.GetChainIndex()
 	if err != nil {
 		return ContractMeta{}, fmt.Errorf("failed to get latest block: %w", err)
 	}
-	host, err := siacentralClient.GetHost(hostKey.String())
+	host, err := r.explorer.GetHost(hostKey.String())
 	if err != nil {
 		return ContractMeta{}, fmt.Errorf("failed to get host: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
-	t, err := dialTransport(ctx, host.NetAddress, hostKey)
+	t, err := r.dialTransport(ctx, host.NetAddress, hostKey)
 	if err != nil {
 		return ContractMeta{}, fmt.Errorf("failed to dial host: %w", err)
 	}
@@ -90,17 +387,16 @@ func (r *Renter) FormDownloadContract(hostKey rhp.PublicKey, downloadAmount, dur
 		return ContractMeta{}, fmt.Errorf("failed to get host settings: %w", err)
 	}
 
-	// estimate the funding required to download the data
-	sectorAccesses := downloadAmount / rhp.SectorSize
-	fundAmount := settings.DownloadBandwidthPrice.Mul64(downloadAmount).Add(settings.SectorAccessPrice.Mul64(sectorAccesses + 1))
 	// create the contract
-	contract := rhp.PrepareContractFormation(r.renterKey, hostKey, fundAmount, types.ZeroCurrency, block.Height+duration, settings, w.Address())
-	// estimate miner fee
-	_, max, err := siacentralClient.GetTransactionFees()
+	funding, err := formationFunding(settings, downloadAmount, opts)
+	if err != nil {
+		return ContractMeta{}, err
+	}
+	contract := rhp.PrepareContractFormation(r.renterKey, hostKey, funding.renterFunds, funding.hostCollateral, block.Height+duration, settings, w.Address())
+	fee, err := r.formationFee()
 	if err != nil {
-		return ContractMeta{}, fmt.Errorf("failed to get transaction fees: %w", err)
+		return ContractMeta{}, err
 	}
-	fee := max.Mul64(1200)
 	formationCost := rhp.ContractFormationCost(contract, settings.ContractPrice)
 	// fund and sign the formation transaction
 	formationTxn := types.Transaction{
@@ -111,16 +407,20 @@ func (r *Renter) FormDownloadContract(hostKey rhp.PublicKey, downloadAmount, dur
 	if err != nil {
 		return ContractMeta{}, fmt.Errorf("failed to fund transaction: %w", err)
 	}
-	defer release()
+	// the inputs stay reserved until the formation transaction confirms, they
+	// are only released if the host never receives the transaction
 	if err := w.SignTransaction(&formationTxn, toSign, wallet.ExplicitCoveredFields(formationTxn)); err != nil {
+		release()
 		return ContractMeta{}, fmt.Errorf("failed to sign transaction: %w", err)
 	}
 
 	// send the contract to the host
 	var blockID rhp.BlockID
 	if n, err := hex.Decode(blockID[:], []byte(block.ID)); err != nil {
+		release()
 		return ContractMeta{}, fmt.Errorf("failed to decode block id: %w", err)
 	} else if n != 32 {
+		release()
 		return ContractMeta{}, fmt.Errorf("invalid block id length: %d", n)
 	}
 	tip := rhp.ConsensusState{
@@ -131,47 +431,269 @@ func (r *Renter) FormDownloadContract(hostKey rhp.PublicKey, downloadAmount, dur
 	}
 	renterContract, _, err := rhp.RPCFormContract(ctx, t, tip, r.renterKey, hostKey, []types.Transaction{formationTxn})
 	if err != nil {
+		release()
 		return ContractMeta{}, fmt.Errorf("failed to form contract: %w", err)
 	}
 	meta := ContractMeta{
 		ID:               renterContract.ID(),
 		HostKey:          hostKey,
 		ExpirationHeight: uint64(renterContract.Revision.NewWindowStart) - 5,
+		NetAddress:       host.NetAddress,
 	}
 	r.mu.Lock()
-	r.contracts[hostKey] = meta
+	r.contracts[hostKey] = append(r.contracts[hostKey], meta)
+	r.dirty = true
 	r.mu.Unlock()
-	return meta, r.save()
+	// the contract has been paid for, save it before anything else can fail
+	if err := r.saveIfDirty(); err != nil {
+		return meta, fmt.Errorf("contract formed but not saved, the save will be retried: %w", err)
+	}
+	return meta, nil
 }
 
-func (r *Renter) save() error {
-	if err := os.MkdirAll(r.dir, 0700); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+// ExpiresWithin returns true if the contract expires within the given number
+// of blocks.
+func (r *Renter) ExpiresWithin(contract ContractMeta, blocks uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return contract.ExpirationHeight <= r.currentHeight+blocks
+}
+
+// RenewDownloadContract renews the host's contract, replacing it with a new
+// contract funded to download downloadAmount bytes that ends duration blocks
+// from now. The old contract is cleared and its remaining funds are refunded
+// to the renter. The funding and host collateral can be overridden with
+// FormOptions.
+func (r *Renter) RenewDownloadContract(hostKey rhp.PublicKey, downloadAmount, duration uint64, w Wallet, opts ...FormOption) (ContractMeta, error) {
+	old, err := r.HostContract(hostKey)
+	if err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to get contract: %w", err)
+	}
+	block, err := r.explorer.GetChainIndex()
+	if err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to get latest block: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	sess, err := r.contractSession(ctx, old)
+	if err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to start session: %w", err)
+	}
+	defer sess.Close()
+
+	settings, err := rhp.RPCSettings(ctx, sess.Transport())
+	if err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to get host settings: %w", err)
+	}
+
+	// create the renewed contract
+	funding, err := formationFunding(settings, downloadAmount, opts)
+	if err != nil {
+		return ContractMeta{}, err
+	}
+	renterKey := r.renterKey
+	if len(old.RenterKey) != 0 {
+		renterKey = old.RenterKey
 	}
+	current := sess.Contract().Revision
+	contract := rhp.PrepareContractRenewal(current, renterKey, hostKey, funding.renterFunds, funding.hostCollateral, block.Height+duration, settings, w.Address())
+	fee, err := r.formationFee()
+	if err != nil {
+		return ContractMeta{}, err
+	}
+	renewalCost := rhp.ContractRenewalCost(contract, settings.ContractPrice)
+	// fund and sign the renewal transaction
+	renewalTxn := types.Transaction{
+		MinerFees:     []types.Currency{fee},
+		FileContracts: []types.FileContract{contract},
+	}
+	toSign, release, err := w.FundTransaction(&renewalTxn, renewalCost.Add(fee))
+	if err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to fund transaction: %w", err)
+	}
+	if err := w.SignTransaction(&renewalTxn, toSign, wallet.ExplicitCoveredFields(renewalTxn)); err != nil {
+		release()
+		return ContractMeta{}, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+
+	var blockID rhp.BlockID
+	if n, err := hex.Decode(blockID[:], []byte(block.ID)); err != nil {
+		release()
+		return ContractMeta{}, fmt.Errorf("failed to decode block id: %w", err)
+	} else if n != 32 {
+		release()
+		return ContractMeta{}, fmt.Errorf("invalid block id length: %d", n)
+	}
+	tip := rhp.ConsensusState{
+		Index: rhp.ChainIndex{
+			Height: block.Height,
+			ID:     blockID,
+		},
+	}
+	// the host is paid for the RPC out of the old contract, the rest of its
+	// funds are refunded when it is cleared
+	finalPayment := settings.BaseRPCPrice
+	if remaining := current.ValidRenterPayout(); finalPayment.Cmp(remaining) > 0 {
+		finalPayment = remaining
+	}
+	renewed, _, err := sess.RenewContract(tip, []types.Transaction{renewalTxn}, finalPayment)
+	if err != nil {
+		release()
+		return ContractMeta{}, fmt.Errorf("failed to renew contract: %w", err)
+	}
+	meta := ContractMeta{
+		ID:               renewed.ID(),
+		HostKey:          hostKey,
+		ExpirationHeight: uint64(renewed.Revision.NewWindowStart) - 5,
+		NetAddress:       old.NetAddress,
+		RenterKey:        old.RenterKey,
+	}
+	r.mu.Lock()
+	contracts := r.contracts[hostKey]
+	replaced := false
+	for i, c := range contracts {
+		if c.ID == old.ID {
+			// the net address may have been updated when the session was opened
+			meta.NetAddress = c.NetAddress
+			contracts[i] = meta
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		contracts = append(contracts, meta)
+	}
+	r.contracts[hostKey] = contracts
+	delete(r.funds, old.ID)
+	r.dirty = true
+	r.mu.Unlock()
+	// the contract has been paid for, save it before anything else can fail
+	if err := r.saveIfDirty(); err != nil {
+		return meta, fmt.Errorf("contract renewed but not saved, the save will be retried: %w", err)
+	}
+	return meta, nil
+}
+
+// encodeContracts writes the renter key and unexpired contracts to w. The
+// contracts are copied under r.mu and encoded after it is released, so
+// sessions are not blocked by the write.
+func (r *Renter) encodeContracts(w io.Writer) error {
+	r.mu.Lock()
 	meta := saveMeta{
+		Network:   r.network,
 		RenterKey: r.renterKey,
 		Contracts: make([]ContractMeta, 0, len(r.contracts)),
 	}
-	r.mu.Lock()
-	for _, contract := range r.contracts {
-		if contract.ExpirationHeight < r.currentHeight {
-			continue
+	for _, contract := range r.allContracts() {
+		if contract.ExpirationHeight >= r.currentHeight {
+			meta.Contracts = append(meta.Contracts, contract)
 		}
-		meta.Contracts = append(meta.Contracts, contract)
 	}
 	r.mu.Unlock()
+	return jsonout.NewEncoder(w, r.indent).Encode(meta)
+}
+
+// save writes the contracts file. If the write fails, the renter stays dirty
+// and the save is retried by the autosave loop and Close.
+func (r *Renter) save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	return r.saveLocked()
+}
 
-	tmpFile := filepath.Join(r.dir, "contracts.json.tmp")
-	outputFile := filepath.Join(r.dir, "contracts.json")
-	f, err := os.Create(tmpFile)
+// saveIfDirty saves the contracts if they have changed since the last
+// successful save. Callers that changed the contracts should use it instead
+// of save: concurrent changes waiting on saveMu are then written once by the
+// first save rather than rewriting the file for each caller.
+func (r *Renter) saveIfDirty() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.mu.Lock()
+	dirty := r.dirty
+	r.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return r.saveLocked()
+}
+
+// saveLocked clears the dirty flag and writes the contracts file. Any change
+// made before the flag is cleared is included in the write. The caller must
+// hold r.saveMu.
+func (r *Renter) saveLocked() error {
+	r.mu.Lock()
+	r.dirty = false
+	r.mu.Unlock()
+	if err := r.writeContracts(); err != nil {
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeContracts atomically replaces the contracts file. The caller must hold
+// r.saveMu.
+func (r *Renter) writeContracts() error {
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	outputFile := filepath.Join(r.dir, contractsFile)
+	switch {
+	case len(r.passphrase) != 0:
+		outputFile = filepath.Join(r.dir, encryptedContractsFile)
+	case r.compress:
+		outputFile = filepath.Join(r.dir, compressedContractsFile)
+	}
+	// the temp file is unique so that another process writing to the same
+	// directory cannot interleave with this write
+	f, err := os.CreateTemp(r.dir, filepath.Base(outputFile)+".*.tmp")
 	if err != nil {
 		return fmt.Errorf("failed to open contracts file: %w", err)
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(meta); err != nil {
+	tmpFile := f.Name()
+	renamed := false
+	defer func() {
+		f.Close()
+		if !renamed {
+			os.Remove(tmpFile)
+		}
+	}()
+
+	// an encrypted file is sealed as a whole, so the contracts are encoded
+	// to memory first
+	var out io.Writer = f
+	var plaintext *bytes.Buffer
+	if len(r.passphrase) != 0 {
+		plaintext = new(bytes.Buffer)
+		out = plaintext
+	}
+	bw := bufio.NewWriter(out)
+	var w io.Writer = bw
+	var gw *gzip.Writer
+	if r.compress {
+		gw = gzip.NewWriter(bw)
+		w = gw
+	}
+	if err := r.encodeContracts(w); err != nil {
 		return fmt.Errorf("failed to encode contracts: %w", err)
+	} else if gw != nil {
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("failed to compress contracts: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write contracts file: %w", err)
+	} else if plaintext != nil {
+		buf, err := encryptContracts(plaintext.Bytes(), r.encryptionKey())
+		if err != nil {
+			return fmt.Errorf("failed to encrypt contracts: %w", err)
+		} else if _, err := f.Write(buf); err != nil {
+			return fmt.Errorf("failed to write contracts file: %w", err)
+		}
 	}
 	// sync and automically replace the old file
 	if err := f.Sync(); err != nil {
@@ -181,32 +703,107 @@ func (r *Renter) save() error {
 	} else if err := os.Rename(tmpFile, outputFile); err != nil {
 		return fmt.Errorf("failed to rename contracts file: %w", err)
 	}
+	renamed = true
+
+	// remove the files in other formats so they are not loaded instead
+	for _, name := range []string{contractsFile, compressedContractsFile} {
+		if fp := filepath.Join(r.dir, name); fp != outputFile {
+			if err := os.Remove(fp); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove old contracts file: %w", err)
+			}
+		}
+	}
 	return nil
 }
 
-func (r *Renter) load() error {
-	inputFile := filepath.Join(r.dir, "contracts.json")
+// networkName returns the name of a recorded network.
+func networkName(network string) string {
+	if len(network) == 0 {
+		return mainnet
+	}
+	return network
+}
+
+// openContracts opens the contracts file, decrypting and decompressing it.
+// The format is chosen by the file that exists rather than the compression
+// and passphrase options: an encrypted file is preferred, then a compressed
+// file.
+func (r *Renter) openContracts() (io.Reader, func() error, error) {
+	buf, err := os.ReadFile(filepath.Join(r.dir, encryptedContractsFile))
+	if err == nil {
+		plaintext, ck, err := decryptContracts(buf, r.passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.contractsKey = ck
+		// the encrypted contracts are compressed if compression was enabled
+		// when they were written
+		if !bytes.HasPrefix(plaintext, []byte{0x1f, 0x8b}) {
+			return bytes.NewReader(plaintext), func() error { return nil }, nil
+		}
+		r.compress = true
+		gr, err := gzip.NewReader(bytes.NewReader(plaintext))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decompress contracts file: %w", err)
+		}
+		return gr, gr.Close, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read contracts file: %w", err)
+	}
+
+	inputFile := filepath.Join(r.dir, compressedContractsFile)
+	compressed := false
+	if _, err := os.Stat(inputFile); err == nil {
+		compressed = true
+		r.compress = true
+	} else {
+		inputFile = filepath.Join(r.dir, contractsFile)
+	}
 	f, err := os.Open(inputFile)
 	if err != nil {
-		return fmt.Errorf("failed to open contracts file: %w", err)
+		return nil, nil, fmt.Errorf("failed to open contracts file: %w", err)
+	} else if !compressed {
+		return bufio.NewReader(f), f.Close, nil
+	}
+	gr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to decompress contracts file: %w", err)
 	}
-	defer f.Close()
-	dec := json.NewDecoder(f)
+	return gr, func() error {
+		gr.Close()
+		return f.Close()
+	}, nil
+}
+
+func (r *Renter) load() error {
+	// a file in a different format than the options select is migrated by
+	// the save below
+	rd, closeFn, err := r.openContracts()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	dec := json.NewDecoder(rd)
 	var meta saveMeta
 	if err := dec.Decode(&meta); err != nil {
 		return fmt.Errorf("failed to decode contracts: %w", err)
+	} else if meta.Network != r.network {
+		return fmt.Errorf("%w: written for %s, using %s", ErrWrongNetwork, networkName(meta.Network), networkName(r.network))
 	}
 	r.renterKey = meta.RenterKey
 	r.mu.Lock()
-	r.contracts = make(map[rhp.PublicKey]ContractMeta)
+	r.contracts = make(map[rhp.PublicKey][]ContractMeta)
+	r.funds = make(map[types.FileContractID]types.Currency)
 	for _, contract := range meta.Contracts {
 		if contract.ExpirationHeight <= r.currentHeight {
 			continue
 		}
-		r.contracts[contract.HostKey] = contract
+		r.contracts[contract.HostKey] = append(r.contracts[contract.HostKey], contract)
 	}
 	r.mu.Unlock()
-	if err := f.Close(); err != nil {
+	if err := closeFn(); err != nil {
 		return fmt.Errorf("failed to close contracts file: %w", err)
 	} else if err := r.save(); err != nil { // prune expired contracts
 		return fmt.Errorf("failed to prune contracts: %w", err)
@@ -214,88 +811,360 @@ func (r *Renter) load() error {
 	return nil
 }
 
-func (r *Renter) HostContract(hostID rhp.PublicKey) (ContractMeta, error) {
+// BlockHeight returns the renter's last known block height.
+func (r *Renter) BlockHeight() uint64 {
 	r.mu.Lock()
-	meta, ok := r.contracts[hostID]
-	currentHeight := r.currentHeight
-	r.mu.Unlock()
-	// check that a contract exists and has not expired
-	if !ok || meta.ExpirationHeight <= currentHeight {
+	defer r.mu.Unlock()
+	return r.currentHeight
+}
+
+// HostContract returns the host's unexpired contract with the most remaining
+// funds. Contracts that have not been locked since the renter was created
+// have unknown funds and are only returned if no other contract is known to
+// have funds remaining.
+func (r *Renter) HostContract(hostID rhp.PublicKey) (ContractMeta, error) {
+	contracts := r.hostContracts(hostID)
+	if len(contracts) == 0 {
 		return ContractMeta{}, ErrNoContract
 	}
-	return meta, nil
+	return r.bestContract(contracts), nil
+}
+
+// hostContracts returns the host's unexpired contracts.
+func (r *Renter) hostContracts(hostKey rhp.PublicKey) (contracts []ContractMeta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, contract := range r.contracts[hostKey] {
+		if contract.ExpirationHeight > r.currentHeight {
+			contracts = append(contracts, contract)
+		}
+	}
+	return
 }
 
+// bestContract returns the contract with the most known remaining funds. Ties,
+// including contracts with unknown funds, keep the first contract.
+func (r *Renter) bestContract(contracts []ContractMeta) ContractMeta {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	best := contracts[0]
+	bestFunds := r.funds[best.ID]
+	for _, contract := range contracts[1:] {
+		if funds := r.funds[contract.ID]; funds.Cmp(bestFunds) > 0 {
+			best, bestFunds = contract, funds
+		}
+	}
+	return best
+}
+
+// allContracts returns every contract the renter has. The caller must hold
+// r.mu.
+func (r *Renter) allContracts() (contracts []ContractMeta) {
+	for _, hostContracts := range r.contracts {
+		contracts = append(contracts, hostContracts...)
+	}
+	return
+}
+
+// ActiveHosts returns the keys of the active hosts matching the filter.
+func (r *Renter) ActiveHosts(filter sia.HostFilter) ([]rhp.PublicKey, error) {
+	hosts, err := r.explorer.ActiveHosts(filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active hosts: %w", err)
+	}
+	active := make([]rhp.PublicKey, 0, len(hosts))
+	for _, host := range hosts {
+		var hostKey rhp.PublicKey
+		if err := hostKey.UnmarshalText([]byte(host.PublicKey)); err != nil {
+			r.debugf("skipping host with invalid public key %q: %v", host.PublicKey, err)
+			continue
+		}
+		active = append(active, hostKey)
+	}
+	return active, nil
+}
+
+// Hosts returns the hosts the renter has an unexpired contract with, except
+// hosts that have reached the failure limit.
 func (r *Renter) Hosts() []rhp.PublicKey {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	var hosts []rhp.PublicKey
-	for _, meta := range r.contracts {
-		if meta.ExpirationHeight > r.currentHeight {
-			hosts = append(hosts, meta.HostKey)
+	for hostKey, contracts := range r.contracts {
+		if r.excludedLocked(hostKey) {
+			continue
+		}
+		for _, meta := range contracts {
+			if meta.ExpirationHeight > r.currentHeight {
+				hosts = append(hosts, hostKey)
+				break
+			}
 		}
 	}
 	return hosts
 }
 
+// RecordReadFailure records a failed read from the host. It returns true if
+// the host has just reached the failure limit and is now excluded from Hosts.
+func (r *Renter) RecordReadFailure(hostKey rhp.PublicKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[hostKey]++
+	return r.failureLimit > 0 && r.failures[hostKey] == r.failureLimit
+}
+
+// RecordReadSuccess resets the host's consecutive failed reads, including it
+// in Hosts again.
+func (r *Renter) RecordReadSuccess(hostKey rhp.PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, hostKey)
+}
+
+// HostExcluded returns true if the host has reached the failure limit.
+func (r *Renter) HostExcluded(hostKey rhp.PublicKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.excludedLocked(hostKey)
+}
+
+// excludedLocked returns true if the host has reached the failure limit. The
+// caller must hold r.mu.
+func (r *Renter) excludedLocked(hostKey rhp.PublicKey) bool {
+	return r.failureLimit > 0 && r.failures[hostKey] >= r.failureLimit
+}
+
 func (r *Renter) Contracts() (contracts []ContractMeta) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for _, meta := range r.contracts {
-		contracts = append(contracts, meta)
-	}
-	return contracts
+	return r.allContracts()
 }
 
+// RemoveHostContract removes all of the host's contracts.
 func (r *Renter) RemoveHostContract(hostID rhp.PublicKey) error {
 	r.mu.Lock()
+	for _, contract := range r.contracts[hostID] {
+		delete(r.funds, contract.ID)
+	}
 	delete(r.contracts, hostID)
+	r.dirty = true
 	r.mu.Unlock()
-	return r.save()
+	return r.saveIfDirty()
+}
+
+// RemoveContract removes a single contract, keeping the host's other
+// contracts.
+func (r *Renter) RemoveContract(contract ContractMeta) error {
+	r.mu.Lock()
+	var kept []ContractMeta
+	for _, c := range r.contracts[contract.HostKey] {
+		if c.ID != contract.ID {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		delete(r.contracts, contract.HostKey)
+	} else {
+		r.contracts[contract.HostKey] = kept
+	}
+	delete(r.funds, contract.ID)
+	r.dirty = true
+	r.mu.Unlock()
+	return r.saveIfDirty()
+}
+
+// hostNetAddress returns the host's current net address from the explorer. If
+// the host cannot be found, the last known address from the contract is used
+// instead.
+func (r *Renter) hostNetAddress(contract ContractMeta) (string, error) {
+	start := time.Now()
+	host, err := r.explorer.GetHost(contract.HostKey.String())
+	if err != nil {
+		if contract.NetAddress == "" {
+			return "", fmt.Errorf("failed to get host: %w", err)
+		}
+		r.debugf("host %v: lookup failed, using last known net address %v: %v", contract.HostKey, contract.NetAddress, err)
+		return contract.NetAddress, nil
+	}
+	r.debugf("host %v: looked up net address %v in %v", contract.HostKey, host.NetAddress, time.Since(start))
+
+	// cache the address in case the host is delisted
+	if host.NetAddress != contract.NetAddress {
+		r.mu.Lock()
+		for i, c := range r.contracts[contract.HostKey] {
+			if c.ID == contract.ID {
+				r.contracts[contract.HostKey][i].NetAddress = host.NetAddress
+				r.dirty = true
+			}
+		}
+		r.mu.Unlock()
+		if err := r.saveIfDirty(); err != nil {
+			return "", fmt.Errorf("failed to save contracts: %w", err)
+		}
+	}
+	return host.NetAddress, nil
+}
+
+// hostKeyMismatchErr adds the key that the explorer reports for the net
+// address to a key mismatch error. The contract cannot be used with the new
+// key, so the session is not retried.
+func (r *Renter) hostKeyMismatchErr(hostKey rhp.PublicKey, netAddress string, err error) error {
+	host, lookupErr := r.explorer.GetHost(netAddress)
+	if lookupErr != nil || host.PublicKey == hostKey.String() {
+		return fmt.Errorf("host %v at %v: %w", hostKey, netAddress, err)
+	}
+	return fmt.Errorf("host %v at %v: %w -- the address now belongs to %v", hostKey, netAddress, err, host.PublicKey)
 }
 
 // NewSession initializes a new rhp session with the given host and locks the
-// contract.
+// host's contract with the most remaining funds.
 func (r *Renter) NewSession(ctx context.Context, hostPub rhp.PublicKey) (*rhp.Session, error) {
-	// get an existing contract or form a new one
-	contract, err := r.HostContract(hostPub)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get contract: %w", err)
+	contracts := r.hostContracts(hostPub)
+	if len(contracts) == 0 {
+		return nil, fmt.Errorf("failed to get contract: %w", ErrNoContract)
+	} else if len(contracts) > 1 {
+		// a contract's funds are only known once it has been locked, lock
+		// each unknown contract once so they can be compared
+		for _, contract := range contracts {
+			r.mu.Lock()
+			_, known := r.funds[contract.ID]
+			r.mu.Unlock()
+			if known {
+				continue
+			}
+			sess, err := r.contractSession(ctx, contract)
+			if err != nil {
+				r.debugf("host %v: failed to lock contract %v: %v", hostPub, contract.ID, err)
+				continue
+			}
+			sess.Close()
+		}
 	}
+	return r.contractSession(ctx, r.bestContract(contracts))
+}
 
-	// get the host's net address
-	siaCentralClient := apisdkgo.NewSiaClient()
-	host, err := siaCentralClient.GetHost(contract.HostKey.String())
+// contractSession initializes a new rhp session with the contract's host and
+// locks the contract, recording its remaining funds.
+func (r *Renter) contractSession(ctx context.Context, contract ContractMeta) (*rhp.Session, error) {
+	hostPub := contract.HostKey
+	netAddress, err := r.hostNetAddress(contract)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get host: %w", err)
+		return nil, err
 	}
 
 	// start an rhp session
-	return rhp.DialSession(ctx, host.NetAddress, contract.HostKey, contract.ID, r.renterKey)
+	start := time.Now()
+	sess, err := r.dialSession(ctx, contract, netAddress)
+	if r.sessionLog != nil {
+		r.sessionLog.opened(SessionRecord{
+			HostKey:     hostPub,
+			NetAddress:  netAddress,
+			ContractID:  contract.ID,
+			Opened:      start,
+			OpenElapsed: time.Since(start),
+		}, sess, err)
+	}
+	if errors.Is(err, rhp.ErrHostKeyMismatch) {
+		return nil, r.hostKeyMismatchErr(hostPub, netAddress, err)
+	} else if err != nil {
+		return nil, err
+	}
+	r.debugf("host %v: dialed session in %v", hostPub, time.Since(start))
+	r.mu.Lock()
+	r.funds[contract.ID] = sess.Contract().RenterFunds()
+	r.mu.Unlock()
+	return sess, nil
+}
+
+// dialSession connects to the host and locks its contract.
+func (r *Renter) dialSession(ctx context.Context, contract ContractMeta, netAddress string) (*rhp.Session, error) {
+	conn, err := r.dialer.DialContext(ctx, "tcp", netAddress)
+	if err != nil {
+		return nil, err
+	}
+	renterKey := r.renterKey
+	if len(contract.RenterKey) != 0 {
+		renterKey = contract.RenterKey
+	}
+	return rhp.NewSession(ctx, conn, contract.HostKey, contract.ID, renterKey)
 }
 
-func (r *Renter) Close() {
+// Close stops the renter's background tasks and saves its contracts. The
+// contracts are saved even if the renter was already closed.
+func (r *Renter) Close() error {
 	select {
 	case <-r.close:
-		return
 	default:
 		close(r.close)
 	}
-	r.save()
+	return r.save()
 }
 
-func New(dir string) (*Renter, error) {
+// HostSettings returns the settings of the session's host. The Settings RPC is
+// only called if the cached settings are older than settingsTTL.
+func (r *Renter) HostSettings(ctx context.Context, sess *rhp.Session) (rhp.HostSettings, error) {
+	hostKey := sess.HostKey()
+	r.mu.Lock()
+	cached, ok := r.settings[hostKey]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetched) < settingsTTL {
+		if r.sessionLog != nil {
+			r.sessionLog.settings(sess, cached.settings, true)
+		}
+		return cached.settings, nil
+	}
+
+	start := time.Now()
+	settings, err := rhp.RPCSettings(ctx, sess.Transport())
+	if err != nil {
+		return rhp.HostSettings{}, err
+	}
+	r.debugf("host %v: settings RPC took %v", hostKey, time.Since(start))
+	if r.sessionLog != nil {
+		r.sessionLog.settings(sess, settings, false)
+	}
+
+	r.mu.Lock()
+	r.settings[hostKey] = cachedSettings{settings: settings, fetched: time.Now()}
+	r.mu.Unlock()
+	return settings, nil
+}
+
+// InvalidateHostSettings removes the host's cached settings. It should be
+// called when an RPC fails in a way that may be caused by outdated prices.
+func (r *Renter) InvalidateHostSettings(hostKey rhp.PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.settings, hostKey)
+}
+
+func New(dir string, opts ...Option) (*Renter, error) {
 	r := &Renter{
 		renterKey: rhp.GeneratePrivateKey(),
 		dir:       dir,
+		indent:    jsonout.DefaultIndent,
+		explorer:  explorer.NewClient(explorer.Mainnet),
+		dialer:    &net.Dialer{},
 
-		contracts: make(map[rhp.PublicKey]ContractMeta),
+		close:     make(chan struct{}),
+		contracts: make(map[rhp.PublicKey][]ContractMeta),
+		funds:     make(map[types.FileContractID]types.Currency),
+		settings:  make(map[rhp.PublicKey]cachedSettings),
+		failures:  make(map[rhp.PublicKey]int),
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
 	// get the current block height
 	if err := r.refreshHeight(); err != nil {
 		return nil, fmt.Errorf("failed to get block height: %w", err)
 	}
-	// batch height requests
+	// renter key and contracts will be overwritten if the file exists
+	if err := r.load(); !errors.Is(err, os.ErrNotExist) && err != nil {
+		return nil, fmt.Errorf("failed to load contracts: %w", err)
+	}
+
+	// batch height requests and retry failed saves
 	t := time.NewTicker(15 * time.Second)
 	go func() {
 		for {
@@ -308,12 +1177,10 @@ func New(dir string) (*Renter, error) {
 
 			// update the renter's block height, ignore the error
 			r.refreshHeight()
+			if err := r.saveIfDirty(); err != nil {
+				r.debugf("failed to autosave contracts: %v", err)
+			}
 		}
 	}()
-
-	// renter key and contracts will be overwritten if the file exists
-	if err := r.load(); !errors.Is(err, os.ErrNotExist) && err != nil {
-		return nil, fmt.Errorf("failed to load contracts: %w", err)
-	}
 	return r, nil
 }
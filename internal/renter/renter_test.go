@@ -0,0 +1,886 @@
+package renter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/encoding"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/hosttest"
+	"go.sia.tech/skyrecover/internal/jsonout"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+	"lukechampine.com/frand"
+)
+
+// testWallet is a Wallet that does not fund or sign transactions. The
+// in-process hosts do not validate the formation transaction.
+type testWallet struct{}
+
+func (testWallet) Address() types.UnlockHash { return types.UnlockHash{} }
+
+func (testWallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	return nil, func() {}, nil
+}
+
+func (testWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash, cf types.CoveredFields) error {
+	return nil
+}
+
+func newTestRenter(dir string, contracts int, compress bool) *Renter {
+	r := &Renter{
+		renterKey: rhp.GeneratePrivateKey(),
+		dir:       dir,
+		compress:  compress,
+		indent:    jsonout.DefaultIndent,
+		contracts: make(map[rhp.PublicKey][]ContractMeta),
+		funds:     make(map[types.FileContractID]types.Currency),
+		failures:  make(map[rhp.PublicKey]int),
+	}
+	for i := 0; i < contracts; i++ {
+		var hostKey rhp.PublicKey
+		frand.Read(hostKey[:])
+		r.contracts[hostKey] = []ContractMeta{{
+			ID:               types.FileContractID(frand.Entropy256()),
+			HostKey:          hostKey,
+			ExpirationHeight: 1000 + uint64(i),
+		}}
+	}
+	return r
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			r := newTestRenter(dir, 100, compress)
+			// add an expired contract that should be pruned
+			r.currentHeight = 500
+			r.contracts[rhp.PublicKey{1}] = []ContractMeta{{HostKey: rhp.PublicKey{1}, ExpirationHeight: 10}}
+			if err := r.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			expectedFile := contractsFile
+			if compress {
+				expectedFile = compressedContractsFile
+			}
+			if _, err := os.Stat(filepath.Join(dir, expectedFile)); err != nil {
+				t.Fatal(err)
+			} else if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+				t.Fatalf("temp files were not replaced: %v", tmp)
+			}
+
+			// compression should be detected when loading
+			r2 := &Renter{dir: dir, currentHeight: 500}
+			if err := r2.load(); err != nil {
+				t.Fatal(err)
+			} else if r2.compress != compress {
+				t.Fatalf("expected compress %v, got %v", compress, r2.compress)
+			} else if r2.renterKey.PublicKey() != r.renterKey.PublicKey() {
+				t.Fatal("renter key mismatch")
+			} else if len(r2.contracts) != 100 {
+				t.Fatalf("expected 100 contracts, got %v", len(r2.contracts))
+			}
+			for hostKey, contract := range r2.contracts {
+				if !reflect.DeepEqual(r.contracts[hostKey], contract) {
+					t.Fatalf("contract mismatch: expected %v, got %v", r.contracts[hostKey], contract)
+				}
+			}
+		})
+	}
+}
+
+func TestSession(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	contract, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{})
+	if err != nil {
+		t.Fatal(err)
+	} else if contract.NetAddress != host.NetAddress() {
+		t.Fatalf("expected net address %v, got %v", host.NetAddress(), contract.NetAddress)
+	}
+
+	var sector [rhp.SectorSize]byte
+	frand.Read(sector[:])
+	root := host.AddSector(&sector)
+
+	readSector := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		sess, err := r.NewSession(ctx, host.PublicKey())
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+
+		settings, err := rhp.RPCSettings(ctx, sess.Transport())
+		if err != nil {
+			return err
+		}
+		sections := []rhp.RPCReadRequestSection{{MerkleRoot: root, Length: rhp.SectorSize}}
+		buf := bytes.NewBuffer(nil)
+		if err := sess.Read(ctx, buf, sections, rhp.RPCReadCost(settings, sections)); err != nil {
+			return err
+		} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+			return errors.New("sector data mismatch")
+		}
+		return nil
+	}
+
+	if err := readSector(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last known address should be used once the host is delisted
+	network.Delist(host)
+	if err := readSector(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a known address the session cannot be created
+	r.mu.Lock()
+	r.contracts[host.PublicKey()][0].NetAddress = ""
+	r.mu.Unlock()
+	if err := readSector(); err == nil {
+		t.Fatal("expected error without a known net address")
+	}
+}
+
+func TestFormPanicRecovery(t *testing.T) {
+	network := hosttest.NewNetwork()
+	var hosts []*hosttest.Host
+	for i := 0; i < 3; i++ {
+		hosts = append(hosts, network.AddHost())
+	}
+
+	dir := t.TempDir()
+	r, err := New(dir, WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// form contracts and crash without closing the renter
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		for _, host := range hosts {
+			if _, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		panic("simulated crash")
+	}()
+	close(r.close) // stop the background loop without saving
+
+	r2, err := New(dir, WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	for _, host := range hosts {
+		if _, err := r2.HostContract(host.PublicKey()); err != nil {
+			t.Fatalf("contract with host %v was not recovered: %v", host.PublicKey(), err)
+		}
+	}
+
+	// Close should persist changes that were not saved
+	r2.mu.Lock()
+	r2.contracts[rhp.PublicKey{1}] = []ContractMeta{{HostKey: rhp.PublicKey{1}, ExpirationHeight: r2.currentHeight + 100}}
+	r2.dirty = true
+	r2.mu.Unlock()
+	if err := r2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r3 := &Renter{dir: dir, currentHeight: r2.currentHeight}
+	if err := r3.load(); err != nil {
+		t.Fatal(err)
+	} else if len(r3.contracts) != len(hosts)+1 {
+		t.Fatalf("expected %v contracts, got %v", len(hosts)+1, len(r3.contracts))
+	}
+}
+
+func TestSessionHostKeyMismatch(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	oldKey := host.PublicKey()
+	if _, err := r.FormDownloadContract(oldKey, 1<<30, 144, testWallet{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host is reinstalled at the same address with a new key
+	host.RotateKey()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = r.NewSession(ctx, oldKey)
+	if !errors.Is(err, rhp.ErrHostKeyMismatch) {
+		t.Fatalf("expected host key mismatch, got %v", err)
+	} else if !strings.Contains(err.Error(), host.PublicKey().String()) {
+		t.Fatalf("expected error to contain new key %v, got %v", host.PublicKey(), err)
+	}
+}
+
+// fundingWallet records the amount funded by the last formation.
+type fundingWallet struct {
+	testWallet
+	funded types.Currency
+}
+
+func (w *fundingWallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	w.funded = amount
+	return nil, func() {}, nil
+}
+
+func TestEstimateFormationCost(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	estimate, err := r.EstimateFormationCost(host.PublicKey(), 1<<30, 144)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(fundingWallet)
+	if _, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, w); err != nil {
+		t.Fatal(err)
+	} else if !estimate.Equals(w.funded) {
+		t.Fatalf("expected estimate %v to equal funded amount %v", estimate, w.funded)
+	}
+}
+
+func TestConcurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenter(dir, 10, false)
+
+	// add and remove contracts concurrently, as parallel formation and
+	// recovery do
+	existing := r.Contracts()
+	var wg sync.WaitGroup
+	errCh := make(chan error, 100)
+	hostKeys := make([]rhp.PublicKey, 50)
+	for i := range hostKeys {
+		frand.Read(hostKeys[i][:])
+		wg.Add(1)
+		go func(hostKey rhp.PublicKey) {
+			defer wg.Done()
+			r.mu.Lock()
+			r.contracts[hostKey] = []ContractMeta{{HostKey: hostKey, ExpirationHeight: 1000}}
+			r.dirty = true
+			r.mu.Unlock()
+			errCh <- r.saveIfDirty()
+		}(hostKeys[i])
+	}
+	for _, contract := range existing[:5] {
+		wg.Add(1)
+		go func(hostKey rhp.PublicKey) {
+			defer wg.Done()
+			errCh <- r.RemoveHostContract(hostKey)
+		}(contract.HostKey)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Fatalf("temp files were not replaced: %v", tmp)
+	}
+	r2 := &Renter{dir: dir}
+	if err := r2.load(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(r2.contracts, r.contracts) {
+		t.Fatalf("expected %v contracts, got %v", len(r.contracts), len(r2.contracts))
+	}
+}
+
+func TestSaveMigrateCompressed(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenter(dir, 10, false)
+	if err := r.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.compress = true
+	if err := r.save(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(dir, contractsFile)); !os.IsNotExist(err) {
+		t.Fatal("uncompressed contracts file was not removed")
+	}
+
+	r2 := &Renter{dir: dir}
+	if err := r2.load(); err != nil {
+		t.Fatal(err)
+	} else if len(r2.contracts) != 10 {
+		t.Fatalf("expected 10 contracts, got %v", len(r2.contracts))
+	}
+}
+
+func TestLoadUncompressedWithCompression(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenter(dir, 10, false)
+	if err := r.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// enabling compression should still load the existing uncompressed file
+	// and migrate it when the contracts are saved
+	r2 := &Renter{dir: dir, compress: true}
+	if err := r2.load(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(r2.contracts, r.contracts) {
+		t.Fatalf("expected %v contracts, got %v", len(r.contracts), len(r2.contracts))
+	} else if _, err := os.Stat(filepath.Join(dir, compressedContractsFile)); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(dir, contractsFile)); !os.IsNotExist(err) {
+		t.Fatal("uncompressed contracts file was not removed")
+	}
+}
+
+func TestEncryptedContracts(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir := t.TempDir()
+			r := newTestRenter(dir, 10, compress)
+			if err := r.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			// loading with a passphrase migrates the plaintext file
+			r2 := &Renter{dir: dir, passphrase: "foo"}
+			if err := r2.load(); err != nil {
+				t.Fatal(err)
+			} else if !ContractsEncrypted(dir) {
+				t.Fatal("expected the contracts file to be encrypted")
+			} else if plain, _ := filepath.Glob(filepath.Join(dir, contractsFile+"*")); len(plain) != 1 || filepath.Base(plain[0]) != encryptedContractsFile {
+				t.Fatalf("expected only the encrypted file, got %v", plain)
+			}
+
+			if err := (&Renter{dir: dir}).load(); !errors.Is(err, ErrPassphraseRequired) {
+				t.Fatalf("expected %v, got %v", ErrPassphraseRequired, err)
+			} else if err := (&Renter{dir: dir, passphrase: "bar"}).load(); !errors.Is(err, ErrWrongPassphrase) {
+				t.Fatalf("expected %v, got %v", ErrWrongPassphrase, err)
+			}
+
+			r3 := &Renter{dir: dir, passphrase: "foo"}
+			if err := r3.load(); err != nil {
+				t.Fatal(err)
+			} else if r3.compress != compress {
+				t.Fatalf("expected compress %v, got %v", compress, r3.compress)
+			} else if r3.renterKey.PublicKey() != r.renterKey.PublicKey() {
+				t.Fatal("renter key mismatch")
+			} else if !reflect.DeepEqual(r3.contracts, r.contracts) {
+				t.Fatalf("expected %v contracts, got %v", len(r.contracts), len(r3.contracts))
+			}
+		})
+	}
+}
+
+func TestWrongNetwork(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRenter(dir, 10, false)
+	r.network = "zen"
+	if err := r.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a mainnet renter should not load the zen contracts
+	r2 := &Renter{dir: dir}
+	if err := r2.load(); !errors.Is(err, ErrWrongNetwork) {
+		t.Fatalf("expected ErrWrongNetwork, got %v", err)
+	}
+
+	r3 := &Renter{dir: dir, network: "zen"}
+	if err := r3.load(); err != nil {
+		t.Fatal(err)
+	} else if len(r3.contracts) != 10 {
+		t.Fatalf("expected 10 contracts, got %v", len(r3.contracts))
+	}
+}
+
+func TestEncodeContractsIndent(t *testing.T) {
+	for _, contracts := range []int{0, 1} {
+		for _, network := range []string{"", "zen"} {
+			r := newTestRenter(t.TempDir(), contracts, false)
+			r.network = network
+			r.indent = ""
+			var compact bytes.Buffer
+			if err := r.encodeContracts(&compact); err != nil {
+				t.Fatal(err)
+			} else if !json.Valid(compact.Bytes()) {
+				t.Fatalf("invalid compact JSON: %s", compact.Bytes())
+			} else if bytes.Count(compact.Bytes(), []byte("\n")) != 1 {
+				t.Fatalf("expected compact JSON, got %s", compact.Bytes())
+			}
+
+			// indented output should match the standard library's indentation
+			for _, indent := range []string{jsonout.DefaultIndent, "\t"} {
+				r.indent = indent
+				var buf, expected bytes.Buffer
+				if err := r.encodeContracts(&buf); err != nil {
+					t.Fatal(err)
+				} else if err := json.Indent(&expected, compact.Bytes(), "", indent); err != nil {
+					t.Fatal(err)
+				} else if buf.String() != expected.String() {
+					t.Fatalf("indent %q: expected %s, got %s", indent, expected.Bytes(), buf.Bytes())
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", compress), func(b *testing.B) {
+			r := newTestRenter(b.TempDir(), 10000, compress)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := r.save(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", compress), func(b *testing.B) {
+			dir := b.TempDir()
+			if err := newTestRenter(dir, 10000, compress).save(); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := &Renter{dir: dir}
+				if err := r.load(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestScanHost(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	settings, _, err := r.ScanHost(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if settings.NetAddress != host.NetAddress() {
+		t.Fatalf("expected net address %v, got %v", host.NetAddress(), settings.NetAddress)
+	} else if len(r.Contracts()) != 0 {
+		t.Fatal("expected no contracts to be formed")
+	}
+
+	// the host can no longer be found or reached
+	network.RemoveHost(host)
+	if _, _, err := r.ScanHost(ctx, host.PublicKey()); err == nil {
+		t.Fatal("expected error for unreachable host")
+	}
+}
+
+func TestContractFunds(t *testing.T) {
+	network := hosttest.NewNetwork()
+	funded, drained := network.AddHost(), network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.FormDownloadContract(funded.PublicKey(), 1<<30, 144, testWallet{}); err != nil {
+		t.Fatal(err)
+	} else if _, err := r.FormDownloadContract(drained.PublicKey(), 0, 144, testWallet{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	remaining, readCost, err := r.ContractFunds(ctx, funded.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if remaining.Cmp(readCost) < 0 {
+		t.Fatalf("expected funded contract to afford a read, %v < %v", remaining, readCost)
+	}
+
+	// a contract funded for no downloads cannot pay for a full sector
+	remaining, readCost, err = r.ContractFunds(ctx, drained.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if remaining.Cmp(readCost) >= 0 {
+		t.Fatalf("expected drained contract to not afford a read, %v >= %v", remaining, readCost)
+	}
+}
+
+func TestMultipleHostContracts(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	drained, err := r.FormDownloadContract(host.PublicKey(), 0, 144, testWallet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	funded, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{})
+	if err != nil {
+		t.Fatal(err)
+	} else if contracts := r.Contracts(); len(contracts) != 2 {
+		t.Fatalf("expected 2 contracts, got %v", len(contracts))
+	} else if hosts := r.Hosts(); len(hosts) != 1 {
+		t.Fatalf("expected 1 host, got %v", len(hosts))
+	}
+
+	// the session should lock the contract with the most remaining funds
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sess, err := r.NewSession(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if sess.Contract().ID() != funded.ID {
+		t.Fatalf("expected contract %v to be locked, got %v", funded.ID, sess.Contract().ID())
+	}
+	sess.Close()
+	if contract, err := r.HostContract(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if contract.ID != funded.ID {
+		t.Fatalf("expected contract %v, got %v", funded.ID, contract.ID)
+	}
+
+	// removing a contract keeps the host's other contracts
+	if err := r.RemoveContract(funded); err != nil {
+		t.Fatal(err)
+	} else if contract, err := r.HostContract(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if contract.ID != drained.ID {
+		t.Fatalf("expected contract %v, got %v", drained.ID, contract.ID)
+	}
+}
+
+func TestHostFailureLimit(t *testing.T) {
+	r := newTestRenter(t.TempDir(), 3, false)
+	r.failureLimit = 2
+	hosts := r.Hosts()
+	failing := hosts[0]
+
+	// a success resets the consecutive failures
+	if r.RecordReadFailure(failing) {
+		t.Fatal("expected the host to be below the limit")
+	}
+	r.RecordReadSuccess(failing)
+	if r.RecordReadFailure(failing) {
+		t.Fatal("expected the success to reset the failures")
+	} else if !r.RecordReadFailure(failing) {
+		t.Fatal("expected the host to reach the limit")
+	} else if r.RecordReadFailure(failing) {
+		t.Fatal("expected the limit to be reported once")
+	} else if !r.HostExcluded(failing) {
+		t.Fatal("expected the host to be excluded")
+	}
+	for _, host := range r.Hosts() {
+		if host == failing {
+			t.Fatal("expected the host to be excluded from Hosts")
+		}
+	}
+	if n := len(r.Hosts()); n != len(hosts)-1 {
+		t.Fatalf("expected %v hosts, got %v", len(hosts)-1, n)
+	}
+
+	// a successful read includes the host again
+	r.RecordReadSuccess(failing)
+	if n := len(r.Hosts()); n != len(hosts) {
+		t.Fatalf("expected %v hosts, got %v", len(hosts), n)
+	}
+
+	// without a limit hosts are never excluded
+	r.failureLimit = 0
+	for i := 0; i < 10; i++ {
+		if r.RecordReadFailure(failing) {
+			t.Fatal("expected no limit")
+		}
+	}
+	if r.HostExcluded(failing) {
+		t.Fatal("expected the host to be included without a limit")
+	}
+}
+
+func TestRenewDownloadContract(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	old, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{})
+	if err != nil {
+		t.Fatal(err)
+	} else if r.ExpiresWithin(old, 100) {
+		t.Fatal("expected contract to not expire within 100 blocks")
+	} else if !r.ExpiresWithin(old, 144) {
+		t.Fatal("expected contract to expire within 144 blocks")
+	}
+
+	renewed, err := r.RenewDownloadContract(host.PublicKey(), 1<<30, 288, testWallet{})
+	if err != nil {
+		t.Fatal(err)
+	} else if renewed.ID == old.ID {
+		t.Fatal("expected renewal to create a new contract")
+	} else if renewed.ExpirationHeight != old.ExpirationHeight+144 {
+		t.Fatalf("expected expiration height %v, got %v", old.ExpirationHeight+144, renewed.ExpirationHeight)
+	} else if renewed.NetAddress != host.NetAddress() {
+		t.Fatalf("expected net address %v, got %v", host.NetAddress(), renewed.NetAddress)
+	}
+
+	contract, err := r.HostContract(host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if contract.ID != renewed.ID {
+		t.Fatalf("expected contract %v, got %v", renewed.ID, contract.ID)
+	}
+
+	// the renewed contract should be usable
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	remaining, readCost, err := r.ContractFunds(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if remaining.Cmp(readCost) < 0 {
+		t.Fatalf("expected renewed contract to afford a read, %v < %v", remaining, readCost)
+	}
+}
+
+func TestFormContractFunding(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	funds, collateral := types.SiacoinPrecision, types.SiacoinPrecision.Mul64(10)
+	defaultCost, err := r.EstimateFormationCost(host.PublicKey(), 1<<30, 144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost, err := r.EstimateFormationCost(host.PublicKey(), 1<<30, 144, WithRenterFunds(funds), WithHostCollateral(collateral))
+	if err != nil {
+		t.Fatal(err)
+	} else if cost.Cmp(defaultCost) <= 0 {
+		t.Fatalf("expected the cost with collateral to be higher than %v, got %v", defaultCost, cost)
+	}
+
+	// collateral above the host's max is rejected
+	maxCollateral := host.Settings().MaxCollateral
+	if _, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{}, WithHostCollateral(maxCollateral.Add64(1))); err == nil {
+		t.Fatal("expected collateral above the host's max to be rejected")
+	} else if _, err := r.HostContract(host.PublicKey()); !errors.Is(err, ErrNoContract) {
+		t.Fatalf("expected no contract, got %v", err)
+	}
+
+	if _, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{}, WithRenterFunds(funds), WithHostCollateral(collateral)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	remaining, _, err := r.ContractFunds(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	} else if !remaining.Equals(funds) {
+		t.Fatalf("expected the contract to be funded with %v, got %v", funds, remaining)
+	}
+}
+
+func TestImportSkydContracts(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	// form a contract with a different renter key, as skyd would have
+	skyd, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skyd.Close()
+	contract, err := skyd.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sk crypto.SecretKey
+	copy(sk[:], skyd.renterKey)
+	renterKey, hostKey := skyd.renterKey.PublicKey(), host.PublicKey()
+	header := skydContractHeader{
+		Transaction: types.Transaction{
+			FileContractRevisions: []types.FileContractRevision{{
+				ParentID: contract.ID,
+				UnlockConditions: types.UnlockConditions{
+					PublicKeys: []types.SiaPublicKey{
+						{Algorithm: types.SignatureEd25519, Key: renterKey[:]},
+						{Algorithm: types.SignatureEd25519, Key: hostKey[:]},
+					},
+					SignaturesRequired: 2,
+				},
+				NewWindowStart: types.BlockHeight(contract.ExpirationHeight + 5),
+			}},
+		},
+		SecretKey: sk,
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, contract.ID.String()+skydHeaderExtension), encoding.Marshal(header), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(dir, contract.ID.String()+".roots"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	imported, err := r.ImportSkydContracts(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(imported) != 1 {
+		t.Fatalf("expected 1 imported contract, got %v", len(imported))
+	} else if imported[0].ID != contract.ID || imported[0].HostKey != contract.HostKey || imported[0].ExpirationHeight != contract.ExpirationHeight {
+		t.Fatalf("expected contract %v, got %v", contract, imported[0])
+	}
+
+	// the session must be signed with skyd's key
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sess, err := r.NewSession(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	// the contract is already imported
+	if imported, err := r.ImportSkydContracts(dir); err != nil {
+		t.Fatal(err)
+	} else if len(imported) != 0 {
+		t.Fatalf("expected no imported contracts, got %v", len(imported))
+	}
+}
+
+func TestSessionRecording(t *testing.T) {
+	network := hosttest.NewNetwork()
+	host := network.AddHost()
+
+	r, err := New(t.TempDir(), WithExplorer(network), WithDialer(network), WithSessionRecording())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.FormDownloadContract(host.PublicKey(), 1<<30, 144, testWallet{}); err != nil {
+		t.Fatal(err)
+	}
+	var sector [rhp.SectorSize]byte
+	frand.Read(sector[:])
+	root := host.AddSector(&sector)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sess, err := r.NewSession(ctx, host.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := r.HostSettings(ctx, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := []rhp.RPCReadRequestSection{{MerkleRoot: root, Length: rhp.SectorSize}}
+	if err := sess.Read(ctx, io.Discard, sections, rhp.RPCReadCost(settings, sections)); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	// a failed session is recorded with its error
+	network.RemoveHost(host)
+	if _, err := r.NewSession(ctx, host.PublicKey()); err == nil {
+		t.Fatal("expected session with a removed host to fail")
+	}
+
+	records := r.Sessions()
+	if len(records) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", len(records))
+	}
+	rec := records[0]
+	if rec.OpenErr != nil {
+		t.Fatalf("expected first session to open, got %v", rec.OpenErr)
+	} else if rec.HostKey != host.PublicKey() || rec.NetAddress != host.NetAddress() {
+		t.Fatalf("unexpected host %v at %v", rec.HostKey, rec.NetAddress)
+	} else if rec.Settings == nil || rec.Settings.Version != host.Settings().Version {
+		t.Fatalf("expected the host's settings to be recorded, got %+v", rec.Settings)
+	} else if len(rec.RPCs) != 1 || rec.RPCs[0].RPC != rhp.RPCReadID || rec.RPCs[0].Err != nil {
+		t.Fatalf("expected one successful read RPC, got %+v", rec.RPCs)
+	} else if rec.Revision <= rec.StartRevision {
+		t.Fatalf("expected the read to revise the contract, got revision %v from %v", rec.Revision, rec.StartRevision)
+	}
+	if records[1].OpenErr == nil {
+		t.Fatal("expected the second session's error to be recorded")
+	}
+}
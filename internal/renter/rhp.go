@@ -2,22 +2,30 @@ package renter
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"time"
 
 	rhpv2 "go.sia.tech/skyrecover/internal/rhp/v2"
 )
 
 // dialTransport is a convenience function that connects to the specified host
-func dialTransport(ctx context.Context, hostIP string, hostKey rhpv2.PublicKey) (_ *rhpv2.Transport, err error) {
-	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", hostIP)
+func (r *Renter) dialTransport(ctx context.Context, hostIP string, hostKey rhpv2.PublicKey) (_ *rhpv2.Transport, err error) {
+	start := time.Now()
+	conn, err := r.dialer.DialContext(ctx, "tcp", hostIP)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial host: %w", err)
 	}
+	r.debugf("host %v: dialed %v in %v", hostKey, hostIP, time.Since(start))
+	start = time.Now()
 	t, err := rhpv2.NewRenterTransport(conn, hostKey)
-	if err != nil {
+	if errors.Is(err, rhpv2.ErrHostKeyMismatch) {
+		conn.Close()
+		return nil, r.hostKeyMismatchErr(hostKey, hostIP, err)
+	} else if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	r.debugf("host %v: completed handshake in %v", hostKey, time.Since(start))
 	return t, nil
 }
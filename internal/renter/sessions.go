@@ -0,0 +1,126 @@
+package renter
+
+import (
+	"sync"
+	"time"
+
+	"go.sia.tech/renterd/metrics"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+type (
+	// A SessionRecord is the lifecycle of a session opened by the renter: the
+	// result of dialing the host and locking its contract, the host's settings
+	// and the RPCs performed.
+	SessionRecord struct {
+		HostKey    rhp.PublicKey
+		NetAddress string
+		ContractID types.FileContractID
+		Opened     time.Time
+		// OpenElapsed is the time taken to dial the host and lock the
+		// contract. OpenErr is set if either failed.
+		OpenElapsed time.Duration
+		OpenErr     error
+
+		// Settings are the host settings returned by HostSettings for the
+		// session, nil if they were not requested. SettingsCached is true if
+		// they were cached rather than fetched over the session.
+		Settings       *rhp.HostSettings
+		SettingsCached bool
+
+		// StartRevision is the contract's revision number when it was locked,
+		// Revision its revision number after the session's last RPC.
+		StartRevision uint64
+		Revision      uint64
+		RPCs          []rhp.MetricRPC
+	}
+
+	// A sessionRecorder records the RPCs of a session to its record.
+	sessionRecorder struct {
+		log  *sessionLog
+		sess *rhp.Session
+		rec  *SessionRecord
+	}
+
+	// A sessionLog holds the records of the renter's sessions.
+	sessionLog struct {
+		mu       sync.Mutex
+		records  []*SessionRecord
+		sessions map[*rhp.Session]*SessionRecord
+	}
+)
+
+// RecordMetric implements metrics.MetricsRecorder. It is called after each of
+// the session's RPCs, from the goroutine that called the RPC.
+func (sr *sessionRecorder) RecordMetric(m metrics.Metric) {
+	rpc, ok := m.(rhp.MetricRPC)
+	if !ok {
+		return
+	}
+	revision := sr.sess.Contract().Revision.NewRevisionNumber
+	sr.log.mu.Lock()
+	defer sr.log.mu.Unlock()
+	sr.rec.RPCs = append(sr.rec.RPCs, rpc)
+	sr.rec.Revision = revision
+}
+
+// opened records the result of opening a session with a host. sess is nil if
+// err is set.
+func (sl *sessionLog) opened(rec SessionRecord, sess *rhp.Session, err error) {
+	rec.OpenErr = err
+	if sess != nil {
+		rec.StartRevision = sess.Contract().Revision.NewRevisionNumber
+		rec.Revision = rec.StartRevision
+	}
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	r := &rec
+	sl.records = append(sl.records, r)
+	if sess != nil {
+		sl.sessions[sess] = r
+		sess.SetRecorder(&sessionRecorder{log: sl, sess: sess, rec: r})
+	}
+}
+
+// settings records the host settings returned for a session.
+func (sl *sessionLog) settings(sess *rhp.Session, settings rhp.HostSettings, cached bool) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	rec, ok := sl.sessions[sess]
+	if !ok {
+		return
+	}
+	rec.Settings = &settings
+	rec.SettingsCached = cached
+}
+
+// WithSessionRecording records the lifecycle of every session opened by the
+// renter. The records are returned by Sessions. It is intended for protocol
+// debugging; the records are kept for the lifetime of the renter.
+func WithSessionRecording() Option {
+	return func(r *Renter) {
+		r.sessionLog = &sessionLog{
+			sessions: make(map[*rhp.Session]*SessionRecord),
+		}
+	}
+}
+
+// Sessions returns the records of the sessions opened by the renter in the
+// order they were opened. It returns nil unless the renter was created with
+// WithSessionRecording.
+func (r *Renter) Sessions() []SessionRecord {
+	if r.sessionLog == nil {
+		return nil
+	}
+	r.sessionLog.mu.Lock()
+	defer r.sessionLog.mu.Unlock()
+	records := make([]SessionRecord, 0, len(r.sessionLog.records))
+	for _, rec := range r.sessionLog.records {
+		c := *rec
+		c.RPCs = append([]rhp.MetricRPC(nil), rec.RPCs...)
+		records = append(records, c)
+	}
+	return records
+}
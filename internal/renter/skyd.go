@@ -0,0 +1,105 @@
+package renter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/NebulousLabs/encoding"
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+const (
+	// skydHeaderExtension is the extension of skyd's contract header files.
+	skydHeaderExtension = ".header"
+	// skydLegacyExtension is the extension of contract files written by
+	// skyd before v1.4.7. The header is at the start of the file.
+	skydLegacyExtension = ".contract"
+
+	// skydHeaderMaxSize is the maximum allocation when decoding a skyd
+	// contract header.
+	skydHeaderMaxSize = 1 << 20
+)
+
+// skydContractHeader is the prefix of skyd's contract header. The remaining
+// fields track spending and are not needed to revise the contract.
+type skydContractHeader struct {
+	Transaction types.Transaction
+	SecretKey   crypto.SecretKey
+}
+
+// readSkydContract reads the contract header at path and converts it to a
+// ContractMeta.
+func readSkydContract(path string) (ContractMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to open contract: %w", err)
+	}
+	defer f.Close()
+
+	var header skydContractHeader
+	if err := encoding.NewDecoder(bufio.NewReader(f), skydHeaderMaxSize).Decode(&header); err != nil {
+		return ContractMeta{}, fmt.Errorf("failed to decode contract header: %w", err)
+	} else if len(header.Transaction.FileContractRevisions) == 0 {
+		return ContractMeta{}, errors.New("contract header has no revisions")
+	}
+	rev := header.Transaction.FileContractRevisions[0]
+	if len(rev.UnlockConditions.PublicKeys) != 2 {
+		return ContractMeta{}, fmt.Errorf("expected 2 public keys in unlock conditions, got %v", len(rev.UnlockConditions.PublicKeys))
+	}
+	hostKey := rev.UnlockConditions.PublicKeys[1]
+	if hostKey.Algorithm != types.SignatureEd25519 || len(hostKey.Key) != len(rhp.PublicKey{}) {
+		return ContractMeta{}, fmt.Errorf("unsupported host key %v", hostKey)
+	}
+	return ContractMeta{
+		ID:               rev.ParentID,
+		HostKey:          *(*rhp.PublicKey)(hostKey.Key),
+		ExpirationHeight: uint64(rev.NewWindowStart) - 5,
+		RenterKey:        rhp.PrivateKey(header.SecretKey[:]),
+	}, nil
+}
+
+// ImportSkydContracts imports the unexpired contracts in a skyd renter's
+// contracts directory, usually ~/.skynet/renter/contracts. Each contract keeps
+// the renter key skyd formed it with so revisions are signed by the key the
+// host expects. Contracts that were already imported are skipped. The
+// imported contracts are returned.
+func (r *Renter) ImportSkydContracts(dir string) ([]ContractMeta, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contracts directory: %w", err)
+	}
+
+	var imported []ContractMeta
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != skydHeaderExtension && ext != skydLegacyExtension) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		contract, err := readSkydContract(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read contract %v: %w", strings.TrimSuffix(entry.Name(), ext), err)
+		}
+
+		r.mu.Lock()
+		exists := false
+		for _, existing := range r.contracts[contract.HostKey] {
+			exists = exists || existing.ID == contract.ID
+		}
+		if contract.ExpirationHeight <= r.currentHeight || exists {
+			r.mu.Unlock()
+			continue
+		}
+		r.contracts[contract.HostKey] = append(r.contracts[contract.HostKey], contract)
+		r.dirty = true
+		r.mu.Unlock()
+		imported = append(imported, contract)
+	}
+	return imported, r.save()
+}
@@ -88,7 +88,11 @@ func marshalHex(prefix string, data []byte) ([]byte, error) {
 }
 
 func unmarshalHex(dst []byte, prefix string, data []byte) error {
-	n, err := hex.Decode(dst, bytes.TrimPrefix(data, []byte(prefix+":")))
+	data = bytes.TrimPrefix(data, []byte(prefix+":"))
+	if hex.DecodedLen(len(data)) > len(dst) {
+		return fmt.Errorf("decoding %v:<hex> failed: expected %v bytes, got %v", prefix, len(dst), hex.DecodedLen(len(data)))
+	}
+	n, err := hex.Decode(dst, data)
 	if n < len(dst) {
 		err = io.EOF
 	}
@@ -496,11 +496,21 @@ func (r *RPCReadRequest) unmarshalBuffer(b *objBuffer) error {
 }
 
 func (r *RPCReadResponse) marshalledSize() int {
-	return 8 + len(r.Signature) + 8 + len(r.Data) + 8 + len(r.MerkleProof)*32
+	n := 8 + 8 + len(r.Data) + 8 + len(r.MerkleProof)*32
+	if r.Signature != (Signature{}) {
+		n += len(r.Signature)
+	}
+	return n
 }
 
 func (r *RPCReadResponse) marshalBuffer(b *objBuffer) {
-	b.writePrefixedBytes(r.Signature[:])
+	// like siad, an empty signature is omitted. Hosts only send the
+	// signature with the final section.
+	if r.Signature == (Signature{}) {
+		b.writePrefix(0)
+	} else {
+		b.writePrefixedBytes(r.Signature[:])
+	}
 	b.writePrefixedBytes(r.Data)
 	b.writePrefix(len(r.MerkleProof))
 	for i := range r.MerkleProof {
@@ -169,6 +169,48 @@ func SectorRoot(sector *[SectorSize]byte) Hash256 {
 	return sa.root()
 }
 
+// A SectorHasher computes the Merkle root of a sector as it is written,
+// avoiding the need to buffer the sector before verifying it.
+type SectorHasher struct {
+	sa  sectorAccumulator
+	buf [LeafSize * 4]byte
+	n   int
+}
+
+// Write implements io.Writer.
+func (sh *SectorHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	if sh.n > 0 {
+		c := copy(sh.buf[sh.n:], p)
+		sh.n += c
+		p = p[c:]
+		if sh.n < len(sh.buf) {
+			return written, nil
+		}
+		sh.sa.appendLeaves(sh.buf[:])
+		sh.n = 0
+	}
+	// hash full batches of leaves in place
+	rem := len(p) % len(sh.buf)
+	sh.sa.appendLeaves(p[:len(p)-rem])
+	sh.n = copy(sh.buf[:], p[len(p)-rem:])
+	return written, nil
+}
+
+// Root returns the Merkle root of the data written so far. Any trailing
+// partial leaf is ignored.
+func (sh *SectorHasher) Root() Hash256 {
+	sa := sh.sa
+	sa.appendLeaves(sh.buf[:sh.n-sh.n%LeafSize])
+	return sa.root()
+}
+
+// Reset resets the hasher to its initial state.
+func (sh *SectorHasher) Reset() {
+	sh.sa = sectorAccumulator{}
+	sh.n = 0
+}
+
 // ReaderRoot returns the Merkle root of the supplied stream, which must contain
 // an integer multiple of leaves.
 func ReaderRoot(r io.Reader) (Hash256, error) {
@@ -83,6 +83,58 @@ func BenchmarkSectorRoot(b *testing.B) {
 	}
 }
 
+func TestSectorHasher(t *testing.T) {
+	var sector [SectorSize]byte
+	frand.Read(sector[:])
+	expected := SectorRoot(&sector)
+
+	// write the sector in uneven pieces
+	var sh SectorHasher
+	for p := sector[:]; len(p) > 0; {
+		n := frand.Intn(3*LeafSize*4) + 1
+		if n > len(p) {
+			n = len(p)
+		}
+		sh.Write(p[:n])
+		p = p[n:]
+	}
+	if sh.Root() != expected {
+		t.Fatal("SectorHasher root does not match SectorRoot")
+	}
+
+	sh.Reset()
+	if _, err := bytes.NewReader(sector[:]).WriteTo(&sh); err != nil {
+		t.Fatal(err)
+	} else if sh.Root() != expected {
+		t.Fatal("SectorHasher root does not match SectorRoot after reset")
+	}
+
+	// writing should not allocate
+	allocs := testing.AllocsPerRun(5, func() {
+		sh.Reset()
+		sh.Write(sector[:100])
+		sh.Write(sector[100:])
+	})
+	if allocs > 0 {
+		t.Error("expected SectorHasher to allocate 0 times, got", allocs)
+	}
+}
+
+func BenchmarkSectorHasher(b *testing.B) {
+	b.ReportAllocs()
+	var sector [SectorSize]byte
+	var sh SectorHasher
+	b.SetBytes(SectorSize)
+	for i := 0; i < b.N; i++ {
+		sh.Reset()
+		// simulate a sector arriving in network-sized writes
+		for j := 0; j < SectorSize; j += 1 << 14 {
+			sh.Write(sector[j : j+1<<14])
+		}
+		_ = sh.Root()
+	}
+}
+
 func TestMetaRoot(t *testing.T) {
 	// test some known roots
 	if MetaRoot(nil) != (Hash256{}) {
@@ -240,3 +292,15 @@ func BenchmarkReadSector(b *testing.B) {
 		}
 	}
 }
+
+func TestDefaultSectorVerifier(t *testing.T) {
+	var sector [SectorSize]byte
+	frand.Read(sector[:])
+	sh := DefaultSectorVerifier.NewSectorHasher()
+	sh.Write(sector[:])
+	if root := DefaultSectorVerifier.SectorRoot(&sector); root != refSectorRoot(&sector) {
+		t.Fatal("default verifier root does not match reference")
+	} else if sh.Root() != root {
+		t.Fatal("default verifier hasher root does not match")
+	}
+}
@@ -131,6 +131,8 @@ type Session struct {
 	contract    Contract
 	key         PrivateKey
 	appendRoots []Hash256
+	verifier    SectorVerifier
+	recorder    metrics.MetricsRecorder
 }
 
 // Transport returns the underlying Transport of the session.
@@ -142,6 +144,23 @@ func (s *Session) HostKey() PublicKey { return s.contract.HostKey() }
 // Contract returns the current revision of the contract.
 func (s *Session) Contract() Contract { return s.contract }
 
+// SectorVerifier returns the SectorVerifier used to verify sectors read from
+// the host.
+func (s *Session) SectorVerifier() SectorVerifier {
+	if s.verifier == nil {
+		return DefaultSectorVerifier
+	}
+	return s.verifier
+}
+
+// SetSectorVerifier sets the SectorVerifier used to verify sectors read from
+// the host, e.g. for a test network with a different Merkle tree.
+func (s *Session) SetSectorVerifier(v SectorVerifier) { s.verifier = v }
+
+// SetRecorder sets a MetricsRecorder that records the session's RPCs in
+// addition to the recorder stored in each RPC's context.
+func (s *Session) SetRecorder(mr metrics.MetricsRecorder) { s.recorder = mr }
+
 func (s *Session) isRevisable() bool {
 	return s.contract.Revision.NewRevisionNumber < math.MaxUint64
 }
@@ -154,7 +173,7 @@ func (s *Session) sufficientCollateral(collateral types.Currency) bool {
 	return s.contract.Revision.NewMissedProofOutputs[1].Value.Cmp(collateral) >= 0
 }
 
-func recordRPC(ctx context.Context, t *Transport, c Contract, id Specifier, err *error) func() {
+func recordRPC(ctx context.Context, t *Transport, c Contract, id Specifier, mr metrics.MetricsRecorder, err *error) func() {
 	startTime := time.Now()
 	contractID := c.ID()
 	var startFunds types.Currency
@@ -184,6 +203,9 @@ func recordRPC(ctx context.Context, t *Transport, c Contract, id Specifier, err
 			m.Collateral = startCollateral.Sub(c.Revision.NewMissedProofOutputs[1].Value)
 		}
 		metrics.Record(ctx, m)
+		if mr != nil {
+			mr.RecordMetric(m)
+		}
 	}
 }
 
@@ -191,7 +213,7 @@ func recordRPC(ctx context.Context, t *Transport, c Contract, id Specifier, err
 // sector Merkle roots of the currently-locked contract.
 func (s *Session) SectorRoots(ctx context.Context, offset, n uint64, price types.Currency) (_ []Hash256, err error) {
 	defer wrapErr(&err, "SectorRoots")
-	defer recordRPC(ctx, s.transport, s.contract, RPCSectorRootsID, &err)()
+	defer recordRPC(ctx, s.transport, s.contract, RPCSectorRootsID, s.recorder, &err)()
 
 	if !s.isRevisable() {
 		return nil, ErrContractFinalized
@@ -274,7 +296,7 @@ func (sw *segWriter) Write(p []byte) (int, error) {
 // is non-nil. Failure to do so may allow an attacker to inject malicious data.
 func (s *Session) Read(ctx context.Context, w io.Writer, sections []RPCReadRequestSection, price types.Currency) (err error) {
 	defer wrapErr(&err, "Read")
-	defer recordRPC(ctx, s.transport, s.contract, RPCReadID, &err)()
+	defer recordRPC(ctx, s.transport, s.contract, RPCReadID, s.recorder, &err)()
 
 	empty := true
 	for _, s := range sections {
@@ -345,7 +367,7 @@ func (s *Session) Read(ctx context.Context, w io.Writer, sections []RPCReadReque
 		}
 		proofStart := sec.Offset / LeafSize
 		proofEnd := proofStart + sec.Length/LeafSize
-		rpv := NewRangeProofVerifier(proofStart, proofEnd)
+		rpv := s.SectorVerifier().NewRangeVerifier(proofStart, proofEnd)
 		tee := io.TeeReader(io.LimitReader(msgReader, int64(sec.Length)), &segWriter{w: w})
 		// the proof verifier Reads one segment at a time, so bufio is crucial
 		// for performance here
@@ -356,7 +378,7 @@ func (s *Session) Read(ctx context.Context, w io.Writer, sections []RPCReadReque
 		if _, err := io.ReadFull(msgReader, lenbuf); err != nil {
 			return fmt.Errorf("couldn't read proof len: %w", err)
 		}
-		if binary.LittleEndian.Uint64(lenbuf) != uint64(RangeProofSize(LeavesPerSector, proofStart, proofEnd)) {
+		if binary.LittleEndian.Uint64(lenbuf) != rpv.ProofSize() {
 			return errors.New("invalid proof size")
 		}
 		proof := make([]Hash256, binary.LittleEndian.Uint64(lenbuf))
@@ -404,7 +426,7 @@ func (s *Session) Read(ctx context.Context, w io.Writer, sections []RPCReadReque
 // always requested.
 func (s *Session) Write(ctx context.Context, actions []RPCWriteAction, price, collateral types.Currency) (err error) {
 	defer wrapErr(&err, "Write")
-	defer recordRPC(ctx, s.transport, s.contract, RPCWriteID, &err)()
+	defer recordRPC(ctx, s.transport, s.contract, RPCWriteID, s.recorder, &err)()
 
 	if !s.isRevisable() {
 		return ErrContractFinalized
@@ -569,7 +591,7 @@ func (s *Session) Close() (err error) {
 // RPCSettings calls the Settings RPC, returning the host's reported settings.
 func RPCSettings(ctx context.Context, t *Transport) (settings HostSettings, err error) {
 	defer wrapErr(&err, "Settings")
-	defer recordRPC(ctx, t, Contract{}, RPCSettingsID, &err)()
+	defer recordRPC(ctx, t, Contract{}, RPCSettingsID, nil, &err)()
 	var resp RPCSettingsResponse
 	if err := t.Call(RPCSettingsID, nil, &resp); err != nil {
 		return HostSettings{}, err
@@ -587,7 +609,7 @@ func RPCSettings(ctx context.Context, t *Transport) (settings HostSettings, err
 // contract is unlocked at the moment the host receives the RPC.)
 func RPCLock(ctx context.Context, t *Transport, id types.FileContractID, key PrivateKey, timeout time.Duration) (_ *Session, err error) {
 	defer wrapErr(&err, "Lock")
-	defer recordRPC(ctx, t, Contract{}, RPCLockID, &err)()
+	defer recordRPC(ctx, t, Contract{}, RPCLockID, nil, &err)()
 	req := &RPCLockRequest{
 		ContractID: id,
 		Signature:  t.SignChallenge(key),
@@ -629,6 +651,13 @@ func DialSession(ctx context.Context, hostIP string, hostKey PublicKey, id types
 	if err != nil {
 		return nil, err
 	}
+	return NewSession(ctx, conn, hostKey, id, renterKey)
+}
+
+// NewSession conducts the renter-host handshake over conn and locks the
+// specified contract. The connection is closed if the session cannot be
+// established.
+func NewSession(ctx context.Context, conn net.Conn, hostKey PublicKey, id types.FileContractID, renterKey PrivateKey) (_ *Session, err error) {
 	done := make(chan struct{})
 	go func() {
 		select {
@@ -38,6 +38,11 @@ var (
 	// ErrRenterClosed is returned by (*Transport).ReadID when the renter sends the
 	// Transport termination signal.
 	ErrRenterClosed = errors.New("renter has terminated Transport")
+
+	// ErrHostKeyMismatch is returned by NewRenterTransport when the host's
+	// handshake is not signed by the expected public key. The host's key may
+	// have changed or the connection was intercepted.
+	ErrHostKeyMismatch = errors.New("host's handshake was not signed by the expected key")
 )
 
 // An RPCError may be sent instead of a response object to any RPC.
@@ -481,7 +486,7 @@ func NewRenterTransport(conn net.Conn, pub PublicKey) (_ *Transport, err error)
 	// validate the signature before doing anything else
 	h := hashKeys(req.PublicKey, resp.PublicKey)
 	if !pub.VerifyHash(h, resp.Signature) {
-		return nil, errors.New("host's handshake signature was invalid")
+		return nil, ErrHostKeyMismatch
 	}
 	if resp.Cipher == cipherNoOverlap {
 		return nil, errors.New("host does not support any of our proposed ciphers")
@@ -0,0 +1,58 @@
+package rhp
+
+import "io"
+
+type (
+	// A SectorRootHasher computes the Merkle root of a sector as it is
+	// written.
+	SectorRootHasher interface {
+		io.Writer
+		Root() Hash256
+	}
+
+	// A RangeVerifier verifies a range of a sector's leaves against the
+	// sector's Merkle root as the data is read.
+	RangeVerifier interface {
+		io.ReaderFrom
+		// ProofSize returns the number of hashes in the range's proof.
+		ProofSize() uint64
+		// Verify verifies the proof using the data read so far.
+		Verify(proof []Hash256, root Hash256) bool
+	}
+
+	// A SectorVerifier computes sector roots and verifies range proofs. The
+	// construction is determined by the host's protocol version.
+	SectorVerifier interface {
+		SectorRoot(sector *[SectorSize]byte) Hash256
+		NewSectorHasher() SectorRootHasher
+		NewRangeVerifier(start, end uint64) RangeVerifier
+	}
+
+	// merkleVerifier is the blake2b Merkle tree used by every released
+	// version of the protocol.
+	merkleVerifier struct{}
+)
+
+// DefaultSectorVerifier verifies sectors read from hosts and sectors loaded
+// from disk. A session uses it unless SetSectorVerifier is called.
+var DefaultSectorVerifier SectorVerifier = merkleVerifier{}
+
+// SectorRoot implements SectorVerifier.
+func (merkleVerifier) SectorRoot(sector *[SectorSize]byte) Hash256 {
+	return SectorRoot(sector)
+}
+
+// NewSectorHasher implements SectorVerifier.
+func (merkleVerifier) NewSectorHasher() SectorRootHasher {
+	return new(SectorHasher)
+}
+
+// NewRangeVerifier implements SectorVerifier.
+func (merkleVerifier) NewRangeVerifier(start, end uint64) RangeVerifier {
+	return NewRangeProofVerifier(start, end)
+}
+
+// ProofSize implements RangeVerifier.
+func (rpv *RangeProofVerifier) ProofSize() uint64 {
+	return RangeProofSize(LeavesPerSector, rpv.start, rpv.end)
+}
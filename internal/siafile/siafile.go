@@ -12,9 +12,21 @@ import (
 	"go.sia.tech/siad/crypto"
 	"go.sia.tech/siad/modules"
 	"go.sia.tech/siad/modules/renter/filesystem/siafile"
+	"go.sia.tech/siad/types"
 	"go.sia.tech/skyrecover/internal/rhp/v2"
 )
 
+const (
+	// pageSize is the size of a page of the chunk table. Each chunk is
+	// stored in PagesPerChunk pages.
+	pageSize = 4096
+
+	// maxPagesPerChunk is the most pages a chunk is allowed to use. skyd
+	// reserves room for three hosts per piece, which needs at most 8 pages
+	// for 256 pieces. Anything much larger is a sign of corrupt metadata.
+	maxPagesPerChunk = 16
+)
+
 type (
 	partialChunkInfo struct {
 		ID     modules.CombinedChunkID `json:"id"`     // ID of the combined chunk
@@ -86,6 +98,19 @@ type (
 		Pieces [][]Piece `json:"pieces"`
 	}
 
+	// A PieceIndex identifies a piece within a file.
+	PieceIndex struct {
+		Chunk int `json:"chunk"`
+		Piece int `json:"piece"`
+	}
+
+	// A RootCollision is a merkle root shared by pieces that should contain
+	// different data.
+	RootCollision struct {
+		MerkleRoot crypto.Hash  `json:"merkleRoot"`
+		Pieces     []PieceIndex `json:"pieces"`
+	}
+
 	SiaFile struct {
 		FileSize     uint64 `json:"filesize"`  // total size of the file
 		PieceSize    uint64 `json:"piecesize"` // size of a single piece of the file
@@ -105,9 +130,71 @@ type (
 		Skylinks []string `json:"skylinks"`
 
 		Chunks []Chunk `json:"chunks"`
+
+		// TableChunks is the number of chunks the chunk table has room for.
+		// It is zero if the file was not loaded from disk.
+		TableChunks uint64 `json:"-"`
 	}
 )
 
+// RootCollisions returns the merkle roots that are used by more than one piece
+// in the file. Each piece is encrypted with its own key, so distinct pieces
+// should never share a root. The same piece stored on multiple hosts is not a
+// collision.
+func (sf SiaFile) RootCollisions() (collisions []RootCollision) {
+	positions := make(map[crypto.Hash][]PieceIndex)
+	var roots []crypto.Hash
+	for i, chunk := range sf.Chunks {
+		for j, pieces := range chunk.Pieces {
+			seen := make(map[crypto.Hash]bool)
+			for _, piece := range pieces {
+				if seen[piece.MerkleRoot] {
+					continue
+				}
+				seen[piece.MerkleRoot] = true
+				if _, ok := positions[piece.MerkleRoot]; !ok {
+					roots = append(roots, piece.MerkleRoot)
+				}
+				positions[piece.MerkleRoot] = append(positions[piece.MerkleRoot], PieceIndex{Chunk: i, Piece: j})
+			}
+		}
+	}
+
+	for _, root := range roots {
+		if len(positions[root]) > 1 {
+			collisions = append(collisions, RootCollision{
+				MerkleRoot: root,
+				Pieces:     positions[root],
+			})
+		}
+	}
+	return
+}
+
+// CheckChunkCount returns an error if the number of chunks is inconsistent
+// with the file size, which indicates the metadata was not parsed correctly.
+// The chunks must cover the file size with only the last chunk partially
+// used, and the chunk table must not hold more chunks than the file needs.
+func (sf SiaFile) CheckChunkCount() error {
+	ec, err := InitErasureCoder(sf.EncoderType, sf.DataPieces, sf.ParityPieces)
+	if err != nil {
+		return fmt.Errorf("failed to init erasure coder: %w", err)
+	}
+	chunkSize := sf.PieceSize * uint64(ec.MinPieces())
+	expected := sf.FileSize / chunkSize
+	if sf.FileSize%chunkSize != 0 || expected == 0 {
+		expected++
+	}
+
+	switch chunks := uint64(len(sf.Chunks)); {
+	case chunks != expected:
+		return fmt.Errorf("file has %v chunks, a %v byte file in %v byte chunks has %v", chunks, sf.FileSize, chunkSize, expected)
+	case sf.TableChunks > expected:
+		return fmt.Errorf("chunk table has %v chunks, a %v byte file in %v byte chunks has %v", sf.TableChunks, sf.FileSize, chunkSize, expected)
+	}
+	return nil
+}
+
 func InitErasureCoder(ecType, dataPieces, parityPieces uint32) (modules.ErasureCoder, error) {
 	switch ecType {
 	case 1:
@@ -119,7 +206,47 @@ func InitErasureCoder(ecType, dataPieces, parityPieces uint32) (modules.ErasureC
 	}
 }
 
-func Load(fp string) (sf SiaFile, _ error) {
+// Params override the erasure coding parameters stored in a siafile's
+// metadata. Zero fields keep the stored value.
+type Params struct {
+	PieceSize    uint64
+	EncoderType  uint32
+	DataPieces   uint32
+	ParityPieces uint32
+}
+
+// IsZero returns true if none of the parameters are overridden.
+func (p Params) IsZero() bool {
+	return p == Params{}
+}
+
+// apply replaces the siafile's parameters with the overridden ones.
+func (p Params) apply(sf *SiaFile) {
+	if p.PieceSize != 0 {
+		sf.PieceSize = p.PieceSize
+	}
+	if p.EncoderType != 0 {
+		sf.EncoderType = p.EncoderType
+	}
+	if p.DataPieces != 0 {
+		sf.DataPieces = p.DataPieces
+	}
+	if p.ParityPieces != 0 {
+		sf.ParityPieces = p.ParityPieces
+	}
+}
+
+// Load loads the siafile at fp.
+func Load(fp string) (SiaFile, error) {
+	return LoadWithParams(fp, Params{})
+}
+
+// LoadWithParams loads the siafile at fp using the given erasure coding
+// parameters instead of the ones stored in its metadata. It is used to recover
+// files whose metadata is corrupt. Since the stored parameters cannot be
+// trusted, the overridden parameters must split the file into exactly as many
+// chunks as the chunk table holds.
+func LoadWithParams(fp string, params Params) (sf SiaFile, _ error) {
 	f, err := os.Open(fp)
 	if err != nil {
 		return SiaFile{}, fmt.Errorf("failed to open file: %w", err)
@@ -143,6 +270,30 @@ func Load(fp string) (sf SiaFile, _ error) {
 	sf.MasterKeyType = meta.MasterKeyType.String()
 	sf.SharingKey = meta.SharingKey
 	sf.SharingKeyType = meta.SharingKeyType.String()
+	params.apply(&sf)
+	if sf.PieceSize == 0 || sf.PieceSize > rhp.SectorSize {
+		return SiaFile{}, fmt.Errorf("invalid piece size %v", sf.PieceSize)
+	} else if sf.EncoderType == 2 && sf.PieceSize%crypto.SegmentSize != 0 {
+		return SiaFile{}, fmt.Errorf("piece size %v is not a multiple of the %v byte segment size", sf.PieceSize, crypto.SegmentSize)
+	}
+
+	if meta.PagesPerChunk == 0 || meta.PagesPerChunk > maxPagesPerChunk {
+		return SiaFile{}, fmt.Errorf("invalid pages per chunk %v", meta.PagesPerChunk)
+	}
+	chunkPageSize := int64(meta.PagesPerChunk) * pageSize
+
+	// check the offsets before using them to size the tables, corrupt
+	// offsets could otherwise allocate gigabytes or panic
+	stat, err := f.Stat()
+	if err != nil {
+		return SiaFile{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := stat.Size()
+	if meta.PubKeyTableOffset < 0 || meta.PubKeyTableOffset > size {
+		return SiaFile{}, fmt.Errorf("host table offset %v is outside of the %v byte file", meta.PubKeyTableOffset, size)
+	} else if meta.ChunkOffset < meta.PubKeyTableOffset || meta.ChunkOffset > size {
+		return SiaFile{}, fmt.Errorf("chunk table offset %v is outside of the host table offset %v and the %v byte file", meta.ChunkOffset, meta.PubKeyTableOffset, size)
+	}
 
 	// read the raw host table data
 	hostKeys := (meta.ChunkOffset - meta.PubKeyTableOffset) / (16 + 8 + 32 + 1)
@@ -166,14 +317,23 @@ func Load(fp string) (sf SiaFile, _ error) {
 		return SiaFile{}, fmt.Errorf("failed to seek to chunk table: %w", err)
 	}
 
-	chunkSize := meta.PieceSize * uint64(ec.MinPieces())
+	chunkSize := sf.PieceSize * uint64(ec.MinPieces())
 	chunks := uint64(meta.FileSize) / chunkSize
 	if uint64(meta.FileSize)%chunkSize != 0 || chunks == 0 {
 		chunks++
 	}
 
-	// each chunk is encoded to a minimum of 4096 bytes
-	chunkBuf := make([]byte, 4096)
+	// the chunk table must hold every chunk of the file. Overridden
+	// parameters must match it exactly since the stored ones are not trusted.
+	tableChunks := uint64((size - meta.ChunkOffset + chunkPageSize - 1) / chunkPageSize)
+	if chunks > tableChunks || (!params.IsZero() && chunks != tableChunks) {
+		return SiaFile{}, fmt.Errorf("chunk table has %v chunks, a %v byte file in %v byte chunks has %v", tableChunks, meta.FileSize, chunkSize, chunks)
+	}
+	sf.TableChunks = tableChunks
+
+	// each chunk is stored in PagesPerChunk pages. The whole chunk must be
+	// read, or the next chunk would be read from the middle of this one.
+	chunkBuf := make([]byte, chunkPageSize)
 	for i := 0; i < int(chunks); i++ {
 		if _, err := io.ReadFull(f, chunkBuf); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
 			return SiaFile{}, fmt.Errorf("failed to read chunk: %w", err)
@@ -206,10 +366,12 @@ func Load(fp string) (sf SiaFile, _ error) {
 				return SiaFile{}, fmt.Errorf("failed to read merkle root: %w", err)
 			}
 
+			// the erasure coding parameters are stored once per file, a piece
+			// outside of them means the chunk was encoded differently
 			if pieceIndex >= uint32(len(chunk.Pieces)) {
-				return SiaFile{}, fmt.Errorf("piece index %v out of range", pieceIndex)
+				return SiaFile{}, fmt.Errorf("chunk %v: piece index %v out of range for %v+%v erasure coding", i+1, pieceIndex, sf.DataPieces, sf.ParityPieces)
 			} else if hostIndex >= uint32(len(hostTable)) {
-				return SiaFile{}, fmt.Errorf("host index %v out of range", hostIndex)
+				return SiaFile{}, fmt.Errorf("chunk %v: host index %v out of range for %v hosts", i+1, hostIndex, len(hostTable))
 			} else if err := piece.HostKey.UnmarshalText([]byte(hostTable[hostIndex].PublicKey.String())); err != nil {
 				return SiaFile{}, fmt.Errorf("failed to decode host key: %w", err)
 			}
@@ -220,3 +382,110 @@ func Load(fp string) (sf SiaFile, _ error) {
 
 	return sf, nil
 }
+
+// Rewrite writes a copy of the siafile at src to dst with its pieces replaced
+// by chunks. The host table is rebuilt from the pieces' host keys. The
+// metadata is copied unchanged except for the host table and chunk offsets.
+func Rewrite(src, dst string, chunks []Chunk) error {
+	buf, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	// decode the metadata twice, once to get the offsets and once to preserve
+	// any fields that are not parsed
+	var meta fileMetadata
+	if err := json.NewDecoder(bytes.NewReader(buf)).Decode(&meta); err != nil {
+		return fmt.Errorf("failed to decode file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(bytes.NewReader(buf)).Decode(&raw); err != nil {
+		return fmt.Errorf("failed to decode file: %w", err)
+	}
+
+	// build the host table
+	var hostTable []rhp.PublicKey
+	hostIndex := make(map[rhp.PublicKey]uint32)
+	for _, chunk := range chunks {
+		for _, pieces := range chunk.Pieces {
+			for _, piece := range pieces {
+				if _, ok := hostIndex[piece.HostKey]; !ok {
+					hostIndex[piece.HostKey] = uint32(len(hostTable))
+					hostTable = append(hostTable, piece.HostKey)
+				}
+			}
+		}
+	}
+	table := bytes.NewBuffer(nil)
+	for _, hostKey := range hostTable {
+		hpk := siafile.HostPublicKey{
+			PublicKey: types.SiaPublicKey{Algorithm: types.SignatureEd25519, Key: append([]byte(nil), hostKey[:]...)},
+			Used:      true,
+		}
+		if err := hpk.MarshalSia(table); err != nil {
+			return fmt.Errorf("failed to encode host key: %w", err)
+		}
+	}
+
+	// encode the chunks in the same number of pages, keeping each chunk's
+	// extension info and stuck bytes
+	if meta.PagesPerChunk == 0 || meta.PagesPerChunk > maxPagesPerChunk {
+		return fmt.Errorf("invalid pages per chunk %v", meta.PagesPerChunk)
+	}
+	chunkPageSize := int(meta.PagesPerChunk) * pageSize
+	chunkPages := make([]byte, len(chunks)*chunkPageSize)
+	for i, chunk := range chunks {
+		page := chunkPages[i*chunkPageSize : (i+1)*chunkPageSize]
+		if off := meta.ChunkOffset + int64(i*chunkPageSize); off+17 <= int64(len(buf)) {
+			copy(page[:17], buf[off:off+17])
+		}
+		var n int
+		for _, pieces := range chunk.Pieces {
+			n += len(pieces)
+		}
+		w := bytes.NewBuffer(nil)
+		binary.Write(w, binary.LittleEndian, uint16(n))
+		for j, pieces := range chunk.Pieces {
+			for _, piece := range pieces {
+				binary.Write(w, binary.LittleEndian, uint32(j))
+				binary.Write(w, binary.LittleEndian, hostIndex[piece.HostKey])
+				w.Write(piece.MerkleRoot[:])
+			}
+		}
+		if 17+w.Len() > chunkPageSize {
+			return fmt.Errorf("chunk %v: %v pieces do not fit in %v pages", i+1, n, meta.PagesPerChunk)
+		}
+		copy(page[17:], w.Bytes())
+	}
+
+	// the metadata's length depends on the offsets, move the host table and
+	// chunks until the metadata fits
+	roundUp := func(n int64) int64 { return (n + pageSize - 1) / pageSize * pageSize }
+	pubKeyTableOffset := meta.PubKeyTableOffset
+	var metaBuf []byte
+	var chunkOffset int64
+	for {
+		chunkOffset = roundUp(pubKeyTableOffset + int64(table.Len()))
+		if chunkOffset == pubKeyTableOffset {
+			chunkOffset += pageSize
+		}
+		raw["pubkeytableoffset"] = json.RawMessage(fmt.Sprint(pubKeyTableOffset))
+		raw["chunkoffset"] = json.RawMessage(fmt.Sprint(chunkOffset))
+		metaBuf, err = json.Marshal(raw)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata: %w", err)
+		} else if int64(len(metaBuf)) <= pubKeyTableOffset {
+			break
+		}
+		pubKeyTableOffset = roundUp(int64(len(metaBuf)))
+	}
+
+	out := make([]byte, chunkOffset, chunkOffset+int64(len(chunkPages)))
+	copy(out, metaBuf)
+	copy(out[pubKeyTableOffset:], table.Bytes())
+	out = append(out, chunkPages...)
+	if err := os.WriteFile(dst, out, 0600); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,647 @@
+package siafile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.sia.tech/siad/crypto"
+	"go.sia.tech/siad/modules"
+	"go.sia.tech/siad/modules/renter/filesystem/siafile"
+	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/rhp/v2"
+)
+
+var updateFixtures = flag.Bool("update", false, "regenerate the .sia fixtures in testdata")
+
+const (
+	fixturePubKeyTableOffset = 4096
+	fixtureChunkOffset       = 8192
+)
+
+type (
+	fixturePiece struct {
+		Index uint32
+		Host  uint32
+	}
+
+	// A fixture describes a .sia file. The encoded file is checked in to
+	// testdata and the expected SiaFile is derived from the description.
+	fixture struct {
+		Name         string
+		FileSize     uint64
+		PieceSize    uint64
+		EncoderType  modules.ErasureCoderType
+		DataPieces   uint32
+		ParityPieces uint32
+		Hosts        int
+		Chunks       [][]fixturePiece
+		// PagesPerChunk defaults to 1.
+		PagesPerChunk uint8
+	}
+)
+
+func fixtureHost(i int) (pk rhp.PublicKey) {
+	for j := range pk {
+		pk[j] = byte(i + 1)
+	}
+	return
+}
+
+func fixtureRoot(name string, chunk int, piece fixturePiece) crypto.Hash {
+	return crypto.HashAll(name, chunk, piece.Index, piece.Host)
+}
+
+func (f fixture) masterKey() []byte {
+	key := crypto.HashObject(f.Name)
+	return key[:]
+}
+
+// encode encodes the fixture using the same layout as skyd.
+func (f fixture) encode(t *testing.T) []byte {
+	t.Helper()
+
+	pages := f.PagesPerChunk
+	if pages == 0 {
+		pages = 1
+	}
+	meta := fileMetadata{
+		UniqueID:          f.Name,
+		PagesPerChunk:     pages,
+		FileSize:          f.FileSize,
+		PieceSize:         f.PieceSize,
+		ChunkOffset:       fixtureChunkOffset,
+		PubKeyTableOffset: fixturePubKeyTableOffset,
+		ErasureCodeType:   f.EncoderType,
+		MasterKey:         f.masterKey(),
+		MasterKeyType:     crypto.TypeXChaCha20,
+		SharingKeyType:    crypto.TypeInvalid,
+		Skylinks:          []string{},
+	}
+	binary.LittleEndian.PutUint32(meta.ErasureCodeParams[:4], f.DataPieces)
+	binary.LittleEndian.PutUint32(meta.ErasureCodeParams[4:], f.ParityPieces)
+
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(buf) > fixturePubKeyTableOffset {
+		t.Fatalf("metadata too large: %v bytes", len(buf))
+	}
+	buf = append(buf, make([]byte, fixturePubKeyTableOffset-len(buf))...)
+
+	table := bytes.NewBuffer(nil)
+	for i := 0; i < f.Hosts; i++ {
+		pk := fixtureHost(i)
+		hpk := siafile.HostPublicKey{
+			PublicKey: types.SiaPublicKey{
+				Algorithm: types.SignatureEd25519,
+				Key:       pk[:],
+			},
+			Used: true,
+		}
+		if err := hpk.MarshalSia(table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.Len() > fixtureChunkOffset-fixturePubKeyTableOffset {
+		t.Fatalf("host table too large: %v bytes", table.Len())
+	}
+	buf = append(buf, table.Bytes()...)
+	buf = append(buf, make([]byte, fixtureChunkOffset-len(buf))...)
+
+	for i, pieces := range f.Chunks {
+		page := make([]byte, int(pages)*pageSize)
+		// extension info and stuck byte are left empty
+		binary.LittleEndian.PutUint16(page[17:], uint16(len(pieces)))
+		for j, piece := range pieces {
+			p := page[19+j*40:]
+			binary.LittleEndian.PutUint32(p[:4], piece.Index)
+			binary.LittleEndian.PutUint32(p[4:8], piece.Host)
+			root := fixtureRoot(f.Name, i, piece)
+			copy(p[8:], root[:])
+		}
+		buf = append(buf, page...)
+	}
+	return buf
+}
+
+// expected returns the SiaFile that Load should produce for the fixture.
+func (f fixture) expected() SiaFile {
+	sf := SiaFile{
+		FileSize:       f.FileSize,
+		PieceSize:      f.PieceSize,
+		EncoderType:    binary.BigEndian.Uint32(f.EncoderType[:]),
+		DataPieces:     f.DataPieces,
+		ParityPieces:   f.ParityPieces,
+		MasterKey:      f.masterKey(),
+		MasterKeyType:  crypto.TypeXChaCha20.String(),
+		SharingKeyType: crypto.TypeInvalid.String(),
+		Skylinks:       []string{},
+	}
+	for i, pieces := range f.Chunks {
+		chunk := Chunk{
+			Pieces: make([][]Piece, f.DataPieces+f.ParityPieces),
+		}
+		for _, piece := range pieces {
+			chunk.Pieces[piece.Index] = append(chunk.Pieces[piece.Index], Piece{
+				MerkleRoot: fixtureRoot(f.Name, i, piece),
+				HostKey:    fixtureHost(int(piece.Host)),
+			})
+		}
+		sf.Chunks = append(sf.Chunks, chunk)
+	}
+	return sf
+}
+
+func TestLoad(t *testing.T) {
+	const pieceSize = 1 << 22
+
+	fixtures := []fixture{
+		{
+			Name:         "single-chunk",
+			FileSize:     10 * pieceSize,
+			PieceSize:    pieceSize,
+			EncoderType:  modules.ECReedSolomon,
+			DataPieces:   10,
+			ParityPieces: 20,
+			Hosts:        1,
+			Chunks: [][]fixturePiece{
+				{{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0}},
+			},
+		},
+		{
+			Name:         "multi-chunk",
+			FileSize:     3 * 2 * pieceSize,
+			PieceSize:    pieceSize,
+			EncoderType:  modules.ECReedSolomon,
+			DataPieces:   2,
+			ParityPieces: 1,
+			Hosts:        3,
+			Chunks: [][]fixturePiece{
+				{{0, 0}, {1, 1}, {2, 2}},
+				{{0, 1}, {1, 2}, {2, 0}},
+				{{0, 2}, {1, 0}, {2, 1}},
+			},
+		},
+		{
+			Name:         "rssub",
+			FileSize:     2 * 4 * pieceSize,
+			PieceSize:    pieceSize,
+			EncoderType:  modules.ECReedSolomonSubShards64,
+			DataPieces:   4,
+			ParityPieces: 2,
+			Hosts:        6,
+			Chunks: [][]fixturePiece{
+				{{0, 0}, {1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}},
+				{{0, 5}, {1, 4}, {2, 3}, {3, 2}, {4, 1}, {5, 0}},
+			},
+		},
+		{
+			// pieces are uploaded to more than one host and some pieces are
+			// missing entirely
+			Name:         "multiple-hosts",
+			FileSize:     3 * pieceSize,
+			PieceSize:    pieceSize,
+			EncoderType:  modules.ECReedSolomon,
+			DataPieces:   3,
+			ParityPieces: 3,
+			Hosts:        10,
+			Chunks: [][]fixturePiece{
+				{{0, 0}, {0, 1}, {0, 2}, {2, 3}, {3, 4}, {3, 9}, {5, 5}, {5, 6}, {5, 7}, {5, 8}},
+			},
+		},
+		{
+			// the final chunk is smaller than the chunk size
+			Name:         "partial-chunk",
+			FileSize:     2*2*pieceSize + 12345,
+			PieceSize:    pieceSize,
+			EncoderType:  modules.ECReedSolomon,
+			DataPieces:   2,
+			ParityPieces: 2,
+			Hosts:        4,
+			Chunks: [][]fixturePiece{
+				{{0, 0}, {1, 1}, {2, 2}, {3, 3}},
+				{{0, 1}, {1, 2}, {2, 3}, {3, 0}},
+				{{0, 2}, {1, 3}},
+			},
+		},
+	}
+
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			fp := filepath.Join("testdata", f.Name+".sia")
+			buf := f.encode(t)
+			if *updateFixtures {
+				if err := os.WriteFile(fp, buf, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the checked-in fixture must match the description
+			existing, err := os.ReadFile(fp)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(existing, buf) {
+				t.Fatalf("fixture %v is out of date, run go test -update", fp)
+			}
+
+			sf, err := Load(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exp := f.expected()
+			switch {
+			case sf.FileSize != exp.FileSize:
+				t.Fatalf("expected file size %v, got %v", exp.FileSize, sf.FileSize)
+			case sf.PieceSize != exp.PieceSize:
+				t.Fatalf("expected piece size %v, got %v", exp.PieceSize, sf.PieceSize)
+			case sf.EncoderType != exp.EncoderType:
+				t.Fatalf("expected encoder type %v, got %v", exp.EncoderType, sf.EncoderType)
+			case sf.DataPieces != exp.DataPieces || sf.ParityPieces != exp.ParityPieces:
+				t.Fatalf("expected %v+%v pieces, got %v+%v", exp.DataPieces, exp.ParityPieces, sf.DataPieces, sf.ParityPieces)
+			case !bytes.Equal(sf.MasterKey, exp.MasterKey) || sf.MasterKeyType != exp.MasterKeyType:
+				t.Fatalf("expected master key %v %x, got %v %x", exp.MasterKeyType, exp.MasterKey, sf.MasterKeyType, sf.MasterKey)
+			case len(sf.Chunks) != len(exp.Chunks):
+				t.Fatalf("expected %v chunks, got %v", len(exp.Chunks), len(sf.Chunks))
+			}
+
+			for i := range exp.Chunks {
+				if !reflect.DeepEqual(sf.Chunks[i], exp.Chunks[i]) {
+					t.Fatalf("chunk %v: expected pieces %v, got %v", i, exp.Chunks[i].Pieces, sf.Chunks[i].Pieces)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMultiPageChunks(t *testing.T) {
+	// 150 pieces need two pages, a one page read would truncate the first
+	// chunk and read the second from the middle of it
+	f := fixture{
+		Name:          "multi-page",
+		FileSize:      2 * 50 * 64,
+		PieceSize:     64,
+		EncoderType:   modules.ECReedSolomon,
+		DataPieces:    50,
+		ParityPieces:  100,
+		Hosts:         3,
+		PagesPerChunk: 2,
+	}
+	for i := 0; i < 2; i++ {
+		var pieces []fixturePiece
+		for j := 0; j < 150; j++ {
+			pieces = append(pieces, fixturePiece{Index: uint32(j), Host: uint32((i + j) % 3)})
+		}
+		f.Chunks = append(f.Chunks, pieces)
+	}
+
+	fp := filepath.Join(t.TempDir(), "multi-page.sia")
+	if err := os.WriteFile(fp, f.encode(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := Load(fp)
+	if err != nil {
+		t.Fatal(err)
+	} else if sf.TableChunks != 2 {
+		t.Fatalf("expected 2 table chunks, got %v", sf.TableChunks)
+	}
+	exp := f.expected()
+	exp.TableChunks = sf.TableChunks
+	if !reflect.DeepEqual(sf, exp) {
+		t.Fatal("loaded file does not match")
+	}
+
+	// rewritten files keep the pages per chunk
+	dst := filepath.Join(t.TempDir(), "rewritten.sia")
+	if err := Rewrite(fp, dst, sf.Chunks); err != nil {
+		t.Fatal(err)
+	} else if rewritten, err := Load(dst); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rewritten, sf) {
+		t.Fatal("rewritten file does not match")
+	}
+
+	// a chunk size the file was not written with is rejected
+	for _, pages := range []uint8{0, maxPagesPerChunk + 1} {
+		f.PagesPerChunk = pages
+		buf := f.encode(t)
+		// the fixture defaults to one page, encode zero explicitly
+		if pages == 0 {
+			buf = bytes.Replace(buf, []byte(`"pagesperchunk":1`), []byte(`"pagesperchunk":0`), 1)
+		}
+		if err := os.WriteFile(fp, buf, 0644); err != nil {
+			t.Fatal(err)
+		} else if _, err := Load(fp); err == nil || !strings.Contains(err.Error(), "pages per chunk") {
+			t.Fatalf("%v pages: expected an invalid pages per chunk error, got %v", pages, err)
+		}
+	}
+}
+
+func TestLoadInconsistent(t *testing.T) {
+	const pieceSize = 1 << 22
+
+	fixtures := []struct {
+		fixture
+		Err string
+	}{
+		{
+			// the second chunk was encoded with more parity pieces than the
+			// file's erasure coder
+			fixture: fixture{
+				Name:         "inconsistent-pieces",
+				FileSize:     2 * 2 * pieceSize,
+				PieceSize:    pieceSize,
+				EncoderType:  modules.ECReedSolomon,
+				DataPieces:   2,
+				ParityPieces: 1,
+				Hosts:        4,
+				Chunks: [][]fixturePiece{
+					{{0, 0}, {1, 1}, {2, 2}},
+					{{0, 0}, {1, 1}, {2, 2}, {3, 3}},
+				},
+			},
+			Err: "chunk 2: piece index 3 out of range for 2+1 erasure coding",
+		},
+		{
+			// a piece references a host that is not in the host table
+			fixture: fixture{
+				Name:         "inconsistent-hosts",
+				FileSize:     2 * pieceSize,
+				PieceSize:    pieceSize,
+				EncoderType:  modules.ECReedSolomon,
+				DataPieces:   2,
+				ParityPieces: 1,
+				Hosts:        1,
+				Chunks: [][]fixturePiece{
+					{{0, 0}, {1, 80}},
+				},
+			},
+			Err: "chunk 1: host index 80 out of range",
+		},
+	}
+
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			fp := filepath.Join("testdata", f.Name+".sia")
+			buf := f.encode(t)
+			if *updateFixtures {
+				if err := os.WriteFile(fp, buf, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := Load(fp); err == nil {
+				t.Fatal("expected error")
+			} else if !strings.Contains(err.Error(), f.Err) {
+				t.Fatalf("expected error %q, got %q", f.Err, err)
+			}
+		})
+	}
+}
+
+func TestLoadWithParams(t *testing.T) {
+	const pieceSize = 1 << 22
+
+	// the second chunk of inconsistent-pieces has a piece that only fits 2+2
+	// erasure coding
+	fp := filepath.Join("testdata", "inconsistent-pieces.sia")
+	sf, err := LoadWithParams(fp, Params{ParityPieces: 2})
+	if err != nil {
+		t.Fatal(err)
+	} else if sf.DataPieces != 2 || sf.ParityPieces != 2 {
+		t.Fatalf("expected 2+2 erasure coding, got %v+%v", sf.DataPieces, sf.ParityPieces)
+	} else if len(sf.Chunks) != 2 || len(sf.Chunks[1].Pieces[3]) != 1 {
+		t.Fatal("expected the fourth piece of the second chunk to be loaded")
+	}
+
+	tests := []struct {
+		params Params
+		err    string
+	}{
+		{Params{PieceSize: pieceSize / 2}, "chunk table has 3 chunks, a 25165824 byte file in 4194304 byte chunks has 6"},
+		{Params{DataPieces: 3}, "chunk table has 3 chunks, a 25165824 byte file in 12582912 byte chunks has 2"},
+		{Params{PieceSize: rhp.SectorSize + 1}, "invalid piece size"},
+		{Params{EncoderType: 3}, "unknown erasure coder type: 3"},
+	}
+	fp = filepath.Join("testdata", "multi-chunk.sia")
+	for _, test := range tests {
+		if _, err := LoadWithParams(fp, test.params); err == nil {
+			t.Fatalf("expected error for %+v", test.params)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("expected error %q, got %q", test.err, err)
+		}
+	}
+
+	// overriding the stored parameters with the same values loads the same
+	// file
+	expected, err := Load(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err = LoadWithParams(fp, Params{PieceSize: pieceSize, EncoderType: 1, DataPieces: 2, ParityPieces: 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(sf, expected) {
+		t.Fatal("expected overridden file to match")
+	}
+}
+
+func TestRootCollisions(t *testing.T) {
+	root := func(b byte) crypto.Hash { return crypto.Hash{b} }
+	sf := SiaFile{
+		Chunks: []Chunk{
+			{Pieces: [][]Piece{
+				// the same piece on multiple hosts is not a collision
+				{{MerkleRoot: root(1), HostKey: fixtureHost(0)}, {MerkleRoot: root(1), HostKey: fixtureHost(1)}},
+				{{MerkleRoot: root(2), HostKey: fixtureHost(0)}},
+				{{MerkleRoot: root(3), HostKey: fixtureHost(0)}},
+			}},
+			{Pieces: [][]Piece{
+				{{MerkleRoot: root(4), HostKey: fixtureHost(0)}},
+				// reused from another chunk
+				{{MerkleRoot: root(2), HostKey: fixtureHost(1)}},
+				// reused within the chunk
+				{{MerkleRoot: root(4), HostKey: fixtureHost(2)}},
+			}},
+		},
+	}
+
+	expected := []RootCollision{
+		{MerkleRoot: root(2), Pieces: []PieceIndex{{Chunk: 0, Piece: 1}, {Chunk: 1, Piece: 1}}},
+		{MerkleRoot: root(4), Pieces: []PieceIndex{{Chunk: 1, Piece: 0}, {Chunk: 1, Piece: 2}}},
+	}
+	if collisions := sf.RootCollisions(); !reflect.DeepEqual(collisions, expected) {
+		t.Fatalf("expected collisions %v, got %v", expected, collisions)
+	}
+}
+
+func TestCheckChunkCount(t *testing.T) {
+	for _, name := range []string{"single-chunk.sia", "multi-chunk.sia", "partial-chunk.sia"} {
+		sf, err := Load(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := sf.CheckChunkCount(); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+
+	// 2 data pieces of 64 bytes make 128 byte chunks
+	sf := SiaFile{PieceSize: 64, EncoderType: 1, DataPieces: 2, ParityPieces: 1}
+	tests := []struct {
+		fileSize    uint64
+		chunks      int
+		tableChunks uint64
+		valid       bool
+	}{
+		{0, 1, 1, true},
+		{128, 1, 1, true},
+		{129, 2, 2, true},
+		{256, 2, 0, true},
+		{256, 1, 1, false},
+		{129, 3, 3, false},
+		{128, 1, 2, false},
+	}
+	for _, test := range tests {
+		sf.FileSize, sf.Chunks, sf.TableChunks = test.fileSize, make([]Chunk, test.chunks), test.tableChunks
+		if err := sf.CheckChunkCount(); test.valid && err != nil {
+			t.Fatalf("%+v: %v", test, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%+v: expected an error", test)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	src := filepath.Join("testdata", "multi-chunk.sia")
+	sf, err := Load(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// move every piece to a new host and add a second host for the first
+	// piece, growing the host table
+	var newHosts []rhp.PublicKey
+	for i := 0; i < 100; i++ {
+		newHosts = append(newHosts, fixtureHost(100+i))
+	}
+	for i := range sf.Chunks {
+		for j := range sf.Chunks[i].Pieces {
+			for k := range sf.Chunks[i].Pieces[j] {
+				sf.Chunks[i].Pieces[j][k].HostKey = newHosts[(i*3+j)%len(newHosts)]
+			}
+		}
+	}
+	sf.Chunks[0].Pieces[0] = append(sf.Chunks[0].Pieces[0], Piece{
+		MerkleRoot: sf.Chunks[0].Pieces[0][0].MerkleRoot,
+		HostKey:    newHosts[99],
+	})
+
+	dst := filepath.Join(t.TempDir(), "rewritten.sia")
+	if err := Rewrite(src, dst, sf.Chunks); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := Load(dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rewritten, sf) {
+		t.Fatal("rewritten file does not match")
+	}
+}
+
+func FuzzLoadOffsets(f *testing.F) {
+	buf, err := os.ReadFile(filepath.Join("testdata", "multi-chunk.sia"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	var meta fileMetadata
+	if err := json.NewDecoder(bytes.NewReader(buf)).Decode(&meta); err != nil {
+		f.Fatal(err)
+	}
+	tables := buf[fixturePubKeyTableOffset:]
+
+	f.Add(meta.PubKeyTableOffset, meta.ChunkOffset, meta.FileSize, meta.PieceSize)
+	f.Add(int64(-1), meta.ChunkOffset, meta.FileSize, meta.PieceSize)
+	f.Add(meta.ChunkOffset, meta.PubKeyTableOffset, meta.FileSize, meta.PieceSize)
+	f.Add(meta.PubKeyTableOffset, int64(1<<40), meta.FileSize, meta.PieceSize)
+	f.Add(meta.PubKeyTableOffset, meta.ChunkOffset, uint64(1<<63), meta.PieceSize)
+	f.Add(meta.PubKeyTableOffset, meta.ChunkOffset, meta.FileSize, uint64(1))
+	f.Add(meta.PubKeyTableOffset, meta.ChunkOffset, meta.FileSize, uint64(0))
+
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, pubKeyTableOffset, chunkOffset int64, fileSize, pieceSize uint64) {
+		m := meta
+		m.PubKeyTableOffset, m.ChunkOffset = pubKeyTableOffset, chunkOffset
+		m.FileSize, m.PieceSize = fileSize, pieceSize
+		header, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(header) > fixturePubKeyTableOffset {
+			t.Skip("metadata too large")
+		}
+		header = append(header, make([]byte, fixturePubKeyTableOffset-len(header))...)
+
+		fp := filepath.Join(dir, "fuzz.sia")
+		if err := os.WriteFile(fp, append(header, tables...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// corrupt offsets must return an error, not panic or allocate more
+		// than the file's size
+		sf, err := Load(fp)
+		if err != nil {
+			return
+		}
+		size := uint64(len(header) + len(tables))
+		if uint64(len(sf.Chunks))*4096 > size {
+			t.Fatalf("loaded %v chunks from a %v byte file", len(sf.Chunks), size)
+		}
+	})
+}
+
+func FuzzLoad(f *testing.F) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.sia"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, fp := range fixtures {
+		buf, err := os.ReadFile(fp)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		fp := filepath.Join(dir, "fuzz.sia")
+		if err := os.WriteFile(fp, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sf, err := Load(fp)
+		if err != nil {
+			return
+		}
+
+		// a loaded file must be usable without further checks
+		if sf.PieceSize == 0 || sf.PieceSize > rhp.SectorSize {
+			t.Fatalf("invalid piece size %v", sf.PieceSize)
+		} else if len(sf.Chunks) == 0 || uint64(len(sf.Chunks))*4096 > uint64(len(buf)) {
+			t.Fatalf("loaded %v chunks from a %v byte file", len(sf.Chunks), len(buf))
+		}
+		ec, err := InitErasureCoder(sf.EncoderType, sf.DataPieces, sf.ParityPieces)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, chunk := range sf.Chunks {
+			if len(chunk.Pieces) != ec.NumPieces() {
+				t.Fatalf("chunk %v has %v pieces, expected %v", i, len(chunk.Pieces), ec.NumPieces())
+			}
+		}
+	})
+}
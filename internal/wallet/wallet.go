@@ -4,34 +4,66 @@ package wallet
 import (
 	"crypto/ed25519"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"sync"
 	"time"
 
-	"github.com/siacentral/apisdkgo"
+	"github.com/siacentral/apisdkgo/sia"
 	"gitlab.com/NebulousLabs/encoding"
 	"go.sia.tech/renterd/wallet"
 	"go.sia.tech/siad/crypto"
 	"go.sia.tech/siad/types"
+	"go.sia.tech/skyrecover/internal/explorer"
 	"lukechampine.com/frand"
 )
 
-var siaCentralClient = apisdkgo.NewSiaClient()
+// lockDuration is how long an output stays reserved after it is used to fund
+// a transaction. If the transaction has not confirmed by then it is assumed to
+// have been dropped.
+const lockDuration = 6 * time.Hour
+
+const locksFile = "wallet_locks.json"
 
 type (
+	// An Explorer looks up the chain, the wallet's outputs, and transaction
+	// fees.
+	Explorer interface {
+		GetChainIndex() (sia.ChainIndex, error)
+		GetAddressBalance(limit, page int, address string) (sia.GetTransactionsResp, error)
+		GetTransactionFees() (min, max types.Currency, err error)
+	}
+
+	// An Option configures a SingleAddressWallet.
+	Option func(*SingleAddressWallet)
+
 	// A SingleAddressWallet is a Siacoin wallet that only uses a single address.
 	SingleAddressWallet struct {
 		priv ed25519.PrivateKey
 		addr types.UnlockHash
+		dir  string
 
-		close chan struct{}
+		explorer Explorer
+		close    chan struct{}
 
 		mu            sync.Mutex
 		currentHeight uint64
 		unspent       []SiacoinElement
-		used          map[types.SiacoinOutputID]bool
+		immature      []immatureOutput
+		// used maps reserved outputs to the time their reservation expires.
+		// Reservations are persisted so they survive a restart.
+		used map[types.SiacoinOutputID]time.Time
+	}
+
+	lockedOutput struct {
+		ID         types.SiacoinOutputID `json:"id"`
+		Expiration time.Time             `json:"expiration"`
 	}
 
 	SiacoinElement struct {
@@ -39,29 +71,69 @@ type (
 		Value      types.Currency
 		UnlockHash types.UnlockHash
 	}
+
+	// An immatureOutput is an unspent output that cannot be spent until the
+	// chain passes its maturity height, e.g. a miner payout or a contract's
+	// refund.
+	immatureOutput struct {
+		Value          types.Currency
+		MaturityHeight uint64
+	}
+
+	// An ImmatureFundsError is returned when the wallet cannot fund an amount
+	// with its spendable outputs, but could once its immature outputs mature.
+	ImmatureFundsError struct {
+		Spendable types.Currency
+		Required  types.Currency
+		// SpendableHeight is the height at which enough outputs have matured
+		// to fund the amount.
+		SpendableHeight uint64
+	}
+
+	// An InsufficientFundsError is returned when the wallet's unused outputs
+	// cannot fund an amount and no immature outputs will.
+	InsufficientFundsError struct {
+		Available types.Currency
+		Required  types.Currency
+	}
 )
 
-func (sw *SingleAddressWallet) refresh() error {
-	client := apisdkgo.NewSiaClient()
+// Error implements error.
+func (e *ImmatureFundsError) Error() string {
+	return fmt.Sprintf("not enough spendable funds: %v < %v, enough funds will mature at height %v", e.Spendable.HumanString(), e.Required.HumanString(), e.SpendableHeight)
+}
+
+// Error implements error.
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("not enough funds to fund transaction: %v < %v", e.Available.HumanString(), e.Required.HumanString())
+}
 
-	tip, err := client.GetChainIndex()
+func (sw *SingleAddressWallet) refresh() error {
+	tip, err := sw.explorer.GetChainIndex()
 	if err != nil {
 		return fmt.Errorf("failed to get consensus state: %w", err)
 	}
 
-	resp, err := siaCentralClient.GetAddressBalance(0, 0, sw.addr.String())
+	resp, err := sw.explorer.GetAddressBalance(0, 0, sw.addr.String())
 	if err != nil {
 		return fmt.Errorf("failed to get address balance: %w", err)
 	}
 
 	var filtered []SiacoinElement
+	var immature []immatureOutput
+	unspent := make(map[types.SiacoinOutputID]bool)
 	for _, utxo := range resp.UnspentSiacoinOutputs {
 		var outputID types.SiacoinOutputID
 		if _, err := hex.Decode(outputID[:], []byte(utxo.OutputID)); err != nil {
 			return fmt.Errorf("failed to decode output id: %w", err)
 		}
+		unspent[outputID] = true
 
 		if utxo.MaturityHeight >= tip.Height {
+			immature = append(immature, immatureOutput{
+				Value:          utxo.Value,
+				MaturityHeight: utxo.MaturityHeight,
+			})
 			continue
 		}
 
@@ -77,6 +149,10 @@ func (sw *SingleAddressWallet) refresh() error {
 	sw.currentHeight = tip.Height
 	// update the wallet's spendable utxos
 	sw.unspent = filtered
+	sort.Slice(immature, func(i, j int) bool {
+		return immature[i].MaturityHeight < immature[j].MaturityHeight
+	})
+	sw.immature = immature
 	// update the used utxos from the wallet's unconfirmed transactions
 	for _, txn := range resp.UnconfirmedTransactions {
 		for _, input := range txn.SiacoinInputs {
@@ -84,7 +160,99 @@ func (sw *SingleAddressWallet) refresh() error {
 			if _, err := hex.Decode(outputID[:], []byte(input.OutputID)); err != nil {
 				return fmt.Errorf("failed to decode output id: %w", err)
 			}
-			sw.used[outputID] = true
+			if _, ok := sw.used[outputID]; !ok {
+				sw.used[outputID] = time.Now().Add(lockDuration)
+			}
+		}
+	}
+	// clear reservations for outputs that have been spent by a confirmed
+	// transaction or whose transaction was never confirmed
+	var changed bool
+	for id, expiration := range sw.used {
+		if !unspent[id] || time.Now().After(expiration) {
+			delete(sw.used, id)
+			changed = true
+		}
+	}
+	if changed {
+		return sw.saveLocks()
+	}
+	return nil
+}
+
+// lock reserves the outputs and persists the reservations. The caller must
+// hold sw.mu.
+func (sw *SingleAddressWallet) lock(ids []crypto.Hash) error {
+	expiration := time.Now().Add(lockDuration)
+	for _, id := range ids {
+		sw.used[types.SiacoinOutputID(id)] = expiration
+	}
+	return sw.saveLocks()
+}
+
+// release releases the reserved outputs. The release is only logged if it
+// cannot be saved; the reservations expire after lockDuration regardless.
+func (sw *SingleAddressWallet) release(ids []crypto.Hash) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for _, id := range ids {
+		delete(sw.used, types.SiacoinOutputID(id))
+	}
+	if err := sw.saveLocks(); err != nil {
+		log.Printf("[WARN] failed to save released wallet outputs: %v", err)
+	}
+}
+
+// saveLocks writes the reserved outputs to disk. The caller must hold sw.mu.
+func (sw *SingleAddressWallet) saveLocks() error {
+	locked := make([]lockedOutput, 0, len(sw.used))
+	for id, expiration := range sw.used {
+		locked = append(locked, lockedOutput{ID: id, Expiration: expiration})
+	}
+	buf, err := json.MarshalIndent(locked, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode locked outputs: %w", err)
+	}
+
+	if err := os.MkdirAll(sw.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	// the temp file is unique so that another process using the same
+	// directory cannot interleave with this write
+	f, err := os.CreateTemp(sw.dir, locksFile+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create locked outputs file: %w", err)
+	}
+	tmpFile := f.Name()
+	defer os.Remove(tmpFile)
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write locked outputs: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close locked outputs file: %w", err)
+	} else if err := os.Rename(tmpFile, filepath.Join(sw.dir, locksFile)); err != nil {
+		return fmt.Errorf("failed to rename locked outputs file: %w", err)
+	}
+	return nil
+}
+
+// loadLocks loads the reserved outputs from disk, skipping expired
+// reservations.
+func (sw *SingleAddressWallet) loadLocks() error {
+	buf, err := os.ReadFile(filepath.Join(sw.dir, locksFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read locked outputs: %w", err)
+	}
+
+	var locked []lockedOutput
+	if err := json.Unmarshal(buf, &locked); err != nil {
+		return fmt.Errorf("failed to decode locked outputs: %w", err)
+	}
+	for _, lo := range locked {
+		if time.Now().Before(lo.Expiration) {
+			sw.used[lo.ID] = lo.Expiration
 		}
 	}
 	return nil
@@ -107,13 +275,64 @@ func (sw *SingleAddressWallet) Balance() (balance types.Currency, _ error) {
 	return
 }
 
+// Height returns the height of the chain when the wallet was last refreshed.
+func (sw *SingleAddressWallet) Height() uint64 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.currentHeight
+}
+
+// ImmatureBalance returns the value of the wallet's outputs that have not
+// matured yet. They are not included in Balance.
+func (sw *SingleAddressWallet) ImmatureBalance() (balance types.Currency) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for _, utxo := range sw.immature {
+		balance = balance.Add(utxo.Value)
+	}
+	return
+}
+
+// immatureFundsError returns an *ImmatureFundsError if the wallet's immature
+// outputs would cover the difference between spendable and required once they
+// mature. Otherwise it returns nil. The caller must hold sw.mu.
+func (sw *SingleAddressWallet) immatureFundsError(spendable, required types.Currency) error {
+	sum := spendable
+	for _, utxo := range sw.immature {
+		sum = sum.Add(utxo.Value)
+		if sum.Cmp(required) >= 0 {
+			// outputs are spendable once the chain is past their maturity
+			// height
+			return &ImmatureFundsError{
+				Spendable:       spendable,
+				Required:        required,
+				SpendableHeight: utxo.MaturityHeight + 1,
+			}
+		}
+	}
+	return nil
+}
+
+// MaturityError returns an *ImmatureFundsError if the wallet cannot fund
+// amount with its spendable outputs but could once its immature outputs
+// mature. Otherwise it returns nil.
+func (sw *SingleAddressWallet) MaturityError(amount types.Currency) error {
+	balance, err := sw.Balance()
+	if err != nil || balance.Cmp(amount) >= 0 {
+		return nil
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.immatureFundsError(balance, amount)
+}
+
 // SpendableUTXOs returns a list of spendable UTXOs.
 func (sw *SingleAddressWallet) SpendableUTXOs() (spendable []SiacoinElement, _ error) {
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
 
 	for _, utxo := range sw.unspent {
-		if sw.used[utxo.ID] {
+		if _, ok := sw.used[utxo.ID]; ok {
 			continue
 		}
 		spendable = append(spendable, utxo)
@@ -140,7 +359,7 @@ func (sw *SingleAddressWallet) FundTransaction(txn *types.Transaction, amount ty
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
 	for _, utxo := range utxos {
-		if sw.used[utxo.ID] {
+		if _, ok := sw.used[utxo.ID]; ok {
 			continue
 		}
 
@@ -161,7 +380,10 @@ func (sw *SingleAddressWallet) FundTransaction(txn *types.Transaction, amount ty
 	}
 
 	if outputSum.Cmp(amount) < 0 {
-		return nil, nil, fmt.Errorf("not enough funds to fund transaction: %v < %v", outputSum, amount)
+		if err := sw.immatureFundsError(outputSum, amount); err != nil {
+			return nil, nil, fmt.Errorf("failed to fund transaction: %w", err)
+		}
+		return nil, nil, &InsufficientFundsError{Available: outputSum, Required: amount}
 	} else if outputSum.Cmp(amount) > 0 {
 		txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{
 			Value:      outputSum.Sub(amount),
@@ -170,17 +392,11 @@ func (sw *SingleAddressWallet) FundTransaction(txn *types.Transaction, amount ty
 	}
 
 	// mark the outputs as spent
-	for _, id := range toSign {
-		sw.used[types.SiacoinOutputID(id)] = true
+	if err := sw.lock(toSign); err != nil {
+		return nil, nil, fmt.Errorf("failed to lock outputs: %w", err)
 	}
 
-	return toSign, func() {
-		sw.mu.Lock()
-		defer sw.mu.Unlock()
-		for _, id := range toSign {
-			delete(sw.used, types.SiacoinOutputID(id))
-		}
-	}, nil
+	return toSign, func() { sw.release(toSign) }, nil
 }
 
 // SignTransaction signs txn with the wallet's private key.
@@ -226,7 +442,7 @@ func (sw *SingleAddressWallet) Redistribute(outputs uint64, amount types.Currenc
 		return utxos[i].Value.Cmp(utxos[j].Value) > 0
 	})
 
-	_, max, err := siaCentralClient.GetTransactionFees()
+	_, max, err := sw.explorer.GetTransactionFees()
 	if err != nil {
 		return types.Transaction{}, nil, fmt.Errorf("failed to get transaction fees: %w", err)
 	}
@@ -242,7 +458,7 @@ func (sw *SingleAddressWallet) Redistribute(outputs uint64, amount types.Currenc
 	fundAmount := outputSum.Add(transactionFee)
 
 	for _, utxo := range utxos {
-		if sw.used[utxo.ID] {
+		if _, ok := sw.used[utxo.ID]; ok {
 			continue
 		}
 
@@ -261,9 +477,15 @@ func (sw *SingleAddressWallet) Redistribute(outputs uint64, amount types.Currenc
 			break
 		}
 	}
+	var immatureErr error
+	if inputSum.Cmp(fundAmount) < 0 {
+		immatureErr = sw.immatureFundsError(inputSum, fundAmount)
+	}
 	sw.mu.Unlock()
 
-	if inputSum.Cmp(fundAmount) < 0 {
+	if immatureErr != nil {
+		return types.Transaction{}, nil, fmt.Errorf("failed to fund transaction: %w", immatureErr)
+	} else if inputSum.Cmp(fundAmount) < 0 {
 		return types.Transaction{}, nil, fmt.Errorf("not enough funds to fund transaction: %v < %v", inputSum, amount)
 	} else if inputSum.Cmp(fundAmount) > 0 {
 		txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{
@@ -277,15 +499,14 @@ func (sw *SingleAddressWallet) Redistribute(outputs uint64, amount types.Currenc
 		return types.Transaction{}, nil, fmt.Errorf("failed to sign transaction: %w", err)
 	}
 
-	for _, id := range toSign {
-		sw.used[types.SiacoinOutputID(id)] = true
+	sw.mu.Lock()
+	err = sw.lock(toSign)
+	sw.mu.Unlock()
+	if err != nil {
+		return types.Transaction{}, nil, fmt.Errorf("failed to lock outputs: %w", err)
 	}
 
-	return txn, func() {
-		for _, id := range toSign {
-			delete(sw.used, types.SiacoinOutputID(id))
-		}
-	}, nil
+	return txn, func() { sw.release(toSign) }, nil
 }
 
 // ExplicitCoveredFields returns a CoveredFields that covers all elements
@@ -324,8 +545,28 @@ func ExplicitCoveredFields(txn types.Transaction) (cf types.CoveredFields) {
 	return
 }
 
-// New initializes a new SingleAddressWallet.
-func New(recoveryPhrase string) (*SingleAddressWallet, error) {
+// AddressFromPhrase derives the wallet address from a recovery phrase without
+// contacting the network. An error is returned if the phrase contains unknown
+// words or has an invalid checksum.
+func AddressFromPhrase(recoveryPhrase string) (types.UnlockHash, error) {
+	key, err := wallet.KeyFromPhrase(recoveryPhrase)
+	if err != nil {
+		return types.UnlockHash{}, fmt.Errorf("invalid recovery phrase: %w", err)
+	}
+	return wallet.StandardAddress(key.PublicKey()), nil
+}
+
+// WithExplorer sets the Explorer used to look up the wallet's outputs. The
+// default is siacentral.
+func WithExplorer(e Explorer) Option {
+	return func(sw *SingleAddressWallet) {
+		sw.explorer = e
+	}
+}
+
+// New initializes a new SingleAddressWallet. Outputs reserved for unconfirmed
+// transactions are persisted in dir.
+func New(dir, recoveryPhrase string, opts ...Option) (*SingleAddressWallet, error) {
 	key, err := wallet.KeyFromPhrase(recoveryPhrase)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create seed: %w", err)
@@ -333,9 +574,17 @@ func New(recoveryPhrase string) (*SingleAddressWallet, error) {
 	w := &SingleAddressWallet{
 		priv: ed25519.PrivateKey(key),
 		addr: wallet.StandardAddress(key.PublicKey()),
-		used: make(map[types.SiacoinOutputID]bool),
+		dir:  dir,
+		used: make(map[types.SiacoinOutputID]time.Time),
+
+		explorer: explorer.NewClient(explorer.Mainnet),
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
-	if err := w.refresh(); err != nil {
+	if err := w.loadLocks(); err != nil {
+		return nil, fmt.Errorf("failed to load locked outputs: %w", err)
+	} else if err := w.refresh(); err != nil {
 		return nil, fmt.Errorf("failed to refresh wallet: %w", err)
 	}
 	ticker := time.NewTicker(10 * time.Second)